@@ -1,3 +1,6 @@
 package config
 
 const UploadDestination = "/var/ncloud_upload/"
+
+// Parts of S3 multipart uploads are stored here until upload is completed
+const MultipartDestination = UploadDestination + ".multipart/"
@@ -0,0 +1,205 @@
+package directories
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/audit"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+// CreateDerivedKey mints access key with subset of permissions of key from DirectoryAccessKey header
+//
+// Derived key can't have more permissions, be recursive if parent key isn't,
+// or expire later than parent derived key. Key is returned only once
+func (h *Handler) CreateDerivedKey(c *gin.Context) {
+	type RequestData struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+		ExpiresIn   int64    `json:"expires_in"` // seconds, 0 means key expires with parent derived key, or never
+		Recursive   bool     `json:"recursive"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	// Verified in DirectoryAuth
+	parent := auth.DirectoryClaimsFromContext(c)
+
+	for _, permission := range data.Permissions {
+		if !auth.ValidatePermissionsFromClaims(parent, permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "access key doesn't have " + permission + " permission",
+			})
+			return
+		}
+	}
+
+	// Owner keys (not derived) can mint recursive keys for their directory
+	if data.Recursive && !parent.Recursive && parent.ID != "" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "access key isn't recursive",
+		})
+		return
+	}
+
+	if data.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid expires_in",
+		})
+		return
+	}
+
+	now := time.Now()
+
+	key := models.DerivedKey{
+		Id:          uuid.New().String(),
+		Directory:   c.Param("id"),
+		User:        parent.User,
+		Owner:       parent.Owner,
+		Name:        data.Name,
+		Permissions: data.Permissions,
+		Recursive:   data.Recursive,
+		Ancestors:   []string{},
+		Created:     now.UnixMilli(),
+	}
+
+	if data.ExpiresIn > 0 {
+		key.Expires = now.Add(time.Duration(data.ExpiresIn) * time.Second).UnixMilli()
+	}
+
+	// Key derived from another derived key is revoked with it and can't outlive it
+	if parent.ID != "" {
+		var parentKey models.DerivedKey
+		if err := h.Db.Collection("derived_keys").FindOne(c, bson.D{{Key: "_id", Value: parent.ID}}).
+			Decode(&parentKey); err != nil {
+			log.Panic(err)
+		}
+
+		key.Ancestors = append(parentKey.Ancestors, parentKey.Id)
+
+		if parentKey.Expires != 0 && (key.Expires == 0 || key.Expires > parentKey.Expires) {
+			key.Expires = parentKey.Expires
+		}
+	}
+
+	if err := key.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	var directory models.Directory
+	opts := options.FindOne().SetProjection(bson.D{{Key: "key_generation", Value: 1}})
+	if err := h.Db.Collection("directories").FindOne(c, bson.D{{Key: "_id", Value: key.Directory}}, opts).
+		Decode(&directory); err != nil {
+		log.Panic(err)
+	}
+
+	accessKey, err := auth.GenerateDerivedAccessKey(&key, directory.KeyGeneration)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if _, err := h.Db.Collection("derived_keys").InsertOne(c, key); err != nil {
+		log.Panic(err)
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionCreateDerivedKey,
+		Targets: []string{key.Directory, key.Id},
+		Details: strings.Join(key.Permissions, ","),
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":        key,
+		"access_key": accessKey,
+	})
+}
+
+// Derived keys are managed by user who derived them and by owner of directory,
+// so owner can revoke keys derived by users directory is shared with
+func derivedKeysOf(userId string) bson.E {
+	return bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "user", Value: userId}},
+		bson.D{{Key: "owner", Value: userId}},
+	}}
+}
+
+// GetDerivedKeys lists derived keys of directory derived by user, or derived by other users from directory of user
+func (h *Handler) GetDerivedKeys(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+	keys, err := models.FindDerivedKeysByFilter(h.Db, bson.D{
+		{Key: "directory", Value: c.Param("id")},
+		derivedKeysOf(claims.Id),
+	}, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Expired keys are no longer valid
+	now := time.Now().UnixMilli()
+	result := make([]models.DerivedKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Expires == 0 || key.Expires > now {
+			result = append(result, key)
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// DeleteDerivedKey revokes derived key and all keys derived from it
+func (h *Handler) DeleteDerivedKey(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+	keyId := c.Param("key")
+
+	res, err := h.Db.Collection("derived_keys").DeleteOne(c, bson.D{
+		{Key: "_id", Value: keyId},
+		{Key: "directory", Value: c.Param("id")},
+		derivedKeysOf(claims.Id),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.DeletedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if _, err := h.Db.Collection("derived_keys").DeleteMany(c, bson.D{{Key: "ancestors", Value: keyId}}); err != nil {
+		log.Println(err)
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionRevokeDerivedKey,
+		Targets: []string{c.Param("id"), keyId},
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// Derived keys of deleted directories can't be used anymore
+func (h *Handler) deleteDerivedKeys(directories []string) {
+	if _, err := h.Db.Collection("derived_keys").DeleteMany(
+		context.TODO(),
+		bson.D{{Key: "directory", Value: bson.D{{Key: "$in", Value: directories}}}},
+	); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,256 @@
+package directories
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/audit"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+const (
+	activityDefaultLimit = 20
+	activityMaxLimit     = 100
+	// Events of the same kind closer to each other than this are grouped together
+	activityBurstWindow = 5 * time.Minute
+)
+
+// Activity is group of similar audit events performed by one user in one directory in short time,
+// e.g. "Alice uploaded 3 files to Reports"
+type Activity struct {
+	Action        string   `json:"action"`
+	Kind          string   `json:"kind"`
+	Actor         string   `json:"actor,omitempty"`
+	ActorName     string   `json:"actor_name,omitempty"`
+	Directory     string   `json:"directory,omitempty"`
+	DirectoryName string   `json:"directory_name,omitempty"`
+	Count         int      `json:"count"`
+	Targets       []string `json:"targets"`
+	Start         int64    `json:"start"`
+	End           int64    `json:"end"`
+
+	// Oldest event of group, used as cursor
+	last *models.AuditEvent
+}
+
+// GetDirectoryActivity returns activity in directory owned by or shared with user,
+// including operations of other users it's shared with
+func (h *Handler) GetDirectoryActivity(c *gin.Context) {
+	directoryId := c.Param("id")
+	claims := auth.ExtractClaimsFromContext(c)
+
+	if !auth.DirectoryAllowed(c, directoryId) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	var directory models.Directory
+
+	opts := options.FindOne().SetProjection(bson.D{{Key: "user", Value: 1}})
+	err := h.Db.Collection("directories").FindOne(c, bson.D{{Key: "_id", Value: directoryId}}, opts).
+		Decode(&directory)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if directory.User != claims.Id {
+		// Every share level and group role allows reading
+		if _, shared := auth.SharedPermissions(c, h.Db, directoryId, directory.User, claims.Id); !shared {
+			c.Status(http.StatusNotFound)
+			return
+		}
+	}
+
+	h.respondWithActivity(c, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "parent_before", Value: directoryId}},
+		bson.D{{Key: "parent_after", Value: directoryId}},
+		bson.D{{Key: "targets", Value: directoryId}},
+	}}})
+}
+
+// GetActivity returns activity of user and activity of other users in directories of user
+func (h *Handler) GetActivity(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	h.respondWithActivity(c, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "actor", Value: claims.Id}},
+		bson.D{{Key: "owner", Value: claims.Id}},
+	}}})
+}
+
+// Respond with page of activity from events matching filter, newest first.
+//
+// cursor query parameter is next_cursor from previous page. Bursts can be split between pages
+func (h *Handler) respondWithActivity(c *gin.Context, filter bson.D) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(activityDefaultLimit)))
+	if err != nil || limit < 1 || limit > activityMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	filter = append(filter,
+		bson.E{Key: "action", Value: bson.D{{Key: "$in", Value: audit.ChangeActions}}},
+		bson.E{Key: "result", Value: models.AuditResultSuccess},
+	)
+
+	// Cursor is time and id of the oldest event of previous page
+	if cursor := c.Query("cursor"); cursor != "" {
+		ts, id, found := strings.Cut(cursor, "_")
+		cursorTime, err := strconv.ParseInt(ts, 10, 64)
+		if !found || err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid cursor",
+			})
+			return
+		}
+
+		filter = append(filter, bson.E{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "time", Value: bson.D{{Key: "$lt", Value: cursorTime}}}},
+				bson.D{{Key: "time", Value: cursorTime}, {Key: "_id", Value: bson.D{{Key: "$lt", Value: id}}}},
+			}}},
+		}})
+	}
+
+	// Several events are usually grouped into one activity
+	fetchLimit := int64(limit * 10)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(fetchLimit)
+
+	events, err := models.FindAuditEventsByFilter(h.Db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	activities := groupActivity(events)
+
+	var next *models.AuditEvent
+	if len(activities) > limit {
+		activities = activities[:limit]
+		next = activities[limit-1].last
+	} else if int64(len(events)) == fetchLimit {
+		next = &events[len(events)-1]
+	}
+
+	if err := h.setActivityNames(c, activities); err != nil {
+		log.Panic(err)
+	}
+
+	nextCursor := ""
+	if next != nil {
+		nextCursor = strconv.FormatInt(next.Time, 10) + "_" + next.Id
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"activity":    activities,
+		"next_cursor": nextCursor,
+	})
+}
+
+// Group consecutive events (sorted from newest) with the same action, kind, actor and directory
+func groupActivity(events []models.AuditEvent) []Activity {
+	activities := make([]Activity, 0)
+
+	for idx := range events {
+		event := &events[idx]
+
+		directory := event.ParentAfter
+		if directory == "" {
+			directory = event.ParentBefore
+		}
+
+		// Copies have both source and copied items in targets
+		targets := event.Targets
+		if event.Action == audit.ActionCopy {
+			copies := make([]string, 0, len(targets)/2)
+			for i := 1; i < len(targets); i += 2 {
+				copies = append(copies, targets[i])
+			}
+			targets = copies
+		}
+
+		if len(activities) > 0 {
+			current := &activities[len(activities)-1]
+			if current.Action == event.Action && current.Kind == event.Kind && current.Actor == event.Actor &&
+				current.Directory == directory &&
+				time.Duration(current.Start-event.Time)*time.Millisecond <= activityBurstWindow {
+				current.Targets = append(current.Targets, targets...)
+				current.Count = len(current.Targets)
+				current.Start = event.Time
+				current.last = event
+				continue
+			}
+		}
+
+		activities = append(activities, Activity{
+			Action:    event.Action,
+			Kind:      event.Kind,
+			Actor:     event.Actor,
+			Directory: directory,
+			Count:     len(targets),
+			Targets:   targets,
+			Start:     event.Time,
+			End:       event.Time,
+			last:      event,
+		})
+	}
+
+	return activities
+}
+
+// Set usernames of actors and names of directories
+func (h *Handler) setActivityNames(ctx context.Context, activities []Activity) error {
+	userIds := make([]string, 0, len(activities))
+	directoryIds := make([]string, 0, len(activities))
+	for _, activity := range activities {
+		userIds = append(userIds, activity.Actor)
+		directoryIds = append(directoryIds, activity.Directory)
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "username", Value: 1}})
+	cursor, err := h.Db.Collection("user").Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: userIds}}}}, opts)
+	if err != nil {
+		return err
+	}
+
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	usernames := make(map[string]string, len(users))
+	for _, user := range users {
+		usernames[user.Id] = user.Username
+	}
+
+	opts = options.Find().SetProjection(bson.D{{Key: "name", Value: 1}})
+	directories, err := models.FindDirectoriesById[models.Directory](h.Db, directoryIds, opts)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]string, len(directories))
+	for _, directory := range directories {
+		names[directory.Id] = directory.Name
+	}
+
+	for idx := range activities {
+		activities[idx].ActorName = usernames[activities[idx].Actor]
+		activities[idx].DirectoryName = names[activities[idx].Directory]
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package directories
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/journal"
+)
+
+const (
+	changesDefaultLimit = 500
+	changesMaxLimit     = 2000
+	// Longest wait of long-polling request in seconds
+	changesMaxWait = 60
+	// How often journal is checked while long-polling
+	changesPollInterval = time.Second
+)
+
+// Change is current state of file or directory changed since cursor
+type Change struct {
+	Seq    int64  `json:"seq"`
+	Op     string `json:"op"`
+	Kind   string `json:"kind"`
+	Id     string `json:"id"`
+	Parent string `json:"parent,omitempty"`
+	// Path from root directory, e.g. /Main/Reports/report.pdf, empty for deleted items
+	Path string `json:"path,omitempty"`
+	// File or directory (with access key), nil for deleted items
+	Item interface{} `json:"item,omitempty"`
+
+	depth int
+}
+
+// Cursor is sequence number of last received entry and time before which no later entry was created,
+// so cursors older than retention period are recognized as expired
+func formatCursor(seq int64, ts int64) string {
+	return strconv.FormatInt(seq, 10) + "_" + strconv.FormatInt(ts, 10)
+}
+
+func parseCursor(cursor string) (seq int64, ts int64, ok bool) {
+	seqValue, tsValue, found := strings.Cut(cursor, "_")
+	seq, err := strconv.ParseInt(seqValue, 10, 64)
+	if !found || err != nil || seq < 0 {
+		return 0, 0, false
+	}
+	ts, err = strconv.ParseInt(tsValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return seq, ts, true
+}
+
+// Owner of journal from group query parameter (user must be member of group) or authenticated user,
+// with permissions of user in directories of owner. Returns false if response was already sent
+func (h *Handler) journalOwner(c *gin.Context) (owner string, permissions []string, ok bool) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	group := c.Query("group")
+	if group == "" {
+		return claims.Id, auth.AllDirectoryPermissions, true
+	}
+
+	member, err := models.FindGroupMember(c, h.Db, group, claims.Id)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return "", nil, false
+	}
+
+	return group, auth.SharePermissions[models.GroupRoleLevels[member.Role]], true
+}
+
+// GetChangesCursor returns cursor of the latest change, used after full listing of directories
+func (h *Handler) GetChangesCursor(c *gin.Context) {
+	owner, _, ok := h.journalOwner(c)
+	if !ok {
+		return
+	}
+
+	latest, err := journal.Latest(c, h.Db, owner)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cursor": formatCursor(latest, time.Now().Add(-journal.GapTimeout).UnixMilli()),
+	})
+}
+
+// GetChanges returns changes of files and directories of user (or group) since cursor.
+//
+// Query parameters: cursor, limit, wait (seconds to wait for changes if there are none, long-polling).
+// Responds with 410 if cursor expired and client has to list all directories again
+func (h *Handler) GetChanges(c *gin.Context) {
+	owner, permissions, ok := h.journalOwner(c)
+	if !ok {
+		return
+	}
+
+	after, cursorTime, ok := parseCursor(c.Query("cursor"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid cursor",
+		})
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(changesDefaultLimit)), 10, 64)
+	if err != nil || limit < 1 || limit > changesMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	wait, err := strconv.Atoi(c.DefaultQuery("wait", "0"))
+	if err != nil || wait < 0 || wait > changesMaxWait {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid wait",
+		})
+		return
+	}
+
+	if time.Since(time.UnixMilli(cursorTime)) > journal.Retention {
+		c.JSON(http.StatusGone, gin.H{
+			"error": "cursor expired, full resync needed",
+		})
+		return
+	}
+
+	latest, err := journal.Latest(c, h.Db, owner)
+	if err != nil {
+		log.Panic(err)
+	}
+	if after > latest {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid cursor",
+		})
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+
+	entries, more, err := journal.Since(c, h.Db, owner, after, limit)
+	for err == nil && len(entries) == 0 && time.Now().Before(deadline) {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(changesPollInterval):
+		}
+		entries, more, err = journal.Since(c, h.Db, owner, after, limit)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cursor := formatCursor(after, time.Now().Add(-journal.GapTimeout).UnixMilli())
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		cursor = formatCursor(last.Seq, time.Now().Add(-journal.GapTimeout).UnixMilli())
+		if more {
+			cursor = formatCursor(last.Seq, last.Time)
+		}
+	}
+
+	changes, err := h.resolveChanges(c, owner, permissions, entries)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"changes":  changes,
+		"cursor":   cursor,
+		"has_more": more,
+	})
+}
+
+// Compact entries to one change with current state of each item, ordered so changes can be applied
+// one by one: deletions first, then directories from the top and files
+func (h *Handler) resolveChanges(
+	c *gin.Context,
+	owner string,
+	permissions []string,
+	entries []models.JournalEntry,
+) ([]Change, error) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	latest := make(map[string]models.JournalEntry, len(entries))
+	created := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		latest[entry.Item] = entry
+		if entry.Op == models.JournalOpCreate {
+			created[entry.Item] = true
+		}
+	}
+
+	fileIds := make([]string, 0)
+	directoryIds := make([]string, 0)
+	for _, entry := range latest {
+		if entry.Op == models.JournalOpDelete {
+			continue
+		}
+		if entry.Kind == models.AuditKindFile {
+			fileIds = append(fileIds, entry.Item)
+		} else {
+			directoryIds = append(directoryIds, entry.Item)
+		}
+	}
+
+	files, err := models.FindFilesById[models.File](h.Db, fileIds)
+	if err != nil {
+		return nil, err
+	}
+	fileMap := make(map[string]models.File, len(files))
+	for _, file := range files {
+		fileMap[file.Id] = file
+	}
+
+	directories, err := models.FindDirectoriesById[models.Directory](h.Db, directoryIds)
+	if err != nil {
+		return nil, err
+	}
+	directoryMap := make(map[string]models.Directory, len(directories))
+	for _, directory := range directories {
+		directoryMap[directory.Id] = directory
+	}
+
+	// Paths are built from names of all directories of owner
+	opts := options.Find().SetProjection(bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "name", Value: 1},
+		{Key: "parent_directory", Value: 1},
+	})
+	tree, err := models.FindDirectoriesByFilter[models.Directory](h.Db, bson.D{{Key: "user", Value: owner}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	treeMap := make(map[string]models.Directory, len(tree))
+	for _, directory := range tree {
+		treeMap[directory.Id] = directory
+	}
+
+	path := func(id string) (string, int) {
+		names := make([]string, 0)
+		for id != "" && len(names) <= len(treeMap) {
+			directory, exists := treeMap[id]
+			if !exists {
+				break
+			}
+			names = append([]string{directory.Name}, names...)
+			id = directory.ParentDirectory
+		}
+		return "/" + strings.Join(names, "/"), len(names)
+	}
+
+	itemOwner := ""
+	if owner != claims.Id {
+		itemOwner = owner
+	}
+
+	changes := make([]Change, 0, len(latest))
+	for _, entry := range entries {
+		// Only the latest entry of item is used
+		if latest[entry.Item].Seq != entry.Seq {
+			continue
+		}
+
+		change := Change{Seq: entry.Seq, Op: entry.Op, Kind: entry.Kind, Id: entry.Item, Parent: entry.Parent}
+		if created[entry.Item] && entry.Op != models.JournalOpDelete {
+			change.Op = models.JournalOpCreate
+		}
+
+		switch {
+		case entry.Op == models.JournalOpDelete:
+		case entry.Kind == models.AuditKindFile:
+			file, exists := fileMap[entry.Item]
+			// Item was deleted later, its deletion is in next entries
+			if !exists {
+				continue
+			}
+			change.Parent = file.ParentDirectory
+			change.Path, change.depth = path(file.ParentDirectory)
+			change.Path = strings.TrimSuffix(change.Path, "/") + "/" + file.Name
+			change.Item = file
+		default:
+			directory, exists := directoryMap[entry.Item]
+			if !exists {
+				continue
+			}
+			directory.AccessKey, err = auth.GenerateAccessKey(
+				directory.Id,
+				claims.Id,
+				itemOwner,
+				permissions,
+				directory.KeyGeneration,
+				false,
+			)
+			if err != nil {
+				return nil, err
+			}
+			change.Parent = directory.ParentDirectory
+			change.Path, change.depth = path(directory.Id)
+			change.Item = directory
+		}
+
+		changes = append(changes, change)
+	}
+
+	rank := func(change *Change) int {
+		switch {
+		case change.Op == models.JournalOpDelete:
+			return 0
+		case change.Kind == models.AuditKindDirectory:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if rank(&changes[i]) != rank(&changes[j]) {
+			return rank(&changes[i]) < rank(&changes[j])
+		}
+		return changes[i].depth < changes[j].depth
+	})
+
+	return changes, nil
+}
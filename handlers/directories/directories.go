@@ -15,10 +15,13 @@ import (
 	cp "github.com/otiai10/copy"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"ncloud-api/config"
 	"ncloud-api/handlers/search"
+	"ncloud-api/middleware/audit"
 	"ncloud-api/middleware/auth"
+	"ncloud-api/middleware/metrics"
 	"ncloud-api/models"
 	"ncloud-api/utils/helper"
 )
@@ -51,23 +54,77 @@ func (h *Handler) GetDirectoryWithFiles(c *gin.Context) {
 	directoryId := c.Param("id")
 	limit := c.Query("limit")
 	skip := c.Query("skip")
+	// Recursive key of requested directory also authorizes everything inside it
+	recursive := c.Query("recursive") == "true"
 
 	claims := auth.ExtractClaimsFromContext(c)
 
+	// Token restricted to directory starts listing from that directory
+	if directoryId == "" && claims.Directory != "" {
+		directoryId = claims.Directory
+	}
+
+	if !auth.DirectoryAllowed(c, directoryId) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	// Directories shared with user and directories of groups are listed with keys limited by level of share
+	// or role of user in group
+	owner := claims.Id
+	permissions := auth.AllDirectoryPermissions
+	ownerPermissions := map[string][]string{claims.Id: permissions}
+
+	if directoryId != "" {
+		var directory models.Directory
+
+		opts := options.FindOne().SetProjection(bson.D{{Key: "user", Value: 1}})
+		err := h.Db.Collection("directories").FindOne(c, bson.D{{Key: "_id", Value: directoryId}}, opts).
+			Decode(&directory)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		if directory.User != claims.Id {
+			var shared bool
+			permissions, shared = auth.SharedPermissions(c, h.Db, directoryId, directory.User, claims.Id)
+			if !shared {
+				c.Status(http.StatusNotFound)
+				return
+			}
+
+			owner = directory.User
+			ownerPermissions = map[string][]string{owner: permissions}
+		}
+	}
+
 	var matchStage bson.D
 
 	if directoryId == "" {
+		// Root directories of groups are listed with Main and Trash
+		groups, err := models.FindGroupsByFilter(h.Db, bson.D{{Key: "members.user", Value: claims.Id}})
+		if err != nil {
+			log.Panic(err)
+		}
+
+		owners := []string{claims.Id}
+		for _, group := range groups {
+			owners = append(owners, group.Id)
+			ownerPermissions[group.Id] = auth.SharePermissions[models.GroupRoleLevels[group.Member(claims.Id).Role]]
+		}
+
 		matchStage = bson.D{
 			{Key: "$match", Value: bson.D{
 				{Key: "parent_directory", Value: nil},
-				{Key: "user", Value: claims.Id},
+				{Key: "user", Value: bson.D{{Key: "$in", Value: owners}}},
 			}},
 		}
 	} else {
 		matchStage = bson.D{
 			{Key: "$match", Value: bson.D{
 				{Key: "_id", Value: directoryId},
-				{Key: "user", Value: claims.Id},
+				{Key: "user", Value: owner},
 			}},
 		}
 	}
@@ -121,9 +178,58 @@ func (h *Handler) GetDirectoryWithFiles(c *gin.Context) {
 		return
 	}
 
+	for _, result := range results {
+		resultOwner, _ := result["user"].(string)
+		permissions := ownerPermissions[resultOwner]
+
+		setAccessKey(result, claims.Id, permissions, recursive)
+
+		children, _ := result["directories"].(bson.A)
+		for _, child := range children {
+			if child, ok := child.(bson.M); ok {
+				setAccessKey(child, claims.Id, permissions, false)
+			}
+		}
+	}
+
 	c.JSON(http.StatusOK, results)
 }
 
+// Replace access key of directory document with new key for user, keys aren't stored because they expire.
+// Key is shared access key if directory belongs to another user
+func setAccessKey(document bson.M, user string, permissions []string, recursive bool) {
+	directory := models.Directory{}
+	directory.Id, _ = document["_id"].(string)
+	directory.User, _ = document["user"].(string)
+
+	switch generation := document["key_generation"].(type) {
+	case int64:
+		directory.KeyGeneration = generation
+	case int32:
+		directory.KeyGeneration = int64(generation)
+	}
+	delete(document, "key_generation")
+
+	owner := ""
+	if directory.User != user {
+		owner = directory.User
+	}
+
+	accessKey, err := auth.GenerateAccessKey(
+		directory.Id,
+		user,
+		owner,
+		permissions,
+		directory.KeyGeneration,
+		recursive,
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	document["access_key"] = accessKey
+}
+
 func (h *Handler) CreateDirectory(c *gin.Context) {
 	parentDirectoryId := c.Param("id")
 
@@ -141,11 +247,13 @@ func (h *Handler) CreateDirectory(c *gin.Context) {
 		return
 	}
 
-	user := auth.ExtractClaimsFromContext(c)
+	// Verified in DirectoryAuth, directory belongs to owner of parent directory
+	parentClaims := auth.DirectoryClaimsFromContext(c)
+	owner := parentClaims.DirectoryOwner()
 
 	// Set parentDirectoryId from URL
 	directory.ParentDirectory = parentDirectoryId
-	directory.User = user.Id
+	directory.User = owner
 
 	directoryId, _ := uuid.NewUUID()
 	directory.Id = directoryId.String()
@@ -153,11 +261,8 @@ func (h *Handler) CreateDirectory(c *gin.Context) {
 	directory.Created = time.Now().UnixMilli()
 	directory.Modified = directory.Created
 
-	// Create and set access key to directory
-	newDirectoryAccessKey, _ := auth.GenerateDirectoryAccessKey(
-		directoryId.String(),
-		auth.AllDirectoryPermissions,
-	)
+	// Create and set access key to directory, with the same permissions as key of parent directory
+	newDirectoryAccessKey, _ := auth.GenerateAccessKeyLike(parentClaims, directoryId.String())
 
 	directory.AccessKey = newDirectoryAccessKey
 
@@ -178,25 +283,73 @@ func (h *Handler) CreateDirectory(c *gin.Context) {
 		Id:        directoryId.String(),
 		Name:      directory.Name,
 		Directory: parentDirectoryId,
-		User:      user.Id,
+		User:      owner,
+	})
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:      audit.ActionCreateDirectory,
+		Kind:        models.AuditKindDirectory,
+		Targets:     []string{directory.Id},
+		ParentAfter: parentDirectoryId,
+		Details:     directory.Name,
 	})
 
 	c.JSON(http.StatusCreated, directory)
 }
 
-func (h *Handler) ModifyDirectory(c *gin.Context) {
+// RotateAccessKey increments key generation of directory owned by user, so all previous access keys
+// of this directory become invalid, and returns new access key
+func (h *Handler) RotateAccessKey(c *gin.Context) {
 	directoryId := c.Param("id")
-	dirAccessKey := c.GetHeader("DirectoryAccessKey")
 	claims := auth.ExtractClaimsFromContext(c)
 
-	// Validate permissions from access key
-	isAuthorized := auth.ValidatePermissions(dirAccessKey, auth.PermissionModify)
-	if !isAuthorized {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error": "no modify permission",
-		})
+	if !auth.DirectoryAllowed(c, directoryId) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	var directory models.Directory
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := h.Db.Collection("directories").FindOneAndUpdate(
+		c,
+		bson.D{{Key: "_id", Value: directoryId}, {Key: "user", Value: claims.Id}},
+		bson.D{{Key: "$inc", Value: bson.M{"key_generation": int64(1)}}},
+		opts,
+	).Decode(&directory)
+	if err == mongo.ErrNoDocuments {
+		c.Status(http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	accessKey, err := auth.GenerateDirectoryAccessKey(
+		directory.Id,
+		directory.User,
+		auth.AllDirectoryPermissions,
+		directory.KeyGeneration,
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionRotateKey,
+		Kind:    models.AuditKindDirectory,
+		Targets: []string{directory.Id},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_key": accessKey,
+	})
+}
+
+func (h *Handler) ModifyDirectory(c *gin.Context) {
+	// Modify permission is verified in RequirePermission
+	directoryId := c.Param("id")
+	claims := auth.DirectoryClaimsFromContext(c)
 
 	var directory models.Directory
 
@@ -214,11 +367,19 @@ func (h *Handler) ModifyDirectory(c *gin.Context) {
 
 	collection := h.Db.Collection("directories")
 
-	_, err := collection.UpdateByID(
+	// Main and Trash directories can't be renamed
+	var previous models.Directory
+
+	opts := options.FindOneAndUpdate().SetProjection(bson.D{{Key: "parent_directory", Value: 1}})
+	err := collection.FindOneAndUpdate(
 		c,
-		directoryId,
+		bson.D{
+			{Key: "_id", Value: directoryId},
+			{Key: "parent_directory", Value: bson.D{{Key: "$ne", Value: nil}}},
+		},
 		bson.D{{Key: "$set", Value: bson.M{"name": directory.Name, "modified": time.Now().UnixMilli()}}},
-	)
+		opts,
+	).Decode(&previous)
 	if err != nil {
 		log.Println(err)
 		c.Status(http.StatusNotFound)
@@ -229,7 +390,15 @@ func (h *Handler) ModifyDirectory(c *gin.Context) {
 	h.UpdateOrAddToSearchDatabase(&SearchDatabaseData{
 		Id:   directoryId,
 		Name: directory.Name,
-		User: claims.Id,
+		User: claims.DirectoryOwner(),
+	})
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:       audit.ActionRename,
+		Kind:         models.AuditKindDirectory,
+		Targets:      []string{directoryId},
+		ParentBefore: previous.ParentDirectory,
+		Details:      directory.Name,
 	})
 
 	c.Status(http.StatusNoContent)
@@ -328,6 +497,16 @@ func (h *Handler) FindAndMapDirectories(user string) map[string][]string {
 	return childrenMap
 }
 
+// Find parent of directory in map from FindAndMapDirectories
+func findParent(directoryMap map[string][]string, id string) string {
+	for parent, children := range directoryMap {
+		if helper.ArrayContains(children, id) {
+			return parent
+		}
+	}
+	return ""
+}
+
 func (h *Handler) DeleteDirectories(c *gin.Context) {
 	type RequestData struct {
 		Id        string `json:"id"`
@@ -340,9 +519,14 @@ func (h *Handler) DeleteDirectories(c *gin.Context) {
 	}
 
 	directoriesToDelete := make([]string, 0, len(directories))
+	// Directories shared with user belong to other users
+	owners := make(map[string]string, len(directories))
 
 	for _, directory := range directories {
-		if isValid := auth.ValidateAccessKeyWithId(directory.AccessKey, directory.Id); !isValid {
+		accessKey := auth.BatchAccessKey(c, directory.AccessKey)
+		if isValid := auth.ValidateAccessKeyPermission(
+			c, h.Db, accessKey, directory.Id, auth.PermissionDelete,
+		); !isValid {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": "invalid access key for directory: " + directory.Id,
 			})
@@ -350,87 +534,136 @@ func (h *Handler) DeleteDirectories(c *gin.Context) {
 		}
 
 		directoriesToDelete = append(directoriesToDelete, directory.Id)
+		owners[directory.Id] = auth.AccessKeyOwner(accessKey)
 	}
 
-	claims := auth.ExtractClaimsFromContext(c)
-	user := claims.Id
-
-	directoryMap := h.FindAndMapDirectories(user)
+	if h.rejectRootDirectories(c, directoriesToDelete) {
+		return
+	}
 
-	// We use len(directoryMap), even though it's not exactly accurate, but this is the highest amount we can estimate
-	// It will reduce a little bit of work caused by appending to already full slice
-	directoryList := make([]string, 0, len(directoryMap))
+	directoryMaps := make(map[string]map[string][]string, 1)
+	ownerList := make([]string, 0, 1)
+	directoryList := make([]string, 0, len(directoriesToDelete))
 
 	for _, val := range directoriesToDelete {
+		owner := owners[val]
+		directoryMap, exists := directoryMaps[owner]
+		if !exists {
+			directoryMap = h.FindAndMapDirectories(owner)
+			directoryMaps[owner] = directoryMap
+			ownerList = append(ownerList, owner)
+		}
+
 		directoryList = append(
 			directoryList,
 			GetDirectoriesFromParents(directoryMap[val], directoryMap)...)
 		directoryList = append(directoryList, val)
 	}
 
+	if err := h.RemoveDirectories(c, ownerList, directoryList); err != nil {
+		log.Panic(err)
+	}
+
+	metrics.ObserveOperation(metrics.OperationDelete, metrics.KindDirectory, int64(len(directoryList)))
+
+	for _, directory := range directoriesToDelete {
+		audit.Record(c, h.Db, models.AuditEvent{
+			Action:       audit.ActionDelete,
+			Kind:         models.AuditKindDirectory,
+			Owner:        owners[directory],
+			Targets:      []string{directory},
+			ParentBefore: findParent(directoryMaps[owners[directory]], directory),
+		})
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveDirectories deletes directories of owners from directoryList (including all directories inside them)
+// with their files from database, disk and search database, with derived keys, shares and webhooks of directories
+func (h *Handler) RemoveDirectories(ctx context.Context, ownerList []string, directoryList []string) error {
 	// Remove all file documents from DB
 	collection := h.Db.Collection("files")
 
 	_, err := collection.DeleteMany(
-		context.TODO(),
+		ctx,
 		bson.D{
 			{Key: "parent_directory", Value: bson.D{{Key: "$in", Value: directoryList}}},
 		},
 	)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	// Remove all directories documents from DB
 	collection = h.Db.Collection("directories")
 
 	_, err = collection.DeleteMany(
-		context.TODO(),
+		ctx,
 		bson.D{
-			{Key: "user", Value: claims.Id},
+			{Key: "user", Value: bson.D{{Key: "$in", Value: ownerList}}},
 			{Key: "_id", Value: bson.D{{Key: "$in", Value: directoryList}}},
 		},
 	)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	// Remove all directories (with files) from disk
 	for _, directory := range directoryList {
 		if err = os.RemoveAll(config.UploadDestination + directory); err != nil {
-			log.Panic(err)
+			return err
 		}
 	}
 
-	if _, err = h.SearchDb.Index("directories").DeleteDocuments(directoriesToDelete); err != nil {
+	h.DeleteFromSearchDatabase(directoryList)
+	h.deleteDerivedKeys(directoryList)
+	if err := models.DeleteWebhooks(ctx, h.Db, bson.D{{Key: "directory", Value: bson.D{{Key: "$in", Value: directoryList}}}}); err != nil {
 		log.Println(err)
 	}
+	h.deleteDirectoryShares(directoryList)
 
 	fileDeleteQuery := make([]string, 0, len(directoryList))
 	for _, dirId := range directoryList {
 		fileDeleteQuery = append(fileDeleteQuery, "parent_directory = "+dirId)
 	}
 
-	if _, err := h.SearchDb.Index("files").DeleteDocumentsByFilter(strings.Join(fileDeleteQuery, " OR ")); err != nil {
+	if err := search.DeleteDocumentsByFilter(h.SearchDb, "files", strings.Join(fileDeleteQuery, " OR ")); err != nil {
 		log.Println(err)
 	}
 
-	c.Status(http.StatusNoContent)
+	return nil
+}
+
+// Main and Trash directories can't be moved or deleted, returns true if response was sent
+func (h *Handler) rejectRootDirectories(c *gin.Context, idList []string) bool {
+	containsRoot, err := models.ContainsRootDirectory(c, h.Db, idList)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if containsRoot {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "root directory can't be moved or deleted",
+		})
+		return true
+	}
+
+	return false
 }
 
 func validateDirectory(
 	c *gin.Context,
+	db *mongo.Database,
 	accessKey string,
 	directoryId string,
 	directoryToMove string,
 	directoryTree map[string][]string,
 ) bool {
-	// Validate access key and check if this access key is for that specific directory
-	accessKeyClaims, IS_VALID_ACCESS_KEY := auth.ValidateAccessKey(accessKey)
-	IS_FOR_THIS_DIRECTORY := accessKeyClaims.Id == directoryId
-
-	// Check if access key allows user to modify (check permissions)
-	VALID_PERMISSIONS := auth.ValidatePermissionsFromClaims(accessKeyClaims, auth.PermissionModify)
+	// Validate access key, check if this access key is for that specific directory and allows user to modify it
+	IS_VALID_ACCESS_KEY := auth.ValidateAccessKeyPermission(
+		c, db, auth.BatchAccessKey(c, accessKey), directoryId, auth.PermissionModify,
+	)
 
 	// Check if destination folder is not in source folder (can't move directory to itself)
 	IS_INSIDE_OF_ITSELF := helper.ArrayContains(
@@ -439,8 +672,13 @@ func validateDirectory(
 	) ||
 		directoryId == directoryToMove
 
-	if !IS_VALID_ACCESS_KEY || !VALID_PERMISSIONS || IS_INSIDE_OF_ITSELF ||
-		!IS_FOR_THIS_DIRECTORY {
+	if !IS_VALID_ACCESS_KEY {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid access key for directory: " + directoryId,
+		})
+		return false
+	}
+	if IS_INSIDE_OF_ITSELF {
 		c.Status(http.StatusBadRequest)
 		return false
 	}
@@ -450,9 +688,6 @@ func validateDirectory(
 func (h *Handler) ChangeDirectory(c *gin.Context) {
 	var operations []mongo.WriteModel
 
-	claims := auth.ExtractClaimsFromContext(c)
-	directoryTree := h.FindAndMapDirectories(claims.Id)
-
 	type RequestData struct {
 		DestinationId        string `json:"id"`
 		DestinationAccessKey string `json:"access_key"`
@@ -469,27 +704,41 @@ func (h *Handler) ChangeDirectory(c *gin.Context) {
 		return
 	}
 
-	// Validate access key and check if the access key is for that specific directory
-	directoryClaims, valid := auth.ValidateAccessKey(data.DestinationAccessKey)
-	if !valid || directoryClaims.Id != data.DestinationId {
+	// Validate access key and check if the access key is for that specific directory and allows adding to it
+	destinationAccessKey := auth.BatchAccessKey(c, data.DestinationAccessKey)
+	if !auth.ValidateAccessKeyPermission(c, h.Db, destinationAccessKey, data.DestinationId, auth.PermissionUpload) {
 		c.JSON(http.StatusForbidden, gin.H{
 			"error": "invalid access key for directory: " + data.DestinationId,
 		})
 		return
 	}
 
+	// Directories can only be moved inside directory tree of one user (e.g. inside shared directory)
+	owner := auth.AccessKeyOwner(destinationAccessKey)
+	directoryTree := h.FindAndMapDirectories(owner)
+
 	// map in format {"_id": "directoryId", "parent_directory": "ID of destination directory"}
 	// used to construct search database update query
 	searchDbQueryList := make([]map[string]interface{}, 0, len(data.Items))
 
 	directoryIdList := make([]string, 0, len(data.Items))
+	itemIdList := make([]string, 0, len(data.Items))
 
 	// Validate each file and add them to searchDbQueryList and directoryIdList
 	for _, directory := range data.Items {
-		if isValidDirectory := validateDirectory(c, directory.AccessKey, directory.Id, data.DestinationId, directoryTree); !isValidDirectory {
+		if isValidDirectory := validateDirectory(c, h.Db, directory.AccessKey, directory.Id, data.DestinationId, directoryTree); !isValidDirectory {
 			return
 		}
 
+		if auth.AccessKeyOwner(auth.BatchAccessKey(c, directory.AccessKey)) != owner {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "directory can't be moved to directory of another user: " + directory.Id,
+			})
+			return
+		}
+
+		itemIdList = append(itemIdList, directory.Id)
+
 		searchDbQueryList = append(searchDbQueryList, map[string]interface{}{
 			"_id":              directory.Id,
 			"parent_directory": data.DestinationId,
@@ -519,6 +768,10 @@ func (h *Handler) ChangeDirectory(c *gin.Context) {
 
 	}
 
+	if h.rejectRootDirectories(c, itemIdList) {
+		return
+	}
+
 	if len(directoryIdList) > 0 {
 		updateOperation := mongo.NewUpdateManyModel()
 
@@ -542,8 +795,19 @@ func (h *Handler) ChangeDirectory(c *gin.Context) {
 		log.Panic(err)
 	}
 
-	if _, err := h.SearchDb.Index("directories").UpdateDocuments(searchDbQueryList); err != nil {
-		log.Println(err)
+	h.UpdateOrAddToSearchDatabase(searchDbQueryList)
+
+	metrics.ObserveOperation(metrics.OperationMove, metrics.KindDirectory, res.ModifiedCount)
+
+	for _, directory := range itemIdList {
+		audit.Record(c, h.Db, models.AuditEvent{
+			Action:       audit.ActionMove,
+			Kind:         models.AuditKindDirectory,
+			Owner:        owner,
+			Targets:      []string{directory},
+			ParentBefore: findParent(directoryTree, directory),
+			ParentAfter:  data.DestinationId,
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -608,8 +872,20 @@ func (h *Handler) RestoreDirectories(c *gin.Context) {
 		log.Panic(err)
 	}
 
-	if _, err := h.SearchDb.Index("directories").UpdateDocuments(searchDbQueryList); err != nil {
-		log.Println(err)
+	h.UpdateOrAddToSearchDatabase(searchDbQueryList)
+
+	metrics.ObserveOperation(metrics.OperationRestore, metrics.KindDirectory, res.ModifiedCount)
+
+	for _, directory := range directories {
+		if directory.PreviousParentDirectory != "" {
+			audit.Record(c, h.Db, models.AuditEvent{
+				Action:       audit.ActionRestore,
+				Kind:         models.AuditKindDirectory,
+				Targets:      []string{directory.Id},
+				ParentBefore: directory.ParentDirectory,
+				ParentAfter:  directory.PreviousParentDirectory,
+			})
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -621,6 +897,9 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 	type RequestData struct {
 		Destination string   `json:"destination"`
 		Directories []string `json:"directories"`
+		// Optional, required only for directories shared with user
+		AccessKey       string `json:"access_key"`
+		SourceAccessKey string `json:"source_access_key"`
 	}
 
 	var data RequestData
@@ -631,8 +910,50 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 
 	user := auth.ExtractClaimsFromContext(c).Id
 
+	// Copies belong to owner of destination directory and count against its quota
+	destination := &auth.DirectoryClaims{User: user, Permissions: auth.AllDirectoryPermissions}
+	if data.AccessKey != "" {
+		claims, isValid := auth.ValidateAccessKey(c, h.Db, data.AccessKey)
+		if !isValid || !auth.ValidatePermissionsFromClaims(claims, auth.PermissionUpload) ||
+			!auth.KeyCoversDirectory(c, h.Db, claims, data.Destination) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "invalid destination directory",
+			})
+			return
+		}
+		destination = claims
+	} else {
+		count, err := h.Db.Collection("directories").CountDocuments(c, bson.D{
+			{Key: "_id", Value: data.Destination},
+			{Key: "user", Value: user},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if count == 0 {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "invalid destination directory",
+			})
+			return
+		}
+	}
+	owner := destination.DirectoryOwner()
+
+	sourceOwner := user
+	if data.SourceAccessKey != "" {
+		for _, directory := range data.Directories {
+			if !auth.ValidateAccessKeyPermission(c, h.Db, data.SourceAccessKey, directory, auth.PermissionRead) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "invalid access key for directory: " + directory,
+				})
+				return
+			}
+		}
+		sourceOwner = auth.AccessKeyOwner(data.SourceAccessKey)
+	}
+
 	filter := bson.D{
-		{Key: "user", Value: user},
+		{Key: "user", Value: sourceOwner},
 		{Key: "parent_directory", Value: bson.D{{Key: "$exists", Value: true}}},
 	}
 
@@ -674,10 +995,7 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 		directoryIdMap[newId.String()] = directory.Id
 		directoryIdMap[directory.Id] = newId.String()
 
-		newAccessKey, _ := auth.GenerateDirectoryAccessKey(
-			newId.String(),
-			auth.AllDirectoryPermissions,
-		)
+		newAccessKey, _ := auth.GenerateAccessKeyLike(destination, newId.String())
 
 		children, exists := childrenMap[directory.Id]
 		if exists {
@@ -687,6 +1005,7 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 		}
 
 		directory.Id = newId.String()
+		directory.User = owner
 		directory.AccessKey = newAccessKey
 	}
 
@@ -698,6 +1017,27 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 		{Key: "parent_directory", Value: bson.D{{Key: "$in", Value: filesParentList}}},
 	}
 
+	filesToCopy, err := models.FindFilesByFilter[models.File](h.Db, filter)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var copySize int64
+	for _, file := range filesToCopy {
+		copySize += file.Size
+	}
+
+	quotaExceeded, err := models.QuotaExceeded(c, h.Db, owner, copySize)
+	if err != nil {
+		log.Panic(err)
+	}
+	if quotaExceeded {
+		c.JSON(http.StatusInsufficientStorage, gin.H{
+			"error": "storage quota exceeded",
+		})
+		return
+	}
+
 	if _, err := h.Db.Collection("directories").InsertMany(context.TODO(), models.DirectoryPointersToBsonNotEmpty(directoriesToCopy)); err != nil {
 		log.Panic(err)
 	}
@@ -710,11 +1050,6 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 		}
 	}
 
-	filesToCopy, err := models.FindFilesByFilter[models.File](h.Db, filter)
-	if err != nil {
-		log.Panic(err)
-	}
-
 	if len(filesToCopy) > 0 {
 		fileIdMap := make(map[string]string, len(filesToCopy))
 		for idx, file := range filesToCopy {
@@ -725,6 +1060,7 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 			filesToCopy[idx].Id = newId.String()
 			filesToCopy[idx].ParentDirectory = directoryIdMap[file.ParentDirectory]
 			filesToCopy[idx].PreviousParentDirectory = ""
+			filesToCopy[idx].User = owner
 		}
 
 		if _, err := h.Db.Collection("files").InsertMany(context.TODO(), models.FilesToBsonNotEmpty(filesToCopy)); err != nil {
@@ -740,5 +1076,21 @@ func (h *Handler) CopyDirectories(c *gin.Context) {
 			}
 		}
 	}
+
+	metrics.ObserveOperation(metrics.OperationCopy, metrics.KindDirectory, int64(len(directoriesToCopy)))
+
+	// Both source directories and their copies are targets
+	copied := make([]string, 0, 2*len(topDirectories))
+	for _, directory := range topDirectories {
+		copied = append(copied, directoryIdMap[directory.Id], directory.Id)
+	}
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:      audit.ActionCopy,
+		Kind:        models.AuditKindDirectory,
+		Owner:       owner,
+		Targets:     copied,
+		ParentAfter: data.Destination,
+	})
+
 	c.JSON(http.StatusOK, topDirectories)
 }
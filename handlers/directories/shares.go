@@ -0,0 +1,276 @@
+package directories
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/audit"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+// Find directory from id parameter owned by authenticated user, respond with 404 if it doesn't exist.
+// Returns nil if response was already sent
+func (h *Handler) findOwnDirectory(c *gin.Context) *models.Directory {
+	var directory models.Directory
+
+	err := h.Db.Collection("directories").FindOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: auth.ExtractClaimsFromContext(c).Id},
+	}).Decode(&directory)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+
+	return &directory
+}
+
+// ShareDirectory shares directory of user with another user at read, upload or edit level.
+// Level of existing share is replaced. Directories inside shared directory can also be shared,
+// user gets the highest level of all shares above directory
+func (h *Handler) ShareDirectory(c *gin.Context) {
+	type RequestData struct {
+		Username string `json:"username"`
+		Level    string `json:"level"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	directory := h.findOwnDirectory(c)
+	if directory == nil {
+		return
+	}
+
+	if directory.ParentDirectory == "" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "root directory can't be shared",
+		})
+		return
+	}
+
+	var user models.User
+
+	opts := options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 1}})
+	err := h.Db.Collection("user").FindOne(c, bson.D{{Key: "username", Value: data.Username}}, opts).Decode(&user)
+	if err != nil || user.Id == directory.User {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid user",
+		})
+		return
+	}
+
+	share := models.DirectoryShare{
+		Id:        uuid.New().String(),
+		Directory: directory.Id,
+		Owner:     directory.User,
+		User:      user.Id,
+		Level:     data.Level,
+		Created:   time.Now().UnixMilli(),
+		Username:  data.Username,
+	}
+
+	if err := share.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter := bson.D{
+		{Key: "directory", Value: share.Directory},
+		{Key: "user", Value: share.User},
+	}
+	res, err := h.Db.Collection("directory_shares").UpdateOne(c, filter, bson.D{
+		{Key: "$set", Value: bson.M{"level": share.Level}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		if _, err := h.Db.Collection("directory_shares").InsertOne(c, share); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionShare,
+		Targets: []string{share.Directory, share.User},
+		Details: share.Level,
+	})
+
+	if res.MatchedCount == 1 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	c.JSON(http.StatusCreated, share)
+}
+
+// GetDirectoryShares lists users directory of user is shared with
+func (h *Handler) GetDirectoryShares(c *gin.Context) {
+	directory := h.findOwnDirectory(c)
+	if directory == nil {
+		return
+	}
+
+	shares, err := models.FindDirectorySharesByFilter(h.Db, bson.D{{Key: "directory", Value: directory.Id}})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err := h.setUsernames(c, shares); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// DeleteDirectoryShare revokes share of directory with user, access keys of user stop working immediately.
+// Share can be removed by owner of directory, or by user it's shared with
+func (h *Handler) DeleteDirectoryShare(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	res, err := h.Db.Collection("directory_shares").DeleteOne(c, bson.D{
+		{Key: "directory", Value: c.Param("id")},
+		{Key: "user", Value: c.Param("user")},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "owner", Value: claims.Id}},
+			bson.D{{Key: "user", Value: claims.Id}},
+		}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.DeletedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionUnshare,
+		Targets: []string{c.Param("id"), c.Param("user")},
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetSharedDirectories lists directories shared with user, with access keys limited by level of share
+func (h *Handler) GetSharedDirectories(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+	shares, err := models.FindDirectorySharesByFilter(h.Db, bson.D{{Key: "user", Value: claims.Id}}, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	directoryIds := make([]string, 0, len(shares))
+	for _, share := range shares {
+		directoryIds = append(directoryIds, share.Directory)
+	}
+
+	directories, err := models.FindDirectoriesById[models.Directory](h.Db, directoryIds)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	directoryMap := make(map[string]models.Directory, len(directories))
+	for _, directory := range directories {
+		directoryMap[directory.Id] = directory
+	}
+
+	type SharedDirectory struct {
+		models.Directory
+		Level string `json:"level"`
+		Owner string `json:"owner"`
+	}
+
+	owners := make([]models.DirectoryShare, 0, len(shares))
+	for _, share := range shares {
+		owners = append(owners, models.DirectoryShare{User: share.Owner})
+	}
+	if err := h.setUsernames(c, owners); err != nil {
+		log.Panic(err)
+	}
+
+	result := make([]SharedDirectory, 0, len(shares))
+	for idx, share := range shares {
+		directory, exists := directoryMap[share.Directory]
+		if !exists {
+			continue
+		}
+
+		directory.AccessKey, err = auth.GenerateAccessKey(
+			directory.Id,
+			claims.Id,
+			share.Owner,
+			auth.SharePermissions[share.Level],
+			directory.KeyGeneration,
+			false,
+		)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		result = append(result, SharedDirectory{
+			Directory: directory,
+			Level:     share.Level,
+			Owner:     owners[idx].Username,
+		})
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// Set usernames of users of shares
+func (h *Handler) setUsernames(ctx context.Context, shares []models.DirectoryShare) error {
+	userIds := make([]string, 0, len(shares))
+	for _, share := range shares {
+		userIds = append(userIds, share.User)
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "username", Value: 1}})
+	cursor, err := h.Db.Collection("user").Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: userIds}}}}, opts)
+	if err != nil {
+		return err
+	}
+
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	usernames := make(map[string]string, len(users))
+	for _, user := range users {
+		usernames[user.Id] = user.Username
+	}
+
+	for idx := range shares {
+		shares[idx].Username = usernames[shares[idx].User]
+	}
+
+	return nil
+}
+
+// Shares of deleted directories are removed with them
+func (h *Handler) deleteDirectoryShares(directories []string) {
+	if _, err := h.Db.Collection("directory_shares").DeleteMany(
+		context.TODO(),
+		bson.D{{Key: "directory", Value: bson.D{{Key: "$in", Value: directories}}}},
+	); err != nil {
+		log.Println(err)
+	}
+}
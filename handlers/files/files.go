@@ -3,8 +3,11 @@ package files
 import (
 	"archive/zip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"time"
@@ -19,7 +22,9 @@ import (
 
 	"ncloud-api/config"
 	"ncloud-api/handlers/search"
+	"ncloud-api/middleware/audit"
 	"ncloud-api/middleware/auth"
+	"ncloud-api/middleware/metrics"
 	"ncloud-api/models"
 	"ncloud-api/utils/helper"
 )
@@ -69,8 +74,10 @@ func (h *Handler) Upload(c *gin.Context) {
 
 	filesToReturn := make([]models.File, 0, len(files))
 
-	directory := c.Param("id")
-	claims := auth.ExtractClaimsFromContext(c)
+	// Verified in DirectoryAuth or ShareAuth, files belong to owner of directory
+	directoryClaims := auth.DirectoryClaimsFromContext(c)
+	directory := directoryClaims.Id
+	owner := directoryClaims.DirectoryOwner()
 
 	// Create array of files based on form data
 	for _, file := range files {
@@ -80,15 +87,21 @@ func (h *Handler) Upload(c *gin.Context) {
 		createdTs := time.Now().UnixMilli()
 		modifiedTs := createdTs
 
+		hash, err := hashFile(file)
+		if err != nil {
+			log.Panic(err)
+		}
+
 		newFile := models.File{
 			Id:              fileId.String(),
 			Name:            file.Filename,
 			ParentDirectory: directory,
-			User:            claims.Id,
+			User:            owner,
 			Type:            fileContentType,
 			Size:            file.Size,
 			Created:         createdTs,
 			Modified:        modifiedTs,
+			Hash:            hash,
 		}
 
 		filesToReturn = append(filesToReturn, newFile)
@@ -101,9 +114,25 @@ func (h *Handler) Upload(c *gin.Context) {
 		}
 	}
 
+	var uploadSize int64
+	for _, file := range files {
+		uploadSize += file.Size
+	}
+
+	quotaExceeded, err := models.QuotaExceeded(c, h.Db, owner, uploadSize)
+	if err != nil {
+		log.Panic(err)
+	}
+	if quotaExceeded {
+		c.JSON(http.StatusInsufficientStorage, gin.H{
+			"error": "storage quota exceeded",
+		})
+		return
+	}
+
 	collection := h.Db.Collection("files")
 
-	_, err := collection.InsertMany(c, models.FilesToBsonNotEmpty(filesToReturn))
+	_, err = collection.InsertMany(c, models.FilesToBsonNotEmpty(filesToReturn))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -115,16 +144,28 @@ func (h *Handler) Upload(c *gin.Context) {
 			log.Panic(err)
 		}
 
+		metrics.BytesUploaded.Add(float64(file.Size))
 	}
 
 	h.InsertDocumentsToSearchDatabase(models.FilesToMap(filesToReturn))
 
+	uploaded := make([]string, 0, len(filesToReturn))
+	for _, file := range filesToReturn {
+		uploaded = append(uploaded, file.Id)
+	}
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:      audit.ActionUpload,
+		Kind:        models.AuditKindFile,
+		Targets:     uploaded,
+		ParentAfter: directory,
+	})
+
 	c.JSON(http.StatusCreated, filesToReturn)
 }
 
 func (h *Handler) UpdateFile(c *gin.Context) {
-	parentDirectoryAccessKey, _ := auth.ValidateAccessKey(c.GetHeader("DirectoryAccessKey"))
-	parentDirectoryId := parentDirectoryAccessKey.Id
+	// Access key and modify permission are verified in FileAuth and RequirePermission
+	parentDirectoryId := auth.DirectoryClaimsFromContext(c).Id
 
 	// Bind request body to File model
 	var file models.File
@@ -163,6 +204,14 @@ func (h *Handler) UpdateFile(c *gin.Context) {
 		Name: file.Name,
 	})
 
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:       audit.ActionRename,
+		Kind:         models.AuditKindFile,
+		Targets:      []string{fileId},
+		ParentBefore: parentDirectoryId,
+		Details:      file.Name,
+	})
+
 	c.Status(http.StatusNoContent)
 }
 
@@ -170,8 +219,7 @@ func (h *Handler) GetFile(c *gin.Context) {
 	// Don't need to validate access key, because it is verified in FileAuth
 	fileId := c.Param("id")
 
-	directoryAccessKey := c.GetHeader("DirectoryAccessKey")
-	directory, _ := auth.ValidateAccessKey(directoryAccessKey)
+	directory := auth.DirectoryClaimsFromContext(c)
 
 	if _, err := uuid.Parse(fileId); err != nil {
 		c.Status(http.StatusBadRequest)
@@ -179,6 +227,17 @@ func (h *Handler) GetFile(c *gin.Context) {
 	}
 
 	c.File(config.UploadDestination + directory.Id + "/" + fileId)
+
+	if size := c.Writer.Size(); size > 0 {
+		metrics.BytesDownloaded.Add(float64(size))
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:       audit.ActionDownload,
+		Kind:         models.AuditKindFile,
+		Targets:      []string{fileId},
+		ParentBefore: directory.Id,
+	})
 }
 
 func (h *Handler) GetFiles(c *gin.Context) {
@@ -192,6 +251,35 @@ func (h *Handler) GetFiles(c *gin.Context) {
 
 	if err := c.MustBindWith(&data, binding.JSON); err != nil {
 		log.Println(err)
+		return
+	}
+
+	// Directory of share link is verified in ShareAuth, it's used instead of access keys
+	shared := auth.DirectoryClaimsFromContext(c)
+
+	for idx, directory := range data {
+		valid := false
+		if shared.Id != "" {
+			valid = auth.ValidatePermissionsFromClaims(shared, auth.PermissionRead) &&
+				auth.KeyCoversDirectory(c, h.Db, shared, directory.Id)
+		} else {
+			valid = auth.ValidateAccessKeyPermission(
+				c, h.Db, auth.BatchAccessKey(c, directory.AccessKey), directory.Id, auth.PermissionRead,
+			)
+		}
+
+		if !valid {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "invalid access key for directory: " + directory.Id,
+			})
+			return
+		}
+
+		files, err := h.findFilesInDirectory(c, directory.Id, directory.Files)
+		if err != nil {
+			log.Panic(err)
+		}
+		data[idx].Files = files
 	}
 
 	zipFile, err := os.CreateTemp("", "files.zip")
@@ -212,6 +300,20 @@ func (h *Handler) GetFiles(c *gin.Context) {
 	zipWriter.Close()
 
 	c.File(zipFile.Name())
+
+	if size := c.Writer.Size(); size > 0 {
+		metrics.BytesDownloaded.Add(float64(size))
+	}
+
+	for _, directory := range data {
+		audit.Record(c, h.Db, models.AuditEvent{
+			Action:       audit.ActionDownload,
+			Kind:         models.AuditKindFile,
+			Owner:        auth.AccessKeyOwner(auth.BatchAccessKey(c, directory.AccessKey)),
+			Targets:      directory.Files,
+			ParentBefore: directory.Id,
+		})
+	}
 }
 
 func (h *Handler) DeleteFiles(c *gin.Context) {
@@ -225,30 +327,44 @@ func (h *Handler) DeleteFiles(c *gin.Context) {
 
 	if err := c.MustBindWith(&data, binding.JSON); err != nil {
 		log.Println(err)
+		return
 	}
 
-	deleteQuery := make([]bson.D, 0, len(data))
 	filesToDelete := make([]string, 0)
 
-	for _, directory := range data {
-		if isValid := auth.ValidateAccessKeyWithId(directory.AccessKey, directory.DirectoryId); !isValid {
+	for idx, directory := range data {
+		if isValid := auth.ValidateAccessKeyPermission(
+			c, h.Db, auth.BatchAccessKey(c, directory.AccessKey), directory.DirectoryId, auth.PermissionDelete,
+		); !isValid {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": "invalid access key for directory: " + directory.DirectoryId,
 			})
 			return
 		}
 
-		deleteQuery = append(deleteQuery, bson.D{
-			{Key: "parent_directory", Value: directory.DirectoryId},
-			{Key: "_id", Value: bson.D{
-				{Key: "$in", Value: directory.Files},
-			}},
+		// Only files inside directory with valid access key are deleted
+		files, err := h.findFilesInDirectory(c, directory.DirectoryId, directory.Files)
+		if err != nil {
+			log.Panic(err)
+		}
+		data[idx].Files = files
+
+		filesToDelete = append(filesToDelete, files...)
+	}
+
+	if len(filesToDelete) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"deleted": 0,
 		})
+		return
 	}
 
 	collection := h.Db.Collection("files")
 
-	result, err := collection.DeleteMany(context.TODO(), bson.D{{Key: "$or", Value: deleteQuery}})
+	result, err := collection.DeleteMany(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: filesToDelete}}}},
+	)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -258,13 +374,24 @@ func (h *Handler) DeleteFiles(c *gin.Context) {
 			if err := os.Remove(config.UploadDestination + directory.DirectoryId + "/" + file); err != nil {
 				log.Println(err)
 			}
-
-			filesToDelete = append(filesToDelete, file)
 		}
 	}
 
-	if _, err := h.SearchDb.Index("files").DeleteDocuments(filesToDelete); err != nil {
-		log.Println(err)
+	h.DeleteFromSearchDatabase(filesToDelete)
+
+	metrics.ObserveOperation(metrics.OperationDelete, metrics.KindFile, result.DeletedCount)
+
+	for _, directory := range data {
+		if len(directory.Files) == 0 {
+			continue
+		}
+		audit.Record(c, h.Db, models.AuditEvent{
+			Action:       audit.ActionDelete,
+			Kind:         models.AuditKindFile,
+			Owner:        auth.AccessKeyOwner(auth.BatchAccessKey(c, directory.AccessKey)),
+			Targets:      directory.Files,
+			ParentBefore: directory.DirectoryId,
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -298,26 +425,47 @@ func (h *Handler) ChangeDirectory(c *gin.Context) {
 		return
 	}
 
-	// Check if destination directory access key is valid and matches destination directory ID
-	if directoryClaims, valid := auth.ValidateAccessKey(data.AccessKey); !valid ||
-		directoryClaims.Id != data.Id {
-		c.JSON(http.StatusBadRequest, gin.H{
+	// Check if destination directory access key is valid, matches destination directory ID and allows adding files
+	destinationAccessKey := auth.BatchAccessKey(c, data.AccessKey)
+	if !auth.ValidateAccessKeyPermission(c, h.Db, destinationAccessKey, data.Id, auth.PermissionUpload) {
+		c.JSON(http.StatusForbidden, gin.H{
 			"error": "invalid access key for directory: " + data.Id,
 		})
 		return
 	}
 
+	// Files can only be moved between directories of one user (e.g. inside shared directory)
+	owner := auth.AccessKeyOwner(destinationAccessKey)
+
+	// Moved files by source directory, for audit log
+	moved := make(map[string][]string, len(data.Directories))
+
 	for _, directory := range data.Directories {
-		// Check if directory access key is valid and matches directory ID
-		if accessKeyClaims, valid := auth.ValidateAccessKey(directory.AccessKey); !valid ||
-			accessKeyClaims.Id != directory.Id {
-			c.JSON(http.StatusBadRequest, gin.H{
+		// Check if directory access key is valid, matches directory ID and allows modifying files
+		accessKey := auth.BatchAccessKey(c, directory.AccessKey)
+		if !auth.ValidateAccessKeyPermission(c, h.Db, accessKey, directory.Id, auth.PermissionModify) {
+			c.JSON(http.StatusForbidden, gin.H{
 				"error": "invalid access key for directory: " + directory.Id,
 			})
 			return
 		}
 
-		for _, file := range directory.Files {
+		if auth.AccessKeyOwner(accessKey) != owner {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "files can't be moved to directory of another user: " + directory.Id,
+			})
+			return
+		}
+
+		// Files which aren't inside directory with valid access key are skipped
+		files, err := h.findFilesInDirectory(c, directory.Id, directory.Files)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		moved[directory.Id] = append(moved[directory.Id], files...)
+
+		for _, file := range files {
 			dbOperation := mongo.NewUpdateOneModel()
 			// File from list in request body AND having parent_directory as directory ID from list
 			// This removes possibility of user providing valid access key, but for different directory and trying to modify file without access to it
@@ -352,6 +500,13 @@ func (h *Handler) ChangeDirectory(c *gin.Context) {
 
 	}
 
+	if len(operations) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"updated": 0,
+		})
+		return
+	}
+
 	// update primary database
 	res, err := h.Db.Collection("files").BulkWrite(context.TODO(), operations)
 	if err != nil {
@@ -359,9 +514,24 @@ func (h *Handler) ChangeDirectory(c *gin.Context) {
 	}
 
 	// update search database
-	if _, err := h.SearchDb.Index("files").UpdateDocuments(searchDbFileList); err != nil {
-		log.Println(err)
+	h.UpdateOrAddToSearchDatabase(searchDbFileList)
+
+	metrics.ObserveOperation(metrics.OperationMove, metrics.KindFile, res.ModifiedCount)
+
+	for directory, files := range moved {
+		if len(files) == 0 {
+			continue
+		}
+		audit.Record(c, h.Db, models.AuditEvent{
+			Action:       audit.ActionMove,
+			Kind:         models.AuditKindFile,
+			Owner:        owner,
+			Targets:      files,
+			ParentBefore: directory,
+			ParentAfter:  data.Id,
+		})
 	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"updated": res.ModifiedCount,
 	})
@@ -431,8 +601,20 @@ func (h *Handler) RestoreFiles(c *gin.Context) {
 	}
 
 	// Update search database
-	if _, err := h.SearchDb.Index("files").UpdateDocuments(searchDbQueryList); err != nil {
-		log.Println(err)
+	h.UpdateOrAddToSearchDatabase(searchDbQueryList)
+
+	metrics.ObserveOperation(metrics.OperationRestore, metrics.KindFile, res.ModifiedCount)
+
+	for _, file := range filesToRestore {
+		if file.PreviousParentDirectory != "" {
+			audit.Record(c, h.Db, models.AuditEvent{
+				Action:       audit.ActionRestore,
+				Kind:         models.AuditKindFile,
+				Targets:      []string{file.Id},
+				ParentBefore: file.ParentDirectory,
+				ParentAfter:  file.PreviousParentDirectory,
+			})
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -440,6 +622,47 @@ func (h *Handler) RestoreFiles(c *gin.Context) {
 	})
 }
 
+// Return ids of files from list which are inside directory
+func (h *Handler) findFilesInDirectory(ctx context.Context, directoryId string, fileList []string) ([]string, error) {
+	if len(fileList) == 0 {
+		return []string{}, nil
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}})
+	filter := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: fileList}}},
+		{Key: "parent_directory", Value: directoryId},
+	}
+
+	files, err := models.FindFilesByFilter[models.File](h.Db, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(files))
+	for _, file := range files {
+		result = append(result, file.Id)
+	}
+
+	return result, nil
+}
+
+// Hex encoded SHA-256 of uploaded file
+func hashFile(file *multipart.FileHeader) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func createFile(destinationPath string) *os.File {
 	destination, err := os.Create(destinationPath)
 	if err != nil {
@@ -463,6 +686,9 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 		Files                []string `json:"files"`
 		SourceAccessKey      string   `json:"source_access_key"`
 		DestinationAccessKey string   `json:"destination_access_key"`
+		// Optional, directories inside directories of recursive keys (directories of keys by default)
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
 	}
 
 	var data RequestData
@@ -470,16 +696,16 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 		return
 	}
 
-	sourceDirectory, isValid := auth.ValidateAccessKey(data.SourceAccessKey)
-	if !isValid {
+	sourceDirectory, isValid := auth.ValidateAccessKey(c, h.Db, data.SourceAccessKey)
+	if !isValid || !auth.ValidatePermissionsFromClaims(sourceDirectory, auth.PermissionRead) {
 		c.JSON(http.StatusForbidden, gin.H{
 			"error": "invalid access key for source directory",
 		})
 		return
 	}
 
-	destinationDirectory, isValid := auth.ValidateAccessKey(data.DestinationAccessKey)
-	if !isValid {
+	destinationDirectory, isValid := auth.ValidateAccessKey(c, h.Db, data.DestinationAccessKey)
+	if !isValid || !auth.ValidatePermissionsFromClaims(destinationDirectory, auth.PermissionUpload) {
 		c.JSON(http.StatusForbidden, gin.H{
 			"error": "invalid access key for destination directory",
 		})
@@ -487,7 +713,26 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 	}
 
 	SOURCE_DIRECTORY_ID := sourceDirectory.Id
+	if data.Source != "" {
+		if !auth.KeyCoversDirectory(c, h.Db, sourceDirectory, data.Source) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "invalid access key for source directory",
+			})
+			return
+		}
+		SOURCE_DIRECTORY_ID = data.Source
+	}
+
 	DESTINATION_DIRECTORY_ID := destinationDirectory.Id
+	if data.Destination != "" {
+		if !auth.KeyCoversDirectory(c, h.Db, destinationDirectory, data.Destination) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "invalid access key for destination directory",
+			})
+			return
+		}
+		DESTINATION_DIRECTORY_ID = data.Destination
+	}
 
 	opts := options.Find().SetProjection(bson.D{
 		{Key: "_id", Value: 1},
@@ -496,10 +741,14 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 		{Key: "user", Value: 1},
 		{Key: "type", Value: 1},
 		{Key: "size", Value: 1},
+		{Key: "hash", Value: 1},
 	},
 	)
 
-	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: data.Files}}}}
+	filter := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: data.Files}}},
+		{Key: "parent_directory", Value: SOURCE_DIRECTORY_ID},
+	}
 	files, err := models.FindFilesByFilter[models.File](h.Db, filter, opts)
 	if err != nil {
 		log.Panic(err)
@@ -510,10 +759,35 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 		return
 	}
 
+	// Copies belong to owner of destination directory and count against its quota
+	owner := destinationDirectory.DirectoryOwner()
+
+	var copySize int64
+	for _, file := range files {
+		copySize += file.Size
+	}
+
+	quotaExceeded, err := models.QuotaExceeded(c, h.Db, owner, copySize)
+	if err != nil {
+		log.Panic(err)
+	}
+	if quotaExceeded {
+		c.JSON(http.StatusInsufficientStorage, gin.H{
+			"error": "storage quota exceeded",
+		})
+		return
+	}
+
+	// Store pair NEW -> OLD for file ID
+	fileIdMap := make(map[string]string, len(files))
+
 	for idx, file := range files {
 		fileId, _ := uuid.NewUUID()
+		fileIdMap[fileId.String()] = file.Id
+
 		file.Id = fileId.String()
 		file.ParentDirectory = DESTINATION_DIRECTORY_ID
+		file.User = owner
 		files[idx] = file
 	}
 
@@ -524,8 +798,8 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 		log.Panic(err)
 	}
 
-	for idx, file := range files {
-		source := openFile(config.UploadDestination + SOURCE_DIRECTORY_ID + "/" + data.Files[idx])
+	for _, file := range files {
+		source := openFile(config.UploadDestination + SOURCE_DIRECTORY_ID + "/" + fileIdMap[file.Id])
 		defer source.Close()
 
 		destination := createFile(
@@ -539,5 +813,21 @@ func (h *Handler) CopyFiles(c *gin.Context) {
 
 	}
 
+	metrics.ObserveOperation(metrics.OperationCopy, metrics.KindFile, int64(len(files)))
+
+	// Both source files and their copies are targets
+	copied := make([]string, 0, 2*len(files))
+	for _, file := range files {
+		copied = append(copied, fileIdMap[file.Id], file.Id)
+	}
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:       audit.ActionCopy,
+		Kind:         models.AuditKindFile,
+		Owner:        owner,
+		Targets:      copied,
+		ParentBefore: SOURCE_DIRECTORY_ID,
+		ParentAfter:  DESTINATION_DIRECTORY_ID,
+	})
+
 	c.JSON(http.StatusOK, files)
 }
@@ -0,0 +1,585 @@
+package groups
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/meilisearch/meilisearch-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/config"
+	"ncloud-api/handlers/search"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+type Handler struct {
+	Db       *mongo.Database
+	SearchDb *meilisearch.Client
+}
+
+type SearchDatabaseData struct {
+	Id   string `json:"_id"`
+	Name string `json:"name,omitempty"`
+	User string `json:"user,omitempty"`
+}
+
+// Find group from id parameter with authenticated user as member, respond with 404 if it doesn't exist.
+// If role is provided, member must have it. Returns nil if response was already sent
+func (h *Handler) findGroup(c *gin.Context, role string) *models.Group {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	var group models.Group
+
+	err := h.Db.Collection("groups").FindOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "members.user", Value: claims.Id},
+	}).Decode(&group)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+
+	if role != "" && group.Member(claims.Id).Role != role {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "only group " + role + " can do this",
+		})
+		return nil
+	}
+
+	return &group
+}
+
+// CreateGroup creates group with its root directory, user becomes its owner
+func (h *Handler) CreateGroup(c *gin.Context) {
+	type RequestData struct {
+		Name string `json:"name"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+	now := time.Now().UnixMilli()
+
+	group := models.Group{
+		Id:        uuid.New().String(),
+		Name:      data.Name,
+		Directory: uuid.New().String(),
+		Members:   []models.GroupMember{{User: claims.Id, Role: models.GroupRoleOwner}},
+		Created:   now,
+	}
+
+	if err := group.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	// Root directory of group, like Main directory of user
+	directory := models.Directory{
+		Id:       group.Directory,
+		Name:     group.Name,
+		User:     group.Id,
+		Created:  now,
+		Modified: now,
+	}
+
+	if _, err := h.Db.Collection("directories").InsertOne(c, directory.ToBsonNotEmpty()); err != nil {
+		log.Panic(err)
+	}
+
+	if err := os.Mkdir(config.UploadDestination+directory.Id, 0700); err != nil {
+		log.Panic(err)
+	}
+
+	if _, err := h.Db.Collection("groups").InsertOne(c, group); err != nil {
+		log.Panic(err)
+	}
+
+	if err := search.InsertDocuments(h.SearchDb, "directories", &SearchDatabaseData{
+		Id:   directory.Id,
+		Name: directory.Name,
+		User: group.Id,
+	}); err != nil {
+		log.Println(err)
+	}
+
+	c.JSON(http.StatusCreated, group)
+}
+
+// GetGroups lists groups user is member of
+func (h *Handler) GetGroups(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	groups, err := models.FindGroupsByFilter(h.Db, bson.D{{Key: "members.user", Value: claims.Id}}, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+// GetGroup returns group with usernames of its members
+func (h *Handler) GetGroup(c *gin.Context) {
+	group := h.findGroup(c, "")
+	if group == nil {
+		return
+	}
+
+	userIds := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		userIds = append(userIds, member.User)
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "username", Value: 1}})
+	cursor, err := h.Db.Collection("user").Find(c, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: userIds}}}}, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var users []models.User
+	if err := cursor.All(c, &users); err != nil {
+		log.Panic(err)
+	}
+
+	usernames := make(map[string]string, len(users))
+	for _, user := range users {
+		usernames[user.Id] = user.Username
+	}
+
+	for idx := range group.Members {
+		group.Members[idx].Username = usernames[group.Members[idx].User]
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+// UpdateGroup renames group and its root directory
+func (h *Handler) UpdateGroup(c *gin.Context) {
+	type RequestData struct {
+		Name string `json:"name"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	group := h.findGroup(c, models.GroupRoleOwner)
+	if group == nil {
+		return
+	}
+
+	group.Name = data.Name
+	if err := group.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	if _, err := h.Db.Collection("groups").UpdateByID(c, group.Id, bson.D{
+		{Key: "$set", Value: bson.M{"name": group.Name}},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	if _, err := h.Db.Collection("directories").UpdateByID(c, group.Directory, bson.D{
+		{Key: "$set", Value: bson.M{"name": group.Name, "modified": time.Now().UnixMilli()}},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	if err := search.UpdateDocuments(h.SearchDb, "directories", &SearchDatabaseData{
+		Id:   group.Directory,
+		Name: group.Name,
+	}); err != nil {
+		log.Println(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteGroup deletes group with all its directories and files
+func (h *Handler) DeleteGroup(c *gin.Context) {
+	group := h.findGroup(c, models.GroupRoleOwner)
+	if group == nil {
+		return
+	}
+
+	if err := h.RemoveGroup(c, group.Id); err != nil {
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Group must always have at least one owner
+func hasOwner(members []models.GroupMember) bool {
+	for _, member := range members {
+		if member.Role == models.GroupRoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+// Update filters check that group still satisfies these rules when it's updated, so concurrent changes
+// can't overwrite each other: user changing group must still be its owner, and group keeps other owner
+func ownerFilter(userId string) bson.D {
+	return bson.D{{Key: "members", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+		{Key: "user", Value: userId},
+		{Key: "role", Value: models.GroupRoleOwner},
+	}}}}}
+}
+
+func otherOwnerFilter(userId string) bson.D {
+	return bson.D{{Key: "members", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+		{Key: "user", Value: bson.D{{Key: "$ne", Value: userId}}},
+		{Key: "role", Value: models.GroupRoleOwner},
+	}}}}}
+}
+
+// Array filter for "members.$[member]" of member with user id
+func memberArrayFilter(userId string) options.ArrayFilters {
+	return options.ArrayFilters{Filters: []interface{}{bson.D{{Key: "member.user", Value: userId}}}}
+}
+
+// SetGroupMember adds user to group or changes its role
+func (h *Handler) SetGroupMember(c *gin.Context) {
+	type RequestData struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	group := h.findGroup(c, models.GroupRoleOwner)
+	if group == nil {
+		return
+	}
+
+	var user models.User
+
+	opts := options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 1}})
+	if err := h.Db.Collection("user").FindOne(c, bson.D{{Key: "username", Value: data.Username}}, opts).
+		Decode(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid user",
+		})
+		return
+	}
+
+	newMember := models.GroupMember{User: user.Id, Role: data.Role}
+	if err := newMember.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid role",
+		})
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+	conditions := bson.A{bson.D{{Key: "_id", Value: group.Id}}, ownerFilter(claims.Id)}
+
+	var update bson.D
+	updateOpts := options.Update()
+
+	if member := group.Member(user.Id); member != nil {
+		member.Role = newMember.Role
+
+		conditions = append(conditions, bson.D{{Key: "members.user", Value: user.Id}})
+		if newMember.Role != models.GroupRoleOwner {
+			conditions = append(conditions, otherOwnerFilter(user.Id))
+		}
+		update = bson.D{{Key: "$set", Value: bson.M{"members.$[member].role": newMember.Role}}}
+		updateOpts.SetArrayFilters(memberArrayFilter(user.Id))
+	} else {
+		group.Members = append(group.Members, newMember)
+
+		conditions = append(conditions, bson.D{{Key: "members.user", Value: bson.D{{Key: "$ne", Value: user.Id}}}})
+		update = bson.D{{Key: "$push", Value: bson.M{"members": newMember}}}
+	}
+
+	if !hasOwner(group.Members) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "group must have owner",
+		})
+		return
+	}
+
+	res, err := h.Db.Collection("groups").UpdateOne(c, bson.D{{Key: "$and", Value: conditions}}, update, updateOpts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "group was changed, try again",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveGroupMember removes user from group, access keys of user stop working immediately.
+// Owners can remove any member, other members can leave group
+func (h *Handler) RemoveGroupMember(c *gin.Context) {
+	group := h.findGroup(c, "")
+	if group == nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+	userId := c.Param("user")
+
+	if userId != claims.Id && group.Member(claims.Id).Role != models.GroupRoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "only group owner can do this",
+		})
+		return
+	}
+
+	members := make([]models.GroupMember, 0, len(group.Members))
+	for _, member := range group.Members {
+		if member.User != userId {
+			members = append(members, member)
+		}
+	}
+
+	if len(members) == len(group.Members) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if !hasOwner(members) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "group must have owner",
+		})
+		return
+	}
+
+	conditions := bson.A{bson.D{{Key: "_id", Value: group.Id}}, otherOwnerFilter(userId)}
+	if userId != claims.Id {
+		conditions = append(conditions, ownerFilter(claims.Id))
+	}
+
+	res, err := h.Db.Collection("groups").UpdateOne(c, bson.D{{Key: "$and", Value: conditions}}, bson.D{
+		{Key: "$pull", Value: bson.M{"members": bson.M{"user": userId}}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "group was changed, try again",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Roles of members in order in which they become owner when the only owner leaves group
+var successionOrder = []string{
+	models.GroupRoleOwner,
+	models.GroupRoleEditor,
+	models.GroupRoleContributor,
+	models.GroupRoleViewer,
+}
+
+// LeaveGroups removes user from all groups. If user is the only owner of group, member with highest role
+// (who joined first) becomes owner, groups without other members are deleted. Errors are logged
+func (h *Handler) LeaveGroups(ctx context.Context, userId string) {
+	groups, err := models.FindGroupsByFilter(h.Db, bson.D{{Key: "members.user", Value: userId}})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, group := range groups {
+		if err := h.leaveGroup(ctx, group.Id, userId); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (h *Handler) leaveGroup(ctx context.Context, groupId, userId string) error {
+	collection := h.Db.Collection("groups")
+
+	// Group can be changed concurrently, so successor is chosen again if user couldn't leave
+	for attempt := 0; attempt < 3; attempt++ {
+		res, err := collection.UpdateOne(ctx, bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "_id", Value: groupId}},
+			otherOwnerFilter(userId),
+		}}}, bson.D{
+			{Key: "$pull", Value: bson.M{"members": bson.M{"user": userId}}},
+		})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 1 {
+			return nil
+		}
+
+		var group models.Group
+		err = collection.FindOne(ctx, bson.D{
+			{Key: "_id", Value: groupId},
+			{Key: "members.user", Value: userId},
+		}).Decode(&group)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		successor := successorOf(group.Members, userId)
+		if successor == "" {
+			if err := h.RemoveGroup(ctx, groupId); err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			return nil
+		}
+
+		if _, err := collection.UpdateOne(ctx, bson.D{
+			{Key: "_id", Value: groupId},
+			{Key: "members.user", Value: successor},
+		}, bson.D{
+			{Key: "$set", Value: bson.M{"members.$[member].role": models.GroupRoleOwner}},
+		}, options.Update().SetArrayFilters(memberArrayFilter(successor))); err != nil {
+			return err
+		}
+	}
+
+	return errors.New("couldn't remove user " + userId + " from group " + groupId)
+}
+
+// Id of member other than user with highest role, empty if user is the only member
+func successorOf(members []models.GroupMember, userId string) string {
+	for _, role := range successionOrder {
+		for _, member := range members {
+			if member.User != userId && member.Role == role {
+				return member.User
+			}
+		}
+	}
+	return ""
+}
+
+// AdminSetGroupQuota sets maximum size of files stored by group in bytes, 0 removes limit
+func (h *Handler) AdminSetGroupQuota(c *gin.Context) {
+	type RequestData struct {
+		Quota int64 `json:"quota"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if data.Quota < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid quota",
+		})
+		return
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.M{"quota": data.Quota}}}
+	if data.Quota == 0 {
+		update = bson.D{{Key: "$unset", Value: bson.M{"quota": ""}}}
+	}
+
+	res, err := h.Db.Collection("groups").UpdateByID(c, c.Param("id"), update)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminDeleteGroup deletes group with all its data, e.g. group without members
+func (h *Handler) AdminDeleteGroup(c *gin.Context) {
+	if err := h.RemoveGroup(c, c.Param("id")); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveGroup deletes group with its directories and files.
+//
+// Only removing group document can return error (mongo.ErrNoDocuments if it doesn't exist),
+// errors in cleanup are logged
+func (h *Handler) RemoveGroup(ctx context.Context, groupId string) error {
+	res, err := h.Db.Collection("groups").DeleteOne(ctx, bson.D{{Key: "_id", Value: groupId}})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount != 1 {
+		return mongo.ErrNoDocuments
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}})
+
+	filter := bson.D{{Key: "user", Value: groupId}}
+	directories, err := models.FindDirectoriesByFilter[models.Directory](h.Db, filter, opts)
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, directory := range directories {
+		if err = os.RemoveAll(config.UploadDestination + directory.Id); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if _, err := h.Db.Collection("directories").DeleteMany(ctx, filter); err != nil {
+		log.Println(err)
+	}
+	if _, err := h.Db.Collection("files").DeleteMany(ctx, filter); err != nil {
+		log.Println(err)
+	}
+	if _, err := h.Db.Collection("derived_keys").DeleteMany(ctx, bson.D{{Key: "owner", Value: groupId}}); err != nil {
+		log.Println(err)
+	}
+	if err := models.DeleteWebhooks(ctx, h.Db, bson.D{{Key: "owner", Value: groupId}}); err != nil {
+		log.Println(err)
+	}
+
+	if err := search.DeleteDocumentsByFilter(h.SearchDb, "directories", "user = "+groupId); err != nil {
+		log.Println(err)
+	}
+	if err := search.DeleteDocumentsByFilter(h.SearchDb, "files", "user = "+groupId); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/websocket"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/events"
+)
+
+type Handler struct {
+	Db  *mongo.Database
+	Bus *events.Bus
+}
+
+const (
+	// Keeps idle connections open through proxies
+	heartbeatInterval = 30 * time.Second
+	// Access keys are validated again, so expired or revoked keys stop receiving events
+	revalidateInterval = time.Minute
+)
+
+var errInvalidAccessKey = errors.New("invalid access key")
+
+// Directories client is subscribed to, with access keys authorizing them
+type subscription struct {
+	mu   sync.Mutex
+	keys map[string]*auth.DirectoryClaims
+}
+
+// Add access keys to subscription, keys must be valid and have read permission.
+// Nothing is added if any key is invalid
+func (s *subscription) add(c *gin.Context, db *mongo.Database, accessKeys []string) ([]string, error) {
+	valid := make(map[string]*auth.DirectoryClaims, len(accessKeys))
+	directories := make([]string, 0, len(accessKeys))
+
+	for _, accessKey := range accessKeys {
+		claims, isValid := auth.ValidateAccessKey(c, db, accessKey)
+		if !isValid || !auth.ValidatePermissionsFromClaims(claims, auth.PermissionRead) {
+			return nil, errInvalidAccessKey
+		}
+		valid[accessKey] = claims
+		directories = append(directories, claims.Id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for accessKey, claims := range valid {
+		s.keys[accessKey] = claims
+	}
+
+	return directories, nil
+}
+
+// Remove keys which are no longer valid, returns number of remaining keys
+func (s *subscription) revalidate(c *gin.Context, db *mongo.Database) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for accessKey := range s.keys {
+		if _, isValid := auth.ValidateAccessKey(c, db, accessKey); !isValid {
+			delete(s.keys, accessKey)
+		}
+	}
+
+	return len(s.keys)
+}
+
+// Event matches if it affects directory of any key, or directory inside directory of recursive key
+func (s *subscription) matches(event *models.ChangeEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, claims := range s.keys {
+		for _, directory := range event.Directories {
+			if directory == claims.Id {
+				return true
+			}
+		}
+
+		if claims.Recursive {
+			for _, directory := range event.Ancestors {
+				if directory == claims.Id {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Last event received by client from Last-Event-ID header (sent by EventSource when reconnecting)
+// or last_event_id query parameter, -1 if client doesn't resume
+func lastEventId(c *gin.Context) (int64, error) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value == "" {
+		return -1, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Send events missed since lastEventId and then new events matching subscription until ctx is done,
+// client is disconnected or all its keys become invalid
+func (h *Handler) stream(
+	ctx context.Context,
+	c *gin.Context,
+	sub *subscription,
+	lastEventId int64,
+	send func(*models.ChangeEvent) error,
+	heartbeat func() error,
+) {
+	live, last := h.Bus.Subscribe()
+	defer h.Bus.Unsubscribe(live)
+
+	for after := lastEventId; after >= 0 && after < last; {
+		missed, err := events.Replay(ctx, h.Db, after, last)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if len(missed) == 0 {
+			break
+		}
+
+		for idx := range missed {
+			if sub.matches(&missed[idx]) {
+				if err := send(&missed[idx]); err != nil {
+					return
+				}
+			}
+			after = missed[idx].Id
+		}
+	}
+
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	revalidateTicker := time.NewTicker(revalidateInterval)
+	defer revalidateTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-live:
+			// Client is too slow, it can reconnect with last event id
+			if !ok {
+				return
+			}
+			if sub.matches(&event) {
+				if err := send(&event); err != nil {
+					return
+				}
+			}
+		case <-heartbeatTicker.C:
+			if err := heartbeat(); err != nil {
+				return
+			}
+		case <-revalidateTicker.C:
+			if sub.revalidate(c, h.Db) == 0 {
+				return
+			}
+		}
+	}
+}
+
+// CreateTicket issues single-use ticket for GET /api/events and /api/events/ws with access keys of subscription,
+// so access token and keys aren't sent in URL. Keys must be valid and have read permission
+func (h *Handler) CreateTicket(c *gin.Context) {
+	type RequestData struct {
+		AccessKeys []string `json:"access_keys"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	sub := &subscription{keys: make(map[string]*auth.DirectoryClaims)}
+	if _, err := sub.add(c, h.Db, data.AccessKeys); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ticket, err := auth.GenerateStreamTicket(c, h.Db, auth.ExtractClaimsFromContext(c), data.AccessKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"ticket":     ticket,
+		"expires_in": int(auth.StreamTicketDuration.Seconds()),
+	})
+}
+
+// Access keys from ticket, or from DirectoryAccessKey headers if request wasn't authorized with ticket
+func streamAccessKeys(c *gin.Context) []string {
+	if ticket := auth.StreamTicketFromContext(c); ticket.TicketHash != "" {
+		return ticket.AccessKeys
+	}
+	return c.Request.Header.Values("DirectoryAccessKey")
+}
+
+// Events streams change events of directories from access keys of ticket as Server-Sent Events
+func (h *Handler) Events(c *gin.Context) {
+	lastId, err := lastEventId(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid last event id",
+		})
+		return
+	}
+
+	sub := &subscription{keys: make(map[string]*auth.DirectoryClaims)}
+	accessKeys := streamAccessKeys(c)
+	if len(accessKeys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "no access keys",
+		})
+		return
+	}
+	if _, err := sub.add(c, h.Db, accessKeys); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	h.stream(c.Request.Context(), c, sub, lastId,
+		func(event *models.ChangeEvent) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Action, data); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		},
+		func() error {
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		},
+	)
+}
+
+// EventsWebSocket streams change events as JSON messages over WebSocket.
+//
+// Client subscribes with access keys of ticket, or later with {"subscribe": ["access key", ...]}
+// message, which is answered with {"subscribed": ["directory id", ...]} or {"error": "..."}
+func (h *Handler) EventsWebSocket(c *gin.Context) {
+	lastId, err := lastEventId(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid last event id",
+		})
+		return
+	}
+
+	sub := &subscription{keys: make(map[string]*auth.DirectoryClaims)}
+	if accessKeys := streamAccessKeys(c); len(accessKeys) > 0 {
+		if _, err := sub.add(c, h.Db, accessKeys); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	server := websocket.Server{
+		// Requests are authorized with access token, so any origin is allowed
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			ctx, cancel := context.WithCancel(c.Request.Context())
+			defer cancel()
+
+			go func() {
+				defer cancel()
+
+				for {
+					var message struct {
+						Subscribe []string `json:"subscribe"`
+					}
+					if err := websocket.JSON.Receive(ws, &message); err != nil {
+						return
+					}
+
+					directories, err := sub.add(c, h.Db, message.Subscribe)
+					if err != nil {
+						_ = websocket.JSON.Send(ws, gin.H{"error": err.Error()})
+						continue
+					}
+					_ = websocket.JSON.Send(ws, gin.H{"subscribed": directories})
+				}
+			}()
+
+			h.stream(ctx, c, sub, lastId,
+				func(event *models.ChangeEvent) error {
+					return websocket.JSON.Send(ws, event)
+				},
+				func() error {
+					return websocket.JSON.Send(ws, gin.H{"heartbeat": time.Now().UnixMilli()})
+				},
+			)
+		},
+	}
+
+	server.ServeHTTP(c.Writer, c.Request)
+}
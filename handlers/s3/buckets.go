@@ -0,0 +1,378 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/handlers/webdav"
+	"ncloud-api/middleware/auth"
+)
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	Id string `xml:"ID"`
+}
+
+type bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type listBucketResult struct {
+	XMLName        xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string         `xml:"Name"`
+	Prefix         string         `xml:"Prefix"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	MaxKeys        int            `xml:"MaxKeys"`
+	EncodingType   string         `xml:"EncodingType,omitempty"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Marker         string         `xml:"Marker"`
+	NextMarker     string         `xml:"NextMarker,omitempty"`
+	Contents       []object       `xml:"Contents"`
+	CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listBucketResultV2 struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	KeyCount              int            `xml:"KeyCount"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// Maximum (and default) number of keys in one response of listing
+const maxKeys = 1000
+
+// ListBuckets lists root directories of file system
+func (h *Handler) ListBuckets(c *gin.Context) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	result := listAllMyBucketsResult{
+		Owner:   owner{Id: auth.ExtractClaimsFromContext(c).Id},
+		Buckets: make([]bucket, 0),
+	}
+	for _, root := range fs.Roots(c) {
+		result.Buckets = append(result.Buckets, bucket{
+			Name:         root.Directory().Name,
+			CreationDate: formatTime(root.Directory().Created),
+		})
+	}
+
+	c.XML(http.StatusOK, result)
+}
+
+func (h *Handler) HeadBucket(c *gin.Context, name string) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	b, ok := resolveBucket(c, fs, name)
+	if !ok {
+		return
+	}
+	if !b.Allows(auth.PermissionRead) {
+		respondError(c, os.ErrPermission)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// GetBucketLocation responds with empty location (default region), any region can be used in signatures
+func (h *Handler) GetBucketLocation(c *gin.Context, name string) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	if _, ok := resolveBucket(c, fs, name); !ok {
+		return
+	}
+
+	c.XML(http.StatusOK, locationConstraint{})
+}
+
+// ListObjects lists files of bucket in order of keys, with ListObjects (v1) or ListObjectsV2 parameters.
+// Directories are listed as common prefixes with delimiter "/"
+func (h *Handler) ListObjects(c *gin.Context, name string, v2 bool) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	b, ok := resolveBucket(c, fs, name)
+	if !ok {
+		return
+	}
+	if !b.Allows(auth.PermissionRead) {
+		respondError(c, os.ErrPermission)
+		return
+	}
+
+	l := &lister{
+		c:         c,
+		fs:        fs,
+		prefix:    c.Query("prefix"),
+		delimiter: c.Query("delimiter"),
+		max:       maxKeys,
+	}
+
+	if value := c.Query("max-keys"); value != "" {
+		max, err := strconv.Atoi(value)
+		if err != nil || max < 0 {
+			auth.AbortWithS3Error(c, http.StatusBadRequest, "InvalidArgument", "max-keys must be non-negative integer")
+			return
+		}
+		if max < l.max {
+			l.max = max
+		}
+	}
+
+	encodingType := c.Query("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		auth.AbortWithS3Error(c, http.StatusBadRequest, "InvalidArgument", "encoding-type must be url")
+		return
+	}
+
+	if v2 {
+		l.after = c.Query("start-after")
+		if token := c.Query("continuation-token"); token != "" {
+			after, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				auth.AbortWithS3Error(c, http.StatusBadRequest, "InvalidArgument", "continuation token is invalid")
+				return
+			}
+			l.after = string(after)
+		}
+	} else {
+		l.after = c.Query("marker")
+	}
+
+	if err := l.list(name); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	truncated := len(l.entries) > l.max
+	if truncated {
+		l.entries = l.entries[:l.max]
+	}
+
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return url.PathEscape(s)
+		}
+		return s
+	}
+
+	contents := make([]object, 0)
+	prefixes := make([]commonPrefix, 0)
+	for _, entry := range l.entries {
+		if entry.info == nil {
+			prefixes = append(prefixes, commonPrefix{Prefix: encode(entry.key)})
+			continue
+		}
+		contents = append(contents, object{
+			Key:          encode(entry.key),
+			LastModified: formatTime(entry.info.ModTime().UnixMilli()),
+			ETag:         etag(c, entry.info),
+			Size:         entry.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	next := ""
+	if truncated {
+		next = l.entries[len(l.entries)-1].key
+	}
+
+	if v2 {
+		result := listBucketResultV2{
+			Name:              name,
+			Prefix:            encode(l.prefix),
+			Delimiter:         encode(l.delimiter),
+			MaxKeys:           l.max,
+			EncodingType:      encodingType,
+			IsTruncated:       truncated,
+			KeyCount:          len(l.entries),
+			ContinuationToken: c.Query("continuation-token"),
+			StartAfter:        encode(c.Query("start-after")),
+			Contents:          contents,
+			CommonPrefixes:    prefixes,
+		}
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+
+		c.XML(http.StatusOK, result)
+		return
+	}
+
+	c.XML(http.StatusOK, listBucketResult{
+		Name:           name,
+		Prefix:         encode(l.prefix),
+		Delimiter:      encode(l.delimiter),
+		MaxKeys:        l.max,
+		EncodingType:   encodingType,
+		IsTruncated:    truncated,
+		Marker:         encode(l.after),
+		NextMarker:     encode(next),
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	})
+}
+
+// Listed file (with info) or common prefix
+type listEntry struct {
+	key  string
+	info os.FileInfo
+}
+
+// lister walks directory tree of bucket in order of keys, collecting one entry more than max
+// to know if listing is truncated
+type lister struct {
+	c         *gin.Context
+	fs        *webdav.FileSystem
+	prefix    string
+	delimiter string
+	// Only keys after this one are listed
+	after   string
+	max     int
+	entries []listEntry
+}
+
+// Start in the deepest directory containing all keys with prefix
+func (l *lister) list(bucket string) error {
+	base := l.prefix[:strings.LastIndex(l.prefix, "/")+1]
+
+	name := "/" + bucket
+	if base != "" {
+		var err error
+		if name, err = objectPath(bucket, base); err != nil {
+			return nil
+		}
+	}
+
+	n, err := l.fs.Resolve(l.c, name)
+	if os.IsNotExist(err) || err == nil && !n.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return l.walk(name, base)
+}
+
+func (l *lister) walk(name, base string) error {
+	directory, err := l.fs.OpenFile(l.c, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	children, err := directory.Readdir(0)
+	if err != nil {
+		return err
+	}
+
+	// Keys of directories end with "/", so sorting children by keys sorts all keys of tree
+	keys := make([]string, len(children))
+	for i, child := range children {
+		keys[i] = base + child.Name()
+		if child.IsDir() {
+			keys[i] += "/"
+		}
+	}
+	sort.Sort(byKey{keys: keys, children: children})
+
+	for i, child := range children {
+		if len(l.entries) > l.max {
+			return nil
+		}
+
+		key := keys[i]
+		if !strings.HasPrefix(key, l.prefix) && !(child.IsDir() && strings.HasPrefix(l.prefix, key)) {
+			continue
+		}
+
+		// All keys with delimiter after prefix are grouped into one common prefix
+		if l.delimiter != "" && strings.HasPrefix(key, l.prefix) {
+			rest := key[len(l.prefix):]
+			if end := strings.Index(rest, l.delimiter); end >= 0 {
+				l.addPrefix(l.prefix + rest[:end+len(l.delimiter)])
+				continue
+			}
+		}
+
+		if child.IsDir() {
+			// Every key inside directory is before start of listing
+			if l.after >= key && !strings.HasPrefix(l.after, key) {
+				continue
+			}
+			if err := l.walk(name+"/"+child.Name(), key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if key > l.after {
+			l.entries = append(l.entries, listEntry{key: key, info: child})
+		}
+	}
+
+	return nil
+}
+
+func (l *lister) addPrefix(prefix string) {
+	if prefix <= l.after {
+		return
+	}
+	if n := len(l.entries); n > 0 && l.entries[n-1].key == prefix {
+		return
+	}
+
+	l.entries = append(l.entries, listEntry{key: prefix})
+}
+
+type byKey struct {
+	keys     []string
+	children []os.FileInfo
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.children[i], b.children[j] = b.children[j], b.children[i]
+}
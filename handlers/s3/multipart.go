@@ -0,0 +1,359 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/config"
+	"ncloud-api/handlers/webdav"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+// How long multipart upload can be in progress, its parts are removed after that
+var MultipartExpiry = helper.GetEnvDuration("S3_MULTIPART_EXPIRY", 7*24*time.Hour)
+
+// How often parts of completed, aborted and expired uploads are removed from disk
+const cleanupInterval = time.Hour
+
+const maxPartNumber = 10000
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// CreateMultipartUpload starts upload of file in parts, file is saved when upload is completed
+func (h *Handler) CreateMultipartUpload(c *gin.Context, bucket, key string) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	b, ok := resolveBucket(c, fs, bucket)
+	if !ok {
+		return
+	}
+
+	if _, err := objectPath(bucket, key); err != nil || strings.HasSuffix(key, "/") {
+		respondError(c, errInvalidKey)
+		return
+	}
+	if !b.Allows(auth.PermissionUpload) {
+		respondError(c, os.ErrPermission)
+		return
+	}
+
+	now := time.Now()
+
+	upload := models.MultipartUpload{
+		Id:          uuid.New().String(),
+		User:        auth.ExtractClaimsFromContext(c).Id,
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: c.GetHeader("Content-Type"),
+		Parts:       []models.MultipartPart{},
+		Created:     now.UnixMilli(),
+		Expires:     now.Add(MultipartExpiry),
+	}
+
+	if _, err := h.Db.Collection("multipart_uploads").InsertOne(c, upload); err != nil {
+		log.Panic(err)
+	}
+
+	if err := os.MkdirAll(config.MultipartDestination+upload.Id, 0700); err != nil {
+		log.Panic(err)
+	}
+
+	c.XML(http.StatusOK, initiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: upload.Id,
+	})
+}
+
+// UploadPart saves part of multipart upload, part uploaded again with the same number replaces previous one
+func (h *Handler) UploadPart(c *gin.Context, bucket, key string) {
+	verifyContentMD5(c)
+
+	number, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		auth.AbortWithS3Error(c, http.StatusBadRequest, "InvalidArgument",
+			"part number must be integer between 1 and 10000")
+		return
+	}
+
+	if c.GetHeader("X-Amz-Copy-Source") != "" {
+		respondError(c, errNotImplemented)
+		return
+	}
+
+	upload, ok := h.findUpload(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+	name, _ := objectPath(bucket, key)
+
+	// Quota of whole upload is checked before part is received, and again when upload is completed.
+	// Parts of other uploads of user are counted too, so they can't fill disk beyond quota until they expire
+	size, err := models.PendingMultipartSize(c, h.Db, upload.User, upload.Id)
+	if err != nil {
+		log.Panic(err)
+	}
+	size += c.Request.ContentLength
+	for _, part := range upload.Parts {
+		if part.Number != number {
+			size += part.Size
+		}
+	}
+	exceeded, err := fs.QuotaExceeded(c, name, size)
+	if err != nil {
+		log.Panic(err)
+	}
+	if exceeded {
+		respondError(c, webdav.ErrQuotaExceeded)
+		return
+	}
+
+	directory := config.MultipartDestination + upload.Id + "/"
+
+	temp, err := os.CreateTemp(directory, ".part-")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer os.Remove(temp.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(temp, hash), c.Request.Body)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := os.Rename(temp.Name(), directory+strconv.Itoa(number)); err != nil {
+		log.Panic(err)
+	}
+
+	part := models.MultipartPart{
+		Number: number,
+		Size:   written,
+		ETag:   `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+	}
+
+	filter := bson.D{{Key: "_id", Value: upload.Id}}
+	collection := h.Db.Collection("multipart_uploads")
+
+	if _, err := collection.UpdateOne(c, filter, bson.D{
+		{Key: "$pull", Value: bson.M{"parts": bson.M{"number": number}}},
+	}); err != nil {
+		log.Panic(err)
+	}
+	if _, err := collection.UpdateOne(c, filter, bson.D{
+		{Key: "$push", Value: bson.M{"parts": part}},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	c.Header("ETag", part.ETag)
+	c.Status(http.StatusOK)
+}
+
+// CompleteMultipartUpload saves file from listed parts, concatenated in order of their numbers
+func (h *Handler) CompleteMultipartUpload(c *gin.Context, bucket, key string) {
+	upload, ok := h.findUpload(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	var data completeMultipartUpload
+	if err := bindXML(c, &data); err != nil {
+		respondError(c, err)
+		return
+	}
+	if len(data.Parts) == 0 {
+		respondError(c, errMalformedXML)
+		return
+	}
+
+	directory := config.MultipartDestination + upload.Id + "/"
+	readers := make([]io.Reader, 0, len(data.Parts))
+
+	previous := 0
+	for _, requested := range data.Parts {
+		if requested.PartNumber <= previous {
+			auth.AbortWithS3Error(c, http.StatusBadRequest, "InvalidPartOrder",
+				"parts must be listed in ascending order of part numbers")
+			return
+		}
+		previous = requested.PartNumber
+
+		found := false
+		for _, part := range upload.Parts {
+			found = found || part.Number == requested.PartNumber &&
+				strings.Trim(part.ETag, `"`) == strings.Trim(requested.ETag, `"`)
+		}
+		if !found {
+			auth.AbortWithS3Error(c, http.StatusBadRequest, "InvalidPart",
+				"part "+strconv.Itoa(requested.PartNumber)+" wasn't uploaded or its ETag doesn't match")
+			return
+		}
+
+		file, err := os.Open(directory + strconv.Itoa(requested.PartNumber))
+		if err != nil {
+			log.Panic(err)
+		}
+		defer file.Close()
+
+		readers = append(readers, file)
+	}
+
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+	fs.ContentType = upload.ContentType
+
+	name, _ := objectPath(bucket, key)
+
+	if err := fs.MkdirAll(c, path.Dir(name)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := fs.Upload(c, name, io.MultiReader(readers...)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	h.removeUpload(c, upload.Id)
+
+	info, err := fs.Stat(c, name)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.XML(http.StatusOK, completeMultipartUploadResult{
+		Location: c.Request.URL.Path,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag(c, info),
+	})
+}
+
+func (h *Handler) AbortMultipartUpload(c *gin.Context, bucket, key string) {
+	upload, ok := h.findUpload(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	h.removeUpload(c, upload.Id)
+
+	c.Status(http.StatusNoContent)
+}
+
+// Find upload of uploadId parameter started by user for the same key
+func (h *Handler) findUpload(c *gin.Context, bucket, key string) (*models.MultipartUpload, bool) {
+	var upload models.MultipartUpload
+
+	err := h.Db.Collection("multipart_uploads").FindOne(c, bson.D{
+		{Key: "_id", Value: c.Query("uploadId")},
+		{Key: "user", Value: auth.ExtractClaimsFromContext(c).Id},
+		{Key: "bucket", Value: bucket},
+		{Key: "key", Value: key},
+	}).Decode(&upload)
+	if err == mongo.ErrNoDocuments {
+		auth.AbortWithS3Error(c, http.StatusNotFound, "NoSuchUpload", "multipart upload doesn't exist")
+		return nil, false
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &upload, true
+}
+
+func (h *Handler) removeUpload(ctx context.Context, uploadId string) {
+	if _, err := h.Db.Collection("multipart_uploads").DeleteOne(ctx, bson.D{{Key: "_id", Value: uploadId}}); err != nil {
+		log.Println(err)
+	}
+
+	if err := os.RemoveAll(config.MultipartDestination + uploadId); err != nil {
+		log.Println(err)
+	}
+}
+
+// RunCleanup periodically removes parts of uploads without document,
+// documents of expired uploads are removed by TTL index
+func (h *Handler) RunCleanup(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.cleanup(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (h *Handler) cleanup(ctx context.Context) error {
+	entries, err := os.ReadDir(config.MultipartDestination)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		count, err := h.Db.Collection("multipart_uploads").CountDocuments(ctx, bson.D{{Key: "_id", Value: entry.Name()}})
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			if err := os.RemoveAll(config.MultipartDestination + entry.Name()); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/handlers/webdav"
+	"ncloud-api/middleware/auth"
+)
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Most keys which can be deleted with one DeleteObjects request
+const maxDeleteKeys = 1000
+
+// ETag of directories, SHA-256 of empty content
+const directoryETag = `"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+
+// Headers of GetObject response which can be overridden with query parameters of presigned URL
+var responseHeaders = map[string]string{
+	"response-content-type":        "Content-Type",
+	"response-content-language":    "Content-Language",
+	"response-expires":             "Expires",
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+}
+
+// GetObject sends content of file (also for HEAD requests), with support of ranges and conditional requests.
+// Directories can be requested with keys ending with "/"
+func (h *Handler) GetObject(c *gin.Context, bucket, key string) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	if _, ok := resolveBucket(c, fs, bucket); !ok {
+		return
+	}
+
+	name, err := objectPath(bucket, key)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	n, err := fs.Resolve(c, name)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if n.IsDir() != strings.HasSuffix(key, "/") {
+		respondError(c, os.ErrNotExist)
+		return
+	}
+	if !n.Allows(auth.PermissionRead) {
+		respondError(c, os.ErrPermission)
+		return
+	}
+
+	if n.IsDir() {
+		c.Header("Content-Type", "application/x-directory")
+		c.Header("ETag", directoryETag)
+		c.Header("Last-Modified", formatHTTPTime(n.Directory().Modified))
+		c.Header("Content-Length", "0")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	file, err := fs.OpenFile(c, name, os.O_RDONLY, 0)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("ETag", etag(c, info))
+	if contentType := contentType(c, info); contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+	for parameter, header := range responseHeaders {
+		if value := c.Query(parameter); value != "" {
+			c.Header(header, value)
+		}
+	}
+
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+
+	fs.RecordDownload()
+}
+
+// PutObject uploads file, or creates directory if key ends with "/". Missing parent directories are created
+func (h *Handler) PutObject(c *gin.Context, bucket, key string) {
+	verifyContentMD5(c)
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	if _, ok := resolveBucket(c, fs, bucket); !ok {
+		return
+	}
+
+	name, err := objectPath(bucket, key)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if strings.HasSuffix(key, "/") {
+		if err := fs.MkdirAll(c, name); err != nil {
+			respondError(c, err)
+			return
+		}
+
+		c.Header("ETag", directoryETag)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if err := fs.MkdirAll(c, path.Dir(name)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// Quota is checked before body is received, and again when file is saved
+	if c.Request.ContentLength > 0 {
+		exceeded, err := fs.QuotaExceeded(c, name, c.Request.ContentLength)
+		if err != nil {
+			log.Panic(err)
+		}
+		if exceeded {
+			respondError(c, webdav.ErrQuotaExceeded)
+			return
+		}
+	}
+
+	if err := fs.Upload(c, name, c.Request.Body); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	info, err := fs.Stat(c, name)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("ETag", etag(c, info))
+	c.Status(http.StatusOK)
+}
+
+// CopyObject copies file from x-amz-copy-source (/bucket/key), content type is copied
+// unless x-amz-metadata-directive is REPLACE
+func (h *Handler) CopyObject(c *gin.Context, bucket, key string) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	if _, ok := resolveBucket(c, fs, bucket); !ok {
+		return
+	}
+
+	name, err := objectPath(bucket, key)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if strings.HasSuffix(key, "/") {
+		respondError(c, errInvalidKey)
+		return
+	}
+
+	// Versions aren't supported, version id is ignored
+	source, _, _ := strings.Cut(c.GetHeader("X-Amz-Copy-Source"), "?")
+	source, err = url.PathUnescape(source)
+	if err != nil {
+		respondError(c, errInvalidKey)
+		return
+	}
+
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	sourceName, err := objectPath(sourceBucket, sourceKey)
+	if err != nil || strings.HasSuffix(sourceKey, "/") {
+		respondError(c, errInvalidKey)
+		return
+	}
+
+	file, err := fs.OpenFile(c, sourceName, os.O_RDONLY, 0)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if info.IsDir() {
+		respondError(c, os.ErrNotExist)
+		return
+	}
+
+	if c.GetHeader("X-Amz-Metadata-Directive") != "REPLACE" {
+		fs.ContentType = contentType(c, info)
+	}
+
+	if err := fs.MkdirAll(c, path.Dir(name)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := fs.Upload(c, name, file); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	info, err = fs.Stat(c, name)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.XML(http.StatusOK, copyObjectResult{
+		LastModified: formatTime(info.ModTime().UnixMilli()),
+		ETag:         etag(c, info),
+	})
+}
+
+// DeleteObject deletes file, or empty directory if key ends with "/".
+// Like in S3, deleting key which doesn't exist succeeds
+func (h *Handler) DeleteObject(c *gin.Context, bucket, key string) {
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	if _, ok := resolveBucket(c, fs, bucket); !ok {
+		return
+	}
+
+	if err := deleteObject(c, fs, bucket, key); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteObjects deletes up to 1000 keys, result of each key is reported in response
+func (h *Handler) DeleteObjects(c *gin.Context, bucket string) {
+	verifyContentMD5(c)
+	fs := webdav.NewFileSystem(c, h.Db, h.SearchDb)
+
+	if _, ok := resolveBucket(c, fs, bucket); !ok {
+		return
+	}
+
+	var data deleteRequest
+	if err := bindXML(c, &data); err != nil {
+		respondError(c, err)
+		return
+	}
+	if len(data.Objects) == 0 || len(data.Objects) > maxDeleteKeys {
+		respondError(c, errMalformedXML)
+		return
+	}
+
+	result := deleteResult{
+		Deleted: make([]deletedObject, 0),
+		Errors:  make([]deleteError, 0),
+	}
+	for _, object := range data.Objects {
+		if err := deleteObject(c, fs, bucket, object.Key); err != nil {
+			_, code, message := s3Error(err)
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: code, Message: message})
+			continue
+		}
+
+		if !data.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: object.Key})
+		}
+	}
+
+	c.XML(http.StatusOK, result)
+}
+
+func deleteObject(c *gin.Context, fs *webdav.FileSystem, bucket, key string) error {
+	name, err := objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	n, err := fs.Resolve(c, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n.IsDir() != strings.HasSuffix(key, "/") {
+		return nil
+	}
+
+	// Directory with content isn't deleted, like prefix with keys still exists in S3
+	if n.IsDir() {
+		directory, err := fs.OpenFile(c, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer directory.Close()
+
+		children, err := directory.Readdir(1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(children) > 0 {
+			return nil
+		}
+	}
+
+	return fs.RemoveAll(c, name)
+}
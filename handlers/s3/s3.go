@@ -0,0 +1,285 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/meilisearch/meilisearch-go"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/handlers/webdav"
+	"ncloud-api/middleware/auth"
+)
+
+// Prefix of S3 routes, clients use path-style requests: /s3/<bucket>/<key>
+const Prefix = "/s3"
+
+// Methods of S3 requests served by ServeS3
+var Methods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPut,
+	http.MethodPost,
+	http.MethodDelete,
+}
+
+// Format of timestamps in XML responses
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Handler serves directories and files of user authenticated with auth.S3Auth over S3-compatible API.
+//
+// Buckets are directories in root of WebDAV file system (Main, Trash and root directories of groups),
+// keys are paths inside them. Keys ending with "/" are directories
+type Handler struct {
+	Db       *mongo.Database
+	SearchDb *meilisearch.Client
+}
+
+// Errors of request bodies, they are mapped to S3 errors by respondError
+var (
+	errBadDigest      = errors.New("Content-MD5 doesn't match body")
+	errInvalidKey     = errors.New("key must not contain empty, \".\" or \"..\" segments")
+	errMalformedXML   = errors.New("XML body is malformed")
+	errNotImplemented = errors.New("operation isn't implemented")
+)
+
+// ServeS3 dispatches request to S3 operation by bucket, key, method and query
+func (h *Handler) ServeS3(c *gin.Context) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(c.Param("path"), "/"), "/")
+	query := c.Request.URL.Query()
+	method := c.Request.Method
+
+	if bucket == "" {
+		if method != http.MethodGet {
+			respondError(c, errNotImplemented)
+			return
+		}
+		h.ListBuckets(c)
+		return
+	}
+
+	if key == "" {
+		switch {
+		case method == http.MethodGet && query.Has("location"):
+			h.GetBucketLocation(c, bucket)
+		case method == http.MethodGet && query.Get("list-type") == "2":
+			h.ListObjects(c, bucket, true)
+		case method == http.MethodGet && hasOnly(query, listParameters):
+			h.ListObjects(c, bucket, false)
+		case method == http.MethodHead:
+			h.HeadBucket(c, bucket)
+		case method == http.MethodPost && query.Has("delete"):
+			h.DeleteObjects(c, bucket)
+		case method == http.MethodPut || method == http.MethodDelete:
+			auth.AbortWithS3Error(c, http.StatusForbidden, "AccessDenied",
+				"buckets are root directories, they can't be created or deleted")
+		default:
+			respondError(c, errNotImplemented)
+		}
+		return
+	}
+
+	switch {
+	case method == http.MethodPost && query.Has("uploads"):
+		h.CreateMultipartUpload(c, bucket, key)
+	case method == http.MethodPost && query.Has("uploadId"):
+		h.CompleteMultipartUpload(c, bucket, key)
+	case method == http.MethodPut && query.Has("uploadId"):
+		h.UploadPart(c, bucket, key)
+	case method == http.MethodDelete && query.Has("uploadId"):
+		h.AbortMultipartUpload(c, bucket, key)
+	case query.Has("uploadId") || method == http.MethodPost:
+		respondError(c, errNotImplemented)
+	case method == http.MethodGet || method == http.MethodHead:
+		h.GetObject(c, bucket, key)
+	case method == http.MethodPut && c.GetHeader("X-Amz-Copy-Source") != "":
+		h.CopyObject(c, bucket, key)
+	case method == http.MethodPut:
+		h.PutObject(c, bucket, key)
+	case method == http.MethodDelete:
+		h.DeleteObject(c, bucket, key)
+	}
+}
+
+// Query parameters of listing, other parameters of GET bucket request are unsupported subresources
+var listParameters = []string{"prefix", "delimiter", "marker", "max-keys", "encoding-type"}
+
+func hasOnly(query map[string][]string, parameters []string) bool {
+	for name := range query {
+		found := false
+		for _, parameter := range parameters {
+			found = found || name == parameter
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Path of key in file system, keys are validated, so they can't resolve to other paths than they name
+func objectPath(bucket, key string) (string, error) {
+	segments := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errInvalidKey
+		}
+	}
+
+	return "/" + bucket + "/" + strings.Join(segments, "/"), nil
+}
+
+// Find bucket, only directories in root of file system are buckets
+func resolveBucket(c *gin.Context, fs *webdav.FileSystem, bucket string) (*webdav.Node, bool) {
+	if strings.Contains(bucket, "/") {
+		respondBucketError(c, os.ErrNotExist)
+		return nil, false
+	}
+
+	n, err := fs.Resolve(c, "/"+bucket)
+	if err != nil {
+		respondBucketError(c, err)
+		return nil, false
+	}
+
+	return n, true
+}
+
+func respondBucketError(c *gin.Context, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		auth.AbortWithS3Error(c, http.StatusNotFound, "NoSuchBucket", "bucket doesn't exist")
+		return
+	}
+	respondError(c, err)
+}
+
+// Respond with S3 error of error returned by file system or request body
+func respondError(c *gin.Context, err error) {
+	status, code, message := s3Error(err)
+	auth.AbortWithS3Error(c, status, code, message)
+}
+
+func s3Error(err error) (status int, code, message string) {
+	var validationErrors validator.ValidationErrors
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, "NoSuchKey", "key doesn't exist"
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden, "AccessDenied", "permission denied"
+	case errors.Is(err, os.ErrExist):
+		return http.StatusConflict, "InvalidRequest", "key conflicts with existing file or directory"
+	case errors.Is(err, webdav.ErrQuotaExceeded):
+		return http.StatusForbidden, "QuotaExceeded", err.Error()
+	case errors.Is(err, auth.ErrContentSHA256Mismatch):
+		return http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error()
+	case errors.Is(err, auth.ErrChunkSignatureInvalid):
+		return http.StatusForbidden, "SignatureDoesNotMatch", err.Error()
+	case errors.Is(err, auth.ErrIncompleteBody):
+		return http.StatusBadRequest, "IncompleteBody", err.Error()
+	case errors.Is(err, errBadDigest):
+		return http.StatusBadRequest, "BadDigest", err.Error()
+	case errors.Is(err, errInvalidKey):
+		return http.StatusBadRequest, "InvalidArgument", err.Error()
+	case errors.Is(err, errMalformedXML):
+		return http.StatusBadRequest, "MalformedXML", err.Error()
+	case errors.Is(err, errNotImplemented):
+		return http.StatusNotImplemented, "NotImplemented", err.Error()
+	case errors.As(err, &validationErrors):
+		return http.StatusBadRequest, "InvalidArgument", err.Error()
+	}
+
+	log.Println(err)
+	return http.StatusInternalServerError, "InternalError", "internal error"
+}
+
+// Decode XML body of request, body is limited to 1 MiB
+func bindXML(c *gin.Context, body interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if err := xml.Unmarshal(data, body); err != nil {
+		return errMalformedXML
+	}
+
+	return nil
+}
+
+// md5Reader returns errBadDigest at the end of body if it doesn't match Content-MD5 header
+type md5Reader struct {
+	io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+// Wrap body of request, so it's verified against Content-MD5 header if it's present
+func verifyContentMD5(c *gin.Context) {
+	expected := c.GetHeader("Content-MD5")
+	if expected == "" {
+		return
+	}
+
+	c.Request.Body = io.NopCloser(&md5Reader{Reader: c.Request.Body, hash: md5.New(), expected: expected})
+}
+
+func (r *md5Reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hash.Write(p[:n])
+
+	if errors.Is(err, io.EOF) && base64.StdEncoding.EncodeToString(r.hash.Sum(nil)) != r.expected {
+		return n, errBadDigest
+	}
+
+	return n, err
+}
+
+// File info of webdav.FileSystem knows content type and ETag (SHA-256 of content) of most files
+type contentTyper interface {
+	ContentType(ctx context.Context) (string, error)
+}
+
+type etager interface {
+	ETag(ctx context.Context) (string, error)
+}
+
+func contentType(ctx context.Context, info os.FileInfo) string {
+	if typer, ok := info.(contentTyper); ok {
+		if contentType, err := typer.ContentType(ctx); err == nil {
+			return contentType
+		}
+	}
+	return ""
+}
+
+// ETag of files uploaded before hashes were stored is based on modification time and size, like in WebDAV
+func etag(ctx context.Context, info os.FileInfo) string {
+	if etager, ok := info.(etager); ok {
+		if etag, err := etager.ETag(ctx); err == nil {
+			return etag
+		}
+	}
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func formatTime(milliseconds int64) string {
+	return time.UnixMilli(milliseconds).UTC().Format(timeFormat)
+}
+
+func formatHTTPTime(milliseconds int64) string {
+	return time.UnixMilli(milliseconds).UTC().Format(http.TimeFormat)
+}
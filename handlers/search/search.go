@@ -1,15 +1,23 @@
 package search
 
 import (
+	"log"
+	"net/http"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/meilisearch/meilisearch-go"
-	"log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
 	"ncloud-api/middleware/auth"
-	"net/http"
+	"ncloud-api/middleware/metrics"
+	"ncloud-api/models"
 )
 
 type Handler struct {
-	Db *meilisearch.Client
+	Db      *meilisearch.Client
+	MongoDb *mongo.Database
 }
 
 func (h *Handler) FindDirectoriesAndFiles(c *gin.Context) {
@@ -21,18 +29,43 @@ func (h *Handler) FindDirectoriesAndFiles(c *gin.Context) {
 		{"user = '" + claims.Id + "'"},
 	}
 
+	// Results also include everything inside directories shared with user and directories of its groups,
+	// but not for tokens restricted to directory
+	if _, restricted := auth.AllowedDirectories(c); !restricted {
+		shared, err := h.sharedFilter(claims.Id)
+		if err != nil {
+			log.Println(err)
+		}
+		filter[0] = append(filter[0], shared...)
+	}
+
 	if parentDirectory != "" {
+		if !auth.DirectoryAllowed(c, parentDirectory) {
+			c.Status(http.StatusForbidden)
+			return
+		}
 		filter = append(filter, []string{"parent_directory = '" + parentDirectory + "'"})
+	} else if allowed, restricted := auth.AllowedDirectories(c); restricted {
+		// Token restricted to directory can only search inside its directory tree
+		parents := make([]string, 0, len(allowed))
+		for _, id := range allowed {
+			parents = append(parents, "parent_directory = '"+id+"'")
+		}
+		filter = append(filter, parents)
 	}
 
-	resp, err := h.Db.Index("directories").Search(name, &meilisearch.SearchRequest{
+	resp, err := Search(h.Db, "directories", name, &meilisearch.SearchRequest{
 		Filter: filter,
 	})
+	if err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
 
-	resp2, err := h.Db.Index("files").Search(name, &meilisearch.SearchRequest{
+	resp2, err := Search(h.Db, "files", name, &meilisearch.SearchRequest{
 		Filter: filter,
 	})
-
 	if err != nil {
 		log.Println(err)
 		c.Status(http.StatusInternalServerError)
@@ -50,23 +83,77 @@ func (h *Handler) FindDirectoriesAndFiles(c *gin.Context) {
 	})
 }
 
-func UpdateDocuments(db *meilisearch.Client, index string, document interface{}) error {
-	if _, err := db.Index(index).UpdateDocuments(document); err != nil {
-		return err
+// Filter conditions for everything inside directories shared with user and for data of groups of user
+func (h *Handler) sharedFilter(user string) ([]string, error) {
+	shares, err := models.FindDirectorySharesByFilter(h.MongoDb, bson.D{{Key: "user", Value: user}})
+	if err != nil {
+		return nil, err
+	}
+
+	filter := make([]string, 0, len(shares))
+	for _, share := range shares {
+		tree, err := models.FindDirectoryTree(h.MongoDb, share.Owner, share.Directory)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range tree {
+			filter = append(filter, "parent_directory = '"+id+"'")
+		}
+	}
+
+	groups, err := models.FindGroupsByFilter(h.MongoDb, bson.D{{Key: "members.user", Value: user}})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	for _, group := range groups {
+		filter = append(filter, "user = '"+group.Id+"'")
+	}
+
+	return filter, nil
 }
+
+func Search(
+	db *meilisearch.Client,
+	index string,
+	query string,
+	request *meilisearch.SearchRequest,
+) (*meilisearch.SearchResponse, error) {
+	start := time.Now()
+	resp, err := db.Index(index).Search(query, request)
+	metrics.ObserveDatabaseCall(metrics.DatabaseMeilisearch, "search", start, err)
+
+	return resp, err
+}
+
+func UpdateDocuments(db *meilisearch.Client, index string, document interface{}) error {
+	start := time.Now()
+	_, err := db.Index(index).UpdateDocuments(document)
+	metrics.ObserveDatabaseCall(metrics.DatabaseMeilisearch, "update_documents", start, err)
+
+	return err
+}
+
 func DeleteDocuments(db *meilisearch.Client, index string, id []string) error {
-	if _, err := db.Index(index).DeleteDocuments(id); err != nil {
-		return err
-	}
-	return nil
+	start := time.Now()
+	_, err := db.Index(index).DeleteDocuments(id)
+	metrics.ObserveDatabaseCall(metrics.DatabaseMeilisearch, "delete_documents", start, err)
+
+	return err
+}
+
+func DeleteDocumentsByFilter(db *meilisearch.Client, index string, filter interface{}) error {
+	start := time.Now()
+	_, err := db.Index(index).DeleteDocumentsByFilter(filter)
+	metrics.ObserveDatabaseCall(metrics.DatabaseMeilisearch, "delete_documents", start, err)
+
+	return err
 }
 
 func InsertDocuments(db *meilisearch.Client, index string, documents interface{}) error {
-	if _, err := db.Index(index).AddDocuments(documents); err != nil {
-		return err
-	}
+	start := time.Now()
+	_, err := db.Index(index).AddDocuments(documents)
+	metrics.ObserveDatabaseCall(metrics.DatabaseMeilisearch, "add_documents", start, err)
 
-	return nil
+	return err
 }
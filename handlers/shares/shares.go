@@ -0,0 +1,542 @@
+package shares
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/audit"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/mailer"
+)
+
+type Handler struct {
+	Db     *mongo.Database
+	Mailer mailer.Mailer
+}
+
+// CreateShareLink creates share link for file or directory
+//
+// Access key of directory (or directory of file) must have read permission, and also upload permission
+// for links with upload or request mode. Token is returned only once, only its hash is stored
+func (h *Handler) CreateShareLink(c *gin.Context) {
+	type RequestData struct {
+		File         string `json:"file"`
+		Directory    string `json:"directory"`
+		AccessKey    string `json:"access_key"`
+		Password     string `json:"password"`
+		Mode         string `json:"mode"`
+		ExpiresIn    int64  `json:"expires_in"` // seconds, 0 means link never expires
+		MaxDownloads int64  `json:"max_downloads"`
+		MaxFileSize  int64  `json:"max_file_size"`
+		MaxUploads   int64  `json:"max_uploads"`
+		UploaderName bool   `json:"uploader_name"`
+		Notify       bool   `json:"notify"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if (data.File == "") == (data.Directory == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "either file or directory must be provided",
+		})
+		return
+	}
+
+	if data.Mode == "" {
+		data.Mode = models.ShareModeRead
+	}
+
+	if data.File != "" && data.Mode != models.ShareModeRead {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "files can only be shared for reading",
+		})
+		return
+	}
+
+	if data.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid expires_in",
+		})
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+
+	directory := data.Directory
+	if data.File != "" {
+		var file models.File
+
+		opts := options.FindOne().SetProjection(bson.D{{Key: "parent_directory", Value: 1}})
+		err := h.Db.Collection("files").FindOne(c, bson.D{
+			{Key: "_id", Value: data.File},
+			{Key: "user", Value: claims.Id},
+		}, opts).Decode(&file)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		directory = file.ParentDirectory
+	}
+
+	permissions := []string{auth.PermissionRead}
+	if data.Mode == models.ShareModeUpload || data.Mode == models.ShareModeRequest {
+		permissions = append(permissions, auth.PermissionUpload)
+	}
+
+	accessKey := auth.BatchAccessKey(c, data.AccessKey)
+	for _, permission := range permissions {
+		if !auth.ValidateAccessKeyPermission(c, h.Db, accessKey, directory, permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "invalid access key for directory: " + directory,
+			})
+			return
+		}
+	}
+
+	// Directories shared with user can't be shared publicly
+	if auth.AccessKeyOwner(accessKey) != claims.Id {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "only owner of directory can create share link",
+		})
+		return
+	}
+
+	token, err := auth.GenerateRandomToken()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	now := time.Now()
+
+	link := models.ShareLink{
+		Id:           uuid.New().String(),
+		User:         claims.Id,
+		TokenHash:    auth.HashToken(token),
+		File:         data.File,
+		Directory:    data.Directory,
+		Mode:         data.Mode,
+		MaxDownloads: data.MaxDownloads,
+		MaxFileSize:  data.MaxFileSize,
+		MaxUploads:   data.MaxUploads,
+		UploaderName: data.UploaderName,
+		Notify:       data.Notify,
+		Created:      now.UnixMilli(),
+	}
+
+	if data.ExpiresIn > 0 {
+		link.Expires = now.Add(time.Duration(data.ExpiresIn) * time.Second).UnixMilli()
+	}
+
+	if err := link.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if data.Password != "" {
+		link.Password, err = crypto.GenerateHash(data.Password)
+		if err != nil {
+			log.Panic(err)
+		}
+		link.HasPassword = true
+	}
+
+	if _, err := h.Db.Collection("share_links").InsertOne(c, link); err != nil {
+		log.Panic(err)
+	}
+
+	targets := []string{link.Id, directory}
+	if link.File != "" {
+		targets = append(targets, link.File)
+	}
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionCreateShareLink,
+		Targets: targets,
+		Details: link.Mode,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token": token,
+		"link":  link,
+	})
+}
+
+// GetShareLinks lists share links of user with their access counts
+func (h *Handler) GetShareLinks(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+
+	links, err := models.FindShareLinksByFilter(h.Db, bson.D{{Key: "user", Value: claims.Id}}, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+// UpdateShareLink changes password, expiry, mode, download or upload limits and options of share link.
+//
+// Only provided fields are changed, empty password removes password, 0 removes expiry or download limit
+func (h *Handler) UpdateShareLink(c *gin.Context) {
+	type RequestData struct {
+		Password     *string `json:"password"`
+		Mode         *string `json:"mode"`
+		ExpiresIn    *int64  `json:"expires_in"`
+		MaxDownloads *int64  `json:"max_downloads"`
+		MaxFileSize  *int64  `json:"max_file_size"`
+		MaxUploads   *int64  `json:"max_uploads"`
+		UploaderName *bool   `json:"uploader_name"`
+		Notify       *bool   `json:"notify"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+	filter := bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: claims.Id},
+	}
+
+	var link models.ShareLink
+	if err := h.Db.Collection("share_links").FindOne(c, filter).Decode(&link); err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+
+	if data.Password != nil {
+		if *data.Password == "" {
+			unset["password"] = ""
+		} else {
+			hash, err := crypto.GenerateHash(*data.Password)
+			if err != nil {
+				log.Panic(err)
+			}
+			set["password"] = hash
+		}
+	}
+
+	if data.Mode != nil {
+		link.Mode = *data.Mode
+		if link.File != "" && link.Mode != models.ShareModeRead {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "files can only be shared for reading",
+			})
+			return
+		}
+		set["mode"] = link.Mode
+	}
+
+	if data.ExpiresIn != nil {
+		switch {
+		case *data.ExpiresIn < 0:
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid expires_in",
+			})
+			return
+		case *data.ExpiresIn == 0:
+			unset["expires"] = ""
+		default:
+			set["expires"] = time.Now().Add(time.Duration(*data.ExpiresIn) * time.Second).UnixMilli()
+		}
+	}
+
+	if data.MaxDownloads != nil {
+		link.MaxDownloads = *data.MaxDownloads
+		if link.MaxDownloads == 0 {
+			unset["max_downloads"] = ""
+		} else {
+			set["max_downloads"] = link.MaxDownloads
+		}
+	}
+
+	if data.MaxFileSize != nil {
+		link.MaxFileSize = *data.MaxFileSize
+		if link.MaxFileSize == 0 {
+			unset["max_file_size"] = ""
+		} else {
+			set["max_file_size"] = link.MaxFileSize
+		}
+	}
+
+	if data.MaxUploads != nil {
+		link.MaxUploads = *data.MaxUploads
+		if link.MaxUploads == 0 {
+			unset["max_uploads"] = ""
+		} else {
+			set["max_uploads"] = link.MaxUploads
+		}
+	}
+
+	if data.UploaderName != nil {
+		set["uploader_name"] = *data.UploaderName
+	}
+
+	if data.Notify != nil {
+		set["notify"] = *data.Notify
+	}
+
+	if err := link.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
+	if len(update) > 0 {
+		if _, err := h.Db.Collection("share_links").UpdateOne(c, filter, update); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteShareLink revokes share link
+func (h *Handler) DeleteShareLink(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	res, err := h.Db.Collection("share_links").DeleteOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: claims.Id},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.DeletedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionDeleteShareLink,
+		Targets: []string{c.Param("id")},
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetSharedContent returns shared file, or content of shared directory (or directory from directory query
+// parameter inside it). Content of directory isn't returned for file requests. Link is verified in ShareAuth
+func (h *Handler) GetSharedContent(c *gin.Context) {
+	link := auth.ShareLinkFromContext(c)
+	claims := auth.DirectoryClaimsFromContext(c)
+
+	if _, err := h.Db.Collection("share_links").UpdateByID(c, link.Id, bson.D{
+		{Key: "$inc", Value: bson.M{"views": 1}},
+		{Key: "$set", Value: bson.M{"last_accessed": time.Now().UnixMilli()}},
+	}); err != nil {
+		log.Println(err)
+	}
+
+	info := gin.H{
+		"mode":          link.Mode,
+		"expires":       link.Expires,
+		"max_downloads": link.MaxDownloads,
+		"downloads":     link.Downloads,
+	}
+
+	if link.Mode == models.ShareModeRequest {
+		info["max_file_size"] = link.MaxFileSize
+		info["max_uploads"] = link.MaxUploads
+		info["uploads"] = link.Uploads
+		info["uploader_name"] = link.UploaderName
+		c.JSON(http.StatusOK, info)
+		return
+	}
+
+	if link.File != "" {
+		files, err := models.FindFilesById[models.File](h.Db, []string{link.File})
+		if err != nil || len(files) == 0 {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		info["file"] = files[0]
+		c.JSON(http.StatusOK, info)
+		return
+	}
+
+	directoryId := c.DefaultQuery("directory", link.Directory)
+	if !auth.KeyCoversDirectory(c, h.Db, claims, directoryId) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	directories, err := models.FindDirectoriesById[models.Directory](h.Db, []string{directoryId})
+	if err != nil || len(directories) == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	children, err := models.FindDirectoriesByFilter[models.Directory](
+		h.Db,
+		bson.D{{Key: "parent_directory", Value: directoryId}},
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	files, err := models.FindFilesByFilter[models.File](h.Db, bson.D{{Key: "parent_directory", Value: directoryId}})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	info["directory"] = directories[0]
+	info["directories"] = children
+	info["files"] = files
+
+	c.JSON(http.StatusOK, info)
+}
+
+// LimitShareUpload enforces upload limits of share link and prefixes names of files with name of uploader,
+// owner is notified after successful upload. Used before Upload handler, must be used after ShareAuth
+func (h *Handler) LimitShareUpload(c *gin.Context) {
+	link := auth.ShareLinkFromContext(c)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "no files",
+		})
+		c.Abort()
+		return
+	}
+
+	files := form.File["upload[]"]
+	if len(files) == 0 {
+		c.Next()
+		return
+	}
+
+	for _, file := range files {
+		if link.MaxFileSize > 0 && file.Size > link.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": "file is too large: " + file.Filename,
+			})
+			c.Abort()
+			return
+		}
+	}
+
+	uploader := strings.TrimSpace(c.PostForm("name"))
+	if link.UploaderName {
+		if uploader == "" || len(uploader) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "name of uploader is required",
+			})
+			c.Abort()
+			return
+		}
+
+		// Upload handler reads the same form
+		for _, file := range files {
+			file.Filename = uploader + " - " + file.Filename
+		}
+	}
+
+	// Number of uploads is reserved before upload, so concurrent uploads can't exceed limit
+	count := int64(len(files))
+	filter := bson.D{{Key: "_id", Value: link.Id}}
+	if link.MaxUploads > 0 {
+		filter = append(filter, bson.E{Key: "uploads", Value: bson.D{{Key: "$lte", Value: link.MaxUploads - count}}})
+	}
+
+	res, err := h.Db.Collection("share_links").UpdateOne(c, filter, bson.D{
+		{Key: "$inc", Value: bson.M{"uploads": count}},
+		{Key: "$set", Value: bson.M{"last_accessed": time.Now().UnixMilli()}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusGone, gin.H{
+			"error": "upload limit reached",
+		})
+		c.Abort()
+		return
+	}
+
+	c.Next()
+
+	if c.Writer.Status() != http.StatusCreated {
+		if _, err := h.Db.Collection("share_links").UpdateByID(context.TODO(), link.Id, bson.D{
+			{Key: "$inc", Value: bson.M{"uploads": -count}},
+		}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if link.Notify {
+		names := make([]string, 0, len(files))
+		for _, file := range files {
+			names = append(names, file.Filename)
+		}
+
+		go h.notifyUpload(link, uploader, names)
+	}
+}
+
+// Send email about files uploaded through share link to its owner, if owner has email
+func (h *Handler) notifyUpload(link *models.ShareLink, uploader string, names []string) {
+	var user models.User
+
+	opts := options.FindOne().SetProjection(bson.D{{Key: "username", Value: 1}, {Key: "email", Value: 1}})
+	err := h.Db.Collection("user").FindOne(context.TODO(), bson.D{{Key: "_id", Value: link.User}}, opts).Decode(&user)
+	if err != nil || user.Email == "" {
+		return
+	}
+
+	var directory models.Directory
+
+	opts = options.FindOne().SetProjection(bson.D{{Key: "name", Value: 1}})
+	if err := h.Db.Collection("directories").FindOne(context.TODO(), bson.D{{Key: "_id", Value: link.Directory}}, opts).
+		Decode(&directory); err != nil {
+		log.Println(err)
+		return
+	}
+
+	body := strconv.Itoa(len(names)) + " file(s) were uploaded to directory " + directory.Name
+	if uploader != "" {
+		body += " by " + uploader
+	}
+	body += ":\n\n" + strings.Join(names, "\n")
+
+	if err := h.Mailer.Send(user.Email, "Files uploaded to "+directory.Name, body); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,143 @@
+package user
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+// Personal access tokens can only be managed with tokens from login, so leaked token can't create new ones
+func rejectPersonalAccessToken(c *gin.Context, claims *auth.SignedClaims) bool {
+	if claims.PersonalAccessToken != "" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "personal access token can't be used to manage personal access tokens",
+		})
+		return true
+	}
+	return false
+}
+
+// CreateAccessToken creates personal access token
+//
+// Token is returned only once, only its hash is stored
+func (h *Handler) CreateAccessToken(c *gin.Context) {
+	type RequestData struct {
+		Name      string `json:"name"`
+		Scope     string `json:"scope"`
+		Directory string `json:"directory"`
+		ExpiresIn int64  `json:"expires_in"` // seconds, 0 means token never expires
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+	if rejectPersonalAccessToken(c, claims) {
+		return
+	}
+
+	if data.Directory != "" {
+		count, err := h.Db.Collection("directories").CountDocuments(c, bson.D{
+			{Key: "_id", Value: data.Directory},
+			{Key: "user", Value: claims.Id},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "directory doesn't exist",
+			})
+			return
+		}
+	}
+
+	token, err := auth.GeneratePersonalAccessToken()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	now := time.Now()
+
+	accessToken := models.PersonalAccessToken{
+		Id:        uuid.New().String(),
+		User:      claims.Id,
+		Name:      data.Name,
+		TokenHash: auth.HashToken(token),
+		Scope:     data.Scope,
+		Directory: data.Directory,
+		Created:   now.UnixMilli(),
+	}
+
+	if data.ExpiresIn > 0 {
+		accessToken.Expires = now.Add(time.Duration(data.ExpiresIn) * time.Second).UnixMilli()
+	}
+
+	if err := accessToken.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if _, err := h.Db.Collection("access_tokens").InsertOne(c, accessToken); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":        token,
+		"access_token": accessToken,
+	})
+}
+
+func (h *Handler) GetAccessTokens(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+	if rejectPersonalAccessToken(c, claims) {
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+
+	accessTokens, err := models.FindAccessTokensByFilter(
+		h.Db,
+		bson.D{{Key: "user", Value: claims.Id}},
+		opts,
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, accessTokens)
+}
+
+func (h *Handler) DeleteAccessToken(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+	if rejectPersonalAccessToken(c, claims) {
+		return
+	}
+
+	res, err := h.Db.Collection("access_tokens").DeleteOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: claims.Id},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.DeletedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,420 @@
+package user
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/validator.v2"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/helper"
+)
+
+const (
+	adminDefaultLimit = 50
+	adminMaxLimit     = 500
+)
+
+// Roles which can be assigned with AdminSetRoles
+var knownRoles = []string{models.RoleAdmin}
+
+// Secrets are never returned by administration API
+var adminUserProjection = bson.D{
+	{Key: "password", Value: 0},
+	{Key: "trash_access_key", Value: 0},
+	{Key: "totp_secret", Value: 0},
+	{Key: "totp_pending_secret", Value: 0},
+	{Key: "recovery_codes", Value: 0},
+}
+
+type adminUser struct {
+	models.User
+	Storage models.StorageUsage `json:"storage"`
+}
+
+func (h *Handler) withStorageUsage(ctx context.Context, users []models.User) ([]adminUser, error) {
+	userIds := make([]string, 0, len(users))
+	for _, user := range users {
+		userIds = append(userIds, user.Id)
+	}
+
+	usage, err := models.FindStorageUsage(ctx, h.Db, userIds)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]adminUser, 0, len(users))
+	for _, user := range users {
+		result = append(result, adminUser{User: user, Storage: usage[user.Id]})
+	}
+
+	return result, nil
+}
+
+// AdminGetUsers lists users with their storage usage
+//
+// Query parameters: query (part of username or email), page (from 0), limit
+func (h *Handler) AdminGetUsers(c *gin.Context) {
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "0"), 10, 64)
+	if err != nil || page < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid page",
+		})
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(adminDefaultLimit)), 10, 64)
+	if err != nil || limit < 1 || limit > adminMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	filter := bson.D{}
+	if query := c.Query("query"); query != "" {
+		pattern := bson.D{
+			{Key: "$regex", Value: regexp.QuoteMeta(query)},
+			{Key: "$options", Value: "i"},
+		}
+		filter = bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "username", Value: pattern}},
+			bson.D{{Key: "email", Value: pattern}},
+		}}}
+	}
+
+	opts := options.Find().
+		SetProjection(adminUserProjection).
+		SetSort(bson.D{{Key: "username", Value: 1}}).
+		SetSkip(page * limit).
+		SetLimit(limit)
+
+	cursor, err := h.Db.Collection("user").Find(c, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	users, err := helper.MapCursorToObject[models.User](cursor)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	total, err := h.Db.Collection("user").CountDocuments(c, filter)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	result, err := h.withStorageUsage(c, users)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users": result,
+		"total": total,
+	})
+}
+
+// AdminGetUser returns user with its storage usage
+func (h *Handler) AdminGetUser(c *gin.Context) {
+	var user models.User
+
+	opts := options.FindOne().SetProjection(adminUserProjection)
+	err := h.Db.Collection("user").FindOne(c, bson.D{{Key: "_id", Value: c.Param("id")}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	result, err := h.withStorageUsage(c, []models.User{user})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, result[0])
+}
+
+// Update user from id parameter, respond with 404 if it doesn't exist.
+// Returns false if response was already sent
+func (h *Handler) adminUpdateUser(c *gin.Context, update bson.D) bool {
+	res, err := h.Db.Collection("user").UpdateByID(c, c.Param("id"), update)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+// Administrators can't suspend, demote or delete themselves, so there is always at least one left
+func rejectSelf(c *gin.Context) bool {
+	if c.Param("id") == auth.ExtractClaimsFromContext(c).Id {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "operation can't be performed on own account",
+		})
+		return true
+	}
+	return false
+}
+
+// Revoke sessions (except keepSession, if it isn't empty), personal access tokens and S3 credentials of user
+func (h *Handler) revokeCredentials(ctx context.Context, userId, keepSession string) {
+	filter := bson.D{{Key: "user", Value: userId}}
+
+	sessionFilter := filter
+	if keepSession != "" {
+		sessionFilter = bson.D{
+			{Key: "user", Value: userId},
+			{Key: "_id", Value: bson.D{{Key: "$ne", Value: keepSession}}},
+		}
+	}
+
+	if _, err := h.Db.Collection("sessions").DeleteMany(ctx, sessionFilter); err != nil {
+		log.Println(err)
+	}
+	if _, err := h.Db.Collection("access_tokens").DeleteMany(ctx, filter); err != nil {
+		log.Println(err)
+	}
+	if _, err := h.Db.Collection("s3_credentials").DeleteMany(ctx, filter); err != nil {
+		log.Println(err)
+	}
+}
+
+// AdminSuspendUser blocks login and all requests of user, its sessions and personal access tokens are revoked
+func (h *Handler) AdminSuspendUser(c *gin.Context) {
+	if rejectSelf(c) {
+		return
+	}
+
+	if !h.adminUpdateUser(c, bson.D{{Key: "$set", Value: bson.M{"suspended": true}}}) {
+		return
+	}
+
+	h.revokeCredentials(c, c.Param("id"), "")
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminUnsuspendUser allows suspended user to log in again
+func (h *Handler) AdminUnsuspendUser(c *gin.Context) {
+	if !h.adminUpdateUser(c, bson.D{{Key: "$unset", Value: bson.M{"suspended": ""}}}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminResetPassword revokes all sessions of user and sets new password.
+//
+// If password isn't provided, current one is removed and reset link is sent to verified email of user
+func (h *Handler) AdminResetPassword(c *gin.Context) {
+	type RequestData struct {
+		Password string `json:"password"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	user, err := h.findUser(c, c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if user.Provider != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "password of user from " + user.Provider + " can't be changed",
+		})
+		return
+	}
+
+	if data.Password != "" {
+		if len(data.Password) < minPasswordLength {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Error in validation",
+			})
+			return
+		}
+
+		if err := h.setPassword(c, user.Id, data.Password, ""); err != nil {
+			log.Panic(err)
+		}
+
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if user.Email == "" || !user.EmailVerified {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "user doesn't have verified email, password must be provided",
+		})
+		return
+	}
+
+	if !h.adminUpdateUser(c, bson.D{{Key: "$set", Value: bson.M{"password": ""}}}) {
+		return
+	}
+	h.revokeCredentials(c, user.Id, "")
+
+	token, err := h.createUserToken(c, user.Id, models.UserTokenPasswordReset, "", passwordResetDuration)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	body := "Administrator has reset password of your account " + user.Username + ".\n\n" +
+		"Set new password by opening this link:\n\n" + PasswordResetUrl + token +
+		"\n\nThe link expires in 1 hour."
+
+	if err := h.Mailer.Send(user.Email, "Reset your password", body); err != nil {
+		log.Println(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminSetQuota sets maximum size of stored files in bytes, 0 removes limit
+func (h *Handler) AdminSetQuota(c *gin.Context) {
+	type RequestData struct {
+		Quota int64 `json:"quota"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if data.Quota < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid quota",
+		})
+		return
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.M{"quota": data.Quota}}}
+	if data.Quota == 0 {
+		update = bson.D{{Key: "$unset", Value: bson.M{"quota": ""}}}
+	}
+
+	if !h.adminUpdateUser(c, update) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminSetRoles replaces roles of user
+func (h *Handler) AdminSetRoles(c *gin.Context) {
+	type RequestData struct {
+		Roles []string `json:"roles"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if rejectSelf(c) {
+		return
+	}
+
+	roles := make([]string, 0, len(data.Roles))
+	for _, role := range data.Roles {
+		if !helper.ArrayContains(knownRoles, role) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "unknown role: " + role,
+			})
+			return
+		}
+		if !helper.ArrayContains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	// Roles set by administrator aren't removed when user leaves LDAP group
+	if !h.adminUpdateUser(c, bson.D{
+		{Key: "$set", Value: bson.M{"roles": roles}},
+		{Key: "$unset", Value: bson.M{"ldap_roles": ""}},
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminDeleteUser deletes user with all its data
+func (h *Handler) AdminDeleteUser(c *gin.Context) {
+	if rejectSelf(c) {
+		return
+	}
+
+	if err := h.RemoveUser(c, c.Param("id")); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// CreateAdmin creates administrator with Main and Trash directories,
+// or grants admin role to existing user with this username
+func (h *Handler) CreateAdmin(ctx context.Context, username, password string) error {
+	res, err := h.Db.Collection("user").UpdateOne(
+		ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{
+			{Key: "$addToSet", Value: bson.M{"roles": models.RoleAdmin}},
+			{Key: "$unset", Value: bson.M{"suspended": ""}},
+			// Role granted here isn't removed when user leaves LDAP group
+			{Key: "$pull", Value: bson.M{"ldap_roles": models.RoleAdmin}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	user := models.User{Username: username, Password: password}
+	if err := validator.Validate(user); err != nil {
+		return err
+	}
+
+	user.Password, err = crypto.GenerateHash(password)
+	if err != nil {
+		return err
+	}
+
+	if err := h.CreateUser(ctx, &user); err != nil {
+		return err
+	}
+
+	_, err = h.Db.Collection("user").UpdateByID(
+		ctx,
+		user.Id,
+		bson.D{{Key: "$set", Value: bson.M{"roles": []string{models.RoleAdmin}}}},
+	)
+
+	return err
+}
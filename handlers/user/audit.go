@@ -0,0 +1,180 @@
+package user
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/audit"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+// Exports (format query parameter) can contain more events than one page
+const auditExportMaxLimit = 10000
+
+// GetAuditEvents lists events performed by user or affecting items owned by user
+func (h *Handler) GetAuditEvents(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	h.respondWithAuditEvents(c, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "actor", Value: claims.Id}},
+		bson.D{{Key: "owner", Value: claims.Id}},
+	}}})
+}
+
+// AdminGetAuditEvents lists events of all users, user query parameter filters events of one user
+func (h *Handler) AdminGetAuditEvents(c *gin.Context) {
+	filter := bson.D{}
+	if user := c.Query("user"); user != "" {
+		filter = bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "actor", Value: user}},
+			bson.D{{Key: "owner", Value: user}},
+		}}}
+	}
+
+	h.respondWithAuditEvents(c, filter)
+}
+
+// Find events matching filter and query parameters (item, action, from, to, page, limit), newest first.
+// Events are exported as attachment if format is csv or json
+func (h *Handler) respondWithAuditEvents(c *gin.Context, filter bson.D) {
+	format := c.Query("format")
+	if format != "" && format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid format",
+		})
+		return
+	}
+
+	maxLimit := int64(adminMaxLimit)
+	if format != "" {
+		maxLimit = auditExportMaxLimit
+	}
+
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "0"), 10, 64)
+	if err != nil || page < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid page",
+		})
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(adminDefaultLimit)), 10, 64)
+	if err != nil || limit < 1 || limit > maxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	if item := c.Query("item"); item != "" {
+		filter = append(filter, bson.E{Key: "targets", Value: item})
+	}
+
+	if action := c.Query("action"); action != "" {
+		if !helper.ArrayContains(audit.Actions, action) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid action",
+			})
+			return
+		}
+		filter = append(filter, bson.E{Key: "action", Value: action})
+	}
+
+	// Time range in milliseconds, both are optional
+	timeRange := bson.D{}
+	for _, param := range []struct{ name, operator string }{{"from", "$gte"}, {"to", "$lte"}} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+
+		ts, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid " + param.name,
+			})
+			return
+		}
+		timeRange = append(timeRange, bson.E{Key: param.operator, Value: ts})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{Key: "time", Value: timeRange})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}}).
+		SetSkip(page * limit).
+		SetLimit(limit)
+
+	events, err := models.FindAuditEventsByFilter(h.Db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	switch format {
+	case "csv":
+		c.Header("Content-Disposition", "attachment; filename=audit.csv")
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+
+		if err := writeAuditCsv(c.Writer, events); err != nil {
+			log.Println(err)
+		}
+	case "json":
+		c.Header("Content-Disposition", "attachment; filename=audit.json")
+		c.JSON(http.StatusOK, events)
+	default:
+		total, err := h.Db.Collection("audit_events").CountDocuments(c, filter)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"events": events,
+			"total":  total,
+		})
+	}
+}
+
+func writeAuditCsv(w http.ResponseWriter, events []models.AuditEvent) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{
+		"id", "time", "action", "actor", "owner", "ip", "user_agent",
+		"targets", "parent_before", "parent_after", "result", "details",
+	}); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := writer.Write([]string{
+			event.Id,
+			time.UnixMilli(event.Time).UTC().Format(time.RFC3339),
+			event.Action,
+			event.Actor,
+			event.Owner,
+			event.Ip,
+			event.UserAgent,
+			strings.Join(event.Targets, " "),
+			event.ParentBefore,
+			event.ParentAfter,
+			event.Result,
+			event.Details,
+		}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
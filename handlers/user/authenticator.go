@@ -0,0 +1,73 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/helper"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// AuthBackends is comma separated list of authenticators used by Login, in order: "password", "ldap"
+var AuthBackends = helper.GetEnv("AUTH_BACKENDS", "password")
+
+// Authenticator verifies username and password in Login
+type Authenticator interface {
+	// Authenticate returns user for valid credentials and ErrInvalidCredentials for invalid ones.
+	// Other errors mean that backend couldn't verify credentials
+	Authenticate(c *gin.Context, username, password string) (*models.User, error)
+}
+
+// NewAuthenticators returns authenticators configured in AUTH_BACKENDS
+func NewAuthenticators(h *Handler) []Authenticator {
+	authenticators := make([]Authenticator, 0)
+
+	for _, backend := range strings.Split(AuthBackends, ",") {
+		switch strings.TrimSpace(backend) {
+		case "password":
+			authenticators = append(authenticators, &PasswordAuthenticator{Db: h.Db})
+		case "ldap":
+			authenticators = append(authenticators, NewLdapAuthenticator(h))
+		default:
+			log.Println("unknown authentication backend: " + backend)
+		}
+	}
+
+	return authenticators
+}
+
+// PasswordAuthenticator verifies password with argon2 hash stored in user document
+type PasswordAuthenticator struct {
+	Db *mongo.Database
+}
+
+func (a *PasswordAuthenticator) Authenticate(
+	c *gin.Context,
+	username, password string,
+) (*models.User, error) {
+	var user models.User
+
+	err := a.Db.Collection("user").FindOne(c, bson.D{{Key: "username", Value: username}}).
+		Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Users from external identity provider don't have password
+	if user.Password == "" || !crypto.ComparePasswordAndHash(password, user.Password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &user, nil
+}
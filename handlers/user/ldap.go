@@ -0,0 +1,230 @@
+package user
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+const ProviderLdap = "ldap"
+
+var (
+	LdapUrl          = helper.GetEnv("LDAP_URL", "") // ldap://host:389 or ldaps://host:636
+	LdapStartTls     = helper.GetEnv("LDAP_START_TLS", "false") == "true"
+	LdapSkipVerify   = helper.GetEnv("LDAP_INSECURE_SKIP_VERIFY", "false") == "true"
+	LdapBindDn       = helper.GetEnv("LDAP_BIND_DN", "")
+	LdapBindPassword = helper.GetEnv("LDAP_BIND_PASSWORD", "")
+	LdapBaseDn       = helper.GetEnv("LDAP_BASE_DN", "")
+	LdapUserFilter   = helper.GetEnv("LDAP_USER_FILTER", "(uid=%s)")
+	LdapIdAttribute  = helper.GetEnv("LDAP_ID_ATTRIBUTE", "entryUUID")
+	// Format: "<group dn>=><role>;<group dn>=><role>"
+	LdapGroupRoles = helper.GetEnv("LDAP_GROUP_ROLES", "")
+)
+
+// LdapAuthenticator searches user with service account, verifies password by binding as found user
+// and creates user with its directories on first login
+type LdapAuthenticator struct {
+	Url          string
+	StartTls     bool
+	TlsConfig    *tls.Config
+	BindDn       string
+	BindPassword string
+	BaseDn       string
+	UserFilter   string // must contain %s for username
+	IdAttribute  string // attribute with stable user id, DN is used if it's empty
+	GroupRoles   map[string]string
+
+	handler *Handler
+}
+
+// NewLdapAuthenticator returns authenticator configured from environment
+func NewLdapAuthenticator(h *Handler) *LdapAuthenticator {
+	return &LdapAuthenticator{
+		Url:          LdapUrl,
+		StartTls:     LdapStartTls,
+		TlsConfig:    &tls.Config{InsecureSkipVerify: LdapSkipVerify},
+		BindDn:       LdapBindDn,
+		BindPassword: LdapBindPassword,
+		BaseDn:       LdapBaseDn,
+		UserFilter:   LdapUserFilter,
+		IdAttribute:  LdapIdAttribute,
+		GroupRoles:   ParseGroupRoles(LdapGroupRoles),
+		handler:      h,
+	}
+}
+
+// ParseGroupRoles parses mapping in format "<group dn>=><role>;<group dn>=><role>"
+func ParseGroupRoles(mapping string) map[string]string {
+	groupRoles := make(map[string]string)
+
+	for _, pair := range strings.Split(mapping, ";") {
+		group, role, found := strings.Cut(pair, "=>")
+		if !found {
+			continue
+		}
+		groupRoles[strings.ToLower(strings.TrimSpace(group))] = strings.TrimSpace(role)
+	}
+
+	return groupRoles
+}
+
+func (a *LdapAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.Url, ldap.DialWithTLSConfig(a.TlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+
+	if a.StartTls {
+		if err := conn.StartTLS(a.TlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (a *LdapAuthenticator) Authenticate(
+	c *gin.Context,
+	username, password string,
+) (*models.User, error) {
+	// Bind with empty password is unauthenticated bind and always succeeds
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.BindDn != "" {
+		if err := conn.Bind(a.BindDn, a.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	attributes := []string{"memberOf"}
+	if a.IdAttribute != "" {
+		attributes = append(attributes, a.IdAttribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		10,
+		false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(username)),
+		attributes,
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	externalId := entry.DN
+	if a.IdAttribute != "" && entry.GetAttributeValue(a.IdAttribute) != "" {
+		externalId = entry.GetAttributeValue(a.IdAttribute)
+	}
+
+	user, err := a.handler.findOrCreateExternalUser(c, ProviderLdap, externalId, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a.GroupRoles) > 0 {
+		a.syncRoles(c, user, entry.GetAttributeValues("memberOf"))
+	}
+
+	return user, nil
+}
+
+// Add roles mapped from groups of user and remove roles which were mapped from groups user left.
+// Other roles (e.g. set by administrator) are kept
+func (a *LdapAuthenticator) syncRoles(c *gin.Context, user *models.User, groups []string) {
+	granted := a.mapRoles(groups)
+
+	revoked := make([]string, 0)
+	for _, role := range user.LdapRoles {
+		if !helper.ArrayContains(granted, role) {
+			revoked = append(revoked, role)
+		}
+	}
+
+	// Role which user already had from administrator stays after user leaves group
+	owned := make([]string, 0)
+	for _, role := range granted {
+		if helper.ArrayContains(user.LdapRoles, role) || !helper.ArrayContains(user.Roles, role) {
+			owned = append(owned, role)
+		}
+	}
+
+	collection := a.handler.Db.Collection("user")
+
+	// Roles can't be added and removed in one update of the same field
+	if _, err := collection.UpdateByID(c, user.Id, bson.D{
+		{Key: "$pullAll", Value: bson.M{"roles": revoked}},
+	}); err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := collection.UpdateByID(c, user.Id, bson.D{
+		{Key: "$addToSet", Value: bson.M{"roles": bson.M{"$each": granted}}},
+		{Key: "$set", Value: bson.M{"ldap_roles": owned}},
+	}); err != nil {
+		log.Println(err)
+		return
+	}
+
+	roles := make([]string, 0, len(user.Roles)+len(granted))
+	for _, role := range user.Roles {
+		if !helper.ArrayContains(revoked, role) {
+			roles = append(roles, role)
+		}
+	}
+	for _, role := range granted {
+		if !helper.ArrayContains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	user.Roles = roles
+	user.LdapRoles = owned
+}
+
+func (a *LdapAuthenticator) mapRoles(groups []string) []string {
+	roles := make([]string, 0)
+
+	for _, group := range groups {
+		role, ok := a.GroupRoles[strings.ToLower(group)]
+		if ok && !helper.ArrayContains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
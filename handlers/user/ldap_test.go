@@ -0,0 +1,339 @@
+package user
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"ncloud-api/models"
+)
+
+const (
+	ldapBaseDn     = "ou=people,dc=test"
+	ldapServiceDn  = "cn=ncloud,ou=services,dc=test"
+	ldapAdminGroup = "cn=admins,ou=groups,dc=test"
+	ldapStaffGroup = "cn=staff,ou=groups,dc=test"
+)
+
+type ldapEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+// ldapServer is in-process LDAP stand-in, it answers simple binds and searches with equality filters
+type ldapServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries map[string]*ldapEntry
+}
+
+func newLdapServer(t *testing.T) *ldapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ldapServer{
+		listener: listener,
+		entries: map[string]*ldapEntry{
+			ldapServiceDn: {password: "service"},
+		},
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *ldapServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// Add user with uid and entryUUID, or replace its password and groups
+func (s *ldapServer) setUser(uid, password string, groups ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries["uid="+uid+","+ldapBaseDn] = &ldapEntry{
+		password: password,
+		attributes: map[string][]string{
+			"uid":       {uid},
+			"entryUUID": {"uuid-" + uid},
+			"memberOf":  groups,
+		},
+	}
+}
+
+func (s *ldapServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(request.Children) < 2 {
+			return
+		}
+
+		messageId := request.Children[0].Value.(int64)
+		operation := request.Children[1]
+
+		switch operation.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := operation.Children[1].Value.(string)
+			password := operation.Children[2].Data.String()
+
+			s.mu.Lock()
+			entry, ok := s.entries[dn]
+			s.mu.Unlock()
+
+			code := ldap.LDAPResultSuccess
+			if !ok || password == "" || entry.password != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			if err := writeLdapResult(conn, messageId, ldap.ApplicationBindResponse, code); err != nil {
+				return
+			}
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(operation.Children[6])
+			if err != nil {
+				return
+			}
+			if err := s.search(conn, messageId, filter); err != nil {
+				return
+			}
+		default:
+			// Unbind and unsupported operations close connection
+			return
+		}
+	}
+}
+
+// Send entries matching filter in format "(attribute=value)"
+func (s *ldapServer) search(w io.Writer, messageId int64, filter string) error {
+	attribute, value, found := strings.Cut(strings.Trim(filter, "()"), "=")
+	if !found {
+		return errors.New("unsupported filter: " + filter)
+	}
+
+	s.mu.Lock()
+	dns := make([]string, 0)
+	for dn, entry := range s.entries {
+		for _, v := range entry.attributes[attribute] {
+			if v == value {
+				dns = append(dns, dn)
+			}
+		}
+	}
+	sort.Strings(dns)
+
+	packets := make([]*ber.Packet, 0, len(dns))
+	for _, dn := range dns {
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range s.entries[dn].attributes {
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		result.AppendChild(attributes)
+
+		packets = append(packets, result)
+	}
+	s.mu.Unlock()
+
+	for _, packet := range packets {
+		if _, err := w.Write(ldapMessage(messageId, packet).Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return writeLdapResult(w, messageId, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+}
+
+func writeLdapResult(w io.Writer, messageId int64, application ber.Tag, code int) error {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, ldap.ApplicationMap[uint8(application)])
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+
+	_, err := w.Write(ldapMessage(messageId, result).Bytes())
+	return err
+}
+
+func ldapMessage(messageId int64, operation *ber.Packet) *ber.Packet {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	message.AppendChild(operation)
+
+	return message
+}
+
+func newLdapAuthenticator(server *ldapServer, h *Handler) *LdapAuthenticator {
+	return &LdapAuthenticator{
+		Url:          server.url(),
+		BindDn:       ldapServiceDn,
+		BindPassword: "service",
+		BaseDn:       ldapBaseDn,
+		UserFilter:   "(uid=%s)",
+		IdAttribute:  "entryUUID",
+		GroupRoles:   ParseGroupRoles(ldapAdminGroup + "=>" + models.RoleAdmin + ";" + ldapStaffGroup + "=>staff"),
+		handler:      h,
+	}
+}
+
+func testContext() *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/login", nil)
+
+	return c
+}
+
+func TestLdapAuthenticateInvalidCredentials(t *testing.T) {
+	server := newLdapServer(t)
+	server.setUser("alice", "password")
+
+	// Credentials are rejected before database is used
+	authenticator := newLdapAuthenticator(server, &Handler{})
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{name: "wrong password", username: "alice", password: "wrong"},
+		{name: "empty password", username: "alice"},
+		{name: "unknown user", username: "bob", password: "password"},
+		{name: "filter injection", username: "*", password: "password"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := authenticator.Authenticate(testContext(), test.username, test.password)
+			if user != nil || err != ErrInvalidCredentials {
+				t.Fatalf("Authenticate() = %v, %v, want ErrInvalidCredentials", user, err)
+			}
+		})
+	}
+}
+
+func TestLdapAuthenticateRoles(t *testing.T) {
+	server := newLdapServer(t)
+	h := newTestHandler(t)
+	authenticator := newLdapAuthenticator(server, h)
+
+	// Roles stored in database after login
+	login := func(t *testing.T, username string) []string {
+		t.Helper()
+
+		user, err := authenticator.Authenticate(testContext(), username, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var stored models.User
+		if err := h.Db.Collection("user").FindOne(testContext(), bson.D{{Key: "_id", Value: user.Id}}).
+			Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+
+		roles := append([]string{}, stored.Roles...)
+		sort.Strings(roles)
+
+		returned := append([]string{}, user.Roles...)
+		sort.Strings(returned)
+		if strings.Join(roles, ",") != strings.Join(returned, ",") {
+			t.Fatalf("returned roles %v, stored roles %v", returned, roles)
+		}
+
+		return roles
+	}
+
+	setRoles := func(t *testing.T, username string, roles ...string) {
+		t.Helper()
+
+		if _, err := h.Db.Collection("user").UpdateOne(testContext(), bson.D{{Key: "username", Value: username}}, bson.D{
+			{Key: "$set", Value: bson.M{"roles": roles}},
+			{Key: "$unset", Value: bson.M{"ldap_roles": ""}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(t *testing.T, roles []string, expected ...string) {
+		t.Helper()
+
+		sort.Strings(expected)
+		if strings.Join(roles, ",") != strings.Join(expected, ",") {
+			t.Fatalf("roles = %v, want %v", roles, expected)
+		}
+	}
+
+	t.Run("mapped roles follow groups", func(t *testing.T) {
+		server.setUser("alice", "password", ldapAdminGroup, ldapStaffGroup, "cn=other,ou=groups,dc=test")
+		expect(t, login(t, "alice"), models.RoleAdmin, "staff")
+
+		server.setUser("alice", "password", ldapStaffGroup)
+		expect(t, login(t, "alice"), "staff")
+
+		server.setUser("alice", "password")
+		expect(t, login(t, "alice"))
+	})
+
+	t.Run("roles set by administrator are kept", func(t *testing.T) {
+		server.setUser("bob", "password")
+		login(t, "bob")
+
+		setRoles(t, "bob", models.RoleAdmin, "auditor")
+		expect(t, login(t, "bob"), models.RoleAdmin, "auditor")
+
+		// Role user already had isn't removed when user leaves group which also grants it
+		server.setUser("bob", "password", ldapAdminGroup, ldapStaffGroup)
+		expect(t, login(t, "bob"), models.RoleAdmin, "auditor", "staff")
+
+		server.setUser("bob", "password")
+		expect(t, login(t, "bob"), models.RoleAdmin, "auditor")
+	})
+
+	t.Run("create-admin role is kept", func(t *testing.T) {
+		server.setUser("carol", "password", ldapAdminGroup)
+		expect(t, login(t, "carol"), models.RoleAdmin)
+
+		if err := h.CreateAdmin(testContext(), "carol", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		server.setUser("carol", "password")
+		expect(t, login(t, "carol"), models.RoleAdmin)
+	})
+}
@@ -0,0 +1,71 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/middleware/ratelimit"
+	"ncloud-api/utils/testdb"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// Handler with empty database, test is skipped without MONGO_TEST_URI
+func newTestHandler(t *testing.T) *Handler {
+	h := &Handler{
+		Db:       testdb.Database(t),
+		SearchDb: testdb.SearchDb(),
+		Lockout:  &ratelimit.Lockout{Store: ratelimit.NewMemoryStore()},
+	}
+	h.Authenticators = []Authenticator{&PasswordAuthenticator{Db: h.Db}}
+
+	return h
+}
+
+// Send request with JSON body (if it isn't nil) and cookies to router
+func request(
+	router http.Handler,
+	method, url string,
+	body interface{},
+	cookies ...*http.Cookie,
+) *httptest.ResponseRecorder {
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			panic(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, url, &reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+// Decode JSON body of response
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+	return body
+}
@@ -0,0 +1,297 @@
+package user
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/helper"
+)
+
+var TotpIssuer = helper.GetEnv("TOTP_ISSUER", "ncloud")
+
+const recoveryCodeCount = 10
+
+func (h *Handler) findUser(c *gin.Context, userId string) (*models.User, error) {
+	var user models.User
+
+	err := h.Db.Collection("user").FindOne(c, bson.D{{Key: "_id", Value: userId}}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// EnrollTotp generates new TOTP secret for user
+//
+// Secret isn't active until it's confirmed with ConfirmTotp
+func (h *Handler) EnrollTotp(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	user, err := h.findUser(c, claims.Id)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if user.TotpEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "two-factor authentication already enabled",
+		})
+		return
+	}
+
+	secret, err := crypto.GenerateTotpSecret()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if _, err := h.Db.Collection("user").UpdateByID(
+		c,
+		user.Id,
+		bson.D{{Key: "$set", Value: bson.M{"totp_pending_secret": secret}}},
+	); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": crypto.TotpProvisioningUri(TotpIssuer, user.Username, secret),
+	})
+}
+
+// ConfirmTotp enables two-factor authentication if code matches pending secret
+// and returns recovery codes. Recovery codes are only returned once
+func (h *Handler) ConfirmTotp(c *gin.Context) {
+	type RequestData struct {
+		Code string `json:"code"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+
+	user, err := h.findUser(c, claims.Id)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if user.TotpPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "no pending enrollment",
+		})
+		return
+	}
+
+	step, valid := crypto.ValidateTotp(user.TotpPendingSecret, data.Code, time.Now())
+	if !valid {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid code",
+		})
+		return
+	}
+
+	recoveryCodes, err := crypto.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	recoveryCodeHashes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		hash, err := crypto.GenerateHash(code)
+		if err != nil {
+			log.Panic(err)
+		}
+		recoveryCodeHashes = append(recoveryCodeHashes, hash)
+	}
+
+	if _, err := h.Db.Collection("user").UpdateByID(c, user.Id, bson.D{
+		{Key: "$set", Value: bson.M{
+			"totp_enabled":   true,
+			"totp_secret":    user.TotpPendingSecret,
+			"totp_last_step": step,
+			"recovery_codes": recoveryCodeHashes,
+		}},
+		{Key: "$unset", Value: bson.M{"totp_pending_secret": ""}},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// DisableTotp requires password and current code (or recovery code)
+func (h *Handler) DisableTotp(c *gin.Context) {
+	type RequestData struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+
+	user, err := h.findUser(c, claims.Id)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if !user.TotpEnabled {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if data.Password == "" || !crypto.ComparePasswordAndHash(data.Password, user.Password) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid password",
+		})
+		return
+	}
+
+	if !h.verifySecondFactor(c, user, data.Code, data.RecoveryCode) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid code",
+		})
+		return
+	}
+
+	if _, err := h.Db.Collection("user").UpdateByID(c, user.Id, bson.D{
+		{Key: "$unset", Value: bson.M{
+			"totp_enabled":   "",
+			"totp_secret":    "",
+			"totp_last_step": "",
+			"recovery_codes": "",
+		}},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// LoginMfa exchanges challenge token from Login and valid code (or recovery code) for tokens
+func (h *Handler) LoginMfa(c *gin.Context) {
+	type RequestData struct {
+		MfaToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		Device       string `json:"device"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims, err := auth.ValidateMfaToken(data.MfaToken)
+	if err != nil {
+		c.Header("WWW-Authenticate", "invalid mfa token")
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.findUser(c, claims.Id)
+	if err != nil || !user.TotpEnabled {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	if h.respondIfLocked(c, user.Username) {
+		return
+	}
+
+	// Every challenge token allows only few attempts, then password has to be verified again
+	allowed, err := h.Lockout.RegisterMfaAttempt(c, data.MfaToken)
+	if err != nil {
+		log.Println(err)
+	}
+	if err == nil && !allowed {
+		c.Header("WWW-Authenticate", "mfa token has no attempts left")
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	if !h.verifySecondFactor(c, user, data.Code, data.RecoveryCode) {
+		h.registerLoginFailure(c, user.Username)
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid code",
+		})
+		return
+	}
+
+	if err := h.Lockout.Reset(c, user.Username); err != nil {
+		log.Println(err)
+	}
+
+	h.respondWithTokens(c, user, data.Device)
+}
+
+// Verify TOTP code or recovery code
+//
+// Code is accepted only if its time step is newer than last used one and recovery code
+// is removed after use, so neither of them can be replayed
+func (h *Handler) verifySecondFactor(c *gin.Context, user *models.User, code, recoveryCode string) bool {
+	collection := h.Db.Collection("user")
+
+	if code != "" {
+		step, valid := crypto.ValidateTotp(user.TotpSecret, code, time.Now())
+		if !valid {
+			return false
+		}
+
+		res, err := collection.UpdateOne(c,
+			bson.D{
+				{Key: "_id", Value: user.Id},
+				{Key: "totp_last_step", Value: bson.D{{Key: "$lt", Value: step}}},
+			},
+			bson.D{{Key: "$set", Value: bson.M{"totp_last_step": step}}},
+		)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+
+		return res.ModifiedCount == 1
+	}
+
+	if recoveryCode == "" {
+		return false
+	}
+
+	for _, hash := range user.RecoveryCodes {
+		if !crypto.ComparePasswordAndHash(recoveryCode, hash) {
+			continue
+		}
+
+		res, err := collection.UpdateOne(c,
+			bson.D{{Key: "_id", Value: user.Id}, {Key: "recovery_codes", Value: hash}},
+			bson.D{{Key: "$pull", Value: bson.M{"recovery_codes": hash}}},
+		)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+
+		return res.ModifiedCount == 1
+	}
+
+	return false
+}
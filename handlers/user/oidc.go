@@ -0,0 +1,210 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+	"ncloud-api/utils/oidc"
+)
+
+const ProviderOidc = "oidc"
+
+// Time user has to log in with identity provider
+const oidcStateDuration = time.Minute * 10
+
+// Cookie binding state to browser which started login, it contains SHA-256 hash of state
+const (
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/api/oidc"
+)
+
+var (
+	OidcIssuer       = helper.GetEnv("OIDC_ISSUER", "")
+	OidcClientId     = helper.GetEnv("OIDC_CLIENT_ID", "")
+	OidcClientSecret = helper.GetEnv("OIDC_CLIENT_SECRET", "")
+	OidcRedirectUrl  = helper.GetEnv("OIDC_REDIRECT_URL", "")
+	OidcScopes       = helper.GetEnv("OIDC_SCOPES", "openid profile email")
+)
+
+// NewOidcProvider returns provider configured from environment, or nil if OIDC_ISSUER isn't set
+func NewOidcProvider() *oidc.Provider {
+	if OidcIssuer == "" {
+		return nil
+	}
+
+	return &oidc.Provider{
+		Issuer:       OidcIssuer,
+		ClientId:     OidcClientId,
+		ClientSecret: OidcClientSecret,
+		RedirectUrl:  OidcRedirectUrl,
+		Scopes:       strings.Fields(OidcScopes),
+		HttpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type oidcState struct {
+	State    string    `bson:"_id"`
+	Nonce    string    `bson:"nonce"`
+	Verifier string    `bson:"verifier"`
+	Expires  time.Time `bson:"expires"`
+}
+
+func CreateOidcIndexes(db *mongo.Database) error {
+	_, err := db.Collection("oidc_states").Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+
+	return err
+}
+
+// OidcLogin starts authorization code flow and returns URL of identity provider login page
+//
+// State, nonce and PKCE verifier are stored in database and used once in OidcCallback.
+// Hash of state is also set in cookie, so callback is accepted only from browser which started login
+func (h *Handler) OidcLogin(c *gin.Context) {
+	state, err := oidc.GenerateRandomString()
+	if err != nil {
+		log.Panic(err)
+	}
+	nonce, err := oidc.GenerateRandomString()
+	if err != nil {
+		log.Panic(err)
+	}
+	verifier, err := oidc.GenerateRandomString()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	authorizationUrl, err := h.Oidc.AuthCodeUrl(c, state, nonce, verifier)
+	if err != nil {
+		log.Println(err)
+		c.Status(http.StatusBadGateway)
+		return
+	}
+
+	if _, err := h.Db.Collection("oidc_states").InsertOne(c, oidcState{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Expires:  time.Now().Add(oidcStateDuration),
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	setOidcStateCookie(c, auth.HashToken(state), int(oidcStateDuration.Seconds()))
+
+	c.JSON(http.StatusOK, gin.H{
+		"authorization_url": authorizationUrl,
+	})
+}
+
+// OidcCallback exchanges code from identity provider for tokens
+//
+// code and state are accepted from query (redirect) or JSON body.
+// User is created with Main and Trash directories on first login
+func (h *Handler) OidcCallback(c *gin.Context) {
+	type RequestData struct {
+		Code   string `json:"code"   form:"code"`
+		State  string `json:"state"  form:"state"`
+		Device string `json:"device" form:"device"`
+	}
+
+	var data RequestData
+	if err := c.ShouldBind(&data); err != nil || data.Code == "" || data.State == "" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	// Without cookie from OidcLogin, code could be from login of attacker (login CSRF)
+	cookie, err := c.Cookie(oidcStateCookie)
+	setOidcStateCookie(c, "", -1)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(auth.HashToken(data.State))) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid state",
+		})
+		return
+	}
+
+	// State can be used only once
+	var state oidcState
+	err = h.Db.Collection("oidc_states").FindOneAndDelete(c, bson.D{
+		{Key: "_id", Value: data.State},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}).Decode(&state)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid state",
+		})
+		return
+	}
+
+	claims, err := h.Oidc.Exchange(c, data.Code, state.Verifier, state.Nonce)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "couldn't verify identity",
+		})
+		return
+	}
+
+	user, err := h.findOrCreateExternalUser(c, ProviderOidc, claims.Subject, claims.Username())
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "user already exists",
+		})
+		return
+	}
+
+	h.completeLogin(c, user, data.Device)
+}
+
+// Cookie is sent with redirect from identity provider (SameSite=Lax), but it isn't readable by scripts
+func setOidcStateCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, oidcStateCookiePath, "", strings.HasPrefix(OidcRedirectUrl, "https://"), true)
+}
+
+// Find user authenticated by external identity provider, or create it with its directories (just-in-time provisioning)
+func (h *Handler) findOrCreateExternalUser(
+	c *gin.Context,
+	provider, externalId, username string,
+) (*models.User, error) {
+	var user models.User
+
+	err := h.Db.Collection("user").FindOne(c, bson.D{
+		{Key: "provider", Value: provider},
+		{Key: "external_id", Value: externalId},
+	}).Decode(&user)
+	if err == nil {
+		return &user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	user = models.User{
+		Username:   username,
+		Provider:   provider,
+		ExternalId: externalId,
+	}
+
+	if err := h.CreateUser(c, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,204 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/utils/oidc/oidctest"
+)
+
+func oidcRouter(h *Handler) *gin.Engine {
+	router := gin.New()
+	router.GET("/api/oidc/login", h.OidcLogin)
+	router.POST("/api/oidc/callback", h.OidcCallback)
+
+	return router
+}
+
+// Start login and return authorization URL with state cookie
+func startOidcLogin(t *testing.T, router *gin.Engine) (string, *http.Cookie) {
+	t.Helper()
+
+	w := request(router, http.MethodGet, "/api/oidc/login", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name != oidcStateCookie {
+			continue
+		}
+		if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != oidcStateCookiePath {
+			t.Fatalf("state cookie isn't HttpOnly and SameSite: %+v", cookie)
+		}
+		return decode(t, w)["authorization_url"].(string), cookie
+	}
+
+	t.Fatal("login didn't set state cookie")
+	return "", nil
+}
+
+func callback(t *testing.T, router *gin.Engine, code, state string, cookie *http.Cookie) (int, map[string]interface{}) {
+	t.Helper()
+
+	var cookies []*http.Cookie
+	if cookie != nil {
+		cookies = append(cookies, cookie)
+	}
+
+	w := request(router, http.MethodPost, "/api/oidc/callback", gin.H{"code": code, "state": state}, cookies...)
+
+	var body map[string]interface{}
+	if w.Body.Len() > 0 {
+		body = decode(t, w)
+	}
+	return w.Code, body
+}
+
+func TestOidcCallbackWithoutStateCookie(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	// State is checked against cookie before database is used
+	router := oidcRouter(&Handler{Oidc: server.Provider()})
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{name: "without cookie"},
+		{name: "cookie of other state", cookie: &http.Cookie{Name: oidcStateCookie, Value: auth.HashToken("other")}},
+		{name: "state in cookie", cookie: &http.Cookie{Name: oidcStateCookie, Value: "state"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := callback(t, router, "code", "state", test.cookie)
+			if status != http.StatusForbidden || body["error"] != "invalid state" {
+				t.Fatalf("status = %d, body %v, want 403 invalid state", status, body)
+			}
+		})
+	}
+}
+
+func TestOidcLogin(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	h := newTestHandler(t)
+	h.Oidc = server.Provider()
+	router := oidcRouter(h)
+
+	authorizationUrl, cookie := startOidcLogin(t, router)
+	code, state, err := server.Authorize(authorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := callback(t, router, code, state, cookie)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body %v", status, body)
+	}
+	if accessToken, _ := body["access_token"].(string); body["username"] != server.Username || accessToken == "" {
+		t.Fatalf("body = %v, want tokens of %s", body, server.Username)
+	}
+
+	// Second login finds user created by first one
+	authorizationUrl, cookie = startOidcLogin(t, router)
+	code, state, err = server.Authorize(authorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := callback(t, router, code, state, cookie); status != http.StatusOK {
+		t.Fatalf("second login status = %d, body %v", status, body)
+	}
+}
+
+func TestOidcCallbackRejected(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	h := newTestHandler(t)
+	h.Oidc = server.Provider()
+	router := oidcRouter(h)
+
+	t.Run("bad state", func(t *testing.T) {
+		authorizationUrl, _ := startOidcLogin(t, router)
+		_, otherCookie := startOidcLogin(t, router)
+
+		code, state, err := server.Authorize(authorizationUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status, body := callback(t, router, code, state, otherCookie); status != http.StatusForbidden {
+			t.Fatalf("status = %d, body %v, want 403", status, body)
+		}
+		if status, body := callback(t, router, code, "unknown", &http.Cookie{
+			Name:  oidcStateCookie,
+			Value: auth.HashToken("unknown"),
+		}); status != http.StatusForbidden || body["error"] != "invalid state" {
+			t.Fatalf("status = %d, body %v, want 403 for unknown state", status, body)
+		}
+	})
+
+	t.Run("reused state", func(t *testing.T) {
+		authorizationUrl, cookie := startOidcLogin(t, router)
+
+		code, state, err := server.Authorize(authorizationUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, body := callback(t, router, code, state, cookie); status != http.StatusOK {
+			t.Fatalf("status = %d, body %v", status, body)
+		}
+
+		code, state, err = server.Authorize(authorizationUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, body := callback(t, router, code, state, cookie); status != http.StatusForbidden ||
+			body["error"] != "invalid state" {
+			t.Fatalf("status = %d, body %v, want 403 invalid state", status, body)
+		}
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		server.Nonce = "other nonce"
+		defer func() { server.Nonce = "" }()
+
+		authorizationUrl, cookie := startOidcLogin(t, router)
+		code, state, err := server.Authorize(authorizationUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status, body := callback(t, router, code, state, cookie); status != http.StatusForbidden ||
+			body["error"] != "couldn't verify identity" {
+			t.Fatalf("status = %d, body %v, want 403 couldn't verify identity", status, body)
+		}
+	})
+
+	t.Run("PKCE verifier mismatch", func(t *testing.T) {
+		// Code issued for other login (e.g. injected by attacker) is exchanged with verifier of this one
+		authorizationUrl, cookie := startOidcLogin(t, router)
+		otherUrl, _ := startOidcLogin(t, router)
+
+		_, state, err := server.Authorize(authorizationUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherCode, _, err := server.Authorize(otherUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status, body := callback(t, router, otherCode, state, cookie); status != http.StatusForbidden ||
+			body["error"] != "couldn't verify identity" {
+			t.Fatalf("status = %d, body %v, want 403 couldn't verify identity", status, body)
+		}
+	})
+}
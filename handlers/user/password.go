@@ -0,0 +1,307 @@
+package user
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/helper"
+)
+
+var (
+	PasswordResetUrl     = helper.GetEnv("PASSWORD_RESET_URL", "https://ncloudapp.com/reset-password?token=")
+	EmailVerificationUrl = helper.GetEnv("EMAIL_VERIFICATION_URL", "https://ncloudapp.com/verify-email?token=")
+)
+
+const (
+	passwordResetDuration     = time.Hour
+	emailVerificationDuration = time.Hour * 24
+	minPasswordLength         = 5
+)
+
+func isValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// Create single-use token of type for user, only its hash is stored
+func (h *Handler) createUserToken(
+	ctx context.Context,
+	userId, tokenType, email string,
+	duration time.Duration,
+) (string, error) {
+	token, err := auth.GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	// Previous tokens of the same type are no longer valid
+	if _, err := h.Db.Collection("user_tokens").DeleteMany(ctx, bson.D{
+		{Key: "user", Value: userId},
+		{Key: "type", Value: tokenType},
+	}); err != nil {
+		return "", err
+	}
+
+	if _, err := h.Db.Collection("user_tokens").InsertOne(ctx, models.UserToken{
+		TokenHash: auth.HashToken(token),
+		User:      userId,
+		Type:      tokenType,
+		Email:     email,
+		Expires:   time.Now().Add(duration),
+	}); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Find and remove token, so it can't be used again
+func (h *Handler) consumeUserToken(
+	ctx context.Context,
+	token, tokenType string,
+) (*models.UserToken, error) {
+	var userToken models.UserToken
+
+	err := h.Db.Collection("user_tokens").FindOneAndDelete(ctx, bson.D{
+		{Key: "_id", Value: auth.HashToken(token)},
+		{Key: "type", Value: tokenType},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}).Decode(&userToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userToken, nil
+}
+
+func (h *Handler) sendVerificationEmail(ctx context.Context, userId, email string) {
+	token, err := h.createUserToken(ctx, userId, models.UserTokenEmailVerification, email, emailVerificationDuration)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	body := "Confirm your email address by opening this link:\n\n" + EmailVerificationUrl + token +
+		"\n\nThe link expires in 24 hours."
+
+	if err := h.Mailer.Send(email, "Verify your email address", body); err != nil {
+		log.Println(err)
+	}
+}
+
+// Update password and revoke credentials of user, only keepSession stays valid
+func (h *Handler) setPassword(ctx context.Context, userId, password, keepSession string) error {
+	passwordHash, err := crypto.GenerateHash(password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.Db.Collection("user").UpdateByID(
+		ctx,
+		userId,
+		bson.D{{Key: "$set", Value: bson.M{"password": passwordHash}}},
+	); err != nil {
+		return err
+	}
+
+	h.revokeCredentials(ctx, userId, keepSession)
+
+	return nil
+}
+
+// ChangePassword requires current password, all other sessions, personal access tokens
+// and S3 credentials of user are revoked
+func (h *Handler) ChangePassword(c *gin.Context) {
+	type RequestData struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if len(data.NewPassword) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+
+	user, err := h.findUser(c, claims.Id)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if user.Password == "" || !crypto.ComparePasswordAndHash(data.CurrentPassword, user.Password) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid password",
+		})
+		return
+	}
+
+	if err := h.setPassword(c, user.Id, data.NewPassword, claims.Session); err != nil {
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RequestPasswordReset sends reset link to verified email of user
+//
+// Response is always the same, so it can't be used to check which emails are registered
+func (h *Handler) RequestPasswordReset(c *gin.Context) {
+	type RequestData struct {
+		Email string `json:"email"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	var user models.User
+	err := h.Db.Collection("user").FindOne(c, bson.D{
+		{Key: "email", Value: data.Email},
+		{Key: "email_verified", Value: true},
+	}).Decode(&user)
+	if err != nil || user.Provider != "" {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	token, err := h.createUserToken(c, user.Id, models.UserTokenPasswordReset, "", passwordResetDuration)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	body := "Someone requested password reset for your account " + user.Username + ".\n\n" +
+		"Set new password by opening this link:\n\n" + PasswordResetUrl + token +
+		"\n\nThe link expires in 1 hour. If you didn't request it, ignore this message."
+
+	if err := h.Mailer.Send(user.Email, "Reset your password", body); err != nil {
+		log.Println(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ResetPassword sets new password with token from email, all sessions, personal access tokens
+// and S3 credentials of user are revoked
+func (h *Handler) ResetPassword(c *gin.Context) {
+	type RequestData struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if len(data.Password) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	userToken, err := h.consumeUserToken(c, data.Token, models.UserTokenPasswordReset)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid or expired token",
+		})
+		return
+	}
+
+	if err := h.setPassword(c, userToken.User, data.Password, ""); err != nil {
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ChangeEmail sets new (unverified) email and sends verification link to it
+func (h *Handler) ChangeEmail(c *gin.Context) {
+	type RequestData struct {
+		Email string `json:"email"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if !isValidEmail(data.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid email",
+		})
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+
+	if _, err := h.Db.Collection("user").UpdateByID(c, claims.Id, bson.D{
+		{Key: "$set", Value: bson.M{"email": data.Email}},
+		{Key: "$unset", Value: bson.M{"email_verified": ""}},
+	}); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "email already used",
+		})
+		return
+	}
+
+	h.sendVerificationEmail(c, claims.Id, data.Email)
+
+	c.Status(http.StatusNoContent)
+}
+
+// VerifyEmail marks email as verified, if it wasn't changed after token was sent
+func (h *Handler) VerifyEmail(c *gin.Context) {
+	type RequestData struct {
+		Token string `json:"token"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	userToken, err := h.consumeUserToken(c, data.Token, models.UserTokenEmailVerification)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid or expired token",
+		})
+		return
+	}
+
+	res, err := h.Db.Collection("user").UpdateOne(c,
+		bson.D{{Key: "_id", Value: userToken.User}, {Key: "email", Value: userToken.Email}},
+		bson.D{{Key: "$set", Value: bson.M{"email_verified": true}}},
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "email was changed",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
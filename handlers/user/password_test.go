@@ -0,0 +1,303 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/mailer"
+	"ncloud-api/utils/mailer/mailertest"
+)
+
+// Handler sending mail to SMTP sink, with routes of password and email flows
+func newMailTestRouter(t *testing.T) (*Handler, *mailertest.Server, *gin.Engine) {
+	sink, err := mailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+
+	h := newTestHandler(t)
+	h.Mailer = &mailer.SmtpMailer{Address: sink.Addr(), From: "ncloud <no-reply@ncloud.test>"}
+
+	router := gin.New()
+	router.POST("/api/register", h.Register)
+	router.POST("/api/login", h.Login)
+	router.POST("/api/password/reset/request", h.RequestPasswordReset)
+	router.POST("/api/password/reset", h.ResetPassword)
+	router.POST("/api/email/verify", h.VerifyEmail)
+
+	authorized := router.Group("/")
+	authorized.Use(auth.Auth(h.Db))
+	authorized.POST("/api/users/password", h.ChangePassword)
+	authorized.POST("/api/users/email", h.ChangeEmail)
+	authorized.POST("/api/tokens", h.CreateAccessToken)
+	authorized.POST("/api/s3/credentials", h.CreateS3Credential)
+
+	return h, sink, router
+}
+
+// Send request authorized with access token
+func authorizedRequest(
+	router http.Handler,
+	method, url, accessToken string,
+	body interface{},
+) *httptest.ResponseRecorder {
+	authorized := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+		router.ServeHTTP(w, r)
+	})
+
+	return request(authorized, method, url, body)
+}
+
+func register(t *testing.T, router http.Handler, username, password, email string) {
+	t.Helper()
+
+	w := request(router, http.MethodPost, "/api/register", gin.H{
+		"username": username,
+		"password": password,
+		"email":    email,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register status = %d, body %s", w.Code, w.Body.String())
+	}
+}
+
+// Log in and return access token, or empty string if login failed
+func login(t *testing.T, router http.Handler, username, password string) string {
+	t.Helper()
+
+	w := request(router, http.MethodPost, "/api/login", gin.H{"username": username, "password": password})
+	if w.Code != http.StatusOK {
+		return ""
+	}
+
+	accessToken, _ := decode(t, w)["access_token"].(string)
+	return accessToken
+}
+
+// Return token from link in last message received by sink, message must be sent to address with subject
+func tokenFromMail(t *testing.T, sink *mailertest.Server, to, subject, url string) string {
+	t.Helper()
+
+	messages := sink.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no message was sent")
+	}
+	message := messages[len(messages)-1]
+
+	if len(message.To) != 1 || message.To[0] != to {
+		t.Fatalf("message was sent to %v, want %s", message.To, to)
+	}
+
+	parsed, body, err := message.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.Get("Subject") != subject {
+		t.Fatalf("subject = %q, want %q", parsed.Header.Get("Subject"), subject)
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, url) {
+			return strings.TrimPrefix(line, url)
+		}
+	}
+
+	t.Fatalf("message doesn't contain link %s: %s", url, body)
+	return ""
+}
+
+func count(t *testing.T, h *Handler, collection, userId string) int64 {
+	t.Helper()
+
+	n, err := h.Db.Collection(collection).CountDocuments(testContext(), bson.D{{Key: "user", Value: userId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func findUserByUsername(t *testing.T, h *Handler, username string) models.User {
+	t.Helper()
+
+	var user models.User
+	if err := h.Db.Collection("user").FindOne(testContext(), bson.D{{Key: "username", Value: username}}).
+		Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Create personal access token and S3 credential, they must be revoked with sessions
+func createCredentials(t *testing.T, router http.Handler, accessToken string) {
+	t.Helper()
+
+	for _, url := range []string{"/api/tokens", "/api/s3/credentials"} {
+		w := authorizedRequest(router, http.MethodPost, url, accessToken, gin.H{"name": "test", "scope": "read"})
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("POST %s status = %d, body %s", url, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	h, sink, router := newMailTestRouter(t)
+
+	register(t, router, "alice", "password", "alice@ncloud.test")
+	token := tokenFromMail(t, sink, "alice@ncloud.test", "Verify your email address", EmailVerificationUrl)
+
+	if w := request(router, http.MethodPost, "/api/email/verify", gin.H{"token": token}); w.Code != http.StatusNoContent {
+		t.Fatalf("verify status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	accessToken := login(t, router, "alice", "password")
+	if accessToken == "" || login(t, router, "alice", "password") == "" {
+		t.Fatal("login failed")
+	}
+	createCredentials(t, router, accessToken)
+
+	user := findUserByUsername(t, h, "alice")
+
+	// Reset isn't sent to unknown address, response is the same
+	sent := len(sink.Messages())
+	if w := request(router, http.MethodPost, "/api/password/reset/request", gin.H{
+		"email": "unknown@ncloud.test",
+	}); w.Code != http.StatusNoContent || len(sink.Messages()) != sent {
+		t.Fatalf("reset of unknown email status = %d, messages %d", w.Code, len(sink.Messages()))
+	}
+
+	if w := request(router, http.MethodPost, "/api/password/reset/request", gin.H{
+		"email": "alice@ncloud.test",
+	}); w.Code != http.StatusNoContent {
+		t.Fatalf("reset request status = %d", w.Code)
+	}
+	token = tokenFromMail(t, sink, "alice@ncloud.test", "Reset your password", PasswordResetUrl)
+
+	if w := request(router, http.MethodPost, "/api/password/reset", gin.H{
+		"token":    token,
+		"password": "new password",
+	}); w.Code != http.StatusNoContent {
+		t.Fatalf("reset status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	for _, collection := range []string{"sessions", "access_tokens", "s3_credentials"} {
+		if n := count(t, h, collection, user.Id); n != 0 {
+			t.Errorf("%d %s weren't revoked", n, collection)
+		}
+	}
+
+	// Token can be used only once
+	if w := request(router, http.MethodPost, "/api/password/reset", gin.H{
+		"token":    token,
+		"password": "other password",
+	}); w.Code != http.StatusForbidden {
+		t.Fatalf("reused token status = %d, want 403", w.Code)
+	}
+
+	if login(t, router, "alice", "password") != "" {
+		t.Fatal("login with old password succeeded")
+	}
+	if login(t, router, "alice", "new password") == "" {
+		t.Fatal("login with new password failed")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	h, _, router := newMailTestRouter(t)
+
+	register(t, router, "bob", "password", "")
+	accessToken := login(t, router, "bob", "password")
+	otherAccessToken := login(t, router, "bob", "password")
+	if accessToken == "" || otherAccessToken == "" {
+		t.Fatal("login failed")
+	}
+	createCredentials(t, router, accessToken)
+
+	user := findUserByUsername(t, h, "bob")
+
+	if w := authorizedRequest(router, http.MethodPost, "/api/users/password", accessToken, gin.H{
+		"current_password": "wrong",
+		"new_password":     "new password",
+	}); w.Code != http.StatusForbidden {
+		t.Fatalf("change with wrong password status = %d, want 403", w.Code)
+	}
+
+	if w := authorizedRequest(router, http.MethodPost, "/api/users/password", accessToken, gin.H{
+		"current_password": "password",
+		"new_password":     "new password",
+	}); w.Code != http.StatusNoContent {
+		t.Fatalf("change status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	// Only session which changed password stays
+	if n := count(t, h, "sessions", user.Id); n != 1 {
+		t.Errorf("%d sessions left, want 1", n)
+	}
+	for _, collection := range []string{"access_tokens", "s3_credentials"} {
+		if n := count(t, h, collection, user.Id); n != 0 {
+			t.Errorf("%d %s weren't revoked", n, collection)
+		}
+	}
+
+	// Access token of revoked session is rejected before it expires
+	if w := authorizedRequest(router, http.MethodPost, "/api/tokens", otherAccessToken, gin.H{
+		"name": "app", "scope": "read",
+	}); w.Code != http.StatusUnauthorized {
+		t.Errorf("request with access token of revoked session status = %d, want 401", w.Code)
+	}
+
+	if login(t, router, "bob", "new password") == "" {
+		t.Fatal("login with new password failed")
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	h, sink, router := newMailTestRouter(t)
+
+	register(t, router, "carol", "password", "")
+	accessToken := login(t, router, "carol", "password")
+	if accessToken == "" {
+		t.Fatal("login failed")
+	}
+
+	if w := authorizedRequest(router, http.MethodPost, "/api/users/email", accessToken, gin.H{
+		"email": "first@ncloud.test",
+	}); w.Code != http.StatusNoContent {
+		t.Fatalf("change email status = %d, body %s", w.Code, w.Body.String())
+	}
+	first := tokenFromMail(t, sink, "first@ncloud.test", "Verify your email address", EmailVerificationUrl)
+
+	if w := authorizedRequest(router, http.MethodPost, "/api/users/email", accessToken, gin.H{
+		"email": "second@ncloud.test",
+	}); w.Code != http.StatusNoContent {
+		t.Fatalf("change email status = %d, body %s", w.Code, w.Body.String())
+	}
+	second := tokenFromMail(t, sink, "second@ncloud.test", "Verify your email address", EmailVerificationUrl)
+
+	// Link sent to previous address can't verify current one
+	if w := request(router, http.MethodPost, "/api/email/verify", gin.H{"token": first}); w.Code == http.StatusNoContent {
+		t.Fatal("token of previous email was accepted")
+	}
+	if user := findUserByUsername(t, h, "carol"); user.EmailVerified {
+		t.Fatal("email was verified with token of previous email")
+	}
+
+	if w := request(router, http.MethodPost, "/api/email/verify", gin.H{"token": second}); w.Code != http.StatusNoContent {
+		t.Fatalf("verify status = %d, body %s", w.Code, w.Body.String())
+	}
+	if user := findUserByUsername(t, h, "carol"); !user.EmailVerified || user.Email != "second@ncloud.test" {
+		t.Fatalf("email %s verified %v", user.Email, user.EmailVerified)
+	}
+
+	if w := request(router, http.MethodPost, "/api/email/verify", gin.H{"token": second}); w.Code != http.StatusForbidden {
+		t.Fatalf("reused token status = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package user
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+// CreateS3Credential creates access key pair of S3-compatible API
+//
+// Secret access key is returned only once
+func (h *Handler) CreateS3Credential(c *gin.Context) {
+	type RequestData struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+	if rejectPersonalAccessToken(c, claims) {
+		return
+	}
+
+	accessKeyId, secret, err := auth.GenerateS3Credentials()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	credential := models.S3Credential{
+		Id:      accessKeyId,
+		User:    claims.Id,
+		Name:    data.Name,
+		Secret:  secret,
+		Scope:   data.Scope,
+		Created: time.Now().UnixMilli(),
+	}
+
+	if err := credential.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if _, err := h.Db.Collection("s3_credentials").InsertOne(c, credential); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"access_key_id":     credential.Id,
+		"secret_access_key": secret,
+		"credential":        credential,
+	})
+}
+
+func (h *Handler) GetS3Credentials(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+	if rejectPersonalAccessToken(c, claims) {
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+
+	credentials, err := models.FindS3CredentialsByFilter(
+		h.Db,
+		bson.D{{Key: "user", Value: claims.Id}},
+		opts,
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+func (h *Handler) DeleteS3Credential(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+	if rejectPersonalAccessToken(c, claims) {
+		return
+	}
+
+	res, err := h.Db.Collection("s3_credentials").DeleteOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: claims.Id},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.DeletedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
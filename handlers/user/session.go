@@ -0,0 +1,210 @@
+package user
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+)
+
+// Number of rotated refresh tokens kept in session to detect their reuse
+const previousTokenHashes = 10
+
+// IssueTokens creates new session for user and returns its access and refresh token
+//
+// It should be used by every login method after user is authenticated
+func IssueTokens(
+	c *gin.Context,
+	db *mongo.Database,
+	userId string,
+	device string,
+) (accessToken, refreshToken string, err error) {
+	sessionId := uuid.New().String()
+
+	accessToken, refreshToken, err = auth.GenerateTokens(userId, sessionId)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+
+	session := models.Session{
+		Id:                  sessionId,
+		User:                userId,
+		TokenHash:           auth.HashToken(refreshToken),
+		PreviousTokenHashes: []string{},
+		Device:              device,
+		Ip:                  c.ClientIP(),
+		UserAgent:           c.Request.UserAgent(),
+		Created:             now.UnixMilli(),
+		LastUsed:            now.UnixMilli(),
+		Expires:             now.Add(auth.RefreshTokenDuration).UnixMilli(),
+	}
+
+	collection := db.Collection("sessions")
+
+	// Remove expired sessions of user, so they don't pile up
+	if _, err := collection.DeleteMany(c, bson.D{
+		{Key: "user", Value: userId},
+		{Key: "expires", Value: bson.D{{Key: "$lt", Value: now.UnixMilli()}}},
+	}); err != nil {
+		log.Println(err)
+	}
+
+	if _, err = collection.InsertOne(c, session); err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// RefreshToken rotates refresh token from Authorization header
+//
+// Every refresh token can be used only once. If already rotated token is used again,
+// whole session is revoked, because token was most likely stolen
+func (h *Handler) RefreshToken(c *gin.Context) {
+	token := c.GetHeader("Authorization")
+
+	if len(token) < len("Bearer ") {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	token = token[len("Bearer "):]
+	tokenHash := auth.HashToken(token)
+
+	collection := h.Db.Collection("sessions")
+	now := time.Now()
+
+	newRefreshToken, err := auth.GenerateRandomToken()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	filter := bson.D{
+		{Key: "token_hash", Value: tokenHash},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: now.UnixMilli()}}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "token_hash", Value: auth.HashToken(newRefreshToken)},
+			{Key: "last_used", Value: now.UnixMilli()},
+			{Key: "expires", Value: now.Add(auth.RefreshTokenDuration).UnixMilli()},
+			{Key: "ip", Value: c.ClientIP()},
+			{Key: "user_agent", Value: c.Request.UserAgent()},
+		}},
+		{Key: "$push", Value: bson.D{{Key: "previous_token_hashes", Value: bson.D{
+			{Key: "$each", Value: bson.A{tokenHash}},
+			{Key: "$slice", Value: -previousTokenHashes},
+		}}}},
+	}
+
+	var session models.Session
+	err = collection.FindOneAndUpdate(c, filter, update).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		// Check if token was already rotated
+		res, err := collection.DeleteOne(c, bson.D{{Key: "previous_token_hashes", Value: tokenHash}})
+		if err != nil {
+			log.Println(err)
+		}
+		if res != nil && res.DeletedCount > 0 {
+			log.Println("refresh token reuse detected, session revoked")
+		}
+
+		c.Header("WWW-Authenticate", "invalid refresh token")
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	accessToken, _, err := auth.GenerateTokens(session.User, session.Id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":     accessToken,
+		"refresh_token":    newRefreshToken,
+		"trash_access_key": h.trashAccessKey(c, session.User),
+	})
+}
+
+// GetSessions returns active sessions of user
+func (h *Handler) GetSessions(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	filter := bson.D{
+		{Key: "user", Value: claims.Id},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now().UnixMilli()}}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "last_used", Value: -1}})
+
+	sessions, err := models.FindSessionsByFilter(h.Db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for idx := range sessions {
+		sessions[idx].Current = sessions[idx].Id == claims.Session
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// DeleteSession revokes single session of user
+func (h *Handler) DeleteSession(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	res, err := h.Db.Collection("sessions").DeleteOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: claims.Id},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if res.DeletedCount == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Logout revokes session of access token used in request
+func (h *Handler) Logout(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	if _, err := h.Db.Collection("sessions").DeleteOne(c, bson.D{
+		{Key: "_id", Value: claims.Session},
+		{Key: "user", Value: claims.Id},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// LogoutAll revokes every session of user
+func (h *Handler) LogoutAll(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	res, err := h.Db.Collection("sessions").
+		DeleteMany(c, bson.D{{Key: "user", Value: claims.Id}})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deleted": res.DeletedCount,
+	})
+}
@@ -3,8 +3,10 @@ package user
 import (
 	"context"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -15,14 +17,25 @@ import (
 	"gopkg.in/validator.v2"
 
 	"ncloud-api/config"
+	"ncloud-api/handlers/groups"
+	"ncloud-api/handlers/search"
+	"ncloud-api/middleware/audit"
 	"ncloud-api/middleware/auth"
+	"ncloud-api/middleware/ratelimit"
 	"ncloud-api/models"
 	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/mailer"
+	"ncloud-api/utils/oidc"
 )
 
 type Handler struct {
 	Db       *mongo.Database
 	SearchDb *meilisearch.Client
+	Lockout  *ratelimit.Lockout
+	Oidc     *oidc.Provider
+	Mailer   mailer.Mailer
+
+	Authenticators []Authenticator
 }
 
 type SearchDatabaseData struct {
@@ -39,13 +52,69 @@ func (h *Handler) Register(c *gin.Context) {
 		return
 	}
 
+	if err := validator.Validate(user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	if user.Email != "" && !isValidEmail(user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid email",
+		})
+		return
+	}
+
+	// hash password
+	passwordHash, err := crypto.GenerateHash(user.Password)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println("Error while creating password hash")
+		return
+	}
+
+	user.Password = passwordHash
+	user.Provider = ""
+	user.Roles = nil
+	user.EmailVerified = false
+	user.Suspended = false
+	user.Quota = 0
+
+	if err := h.CreateUser(c, &user); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "user already exists",
+		})
+		return
+	}
+
+	if user.Email != "" {
+		h.sendVerificationEmail(c, user.Id, user.Email)
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionRegister,
+		Actor:   user.Id,
+		Targets: []string{user.Id},
+		Details: user.Username,
+	})
+
+	// Remove password so it won't be included in response
+	user.Password = ""
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// CreateUser inserts user with new id and creates its Main and Trash directories
+//
+// Password must already be hashed (or empty for users from external identity providers).
+// Error is only returned if user couldn't be inserted (e.g. username already exists)
+func (h *Handler) CreateUser(ctx context.Context, user *models.User) error {
 	userId, _ := uuid.NewUUID()
 	user.Id = userId.String()
 
-	permissions := []string{auth.PermissionRead, auth.PermissionUpload}
-
 	mainId, _ := uuid.NewUUID()
-	accessKey, _ := auth.GenerateDirectoryAccessKey(mainId.String(), permissions)
+	accessKey, _ := auth.GenerateDirectoryAccessKey(mainId.String(), user.Id, auth.AllDirectoryPermissions, 0)
 	mainDir := models.Directory{
 		Name:      "Main",
 		User:      userId.String(),
@@ -54,7 +123,7 @@ func (h *Handler) Register(c *gin.Context) {
 	}
 
 	trashId, _ := uuid.NewUUID()
-	trashAccessKey, _ := auth.GenerateDirectoryAccessKey(trashId.String(), permissions)
+	trashAccessKey, _ := auth.GenerateDirectoryAccessKey(trashId.String(), user.Id, auth.AllDirectoryPermissions, 0)
 	trashDir := models.Directory{
 		Name:      "Trash",
 		User:      userId.String(),
@@ -64,38 +133,17 @@ func (h *Handler) Register(c *gin.Context) {
 
 	user.TrashAccessKey = trashAccessKey
 
-	if err := validator.Validate(user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Error in validation",
-		})
-		return
-	}
-
 	// Insert to DB
 	collection := h.Db.Collection("user")
 
-	// hash password
-	passwordHash, err := crypto.GenerateHash(user.Password)
-	if err != nil {
-		c.Status(http.StatusInternalServerError)
-		log.Println("Error while creating password hash")
-		return
-	}
-
-	user.Password = passwordHash
-
-	_, err = collection.InsertOne(c, user.ToBSON())
-	if err != nil {
-		c.JSON(http.StatusConflict, gin.H{
-			"error": "user already exists",
-		})
-		return
+	if _, err := collection.InsertOne(ctx, user.ToBSON()); err != nil {
+		return err
 	}
 
 	collection = h.Db.Collection("directories")
 
 	_, _ = collection.InsertMany(
-		c,
+		ctx,
 		models.DirectoriesToBsonNotEmpty([]models.Directory{mainDir, trashDir}),
 	)
 
@@ -107,11 +155,8 @@ func (h *Handler) Register(c *gin.Context) {
 		log.Println(err)
 	}
 
-	// Remove password so it won't be included in response
-	user.Password = ""
-
 	// Add to search database
-	if _, err := h.SearchDb.Index("directories").AddDocuments(&SearchDatabaseData{
+	if err := search.InsertDocuments(h.SearchDb, "directories", &SearchDatabaseData{
 		Id:   mainId.String(),
 		Name: "Main",
 		User: userId.String(),
@@ -119,7 +164,7 @@ func (h *Handler) Register(c *gin.Context) {
 		log.Println(err)
 	}
 
-	if _, err := h.SearchDb.Index("directories").AddDocuments(&SearchDatabaseData{
+	if err := search.InsertDocuments(h.SearchDb, "directories", &SearchDatabaseData{
 		Id:   trashId.String(),
 		Name: "Trash",
 		User: userId.String(),
@@ -127,13 +172,14 @@ func (h *Handler) Register(c *gin.Context) {
 		log.Println(err)
 	}
 
-	c.JSON(http.StatusCreated, user)
+	return nil
 }
 
 func (h *Handler) Login(c *gin.Context) {
 	type RequestData struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Device   string `json:"device"`
 	}
 
 	var data RequestData
@@ -148,61 +194,158 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	var result bson.M
+	// Check lock before comparing password, so locked account can't be used for password guessing
+	if h.respondIfLocked(c, data.Username) {
+		return
+	}
 
-	collection := h.Db.Collection("user")
-	err := collection.FindOne(c, bson.D{{Key: "username", Value: data.Username}}).
-		Decode(&result)
-	if err != nil {
-		log.Println(err)
+	user := h.authenticate(c, data.Username, data.Password)
+	if user == nil {
+		h.registerLoginFailure(c, data.Username)
 		c.Status(http.StatusForbidden)
 		return
 	}
 
-	passwordHash := result["password"].(string)
+	// With second factor, failures are reset only after it's verified in LoginMfa
+	if !user.TotpEnabled {
+		if err := h.Lockout.Reset(c, data.Username); err != nil {
+			log.Println(err)
+		}
+	}
 
-	isValidPassword := crypto.ComparePasswordAndHash(data.Password, passwordHash)
-	if !isValidPassword {
+	h.completeLogin(c, user, data.Device)
+}
+
+// Respond with 429 if username is locked after too many failed logins
+func (h *Handler) respondIfLocked(c *gin.Context, username string) bool {
+	lockedFor, err := h.Lockout.LockedFor(c, username)
+	if err != nil {
 		log.Println(err)
-		c.Status(http.StatusForbidden)
+	}
+	if lockedFor <= 0 {
+		return false
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionLogin,
+		Result:  models.AuditResultFailure,
+		Details: username + ": account locked",
+	})
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": "account temporarily locked",
+	})
+	return true
+}
+
+// Try every authenticator in order, nil is returned if none of them accepted credentials
+func (h *Handler) authenticate(c *gin.Context, username, password string) *models.User {
+	for _, authenticator := range h.Authenticators {
+		user, err := authenticator.Authenticate(c, username, password)
+		if err == nil {
+			return user
+		}
+		if err != ErrInvalidCredentials {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// Return tokens for user authenticated with any method, or challenge if second factor is required
+func (h *Handler) completeLogin(c *gin.Context, user *models.User, device string) {
+	// Tokens are issued after second factor is verified in LoginMfa
+	if user.TotpEnabled {
+		mfaToken, err := auth.GenerateMfaToken(user.Id)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"username":     user.Username,
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		})
 		return
 	}
 
-	userId := result["_id"].(string)
+	h.respondWithTokens(c, user, device)
+}
+
+// Create session for authenticated user and return its tokens
+func (h *Handler) respondWithTokens(c *gin.Context, user *models.User, device string) {
+	if user.Suspended {
+		audit.Record(c, h.Db, models.AuditEvent{
+			Action:  audit.ActionLogin,
+			Actor:   user.Id,
+			Result:  models.AuditResultFailure,
+			Details: user.Username + ": account suspended",
+		})
+
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "account is suspended",
+		})
+		return
+	}
 
-	accessToken, refreshToken, err := auth.GenerateTokens(userId)
+	accessToken, refreshToken, err := IssueTokens(c, h.Db, user.Id, device)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	trashAccessKey := result["trash_access_key"].(string)
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionLogin,
+		Actor:   user.Id,
+		Details: user.Username,
+	})
 
 	c.JSON(http.StatusOK, gin.H{
-		"username":         data.Username,
+		"username":         user.Username,
 		"access_token":     accessToken,
 		"refresh_token":    refreshToken,
-		"trash_access_key": trashAccessKey,
+		"trash_access_key": h.trashAccessKey(c, user.Id),
 	})
 }
 
-func (h *Handler) RefreshToken(c *gin.Context) {
-	token := c.GetHeader("Authorization")
+// Access keys expire, so new key for Trash directory is issued with every token
+func (h *Handler) trashAccessKey(ctx context.Context, userId string) string {
+	var trash models.Directory
 
-	if len(token) < len("Bearer ") {
-		c.Status(http.StatusBadRequest)
-		return
+	err := h.Db.Collection("directories").FindOne(ctx, bson.D{
+		{Key: "user", Value: userId},
+		{Key: "name", Value: "Trash"},
+		{Key: "parent_directory", Value: nil},
+	}).Decode(&trash)
+	if err != nil {
+		log.Println(err)
+		return ""
 	}
-	token = token[len("Bearer "):]
 
-	accessToken, err := auth.GenerateAccessTokenFromRefreshToken(token)
+	accessKey, err := auth.GenerateDirectoryAccessKey(
+		trash.Id,
+		userId,
+		auth.AllDirectoryPermissions,
+		trash.KeyGeneration,
+	)
 	if err != nil {
-		c.Status(http.StatusUnauthorized)
-		c.Header("WWW-Authenticate", err.Error())
-		return
+		log.Panic(err)
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
+	return accessKey
+}
+
+// Failures are also counted for non-existing users, so lockout doesn't reveal which usernames exist
+func (h *Handler) registerLoginFailure(c *gin.Context, username string) {
+	if err := h.Lockout.RegisterFailure(c, username); err != nil {
+		log.Println(err)
+	}
+
+	audit.Record(c, h.Db, models.AuditEvent{
+		Action:  audit.ActionLogin,
+		Result:  models.AuditResultFailure,
+		Details: username,
 	})
 }
 
@@ -215,16 +358,31 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 		return
 	}
 
-	filter := bson.D{{Key: "_id", Value: claims.Id}}
-	res, err := h.Db.Collection("user").DeleteOne(context.TODO(), filter)
-	if err != nil {
+	if err := h.RemoveUser(c, claims.Id); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(http.StatusNotFound)
+			return
+		}
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveUser deletes user with its directories, files, sessions and tokens.
+//
+// Only removing user document can return error (mongo.ErrNoDocuments if it doesn't exist),
+// errors in cleanup are logged
+func (h *Handler) RemoveUser(ctx context.Context, userId string) error {
+	filter := bson.D{{Key: "_id", Value: userId}}
+	res, err := h.Db.Collection("user").DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+
 	if res.DeletedCount != 1 {
-		c.Status(http.StatusNotFound)
-		return
+		return mongo.ErrNoDocuments
 	}
 
 	opts := options.Find().SetProjection(
@@ -233,7 +391,7 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 		},
 	)
 
-	filter = bson.D{{Key: "user", Value: claims.Id}}
+	filter = bson.D{{Key: "user", Value: userId}}
 	directoriesToDelete, err := models.FindDirectoriesByFilter[models.Directory](h.Db, filter, opts)
 	if err != nil {
 		log.Println(err)
@@ -245,17 +403,66 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 		}
 	}
 
-	_, err = h.Db.Collection("directories").DeleteMany(context.TODO(), filter)
+	_, err = h.Db.Collection("directories").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("files").DeleteMany(ctx, filter)
 	if err != nil {
 		log.Println(err)
 	}
-	_, err = h.Db.Collection("files").DeleteMany(context.TODO(), filter)
+	_, err = h.Db.Collection("sessions").DeleteMany(ctx, filter)
 	if err != nil {
 		log.Println(err)
 	}
+	_, err = h.Db.Collection("access_tokens").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("s3_credentials").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("multipart_uploads").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("user_tokens").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("derived_keys").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("share_links").DeleteMany(ctx, filter)
+	if err != nil {
+		log.Println(err)
+	}
+	err = models.DeleteWebhooks(ctx, h.Db, bson.D{{Key: "$or", Value: bson.A{
+		filter,
+		bson.D{{Key: "owner", Value: userId}},
+	}}})
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = h.Db.Collection("directory_shares").DeleteMany(ctx, bson.D{{Key: "$or", Value: bson.A{
+		filter,
+		bson.D{{Key: "owner", Value: userId}},
+	}}})
+	if err != nil {
+		log.Println(err)
+	}
+	// Groups aren't left without owner
+	groupHandler := groups.Handler{Db: h.Db, SearchDb: h.SearchDb}
+	groupHandler.LeaveGroups(ctx, userId)
 
-	h.SearchDb.Index("directories").DeleteDocumentsByFilter("user = " + claims.Id)
-	h.SearchDb.Index("files").DeleteDocumentsByFilter("user = " + claims.Id)
+	if err := search.DeleteDocumentsByFilter(h.SearchDb, "directories", "user = "+userId); err != nil {
+		log.Println(err)
+	}
+	if err := search.DeleteDocumentsByFilter(h.SearchDb, "files", "user = "+userId); err != nil {
+		log.Println(err)
+	}
 
-	c.Status(http.StatusNoContent)
+	return nil
 }
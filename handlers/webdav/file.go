@@ -0,0 +1,222 @@
+package webdav
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/webdav"
+
+	"ncloud-api/models"
+)
+
+// fileInfo implements os.FileInfo with content type and ETag (SHA-256 of content) known from database
+type fileInfo struct {
+	name        string
+	size        int64
+	modified    int64
+	isDir       bool
+	contentType string
+	hash        string
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return time.UnixMilli(fi.modified) }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+// ContentType is used by webdav.Handler instead of reading content, if type is known
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.contentType, nil
+}
+
+// ETag is hash of content, files uploaded before hashes were stored use default ETag
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.hash == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.hash + `"`, nil
+}
+
+// directoryHandle lists directories and files inside directory (or root directories)
+type directoryHandle struct {
+	fs       *FileSystem
+	node     *Node
+	children []os.FileInfo
+	loaded   bool
+	offset   int
+}
+
+func (d *directoryHandle) Close() error { return nil }
+
+func (d *directoryHandle) Read([]byte) (int, error) { return 0, os.ErrInvalid }
+
+func (d *directoryHandle) Seek(int64, int) (int64, error) { return 0, os.ErrInvalid }
+
+func (d *directoryHandle) Write([]byte) (int, error) { return 0, os.ErrPermission }
+
+func (d *directoryHandle) Stat() (os.FileInfo, error) { return d.node.info(), nil }
+
+func (d *directoryHandle) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.loaded {
+		d.load()
+	}
+
+	if count <= 0 {
+		children := d.children[d.offset:]
+		d.offset = len(d.children)
+		return children, nil
+	}
+
+	if d.offset >= len(d.children) {
+		return nil, io.EOF
+	}
+
+	end := d.offset + count
+	if end > len(d.children) {
+		end = len(d.children)
+	}
+	children := d.children[d.offset:end]
+	d.offset = end
+
+	return children, nil
+}
+
+// Only the oldest item with each name is listed, as only this one can be resolved from path
+func (d *directoryHandle) load() {
+	d.loaded = true
+	names := make(map[string]bool)
+
+	add := func(info *fileInfo) {
+		if names[info.name] {
+			return
+		}
+		names[info.name] = true
+		d.children = append(d.children, info)
+	}
+
+	if d.node.isRoot() {
+		for _, root := range d.fs.Roots(d.fs.c) {
+			add(root.info())
+		}
+		return
+	}
+
+	filter := bson.D{{Key: "parent_directory", Value: d.node.directory.Id}}
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+
+	directories, err := models.FindDirectoriesByFilter[models.Directory](d.fs.db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, directory := range directories {
+		add(&fileInfo{name: directory.Name, isDir: true, modified: directory.Modified})
+	}
+
+	files, err := models.FindFilesByFilter[models.File](d.fs.db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, file := range files {
+		child := Node{name: file.Name, file: file}
+		add(child.info())
+	}
+}
+
+// fileHandle reads content of file from disk
+type fileHandle struct {
+	*os.File
+	node *Node
+}
+
+func (f *fileHandle) Stat() (os.FileInfo, error) { return f.node.info(), nil }
+
+func (f *fileHandle) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *fileHandle) Write([]byte) (int, error) { return 0, os.ErrPermission }
+
+// uploadHandle writes content to temporary file, hashing it on the way. File is saved when upload is closed
+type uploadHandle struct {
+	*os.File
+	fs       *FileSystem
+	parent   *Node
+	name     string
+	existing *models.File
+	hash     hash.Hash
+	size     int64
+	err      error
+}
+
+func (u *uploadHandle) Write(p []byte) (int, error) {
+	n, err := u.File.Write(p)
+	u.hash.Write(p[:n])
+	u.size += int64(n)
+	if err != nil {
+		u.err = err
+	}
+
+	return n, err
+}
+
+// ReadFrom hides ReadFrom of os.File, so io.Copy writes through Write
+func (u *uploadHandle) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{u}, r)
+}
+
+func (u *uploadHandle) Seek(int64, int) (int64, error) { return 0, os.ErrInvalid }
+
+func (u *uploadHandle) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (u *uploadHandle) Stat() (os.FileInfo, error) {
+	info := &fileInfo{name: u.name, size: u.size, modified: time.Now().UnixMilli()}
+	info.hash = hex.EncodeToString(u.hash.Sum(nil))
+
+	return info, nil
+}
+
+func (u *uploadHandle) Close() error {
+	// Temporary file no longer exists if upload was saved
+	defer os.Remove(u.File.Name())
+
+	if err := u.File.Close(); err != nil {
+		return err
+	}
+	if u.err != nil {
+		return u.err
+	}
+
+	return u.fs.saveUpload(u)
+}
+
+// requestBody remembers error of reading body, so incomplete uploads aren't saved
+type requestBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.err = err
+	}
+
+	return n, err
+}
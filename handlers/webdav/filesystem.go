@@ -0,0 +1,807 @@
+package webdav
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/meilisearch/meilisearch-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/webdav"
+
+	"ncloud-api/config"
+	"ncloud-api/handlers/directories"
+	"ncloud-api/handlers/files"
+	"ncloud-api/middleware/audit"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/middleware/metrics"
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+// ErrQuotaExceeded is returned when upload is closed if its size would exceed quota of owner
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// FileSystem implements webdav.FileSystem on directories and files of one request.
+//
+// "/" lists root directories of user (Main, Trash and root directories of groups),
+// e.g. /Main/Reports/report.pdf. Personal access token restricted to directory only has this directory in "/".
+// Items with the same name in one directory are resolved to the oldest one (directories first)
+type FileSystem struct {
+	db       *mongo.Database
+	searchDb *meilisearch.Client
+	c        *gin.Context
+	claims   *auth.SignedClaims
+
+	// Type of uploaded files, Content-Type of PUT request or type by extension of name by default
+	ContentType string
+
+	// Loaded on first use
+	roots []Node
+	// Body of PUT request, upload isn't saved if it wasn't received completely
+	body *requestBody
+	// File sent to GET request
+	downloaded *Node
+}
+
+// Node is resolved path, root of file system has neither directory nor file
+type Node struct {
+	name  string
+	isDir bool
+	// Directory listed in root of file system
+	top       bool
+	directory models.Directory
+	file      models.File
+	// Owner of directory tree (user or group) and permissions of user in it, limited by scope of token
+	owner       string
+	permissions []string
+}
+
+func (n *Node) IsDir() bool {
+	return n.isDir
+}
+
+func (n *Node) Directory() models.Directory {
+	return n.directory
+}
+
+func (n *Node) File() models.File {
+	return n.file
+}
+
+// Owner returns owner of directory tree of node (user or group)
+func (n *Node) Owner() string {
+	return n.owner
+}
+
+func (n *Node) isRoot() bool {
+	return n.isDir && n.directory.Id == ""
+}
+
+// IsRootDirectory checks if node is directory in root of file system (Main, Trash, root directory of group
+// or directory of token), which can't be renamed, moved or deleted
+func (n *Node) IsRootDirectory() bool {
+	return n.top
+}
+
+// Allows checks if user has permission in directory tree of node
+func (n *Node) Allows(permission string) bool {
+	return helper.ArrayContains(n.permissions, permission)
+}
+
+func (n *Node) parent() string {
+	if n.isDir {
+		return n.directory.ParentDirectory
+	}
+	return n.file.ParentDirectory
+}
+
+func (n *Node) info() *fileInfo {
+	if n.isDir {
+		return &fileInfo{name: n.name, isDir: true, modified: n.directory.Modified}
+	}
+
+	return &fileInfo{
+		name:        n.name,
+		size:        n.file.Size,
+		modified:    n.file.Modified,
+		contentType: n.file.Type,
+		hash:        n.file.Hash,
+	}
+}
+
+// NewFileSystem returns file system of user authenticated in request (with auth.BasicAuth or auth.S3Auth)
+func NewFileSystem(c *gin.Context, db *mongo.Database, searchDb *meilisearch.Client) *FileSystem {
+	fs := &FileSystem{db: db, searchDb: searchDb, c: c, claims: auth.ExtractClaimsFromContext(c)}
+
+	if c.Request.Method == http.MethodPut {
+		fs.body = &requestBody{ReadCloser: c.Request.Body}
+		c.Request.Body = fs.body
+	}
+
+	return fs
+}
+
+// RecordDownload records download of file opened for GET request, if it was sent successfully
+func (fs *FileSystem) RecordDownload() {
+	if fs.downloaded == nil || fs.c.Writer.Status() >= http.StatusMultipleChoices {
+		return
+	}
+
+	if size := fs.c.Writer.Size(); size > 0 {
+		metrics.BytesDownloaded.Add(float64(size))
+	}
+
+	audit.Record(fs.c, fs.db, models.AuditEvent{
+		Action:       audit.ActionDownload,
+		Kind:         models.AuditKindFile,
+		Owner:        fs.downloaded.owner,
+		Targets:      []string{fs.downloaded.file.Id},
+		ParentBefore: fs.downloaded.file.ParentDirectory,
+	})
+}
+
+func (fs *FileSystem) directories() *directories.Handler {
+	return &directories.Handler{Db: fs.db, SearchDb: fs.searchDb}
+}
+
+func (fs *FileSystem) files() *files.Handler {
+	return &files.Handler{Db: fs.db, SearchDb: fs.searchDb}
+}
+
+// Permissions of owner allowed by scope of token
+func (fs *FileSystem) scoped(permissions []string) []string {
+	result := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		if helper.ArrayContains(auth.ScopePermissions[fs.claims.Scope], permission) {
+			result = append(result, permission)
+		}
+	}
+	return result
+}
+
+// Roots returns root directories of file system, listed in "/"
+func (fs *FileSystem) Roots(ctx context.Context) []Node {
+	if fs.roots != nil {
+		return fs.roots
+	}
+
+	fs.roots = make([]Node, 0)
+	add := func(directories []models.Directory, permissions map[string][]string) {
+		for _, directory := range directories {
+			exists := false
+			for _, root := range fs.roots {
+				exists = exists || root.name == directory.Name
+			}
+			if exists {
+				continue
+			}
+
+			fs.roots = append(fs.roots, Node{
+				name:        directory.Name,
+				isDir:       true,
+				top:         true,
+				directory:   directory,
+				owner:       directory.User,
+				permissions: fs.scoped(permissions[directory.User]),
+			})
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+
+	if fs.claims.Directory != "" {
+		found, err := models.FindDirectoriesByFilter[models.Directory](fs.db, bson.D{
+			{Key: "_id", Value: fs.claims.Directory},
+			{Key: "user", Value: fs.claims.Id},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		add(found, map[string][]string{fs.claims.Id: auth.AllDirectoryPermissions})
+		return fs.roots
+	}
+
+	own, err := models.FindDirectoriesByFilter[models.Directory](fs.db, bson.D{
+		{Key: "user", Value: fs.claims.Id},
+		{Key: "parent_directory", Value: nil},
+	}, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	add(own, map[string][]string{fs.claims.Id: auth.AllDirectoryPermissions})
+
+	// Permissions in directories of groups depend on role of user
+	groups, err := models.FindGroupsByFilter(fs.db, bson.D{{Key: "members.user", Value: fs.claims.Id}})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	permissions := make(map[string][]string, len(groups))
+	groupDirectories := make([]string, 0, len(groups))
+	for _, group := range groups {
+		permissions[group.Id] = auth.SharePermissions[models.GroupRoleLevels[group.Member(fs.claims.Id).Role]]
+		groupDirectories = append(groupDirectories, group.Directory)
+	}
+
+	found, err := models.FindDirectoriesById[models.Directory](fs.db, groupDirectories, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	add(found, permissions)
+
+	return fs.roots
+}
+
+// Resolve finds node of path, returns os.ErrNotExist if path doesn't exist
+func (fs *FileSystem) Resolve(ctx context.Context, name string) (*Node, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return &Node{name: "/", isDir: true, permissions: []string{auth.PermissionRead}}, nil
+	}
+
+	segments := strings.Split(name[1:], "/")
+
+	var current *Node
+	for _, root := range fs.Roots(ctx) {
+		if root.name == segments[0] {
+			root := root
+			current = &root
+			break
+		}
+	}
+	if current == nil {
+		return nil, os.ErrNotExist
+	}
+
+	for _, segment := range segments[1:] {
+		if !current.isDir {
+			return nil, os.ErrNotExist
+		}
+
+		child, err := fs.findChild(ctx, current, segment)
+		if err != nil {
+			return nil, err
+		}
+		current = child
+	}
+
+	return current, nil
+}
+
+// Find directory or file with name inside directory of parent
+func (fs *FileSystem) findChild(ctx context.Context, parent *Node, name string) (*Node, error) {
+	filter := bson.D{
+		{Key: "parent_directory", Value: parent.directory.Id},
+		{Key: "name", Value: name},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "created", Value: 1}})
+
+	child := &Node{name: name, owner: parent.owner, permissions: parent.permissions}
+
+	err := fs.db.Collection("directories").FindOne(ctx, filter, opts).Decode(&child.directory)
+	if err == nil {
+		child.isDir = true
+		return child, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		log.Panic(err)
+	}
+
+	err = fs.db.Collection("files").FindOne(ctx, filter, opts).Decode(&child.file)
+	if err == mongo.ErrNoDocuments {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return child, nil
+}
+
+// Find directory new item with name would be created in
+func (fs *FileSystem) resolveParent(ctx context.Context, name string) (*Node, error) {
+	parent, err := fs.Resolve(ctx, path.Dir(path.Clean("/"+name)))
+	if err != nil {
+		return nil, err
+	}
+	if !parent.isDir {
+		return nil, os.ErrNotExist
+	}
+	// Only root directories are in root of file system
+	if parent.isRoot() {
+		return nil, os.ErrPermission
+	}
+
+	return parent, nil
+}
+
+// QuotaExceeded checks if uploading file of size to path would exceed quota of owner
+func (fs *FileSystem) QuotaExceeded(ctx context.Context, name string, size int64) (bool, error) {
+	parent, err := fs.resolveParent(ctx, name)
+	if err != nil {
+		return false, nil
+	}
+
+	if existing, err := fs.Resolve(ctx, name); err == nil && !existing.isDir {
+		size -= existing.file.Size
+	}
+
+	return models.QuotaExceeded(ctx, fs.db, parent.owner, size)
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.Resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.info(), nil
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return fs.openUpload(ctx, name)
+	}
+
+	n, err := fs.Resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Allows(auth.PermissionRead) {
+		return nil, os.ErrPermission
+	}
+
+	if n.isDir {
+		return &directoryHandle{fs: fs, node: n}, nil
+	}
+
+	file, err := os.Open(config.UploadDestination + n.file.ParentDirectory + "/" + n.file.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.c.Request.Method == http.MethodGet {
+		fs.downloaded = n
+	}
+
+	return &fileHandle{File: file, node: n}, nil
+}
+
+// Content is written to temporary file in directory of file, it replaces file when upload is closed
+func (fs *FileSystem) openUpload(ctx context.Context, name string) (webdav.File, error) {
+	parent, err := fs.resolveParent(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &uploadHandle{fs: fs, parent: parent, name: path.Base(path.Clean("/" + name)), hash: sha256.New()}
+
+	existing, err := fs.Resolve(ctx, name)
+	switch {
+	case err == nil && existing.isDir:
+		return nil, os.ErrExist
+	case err == nil:
+		// Content of existing file is replaced
+		if !parent.Allows(auth.PermissionUpload) || !parent.Allows(auth.PermissionModify) {
+			return nil, os.ErrPermission
+		}
+		upload.existing = &existing.file
+	case errors.Is(err, os.ErrNotExist):
+		if !parent.Allows(auth.PermissionUpload) {
+			return nil, os.ErrPermission
+		}
+	default:
+		return nil, err
+	}
+
+	upload.File, err = os.CreateTemp(config.UploadDestination+parent.directory.Id, ".webdav-")
+	if err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// Upload saves content to file of path like PUT request does.
+// File isn't saved if content can't be read completely
+func (fs *FileSystem) Upload(ctx context.Context, name string, content io.Reader) error {
+	f, err := fs.openUpload(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	upload := f.(*uploadHandle)
+	if _, err := io.Copy(upload, content); err != nil && upload.err == nil {
+		upload.err = err
+	}
+
+	return upload.Close()
+}
+
+// Save uploaded file like files.Handler.Upload does, or replace content of existing file
+func (fs *FileSystem) saveUpload(upload *uploadHandle) error {
+	if fs.body != nil && fs.body.err != nil {
+		return fs.body.err
+	}
+
+	owner := upload.parent.owner
+
+	additional := upload.size
+	if upload.existing != nil {
+		additional -= upload.existing.Size
+	}
+
+	quotaExceeded, err := models.QuotaExceeded(fs.c, fs.db, owner, additional)
+	if err != nil {
+		log.Panic(err)
+	}
+	if quotaExceeded {
+		return ErrQuotaExceeded
+	}
+
+	contentType := fs.ContentType
+	if contentType == "" && fs.c.Request.Method == http.MethodPut {
+		contentType = fs.c.GetHeader("Content-Type")
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(upload.name))
+	}
+
+	now := time.Now().UnixMilli()
+	fileId, _ := uuid.NewUUID()
+
+	file := models.File{
+		Id:              fileId.String(),
+		Name:            upload.name,
+		ParentDirectory: upload.parent.directory.Id,
+		User:            owner,
+		Type:            contentType,
+		Size:            upload.size,
+		Created:         now,
+		Modified:        now,
+		Hash:            hex.EncodeToString(upload.hash.Sum(nil)),
+	}
+	if upload.existing != nil {
+		file.Id = upload.existing.Id
+		file.Created = upload.existing.Created
+	}
+
+	if err := file.Validate(); err != nil {
+		return err
+	}
+
+	collection := fs.db.Collection("files")
+	destination := config.UploadDestination + file.ParentDirectory + "/" + file.Id
+
+	if upload.existing == nil {
+		if _, err := collection.InsertOne(fs.c, file.ToBSONnotEmpty()); err != nil {
+			log.Panic(err)
+		}
+
+		if err := os.Rename(upload.File.Name(), destination); err != nil {
+			// Remove file document if saving it wasn't successful
+			_, _ = collection.DeleteOne(fs.c, bson.D{{Key: "_id", Value: file.Id}})
+			log.Panic(err)
+		}
+
+		fs.files().InsertDocumentsToSearchDatabase(models.FilesToMap([]models.File{file}))
+	} else {
+		if err := os.Rename(upload.File.Name(), destination); err != nil {
+			log.Panic(err)
+		}
+
+		if _, err := collection.UpdateOne(
+			fs.c,
+			bson.D{{Key: "_id", Value: file.Id}},
+			bson.D{{Key: "$set", Value: bson.M{
+				"type":     file.Type,
+				"size":     file.Size,
+				"hash":     file.Hash,
+				"modified": file.Modified,
+			}}},
+		); err != nil {
+			log.Panic(err)
+		}
+
+		fs.files().UpdateOrAddToSearchDatabase(&files.SearchDatabaseData{Id: file.Id, Type: file.Type})
+	}
+
+	metrics.BytesUploaded.Add(float64(file.Size))
+
+	audit.Record(fs.c, fs.db, models.AuditEvent{
+		Action:      audit.ActionUpload,
+		Kind:        models.AuditKindFile,
+		Owner:       owner,
+		Targets:     []string{file.Id},
+		ParentAfter: file.ParentDirectory,
+	})
+
+	return nil
+}
+
+// Mkdir creates directory like CreateDirectory does
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fs.Resolve(ctx, name); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	parent, err := fs.resolveParent(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !parent.Allows(auth.PermissionUpload) {
+		return os.ErrPermission
+	}
+
+	directoryId, _ := uuid.NewUUID()
+	now := time.Now().UnixMilli()
+
+	directory := models.Directory{
+		Id:              directoryId.String(),
+		Name:            path.Base(path.Clean("/" + name)),
+		ParentDirectory: parent.directory.Id,
+		User:            parent.owner,
+		Created:         now,
+		Modified:        now,
+	}
+
+	if err := directory.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := fs.db.Collection("directories").InsertOne(ctx, directory.ToBsonNotEmpty()); err != nil {
+		log.Panic(err)
+	}
+
+	if err := os.Mkdir(config.UploadDestination+directory.Id, 0700); err != nil {
+		log.Panic(err)
+	}
+
+	fs.directories().UpdateOrAddToSearchDatabase(&directories.SearchDatabaseData{
+		Id:        directory.Id,
+		Name:      directory.Name,
+		Directory: directory.ParentDirectory,
+		User:      directory.User,
+	})
+
+	audit.Record(fs.c, fs.db, models.AuditEvent{
+		Action:      audit.ActionCreateDirectory,
+		Kind:        models.AuditKindDirectory,
+		Owner:       directory.User,
+		Targets:     []string{directory.Id},
+		ParentAfter: directory.ParentDirectory,
+		Details:     directory.Name,
+	})
+
+	return nil
+}
+
+// MkdirAll creates directory of path with all missing parents
+func (fs *FileSystem) MkdirAll(ctx context.Context, name string) error {
+	current := ""
+	for _, segment := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		current += "/" + segment
+
+		n, err := fs.Resolve(ctx, current)
+		switch {
+		case err == nil && !n.isDir:
+			return os.ErrExist
+		case errors.Is(err, os.ErrNotExist):
+			if err := fs.Mkdir(ctx, current, 0700); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveAll deletes file, or directory with everything inside it like DeleteDirectories does
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	n, err := fs.Resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	if n.IsRootDirectory() || !n.Allows(auth.PermissionDelete) {
+		return os.ErrPermission
+	}
+
+	if n.isDir {
+		tree, err := models.FindDirectoryTree(fs.db, n.owner, n.directory.Id)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if err := fs.directories().RemoveDirectories(ctx, []string{n.owner}, tree); err != nil {
+			log.Panic(err)
+		}
+
+		metrics.ObserveOperation(metrics.OperationDelete, metrics.KindDirectory, int64(len(tree)))
+
+		audit.Record(fs.c, fs.db, models.AuditEvent{
+			Action:       audit.ActionDelete,
+			Kind:         models.AuditKindDirectory,
+			Owner:        n.owner,
+			Targets:      []string{n.directory.Id},
+			ParentBefore: n.directory.ParentDirectory,
+		})
+
+		return nil
+	}
+
+	if _, err := fs.db.Collection("files").DeleteOne(ctx, bson.D{
+		{Key: "_id", Value: n.file.Id},
+		{Key: "parent_directory", Value: n.file.ParentDirectory},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	if err := os.Remove(config.UploadDestination + n.file.ParentDirectory + "/" + n.file.Id); err != nil {
+		log.Println(err)
+	}
+
+	fs.files().DeleteFromSearchDatabase([]string{n.file.Id})
+
+	metrics.ObserveOperation(metrics.OperationDelete, metrics.KindFile, 1)
+
+	audit.Record(fs.c, fs.db, models.AuditEvent{
+		Action:       audit.ActionDelete,
+		Kind:         models.AuditKindFile,
+		Owner:        n.owner,
+		Targets:      []string{n.file.Id},
+		ParentBefore: n.file.ParentDirectory,
+	})
+
+	return nil
+}
+
+// Rename renames and moves files and directories inside directory tree of one owner,
+// like UpdateFile, ModifyDirectory and moving endpoints do
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	n, err := fs.Resolve(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if n.isRoot() || n.IsRootDirectory() {
+		return os.ErrPermission
+	}
+
+	if _, err := fs.Resolve(ctx, newName); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	parent, err := fs.resolveParent(ctx, newName)
+	if err != nil {
+		return err
+	}
+
+	name := path.Base(path.Clean("/" + newName))
+	previousParent := n.parent()
+	moved := parent.directory.Id != previousParent
+	renamed := name != n.name
+
+	// Items can't be moved to directory of another owner
+	if parent.owner != n.owner || !n.Allows(auth.PermissionModify) ||
+		moved && !parent.Allows(auth.PermissionUpload) {
+		return os.ErrPermission
+	}
+
+	kind := models.AuditKindFile
+	metricsKind := metrics.KindFile
+	id := n.file.Id
+	update := bson.M{}
+
+	if n.isDir {
+		kind = models.AuditKindDirectory
+		metricsKind = metrics.KindDirectory
+		id = n.directory.Id
+
+		if err := (&models.Directory{Name: name}).Validate(); err != nil {
+			return err
+		}
+
+		if moved {
+			inside, err := models.IsInsideDirectory(ctx, fs.db, parent.directory.Id, id)
+			if err != nil {
+				log.Panic(err)
+			}
+			if inside {
+				return os.ErrPermission
+			}
+			update["parent_directory"] = parent.directory.Id
+		}
+	} else {
+		if err := (&models.File{Name: name}).Validate(); err != nil {
+			return err
+		}
+
+		if moved {
+			if err := os.Rename(
+				config.UploadDestination+previousParent+"/"+id,
+				config.UploadDestination+parent.directory.Id+"/"+id,
+			); err != nil {
+				log.Panic(err)
+			}
+			update["parent_directory"] = parent.directory.Id
+			update["previous_parent_directory"] = previousParent
+		}
+	}
+
+	if renamed {
+		update["name"] = name
+		update["modified"] = time.Now().UnixMilli()
+	}
+
+	collection := "files"
+	if n.isDir {
+		collection = "directories"
+	}
+	if _, err := fs.db.Collection(collection).UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "parent_directory", Value: previousParent}},
+		bson.D{{Key: "$set", Value: update}},
+	); err != nil {
+		log.Panic(err)
+	}
+
+	if n.isDir {
+		fs.directories().UpdateOrAddToSearchDatabase(&directories.SearchDatabaseData{
+			Id:        id,
+			Name:      name,
+			Directory: parent.directory.Id,
+			User:      n.owner,
+		})
+	} else {
+		fs.files().UpdateOrAddToSearchDatabase(&files.SearchDatabaseData{
+			Id:        id,
+			Name:      name,
+			Directory: parent.directory.Id,
+		})
+	}
+
+	if moved {
+		metrics.ObserveOperation(metrics.OperationMove, metricsKind, 1)
+
+		audit.Record(fs.c, fs.db, models.AuditEvent{
+			Action:       audit.ActionMove,
+			Kind:         kind,
+			Owner:        n.owner,
+			Targets:      []string{id},
+			ParentBefore: previousParent,
+			ParentAfter:  parent.directory.Id,
+		})
+	}
+
+	if renamed {
+		audit.Record(fs.c, fs.db, models.AuditEvent{
+			Action:       audit.ActionRename,
+			Kind:         kind,
+			Owner:        n.owner,
+			Targets:      []string{id},
+			ParentBefore: parent.directory.Id,
+			Details:      name,
+		})
+	}
+
+	return nil
+}
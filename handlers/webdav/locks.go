@@ -0,0 +1,87 @@
+package webdav
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"ncloud-api/utils/helper"
+)
+
+// LockTimeout is the longest time lock can be held without refresh, longer and infinite timeouts are shortened
+var LockTimeout = helper.GetEnvDuration("WEBDAV_LOCK_TIMEOUT", time.Hour)
+
+// Locks of user, kept in memory of this instance
+type userLocks struct {
+	webdav.LockSystem
+	used time.Time
+}
+
+func init() {
+	if LockTimeout < time.Second {
+		log.Fatal("invalid WEBDAV_LOCK_TIMEOUT: must be at least 1s")
+	}
+}
+
+func (h *Handler) lockSystem(user string) webdav.LockSystem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	locks, exists := h.locks[user]
+	if !exists {
+		locks = &userLocks{LockSystem: webdav.NewMemLS()}
+		h.locks[user] = locks
+	}
+	locks.used = time.Now()
+
+	return locks
+}
+
+// Locks expire at most LockTimeout after they were created or refreshed,
+// so lock systems not used for longer don't have any locks (minute is left for requests in progress)
+func (h *Handler) evictLocks() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	idle := time.Now().Add(-LockTimeout - time.Minute)
+	for user, locks := range h.locks {
+		if locks.used.Before(idle) {
+			delete(h.locks, user)
+		}
+	}
+}
+
+// RunCleanup periodically removes lock systems of users without locks
+func (h *Handler) RunCleanup(ctx context.Context) {
+	ticker := time.NewTicker(LockTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.evictLocks()
+		}
+	}
+}
+
+// Limit Timeout header of LOCK request to LockTimeout (missing header means infinite timeout)
+func limitTimeout(header string) string {
+	max := int64(LockTimeout / time.Second)
+
+	timeout, _, _ := strings.Cut(header, ",")
+	timeout = strings.TrimSpace(timeout)
+	if strings.HasPrefix(timeout, "Second-") {
+		n, err := strconv.ParseInt(strings.TrimPrefix(timeout, "Second-"), 10, 64)
+		if err == nil && n >= 0 && n <= max {
+			return header
+		}
+	}
+
+	return "Second-" + strconv.FormatInt(max, 10)
+}
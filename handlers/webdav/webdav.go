@@ -0,0 +1,103 @@
+package webdav
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/meilisearch/meilisearch-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/webdav"
+
+	"ncloud-api/middleware/auth"
+)
+
+// Prefix of WebDAV routes
+const Prefix = "/dav"
+
+// Methods of WebDAV class 1 and 2 served by ServeDav
+var Methods = []string{
+	http.MethodOptions,
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPut,
+	http.MethodDelete,
+	"PROPFIND",
+	"PROPPATCH",
+	"MKCOL",
+	"COPY",
+	"MOVE",
+	"LOCK",
+	"UNLOCK",
+}
+
+// Handler serves directories and files of user authenticated with auth.BasicAuth over WebDAV
+type Handler struct {
+	Db       *mongo.Database
+	SearchDb *meilisearch.Client
+
+	// Locks of each user, removed by RunCleanup when they aren't used
+	mu    sync.Mutex
+	locks map[string]*userLocks
+}
+
+func NewHandler(db *mongo.Database, searchDb *meilisearch.Client) *Handler {
+	return &Handler{
+		Db:       db,
+		SearchDb: searchDb,
+		locks:    make(map[string]*userLocks),
+	}
+}
+
+// ServeDav maps WebDAV request on directories and files of user, see FileSystem for paths
+func (h *Handler) ServeDav(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+	fs := NewFileSystem(c, h.Db, h.SearchDb)
+
+	// Quota is checked before body is received, webdav.Handler can't respond with 507
+	if c.Request.Method == http.MethodPut && c.Request.ContentLength > 0 {
+		exceeded, err := fs.QuotaExceeded(c, strings.TrimPrefix(c.Request.URL.Path, Prefix), c.Request.ContentLength)
+		if err != nil {
+			log.Panic(err)
+		}
+		if exceeded {
+			c.Status(http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	// Locks are held at most LockTimeout without refresh, so lock systems of users can be removed
+	if c.Request.Method == "LOCK" {
+		c.Request.Header.Set("Timeout", limitTimeout(c.GetHeader("Timeout")))
+	}
+
+	// Directory can't be copied or moved into itself
+	if (c.Request.Method == "COPY" || c.Request.Method == "MOVE") && isInside(c.Request, c.GetHeader("Destination")) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     Prefix,
+		FileSystem: fs,
+		LockSystem: h.lockSystem(claims.Id),
+	}
+	handler.ServeHTTP(c.Writer, c.Request)
+
+	fs.RecordDownload()
+}
+
+// Check if destination URL of request is inside its path (or is the same path)
+func isInside(r *http.Request, destination string) bool {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return false
+	}
+
+	source := strings.TrimSuffix(r.URL.Path, "/") + "/"
+
+	return strings.HasPrefix(strings.TrimSuffix(u.Path, "/")+"/", source)
+}
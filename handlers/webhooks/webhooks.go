@@ -0,0 +1,342 @@
+package webhooks
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/webhooks"
+)
+
+type Handler struct {
+	Db *mongo.Database
+}
+
+const (
+	deliveriesDefaultLimit = 50
+	deliveriesMaxLimit     = 100
+)
+
+// Only HTTP URLs are allowed, validator accepts any scheme
+func validUrl(url string) bool {
+	return strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")
+}
+
+// Find webhook from id parameter owned by authenticated user, respond with 404 if it doesn't exist.
+// Returns nil if response was already sent
+func (h *Handler) findWebhook(c *gin.Context) *models.Webhook {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	var webhook models.Webhook
+
+	err := h.Db.Collection("webhooks").FindOne(c, bson.D{
+		{Key: "_id", Value: c.Param("id")},
+		{Key: "user", Value: claims.Id},
+	}).Decode(&webhook)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+
+	return &webhook
+}
+
+// CreateWebhook registers webhook of directory owned by or shared with user
+//
+// Secret of signatures is returned only once
+func (h *Handler) CreateWebhook(c *gin.Context) {
+	type RequestData struct {
+		Directory string   `json:"directory"`
+		Url       string   `json:"url"`
+		Recursive bool     `json:"recursive"`
+		Events    []string `json:"events"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	claims := auth.ExtractClaimsFromContext(c)
+
+	if !auth.DirectoryAllowed(c, data.Directory) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	var directory models.Directory
+
+	opts := options.FindOne().SetProjection(bson.D{{Key: "user", Value: 1}})
+	err := h.Db.Collection("directories").FindOne(c, bson.D{{Key: "_id", Value: data.Directory}}, opts).
+		Decode(&directory)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "directory doesn't exist",
+		})
+		return
+	}
+
+	owner := ""
+	if directory.User != claims.Id {
+		// Every share level and group role allows reading
+		if _, shared := auth.SharedPermissions(c, h.Db, data.Directory, directory.User, claims.Id); !shared {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "directory doesn't exist",
+			})
+			return
+		}
+		owner = directory.User
+	}
+
+	secret, err := auth.GenerateRandomToken()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if data.Events == nil {
+		data.Events = []string{}
+	}
+
+	webhook := models.Webhook{
+		Id:        uuid.New().String(),
+		User:      claims.Id,
+		Directory: data.Directory,
+		Owner:     owner,
+		Url:       data.Url,
+		Recursive: data.Recursive,
+		Events:    data.Events,
+		Secret:    secret,
+		Active:    true,
+		Created:   time.Now().UnixMilli(),
+	}
+
+	if err := webhook.Validate(); err != nil || !validUrl(webhook.Url) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	if _, err := h.Db.Collection("webhooks").InsertOne(c, webhook); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// GetWebhooks lists webhooks of user, optionally only of directory from directory query parameter
+func (h *Handler) GetWebhooks(c *gin.Context) {
+	claims := auth.ExtractClaimsFromContext(c)
+
+	filter := bson.D{{Key: "user", Value: claims.Id}}
+	if directory := c.Query("directory"); directory != "" {
+		filter = append(filter, bson.E{Key: "directory", Value: directory})
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+	result, err := models.FindWebhooksByFilter(c, h.Db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// UpdateWebhook changes URL, events or recursion of webhook. Webhook disabled after failures
+// is enabled again with {"active": true}
+func (h *Handler) UpdateWebhook(c *gin.Context) {
+	type RequestData struct {
+		Url       *string   `json:"url"`
+		Recursive *bool     `json:"recursive"`
+		Events    *[]string `json:"events"`
+		Active    *bool     `json:"active"`
+	}
+
+	var data RequestData
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	webhook := h.findWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+
+	if data.Url != nil {
+		webhook.Url = *data.Url
+		set["url"] = webhook.Url
+	}
+
+	if data.Recursive != nil {
+		set["recursive"] = *data.Recursive
+	}
+
+	if data.Events != nil {
+		webhook.Events = *data.Events
+		if webhook.Events == nil {
+			webhook.Events = []string{}
+		}
+		set["events"] = webhook.Events
+	}
+
+	if data.Active != nil && *data.Active != webhook.Active {
+		set["active"] = *data.Active
+		if *data.Active {
+			set["failures"] = 0
+			unset["disabled"] = ""
+		} else {
+			set["disabled"] = time.Now().UnixMilli()
+		}
+	}
+
+	if err := webhook.Validate(); err != nil || !validUrl(webhook.Url) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Error in validation",
+		})
+		return
+	}
+
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
+	if len(update) > 0 {
+		if _, err := h.Db.Collection("webhooks").UpdateByID(c, webhook.Id, update); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RotateWebhookSecret replaces secret of signatures, new secret is returned only once
+func (h *Handler) RotateWebhookSecret(c *gin.Context) {
+	webhook := h.findWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	secret, err := auth.GenerateRandomToken()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if _, err := h.Db.Collection("webhooks").UpdateByID(c, webhook.Id, bson.D{
+		{Key: "$set", Value: bson.M{"secret": secret}},
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+	})
+}
+
+// DeleteWebhook deletes webhook with its delivery log
+func (h *Handler) DeleteWebhook(c *gin.Context) {
+	webhook := h.findWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	if err := models.DeleteWebhooks(c, h.Db, bson.D{{Key: "_id", Value: webhook.Id}}); err != nil {
+		log.Panic(err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns page of delivery log of webhook, newest first.
+// Query parameters: status (pending | success | failure), page, limit
+func (h *Handler) GetWebhookDeliveries(c *gin.Context) {
+	webhook := h.findWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "0"), 10, 64)
+	if err != nil || page < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid page",
+		})
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(deliveriesDefaultLimit)), 10, 64)
+	if err != nil || limit < 1 || limit > deliveriesMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	filter := bson.D{{Key: "webhook", Value: webhook.Id}}
+	if status := c.Query("status"); status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created", Value: -1}}).
+		SetSkip(page * limit).
+		SetLimit(limit)
+
+	deliveries, err := models.FindWebhookDeliveriesByFilter(c, h.Db, filter, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// RedeliverWebhookDelivery sends payload of delivery again as new delivery
+func (h *Handler) RedeliverWebhookDelivery(c *gin.Context) {
+	webhook := h.findWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	var delivery models.WebhookDelivery
+
+	err := h.Db.Collection("webhook_deliveries").FindOne(c, bson.D{
+		{Key: "_id", Value: c.Param("delivery")},
+		{Key: "webhook", Value: webhook.Id},
+	}).Decode(&delivery)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if !webhook.Active {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "webhook is disabled",
+		})
+		return
+	}
+
+	redelivery, err := webhooks.Redeliver(c, h.Db, &delivery)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	c.JSON(http.StatusAccepted, redelivery)
+}
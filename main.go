@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/autotls"
 	"github.com/gin-gonic/gin"
 	"github.com/meilisearch/meilisearch-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -17,11 +21,23 @@ import (
 
 	"ncloud-api/handlers/directories"
 	"ncloud-api/handlers/files"
+	"ncloud-api/handlers/groups"
+	"ncloud-api/handlers/notifications"
+	"ncloud-api/handlers/s3"
 	"ncloud-api/handlers/search"
+	"ncloud-api/handlers/shares"
 	"ncloud-api/handlers/user"
+	"ncloud-api/handlers/webdav"
+	webhookHandlers "ncloud-api/handlers/webhooks"
 	"ncloud-api/middleware/auth"
 	"ncloud-api/middleware/cors"
+	"ncloud-api/middleware/metrics"
+	"ncloud-api/middleware/ratelimit"
+	"ncloud-api/models"
+	"ncloud-api/utils/events"
 	"ncloud-api/utils/helper"
+	"ncloud-api/utils/mailer"
+	"ncloud-api/utils/webhooks"
 )
 
 var (
@@ -32,6 +48,8 @@ var (
 	MeiliApiKey string
 	MeiliHost   string
 	Mode        string
+	// Comma separated addresses or CIDRs of proxies trusted to set X-Forwarded-For, none by default
+	TrustedProxies string
 )
 
 func health(c *gin.Context) {
@@ -133,6 +151,19 @@ func initMeiliSearch(db *mongo.Database, meiliClient *meilisearch.Client) {
 	}
 }
 
+func createAdmin(userHandler *user.Handler, args []string) {
+	flags := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	username := flags.String("username", "admin", "username of administrator")
+	password := flags.String("password", helper.GetEnv("ADMIN_PASSWORD", ""), "password, used only if user doesn't exist")
+	_ = flags.Parse(args)
+
+	if err := userHandler.CreateAdmin(context.TODO(), *username, *password); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("user " + *username + " is administrator")
+}
+
 func main() {
 	// Setup database
 	DbHost = helper.GetEnv("DB_HOST", "localhost:27017")
@@ -142,9 +173,13 @@ func main() {
 	MeiliApiKey = helper.GetEnv("MEILI_MASTER_KEY", "meili_master_key")
 	MeiliHost = helper.GetEnv("MEILI_HOST", "http://localhost:7700")
 	Mode = helper.GetEnv("RUN_MODE", "debug")
+	gin.SetMode(Mode)
+	TrustedProxies = helper.GetEnv("TRUSTED_PROXIES", "")
 
 	mongoClient, err := mongo.NewClient(
-		options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@%s", DbUser, DbPassword, DbHost)),
+		options.Client().
+			ApplyURI(fmt.Sprintf("mongodb://%s:%s@%s", DbUser, DbPassword, DbHost)).
+			SetMonitor(metrics.MongoMonitor()),
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -167,54 +202,289 @@ func main() {
 	db := mongoClient.Database(DbName)
 	initMeiliSearch(db, meiliClient)
 
-	userHandler := user.Handler{Db: db, SearchDb: meiliClient}
+	if err := models.CreateSessionIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateAccessTokenIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateUserIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateDerivedKeyIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateShareLinkIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateDirectoryShareIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateGroupIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateAuditEventIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateChangeEventIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateWebhookIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateJournalEntryIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateS3CredentialIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateMultipartUploadIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := models.CreateStreamTicketIndexes(db); err != nil {
+		log.Println(err)
+	}
+	if err := user.CreateOidcIndexes(db); err != nil {
+		log.Println(err)
+	}
+
+	mail, err := mailer.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rateLimitStore := ratelimit.NewStore(db)
+	limiter := ratelimit.Limiter{Store: rateLimitStore}
+
+	userHandler := user.Handler{
+		Db:       db,
+		SearchDb: meiliClient,
+		Lockout:  &ratelimit.Lockout{Store: rateLimitStore},
+		Oidc:     user.NewOidcProvider(),
+		Mailer:   mail,
+	}
+	userHandler.Authenticators = user.NewAuthenticators(&userHandler)
+
+	// Bootstrap first administrator: ncloud-api create-admin -username admin (password from ADMIN_PASSWORD)
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		createAdmin(&userHandler, os.Args[2:])
+		return
+	}
+
 	fileHandler := files.Handler{Db: db, SearchDb: meiliClient}
 	directoryHandler := directories.Handler{Db: db, SearchDb: meiliClient}
-	searchHandler := search.Handler{Db: meiliClient}
+	searchHandler := search.Handler{Db: meiliClient, MongoDb: db}
+	shareHandler := shares.Handler{Db: db, Mailer: mail}
+	groupHandler := groups.Handler{Db: db, SearchDb: meiliClient}
 
-	gin.SetMode(Mode)
-	router := gin.Default()
+	// Change events of all API instances are read from database and delivered to clients of this instance
+	eventBus := events.NewBus(db)
+	go eventBus.Run(context.Background())
+	notificationHandler := notifications.Handler{Db: db, Bus: eventBus}
+
+	// Pending webhook deliveries are shared by all API instances
+	go webhooks.NewDispatcher(db).Run(context.Background())
+	webhookHandler := webhookHandlers.Handler{Db: db}
+
+	webdavHandler := webdav.NewHandler(db, meiliClient)
+	go webdavHandler.RunCleanup(context.Background())
+
+	// Parts of finished and expired multipart uploads are removed by every API instance
+	s3Handler := s3.Handler{Db: db, SearchDb: meiliClient}
+	go s3Handler.RunCleanup(context.Background())
+
+	prometheus.MustRegister(metrics.NewStorageCollector(db), metrics.NewQueueCollector(db))
+
+	router := gin.New()
+	// Query of event streams can contain ticket, it's not logged
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{SkipPaths: []string{"/api/events", "/api/events/ws"}}))
+	router.Use(gin.Recovery())
+
+	// Client IP is used by rate limits, so it's taken from X-Forwarded-For only behind trusted proxies
+	var trustedProxies []string
+	if TrustedProxies != "" {
+		trustedProxies = strings.Split(strings.ReplaceAll(TrustedProxies, " ", ""), ",")
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal(err)
+	}
 
 	router.Use(cors.Middleware())
+	router.Use(metrics.Middleware())
+
+	// Metrics are available only with METRICS_TOKEN or on separate METRICS_ADDRESS
+	if metrics.Address != "" {
+		metricsRouter := gin.New()
+		metricsRouter.GET("/metrics", metrics.Handler())
+		go func() {
+			log.Fatal(metricsRouter.Run(metrics.Address))
+		}()
+	} else if metrics.Token != "" {
+		router.GET("/metrics", metrics.Handler())
+	}
 
-	router.POST("/api/files/download", fileHandler.GetFiles)
+	router.POST("/api/files/download", auth.OptionalAuth(db), fileHandler.GetFiles)
 	router.GET("/api/health", health)
-	router.POST("/api/register", userHandler.Register)
-	router.POST("/api/login", userHandler.Login)
+	router.POST(
+		"/api/register",
+		limiter.ByIp(ratelimit.RegisterRule),
+		userHandler.Register,
+	)
+	router.POST(
+		"/api/login",
+		limiter.ByIp(ratelimit.LoginIpRule),
+		limiter.ByUsername(ratelimit.LoginUserRule),
+		userHandler.Login,
+	)
+	if userHandler.Oidc != nil {
+		router.GET("/api/oidc/login", limiter.ByIp(ratelimit.LoginIpRule), userHandler.OidcLogin)
+		router.GET("/api/oidc/callback", limiter.ByIp(ratelimit.LoginIpRule), userHandler.OidcCallback)
+		router.POST("/api/oidc/callback", limiter.ByIp(ratelimit.LoginIpRule), userHandler.OidcCallback)
+	}
+	router.POST(
+		"/api/login/mfa",
+		limiter.ByIp(ratelimit.LoginIpRule),
+		userHandler.LoginMfa,
+	)
+	router.POST(
+		"/api/password/reset/request",
+		limiter.ByIp(ratelimit.RegisterRule),
+		userHandler.RequestPasswordReset,
+	)
+	router.POST("/api/password/reset", limiter.ByIp(ratelimit.LoginIpRule), userHandler.ResetPassword)
+	router.POST("/api/email/verify", limiter.ByIp(ratelimit.LoginIpRule), userHandler.VerifyEmail)
 	router.GET("/api/token/refresh", userHandler.RefreshToken)
-	router.POST("/api/files/delete", fileHandler.DeleteFiles)
-	router.POST("/api/files/move", fileHandler.ChangeDirectory)
-	router.POST("/api/files/copy", fileHandler.CopyFiles)
+
+	// Public share links, password is sent in SharePassword header (or session from ShareSession header)
+	shareGroup := router.Group("/api/shares/:token")
+	shareGroup.Use(limiter.ByIp(ratelimit.ShareIpRule), auth.ShareAuth(db, userHandler.Lockout))
+	{
+		shareGroup.GET("", shareHandler.GetSharedContent)
+		registerPermissionRoutes(shareGroup, shareRoutes(db, &shareHandler, &fileHandler))
+		registerPermissionRoutes(shareGroup.Group("/files", auth.ShareFileAuth(db)), shareFileRoutes(db, &fileHandler))
+	}
+
+	// Change notifications, browsers authorize streams with single-use ticket from POST /api/events/ticket
+	notificationGroup := router.Group("/api/events")
+	notificationGroup.Use(
+		auth.StreamAuth(db),
+		limiter.ByUser(ratelimit.ApiUserRule),
+	)
+	{
+		notificationGroup.GET("", notificationHandler.Events)
+		notificationGroup.GET("/ws", notificationHandler.EventsWebSocket)
+	}
+
+	// WebDAV, clients authenticate with username and personal access token as password (app password)
+	davGroup := router.Group(webdav.Prefix)
+	davGroup.Use(auth.BasicAuth(db), limiter.ByUser(ratelimit.ApiUserRule))
+	for _, method := range webdav.Methods {
+		davGroup.Handle(method, "/*path", webdavHandler.ServeDav)
+	}
+
+	// S3-compatible API, requests are signed with S3 credentials of user (AWS Signature Version 4)
+	s3Group := router.Group(s3.Prefix)
+	s3Group.Use(auth.S3Auth(db), limiter.ByUser(ratelimit.ApiUserRule))
+	for _, method := range s3.Methods {
+		s3Group.Handle(method, "", s3Handler.ServeS3)
+		s3Group.Handle(method, "/*path", s3Handler.ServeS3)
+	}
 
 	router.MaxMultipartMemory = 8 << 20 // 8 MiB
 
 	authorized := router.Group("/")
-	authorized.Use(auth.Auth())
+	authorized.Use(auth.Auth(db), limiter.ByUser(ratelimit.ApiUserRule))
 	{
 		authorized.GET("/api/directories/search", searchHandler.FindDirectoriesAndFiles)
 		authorized.POST("/api/directories/copy", directoryHandler.CopyDirectories)
 
 		authorized.GET("/api/directories", directoryHandler.GetDirectoryWithFiles)
+		authorized.GET("/api/directories/shared", directoryHandler.GetSharedDirectories)
 		authorized.GET("/api/directories/:id", directoryHandler.GetDirectoryWithFiles)
+		authorized.GET("/api/directories/:id/activity", directoryHandler.GetDirectoryActivity)
 		authorized.POST("/api/directories/delete", directoryHandler.DeleteDirectories)
 		authorized.POST("/api/directories/move", directoryHandler.ChangeDirectory)
 		authorized.POST("/api/directories/restore", directoryHandler.RestoreDirectories)
+		authorized.POST("/api/directories/:id/access_key", directoryHandler.RotateAccessKey)
+		authorized.GET("/api/directories/:id/access_keys", directoryHandler.GetDerivedKeys)
+		authorized.DELETE("/api/directories/:id/access_keys/:key", directoryHandler.DeleteDerivedKey)
+		authorized.GET("/api/directories/:id/shares", directoryHandler.GetDirectoryShares)
+		authorized.POST("/api/directories/:id/shares", directoryHandler.ShareDirectory)
+		authorized.DELETE("/api/directories/:id/shares/:user", directoryHandler.DeleteDirectoryShare)
 		authorized.POST("/api/files/restore", fileHandler.RestoreFiles)
+		authorized.POST("/api/files/delete", fileHandler.DeleteFiles)
+		authorized.POST("/api/files/move", fileHandler.ChangeDirectory)
+		authorized.POST("/api/files/copy", fileHandler.CopyFiles)
 		authorized.DELETE("/api/users/:id", userHandler.DeleteUser)
+		authorized.POST("/api/users/password", userHandler.ChangePassword)
+		authorized.POST("/api/users/email", userHandler.ChangeEmail)
+		authorized.POST("/api/logout", userHandler.Logout)
+		authorized.POST("/api/logout/all", userHandler.LogoutAll)
+		authorized.GET("/api/sessions", userHandler.GetSessions)
+		authorized.DELETE("/api/sessions/:id", userHandler.DeleteSession)
+		authorized.POST("/api/mfa/totp/enroll", userHandler.EnrollTotp)
+		authorized.POST("/api/mfa/totp/confirm", userHandler.ConfirmTotp)
+		authorized.POST("/api/mfa/totp/disable", userHandler.DisableTotp)
+		authorized.POST("/api/tokens", userHandler.CreateAccessToken)
+		authorized.GET("/api/tokens", userHandler.GetAccessTokens)
+		authorized.DELETE("/api/tokens/:id", userHandler.DeleteAccessToken)
+		authorized.POST("/api/s3/credentials", userHandler.CreateS3Credential)
+		authorized.GET("/api/s3/credentials", userHandler.GetS3Credentials)
+		authorized.DELETE("/api/s3/credentials/:id", userHandler.DeleteS3Credential)
+		authorized.POST("/api/shares", shareHandler.CreateShareLink)
+		authorized.GET("/api/shares", shareHandler.GetShareLinks)
+		authorized.PATCH("/api/shares/:id", shareHandler.UpdateShareLink)
+		authorized.DELETE("/api/shares/:id", shareHandler.DeleteShareLink)
+
+		authorized.GET("/api/audit", userHandler.GetAuditEvents)
+		authorized.GET("/api/activity", directoryHandler.GetActivity)
+		authorized.GET("/api/changes", directoryHandler.GetChanges)
+		authorized.GET("/api/changes/cursor", directoryHandler.GetChangesCursor)
+		authorized.POST("/api/events/ticket", notificationHandler.CreateTicket)
+
+		authorized.POST("/api/groups", groupHandler.CreateGroup)
+		authorized.GET("/api/groups", groupHandler.GetGroups)
+		authorized.GET("/api/groups/:id", groupHandler.GetGroup)
+		authorized.PATCH("/api/groups/:id", groupHandler.UpdateGroup)
+		authorized.DELETE("/api/groups/:id", groupHandler.DeleteGroup)
+		authorized.PUT("/api/groups/:id/members", groupHandler.SetGroupMember)
+		authorized.DELETE("/api/groups/:id/members/:user", groupHandler.RemoveGroupMember)
+
+		authorized.POST("/api/webhooks", webhookHandler.CreateWebhook)
+		authorized.GET("/api/webhooks", webhookHandler.GetWebhooks)
+		authorized.PATCH("/api/webhooks/:id", webhookHandler.UpdateWebhook)
+		authorized.DELETE("/api/webhooks/:id", webhookHandler.DeleteWebhook)
+		authorized.POST("/api/webhooks/:id/secret", webhookHandler.RotateWebhookSecret)
+		authorized.GET("/api/webhooks/:id/deliveries", webhookHandler.GetWebhookDeliveries)
+		authorized.POST("/api/webhooks/:id/deliveries/:delivery/redeliver", webhookHandler.RedeliverWebhookDelivery)
+
+		adminGroup := authorized.Group("/api/admin/")
+		adminGroup.Use(auth.RequireRole(models.RoleAdmin))
+		{
+			adminGroup.GET("users", userHandler.AdminGetUsers)
+			adminGroup.GET("users/:id", userHandler.AdminGetUser)
+			adminGroup.DELETE("users/:id", userHandler.AdminDeleteUser)
+			adminGroup.POST("users/:id/suspend", userHandler.AdminSuspendUser)
+			adminGroup.POST("users/:id/unsuspend", userHandler.AdminUnsuspendUser)
+			adminGroup.POST("users/:id/password", userHandler.AdminResetPassword)
+			adminGroup.PUT("users/:id/quota", userHandler.AdminSetQuota)
+			adminGroup.PUT("users/:id/roles", userHandler.AdminSetRoles)
+			adminGroup.GET("audit", userHandler.AdminGetAuditEvents)
+			adminGroup.PUT("groups/:id/quota", groupHandler.AdminSetGroupQuota)
+			adminGroup.DELETE("groups/:id", groupHandler.AdminDeleteGroup)
+		}
 
 		directoryGroup := authorized.Group("/api/")
-		directoryGroup.Use(auth.DirectoryAuth())
+		directoryGroup.Use(auth.DirectoryAuth(db))
 		{
-			directoryGroup.POST("directories/:id", directoryHandler.CreateDirectory)
-			directoryGroup.POST("upload/:id", fileHandler.Upload)
-			directoryGroup.PATCH("directories/:id", directoryHandler.ModifyDirectory)
+			registerPermissionRoutes(directoryGroup, directoryRoutes(&directoryHandler, &fileHandler))
+			directoryGroup.POST("directories/:id/access_keys", directoryHandler.CreateDerivedKey)
 		}
 
 		fileGroup := authorized.Group("/")
-		fileGroup.Use(auth.FileAuth())
+		fileGroup.Use(auth.FileAuth(db))
 		{
-			fileGroup.GET("/files/:id", fileHandler.GetFile)
-			fileGroup.PATCH("/api/files/:id", fileHandler.UpdateFile)
+			registerPermissionRoutes(fileGroup, fileRoutes(&fileHandler))
 		}
 
 	}
@@ -0,0 +1,911 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/config"
+	"ncloud-api/handlers/directories"
+	"ncloud-api/handlers/files"
+	"ncloud-api/handlers/shares"
+	"ncloud-api/middleware/auth"
+	"ncloud-api/middleware/ratelimit"
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/helper"
+	"ncloud-api/utils/testdb"
+)
+
+const (
+	testOwner        = "owner"
+	testCollaborator = "collaborator"
+	testDirectory    = "directory"
+	testFile         = "file"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// Directory of owner with one file, shared with collaborator with edit level (all permissions)
+func newPermissionTestDb(t *testing.T) *mongo.Database {
+	db := testdb.Database(t)
+	ctx := context.Background()
+
+	documents := map[string]interface{}{
+		"directories": models.Directory{Id: testDirectory, Name: "Main", User: testOwner},
+		"files":       models.File{Id: testFile, Name: "file.txt", ParentDirectory: testDirectory, User: testOwner},
+		"directory_shares": models.DirectoryShare{
+			Id:        "share",
+			Directory: testDirectory,
+			Owner:     testOwner,
+			User:      testCollaborator,
+			Level:     models.ShareLevelEdit,
+		},
+	}
+	for collection, document := range documents {
+		if _, err := db.Collection(collection).InsertOne(ctx, document); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db
+}
+
+// protectedRoute is permission route registered in group with prefix, id parameter is set to id
+type protectedRoute struct {
+	permissionRoute
+	prefix string
+	id     string
+}
+
+func (r protectedRoute) url() string {
+	return strings.ReplaceAll(path.Join(r.prefix, r.path), ":id", r.id)
+}
+
+// Replace handlers of routes, so only authorization is tested
+func stubRoutes(routes []permissionRoute) []permissionRoute {
+	stubbed := make([]permissionRoute, len(routes))
+	for i, route := range routes {
+		route.handlers = []gin.HandlerFunc{func(c *gin.Context) { c.Status(http.StatusNoContent) }}
+		stubbed[i] = route
+	}
+	return stubbed
+}
+
+func register(group *gin.RouterGroup, routes []permissionRoute, id string) []protectedRoute {
+	routes = stubRoutes(routes)
+	registerPermissionRoutes(group, routes)
+
+	protected := make([]protectedRoute, len(routes))
+	for i, route := range routes {
+		protected[i] = protectedRoute{permissionRoute: route, prefix: group.BasePath(), id: id}
+	}
+	return protected
+}
+
+func send(router http.Handler, method, url, accessKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("DirectoryAccessKey", accessKey)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+// Check that request got through authorization, or was rejected because access key doesn't have permission
+func expectAllowed(t *testing.T, w *httptest.ResponseRecorder, route protectedRoute, allowed bool) {
+	t.Helper()
+
+	if allowed {
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("status = %d, body %s, want request to get through", w.Code, w.Body.String())
+		}
+		return
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+
+	if w.Code != http.StatusForbidden || body.Error != "no "+route.permission+" permission" {
+		t.Fatalf("status = %d, body %s, want 403 without %s permission", w.Code, w.Body.String(), route.permission)
+	}
+}
+
+func without(permissions []string, permission string) []string {
+	result := make([]string, 0, len(permissions))
+	for _, p := range permissions {
+		if p != permission {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func TestPermissionRoutes(t *testing.T) {
+	db := newPermissionTestDb(t)
+
+	router := gin.New()
+	routes := append(
+		register(
+			router.Group("/api/", auth.DirectoryAuth(db)),
+			directoryRoutes(&directories.Handler{}, &files.Handler{}),
+			testDirectory,
+		),
+		register(router.Group("/", auth.FileAuth(db)), fileRoutes(&files.Handler{}), testFile)...,
+	)
+
+	derivedKey := func(t *testing.T, user, owner string, permissions []string) string {
+		key := models.DerivedKey{
+			Id:          uuid.New().String(),
+			Directory:   testDirectory,
+			User:        user,
+			Owner:       owner,
+			Permissions: permissions,
+			Created:     time.Now().UnixMilli(),
+		}
+		if _, err := db.Collection("derived_keys").InsertOne(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+
+		accessKey, err := auth.GenerateDerivedAccessKey(&key, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return accessKey
+	}
+
+	keys := []struct {
+		name string
+		key  func(t *testing.T, permissions []string) (string, error)
+	}{
+		{
+			name: "owner key",
+			key: func(t *testing.T, permissions []string) (string, error) {
+				return auth.GenerateDirectoryAccessKey(testDirectory, testOwner, permissions, 0)
+			},
+		},
+		{
+			name: "shared directory key",
+			key: func(t *testing.T, permissions []string) (string, error) {
+				return auth.GenerateAccessKey(testDirectory, testCollaborator, testOwner, permissions, 0, true)
+			},
+		},
+		{
+			name: "derived key",
+			key: func(t *testing.T, permissions []string) (string, error) {
+				return derivedKey(t, testOwner, "", permissions), nil
+			},
+		},
+		{
+			name: "key derived from shared directory key",
+			key: func(t *testing.T, permissions []string) (string, error) {
+				return derivedKey(t, testCollaborator, testOwner, permissions), nil
+			},
+		},
+	}
+
+	for _, key := range keys {
+		for _, route := range routes {
+			name := key.name + " " + route.method + " " + route.url()
+
+			// Only required permission is sufficient
+			for _, permission := range auth.AllDirectoryPermissions {
+				t.Run(name+" with "+permission, func(t *testing.T) {
+					accessKey, err := key.key(t, []string{permission})
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					expectAllowed(t, send(router, route.method, route.url(), accessKey), route, permission == route.permission)
+				})
+			}
+
+			// All other permissions together aren't
+			t.Run(name+" without "+route.permission, func(t *testing.T) {
+				accessKey, err := key.key(t, without(auth.AllDirectoryPermissions, route.permission))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expectAllowed(t, send(router, route.method, route.url(), accessKey), route, false)
+			})
+		}
+	}
+}
+
+func TestSharePermissionRoutes(t *testing.T) {
+	db := newPermissionTestDb(t)
+
+	router := gin.New()
+	lockout := &ratelimit.Lockout{Store: ratelimit.NewMemoryStore()}
+	shareGroup := router.Group("/api/shares/:token", auth.ShareAuth(db, lockout))
+	routes := register(shareGroup, shareRoutes(db, &shares.Handler{}, &files.Handler{}), "")
+	sharedFileRoutes := register(
+		shareGroup.Group("/files", auth.ShareFileAuth(db)),
+		shareFileRoutes(db, &files.Handler{}),
+		testFile,
+	)
+
+	links := []struct {
+		link models.ShareLink
+		// Permissions of link in routes of shared directory and of its file
+		permissions     []string
+		filePermissions []string
+	}{
+		{
+			link:            models.ShareLink{Directory: testDirectory, Mode: models.ShareModeRead},
+			permissions:     []string{auth.PermissionRead},
+			filePermissions: []string{auth.PermissionRead},
+		},
+		{
+			link:            models.ShareLink{Directory: testDirectory, Mode: models.ShareModeUpload},
+			permissions:     []string{auth.PermissionRead, auth.PermissionUpload},
+			filePermissions: []string{auth.PermissionRead, auth.PermissionUpload},
+		},
+		{
+			link:            models.ShareLink{Directory: testDirectory, Mode: models.ShareModeRequest},
+			permissions:     []string{auth.PermissionUpload},
+			filePermissions: []string{auth.PermissionUpload},
+		},
+		{
+			link:            models.ShareLink{File: testFile, Mode: models.ShareModeRead},
+			permissions:     []string{},
+			filePermissions: []string{auth.PermissionRead},
+		},
+	}
+
+	for _, test := range links {
+		token := uuid.New().String()
+
+		link := test.link
+		link.Id = uuid.New().String()
+		link.User = testOwner
+		link.TokenHash = auth.HashToken(token)
+		if _, err := db.Collection("share_links").InsertOne(context.Background(), link); err != nil {
+			t.Fatal(err)
+		}
+
+		name := link.Mode + " link of directory"
+		if link.File != "" {
+			name = link.Mode + " link of file"
+		}
+
+		check := func(routes []protectedRoute, permissions []string) {
+			for _, route := range routes {
+				route.prefix = strings.ReplaceAll(route.prefix, ":token", token)
+
+				t.Run(name+" "+route.method+" "+route.path, func(t *testing.T) {
+					w := send(router, route.method, route.url(), "")
+					expectAllowed(t, w, route, helper.ArrayContains(permissions, route.permission))
+				})
+			}
+		}
+
+		check(routes, test.permissions)
+		check(sharedFileRoutes, test.filePermissions)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	db := newPermissionTestDb(t)
+
+	router := gin.New()
+	router.GET("/api/shares/:token", auth.ShareAuth(db, &ratelimit.Lockout{Store: ratelimit.NewMemoryStore()}),
+		func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	password, err := crypto.GenerateHash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := make([]string, 2)
+	for i := range tokens {
+		tokens[i] = uuid.New().String()
+
+		link := models.ShareLink{
+			Id:        uuid.New().String(),
+			User:      testOwner,
+			TokenHash: auth.HashToken(tokens[i]),
+			Directory: testDirectory,
+			Mode:      models.ShareModeRead,
+			Password:  password,
+		}
+		if _, err := db.Collection("share_links").InsertOne(context.Background(), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(token, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/shares/"+token, nil)
+		req.Header.Set(header, value)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := get(tokens[0], "SharePassword", "password")
+	session := w.Header().Get("ShareSession")
+	if w.Code != http.StatusNoContent || session == "" {
+		t.Fatalf("status = %d, session %q, want session after password", w.Code, session)
+	}
+
+	if w := get(tokens[0], "ShareSession", session); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d with session, want 204", w.Code)
+	}
+	if w := get(tokens[1], "ShareSession", session); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d with session of other link, want 401", w.Code)
+	}
+
+	for i := int64(0); i < ratelimit.LockoutThreshold; i++ {
+		if w := get(tokens[0], "SharePassword", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d with wrong password, want 401", w.Code)
+		}
+	}
+
+	// Locked link doesn't check password, other links and sessions aren't affected
+	if w := get(tokens[0], "SharePassword", "password"); w.Code != http.StatusTooManyRequests ||
+		w.Header().Get("Retry-After") == "" {
+		t.Fatalf("status = %d of locked link, want 429 with Retry-After", w.Code)
+	}
+	if w := get(tokens[0], "ShareSession", session); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d with session of locked link, want 204", w.Code)
+	}
+	if w := get(tokens[1], "SharePassword", "password"); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d of other link, want 204", w.Code)
+	}
+
+	// Changing password ends sessions
+	newPassword, err := crypto.GenerateHash("new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("share_links").UpdateOne(context.Background(),
+		bson.D{{Key: "token_hash", Value: auth.HashToken(tokens[0])}},
+		bson.D{{Key: "$set", Value: bson.M{"password": newPassword}}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(tokens[0], "ShareSession", session); w.Code == http.StatusNoContent {
+		t.Fatal("session was accepted after password of link was changed")
+	}
+}
+
+// batchTree is directory of owner inside root directory with file and subdirectory, created for every request
+// of batch route test, because batch routes change them
+type batchTree struct {
+	root, directory, subdirectory, file string
+}
+
+func newBatchTree(t *testing.T, db *mongo.Database, root string) batchTree {
+	tree := batchTree{
+		root:         root,
+		directory:    uuid.New().String(),
+		subdirectory: uuid.New().String(),
+		file:         uuid.New().String(),
+	}
+	ctx := context.Background()
+
+	if _, err := db.Collection("directories").InsertMany(ctx, []interface{}{
+		models.Directory{Id: tree.directory, Name: "Reports", ParentDirectory: root, User: testOwner},
+		models.Directory{Id: tree.subdirectory, Name: "2024", ParentDirectory: tree.directory, User: testOwner},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	file := models.File{Id: tree.file, Name: "report.txt", ParentDirectory: tree.directory, User: testOwner, Size: 6}
+	if _, err := db.Collection("files").InsertOne(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, directory := range []string{tree.directory, tree.subdirectory} {
+		if err := os.MkdirAll(config.UploadDestination+directory, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(config.UploadDestination+tree.directory+"/"+tree.file, []byte("report"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+// batchRole is access key in body of batch request, it must have permission for directory
+type batchRole struct {
+	name       string
+	permission string
+	directory  func(tree batchTree) string
+}
+
+type batchRoute struct {
+	path  string
+	roles []batchRole
+	// Request body with access keys by name of role
+	body func(tree batchTree, keys map[string]string) interface{}
+}
+
+func inDirectory(tree batchTree) string    { return tree.directory }
+func inSubdirectory(tree batchTree) string { return tree.subdirectory }
+
+var batchRoutes = []batchRoute{
+	{
+		path:  "/api/files/download",
+		roles: []batchRole{{"access_key", auth.PermissionRead, inDirectory}},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return []gin.H{{"id": tree.directory, "access_key": keys["access_key"], "files": []string{tree.file}}}
+		},
+	},
+	{
+		path:  "/api/files/delete",
+		roles: []batchRole{{"access_key", auth.PermissionDelete, inDirectory}},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return []gin.H{{"id": tree.directory, "access_key": keys["access_key"], "files": []string{tree.file}}}
+		},
+	},
+	{
+		path: "/api/files/move",
+		roles: []batchRole{
+			{"access_key", auth.PermissionUpload, inSubdirectory},
+			{"directories.access_key", auth.PermissionModify, inDirectory},
+		},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return gin.H{
+				"id":         tree.subdirectory,
+				"access_key": keys["access_key"],
+				"directories": []gin.H{
+					{"id": tree.directory, "access_key": keys["directories.access_key"], "files": []string{tree.file}},
+				},
+			}
+		},
+	},
+	{
+		path: "/api/files/copy",
+		roles: []batchRole{
+			{"source_access_key", auth.PermissionRead, inDirectory},
+			{"destination_access_key", auth.PermissionUpload, inSubdirectory},
+		},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return gin.H{
+				"files":                  []string{tree.file},
+				"source_access_key":      keys["source_access_key"],
+				"destination_access_key": keys["destination_access_key"],
+				"source":                 tree.directory,
+				"destination":            tree.subdirectory,
+			}
+		},
+	},
+	{
+		path:  "/api/directories/delete",
+		roles: []batchRole{{"access_key", auth.PermissionDelete, inSubdirectory}},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return []gin.H{{"id": tree.subdirectory, "access_key": keys["access_key"]}}
+		},
+	},
+	{
+		path: "/api/directories/move",
+		roles: []batchRole{
+			{"access_key", auth.PermissionUpload, inDirectory},
+			{"items.access_key", auth.PermissionModify, inSubdirectory},
+		},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return gin.H{
+				"id":         tree.directory,
+				"access_key": keys["access_key"],
+				"items":      []gin.H{{"id": tree.subdirectory, "access_key": keys["items.access_key"]}},
+			}
+		},
+	},
+	{
+		path: "/api/directories/copy",
+		roles: []batchRole{
+			{"access_key", auth.PermissionUpload, inDirectory},
+			{"source_access_key", auth.PermissionRead, inSubdirectory},
+		},
+		body: func(tree batchTree, keys map[string]string) interface{} {
+			return gin.H{
+				"destination":       tree.directory,
+				"directories":       []string{tree.subdirectory},
+				"access_key":        keys["access_key"],
+				"source_access_key": keys["source_access_key"],
+			}
+		},
+	},
+}
+
+// Access key of user for directory, or recursive key for root directory, with permissions
+type batchKey struct {
+	name string
+	user string
+	key  func(t *testing.T, db *mongo.Database, root, directory string, permissions []string) string
+}
+
+func batchKeys() []batchKey {
+	signed := func(user, owner string, recursive bool) func(*testing.T, *mongo.Database, string, string, []string) string {
+		return func(t *testing.T, db *mongo.Database, root, directory string, permissions []string) string {
+			if recursive {
+				directory = root
+			}
+			accessKey, err := auth.GenerateAccessKey(directory, user, owner, permissions, 0, recursive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return accessKey
+		}
+	}
+
+	derived := func(user, owner string, recursive bool) func(*testing.T, *mongo.Database, string, string, []string) string {
+		return func(t *testing.T, db *mongo.Database, root, directory string, permissions []string) string {
+			if recursive {
+				directory = root
+			}
+			key := models.DerivedKey{
+				Id:          uuid.New().String(),
+				Directory:   directory,
+				User:        user,
+				Owner:       owner,
+				Permissions: permissions,
+				Recursive:   recursive,
+				Created:     time.Now().UnixMilli(),
+			}
+			if _, err := db.Collection("derived_keys").InsertOne(context.Background(), key); err != nil {
+				t.Fatal(err)
+			}
+
+			accessKey, err := auth.GenerateDerivedAccessKey(&key, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return accessKey
+		}
+	}
+
+	keys := make([]batchKey, 0, 8)
+	for _, recursive := range []bool{false, true} {
+		prefix := ""
+		if recursive {
+			prefix = "recursive "
+		}
+		keys = append(keys,
+			batchKey{prefix + "owner key", testOwner, signed(testOwner, "", recursive)},
+			batchKey{prefix + "shared directory key", testCollaborator, signed(testCollaborator, testOwner, recursive)},
+			batchKey{prefix + "derived key", testOwner, derived(testOwner, "", recursive)},
+			batchKey{
+				prefix + "key derived from shared directory key",
+				testCollaborator,
+				derived(testCollaborator, testOwner, recursive),
+			},
+		)
+	}
+	return keys
+}
+
+// Users with sessions, access tokens are returned by user
+func newBatchTestUsers(t *testing.T, db *mongo.Database) map[string]string {
+	accessTokens := make(map[string]string, 2)
+
+	for _, user := range []string{testOwner, testCollaborator} {
+		session := uuid.New().String()
+
+		if _, err := db.Collection("user").InsertOne(context.Background(), models.User{Id: user, Username: user}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Collection("sessions").InsertOne(
+			context.Background(),
+			models.Session{Id: session, User: user, TokenHash: session},
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		accessToken, _, err := auth.GenerateTokens(user, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessTokens[user] = accessToken
+	}
+
+	return accessTokens
+}
+
+func TestBatchPermissionRoutes(t *testing.T) {
+	db := newPermissionTestDb(t)
+
+	if err := os.MkdirAll(config.UploadDestination, 0700); err != nil {
+		t.Skipf("upload destination isn't writable: %v", err)
+	}
+	t.Cleanup(func() {
+		// Directories of trees and their copies
+		ids, err := db.Collection("directories").Distinct(context.Background(), "_id", bson.D{})
+		if err != nil {
+			t.Log(err)
+		}
+		for _, id := range ids {
+			if id, ok := id.(string); ok && id != "" {
+				os.RemoveAll(config.UploadDestination + id)
+			}
+		}
+	})
+
+	accessTokens := newBatchTestUsers(t, db)
+
+	// Owner shares root directory with collaborator (see newPermissionTestDb)
+	root := testDirectory
+	if _, err := db.Collection("directories").UpdateOne(context.Background(),
+		bson.D{{Key: "_id", Value: root}},
+		bson.D{{Key: "$set", Value: bson.M{"parent_directory": nil}}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	directoryHandler := &directories.Handler{Db: db, SearchDb: testdb.SearchDb()}
+	fileHandler := &files.Handler{Db: db, SearchDb: testdb.SearchDb()}
+
+	router := gin.New()
+	router.POST("/api/files/download", auth.OptionalAuth(db), fileHandler.GetFiles)
+	authorized := router.Group("/", auth.Auth(db))
+	authorized.POST("/api/files/delete", fileHandler.DeleteFiles)
+	authorized.POST("/api/files/move", fileHandler.ChangeDirectory)
+	authorized.POST("/api/files/copy", fileHandler.CopyFiles)
+	authorized.POST("/api/directories/delete", directoryHandler.DeleteDirectories)
+	authorized.POST("/api/directories/move", directoryHandler.ChangeDirectory)
+	authorized.POST("/api/directories/copy", directoryHandler.CopyDirectories)
+
+	post := func(t *testing.T, key batchKey, route batchRoute, tested batchRole, permissions []string) *httptest.ResponseRecorder {
+		tree := newBatchTree(t, db, root)
+
+		// Other keys of request have all permissions
+		keys := make(map[string]string, len(route.roles))
+		for _, role := range route.roles {
+			rolePermissions := auth.AllDirectoryPermissions
+			if role.name == tested.name {
+				rolePermissions = permissions
+			}
+			keys[role.name] = key.key(t, db, root, role.directory(tree), rolePermissions)
+		}
+
+		body, err := json.Marshal(route.body(tree, keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, route.path, strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+accessTokens[key.user])
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	expect := func(t *testing.T, w *httptest.ResponseRecorder, role batchRole, allowed bool) {
+		t.Helper()
+
+		if allowed {
+			if w.Code < 200 || w.Code > 299 {
+				t.Fatalf("status = %d, body %s, want success", w.Code, w.Body.String())
+			}
+			return
+		}
+
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+
+		if w.Code != http.StatusForbidden || !strings.HasPrefix(body.Error, "invalid") {
+			t.Fatalf("status = %d, body %s, want 403 without %s permission", w.Code, w.Body.String(), role.permission)
+		}
+	}
+
+	for _, key := range batchKeys() {
+		for _, route := range batchRoutes {
+			for _, role := range route.roles {
+				name := key.name + " " + route.path + " " + role.name
+
+				// Only required permission is sufficient
+				for _, permission := range auth.AllDirectoryPermissions {
+					t.Run(name+" with "+permission, func(t *testing.T) {
+						w := post(t, key, route, role, []string{permission})
+						expect(t, w, role, permission == role.permission)
+					})
+				}
+
+				// All other permissions together aren't
+				t.Run(name+" without "+role.permission, func(t *testing.T) {
+					w := post(t, key, route, role, without(auth.AllDirectoryPermissions, role.permission))
+					expect(t, w, role, false)
+				})
+			}
+		}
+	}
+}
+
+func TestRestrictedTokenDownload(t *testing.T) {
+	db := newPermissionTestDb(t)
+
+	if err := os.MkdirAll(config.UploadDestination, 0700); err != nil {
+		t.Skipf("upload destination isn't writable: %v", err)
+	}
+
+	newBatchTestUsers(t, db)
+	tree := newBatchTree(t, db, testDirectory)
+	t.Cleanup(func() {
+		os.RemoveAll(config.UploadDestination + tree.directory)
+		os.RemoveAll(config.UploadDestination + tree.subdirectory)
+	})
+
+	// Read token restricted to subdirectory
+	token, err := auth.GeneratePersonalAccessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("access_tokens").InsertOne(context.Background(), models.PersonalAccessToken{
+		Id:        uuid.New().String(),
+		User:      testOwner,
+		Name:      "restricted",
+		TokenHash: auth.HashToken(token),
+		Scope:     auth.ScopeRead,
+		Directory: tree.subdirectory,
+		Created:   time.Now().UnixMilli(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.POST("/api/files/download", auth.OptionalAuth(db), (&files.Handler{Db: db}).GetFiles)
+
+	download := func(authorization, directory string) int {
+		accessKey, err := auth.GenerateDirectoryAccessKey(directory, testOwner, []string{auth.PermissionRead}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal([]gin.H{{"id": directory, "access_key": accessKey, "files": []string{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/files/download", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", "Bearer "+authorization)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	if code := download(token, tree.subdirectory); code != http.StatusOK {
+		t.Fatalf("status = %d in directory of token, want 200", code)
+	}
+	if code := download(token, tree.directory); code != http.StatusForbidden {
+		t.Fatalf("status = %d outside of directory of token, want 403", code)
+	}
+	if code := download("", tree.directory); code != http.StatusOK {
+		t.Fatalf("status = %d without token, want 200", code)
+	}
+}
+
+func TestNestedDirectoryShares(t *testing.T) {
+	db := newPermissionTestDb(t)
+	ctx := context.Background()
+
+	// Main > Nested > Child, Main is shared with collaborator (see newPermissionTestDb)
+	for _, directory := range []models.Directory{
+		{Id: "nested", Name: "Nested", ParentDirectory: testDirectory, User: testOwner},
+		{Id: "child", Name: "Child", ParentDirectory: "nested", User: testOwner},
+	} {
+		if _, err := db.Collection("directories").InsertOne(ctx, directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Collection("directory_shares").InsertOne(ctx, models.DirectoryShare{
+		Id:        "nested-share",
+		Directory: "nested",
+		Owner:     testOwner,
+		User:      testCollaborator,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rootLevel   string
+		nestedLevel string
+		// Levels of Main, Nested and Child
+		want []string
+	}{
+		{models.ShareLevelRead, models.ShareLevelEdit,
+			[]string{models.ShareLevelRead, models.ShareLevelEdit, models.ShareLevelEdit}},
+		{models.ShareLevelEdit, models.ShareLevelRead,
+			[]string{models.ShareLevelEdit, models.ShareLevelEdit, models.ShareLevelEdit}},
+		{models.ShareLevelUpload, models.ShareLevelRead,
+			[]string{models.ShareLevelUpload, models.ShareLevelUpload, models.ShareLevelUpload}},
+	}
+
+	for _, test := range tests {
+		for id, level := range map[string]string{"share": test.rootLevel, "nested-share": test.nestedLevel} {
+			if _, err := db.Collection("directory_shares").UpdateByID(ctx, id,
+				bson.D{{Key: "$set", Value: bson.M{"level": level}}},
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for idx, directory := range []string{testDirectory, "nested", "child"} {
+			// Result must not depend on order of shares in database
+			for i := 0; i < 5; i++ {
+				permissions, shared := auth.SharedPermissions(ctx, db, directory, testOwner, testCollaborator)
+				if !shared || !reflect.DeepEqual(permissions, auth.SharePermissions[test.want[idx]]) {
+					t.Fatalf("%s shared at %s, nested at %s: permissions = %v, want level %s",
+						directory, test.rootLevel, test.nestedLevel, permissions, test.want[idx])
+				}
+			}
+		}
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	db := newPermissionTestDb(t)
+
+	router := gin.New()
+	shareGroup := router.Group("/api/shares/:token", auth.ShareAuth(db, &ratelimit.Lockout{Store: ratelimit.NewMemoryStore()}))
+	registerPermissionRoutes(shareGroup, shareRoutes(db, &shares.Handler{Db: db}, &files.Handler{Db: db}))
+
+	token := uuid.New().String()
+	link := models.ShareLink{
+		Id:           uuid.New().String(),
+		User:         testOwner,
+		TokenHash:    auth.HashToken(token),
+		Directory:    testDirectory,
+		Mode:         models.ShareModeRead,
+		MaxDownloads: 1,
+	}
+	if _, err := db.Collection("share_links").InsertOne(context.Background(), link); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/shares/"+token+"/download", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	// Rejected requests don't use up downloads of link
+	if code := download(`[{"id": "other", "files": []}]`); code != http.StatusForbidden {
+		t.Fatalf("status = %d for directory outside of link, want 403", code)
+	}
+	if code := download(`{`); code != http.StatusBadRequest {
+		t.Fatalf("status = %d for invalid body, want 400", code)
+	}
+
+	body := `[{"id": "` + testDirectory + `", "files": []}]`
+	if code := download(body); code != http.StatusOK {
+		t.Fatalf("status = %d for first download, want 200", code)
+	}
+	if code := download(body); code != http.StatusGone {
+		t.Fatalf("status = %d after download limit, want 410", code)
+	}
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/events"
+	"ncloud-api/utils/helper"
+	"ncloud-api/utils/journal"
+	"ncloud-api/utils/webhooks"
+)
+
+const (
+	ActionRegister         = "register"
+	ActionLogin            = "login"
+	ActionUpload           = "upload"
+	ActionDownload         = "download"
+	ActionCreateDirectory  = "create_directory"
+	ActionRename           = "rename"
+	ActionMove             = "move"
+	ActionCopy             = "copy"
+	ActionDelete           = "delete"
+	ActionRestore          = "restore"
+	ActionShare            = "share"
+	ActionUnshare          = "unshare"
+	ActionCreateShareLink  = "create_share_link"
+	ActionDeleteShareLink  = "delete_share_link"
+	ActionRotateKey        = "rotate_key"
+	ActionCreateDerivedKey = "create_derived_key"
+	ActionRevokeDerivedKey = "revoke_derived_key"
+)
+
+// Actions can be used to filter events
+var Actions = []string{
+	ActionRegister, ActionLogin, ActionUpload, ActionDownload, ActionCreateDirectory, ActionRename, ActionMove,
+	ActionCopy, ActionDelete, ActionRestore, ActionShare, ActionUnshare, ActionCreateShareLink,
+	ActionDeleteShareLink, ActionRotateKey, ActionCreateDerivedKey, ActionRevokeDerivedKey,
+}
+
+// Changes of files and directories, they are also published to subscribed clients
+var ChangeActions = []string{
+	ActionUpload, ActionCreateDirectory, ActionRename, ActionMove, ActionCopy, ActionDelete, ActionRestore,
+}
+
+// Record appends event to audit log with time, IP and user agent of request, and publishes successful
+// changes of files and directories to change journal of their owner, subscribed clients and webhooks
+// (see journal.Append, events.Publish and webhooks.Enqueue).
+//
+// Actor defaults to authenticated user and owner to owner of directory from access key in context,
+// result defaults to success. Errors are only logged, operation was already done
+func Record(c *gin.Context, db *mongo.Database, event models.AuditEvent) {
+	event.Id = uuid.New().String()
+	event.Time = time.Now().UnixMilli()
+	event.Ip = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+
+	if event.Actor == "" {
+		event.Actor = auth.UserIdFromContext(c)
+	}
+	if event.Owner == "" {
+		event.Owner = auth.DirectoryClaimsFromContext(c).DirectoryOwner()
+	}
+	if event.Result == "" {
+		event.Result = models.AuditResultSuccess
+	}
+	if event.Owner == event.Actor {
+		event.Owner = ""
+	}
+
+	if _, err := db.Collection("audit_events").InsertOne(c, event); err != nil {
+		log.Println(err)
+	}
+
+	if event.Result == models.AuditResultSuccess && helper.ArrayContains(ChangeActions, event.Action) {
+		change := models.ChangeEvent{
+			Action:       event.Action,
+			Kind:         event.Kind,
+			Actor:        event.Actor,
+			Targets:      event.Targets,
+			ParentBefore: event.ParentBefore,
+			ParentAfter:  event.ParentAfter,
+		}
+
+		// Items belong to actor unless owner is set
+		owner := event.Owner
+		if owner == "" {
+			owner = event.Actor
+		}
+		if err := journal.Append(c, db, owner, &change); err != nil {
+			log.Println(err)
+		}
+
+		// Webhooks don't depend on event stream, event has directories even if it wasn't published
+		if err := events.Publish(c, db, &change); err != nil {
+			log.Println(err)
+		}
+		if err := webhooks.Enqueue(c, db, &change); err != nil {
+			log.Println(err)
+		}
+	}
+}
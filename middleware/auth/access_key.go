@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+var (
+	FileSecretKey   = helper.GetEnv("FILE_SECRET_KEY", "file_secret")
+	FileSecretKeyId = helper.GetEnv("FILE_SECRET_KEY_ID", "1")
+
+	// Previous signing key is accepted during rotation, until FILE_SECRET_KEY_GRACE after FILE_SECRET_KEY_ROTATED_AT
+	PreviousFileSecretKey   = helper.GetEnv("FILE_SECRET_KEY_PREVIOUS", "")
+	PreviousFileSecretKeyId = helper.GetEnv("FILE_SECRET_KEY_PREVIOUS_ID", "")
+	FileSecretKeyRotatedAt  = parseRotatedAt("FILE_SECRET_KEY_ROTATED_AT")
+	FileSecretKeyGrace      = helper.GetEnvDuration("FILE_SECRET_KEY_GRACE", time.Hour*24)
+
+	AccessKeyDuration = helper.GetEnvDuration("ACCESS_KEY_DURATION", time.Hour*24)
+)
+
+type DirectoryClaims struct {
+	Id string `json:"id"`
+	// Owner of key, directory must belong to this user, or be shared with this user by Owner
+	User        string   `json:"user"`
+	Owner       string   `json:"owner,omitempty"`
+	Permissions []string `json:"permissions"`
+	// Must be equal to key generation of directory, incremented when key is rotated
+	Generation int64 `json:"gen"`
+	// Key also authorizes directories inside its directory
+	Recursive bool `json:"recursive,omitempty"`
+	// ID (jti) is only set for derived keys, it's id of DerivedKey record
+	jwt.RegisteredClaims
+}
+
+// Time of key rotation in RFC 3339 format, it's required if previous key is set
+func parseRotatedAt(key string) time.Time {
+	value := helper.GetEnv(key, "")
+	if value == "" {
+		if PreviousFileSecretKey != "" {
+			log.Fatal(key + " is required with FILE_SECRET_KEY_PREVIOUS")
+		}
+		return time.Time{}
+	}
+
+	rotatedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatal("invalid " + key + ": " + err.Error())
+	}
+	return rotatedAt
+}
+
+// GenerateDirectoryAccessKey
+// generates access key for directory with its owner, permissions and key generation of directory.
+//
+// Key expires after ACCESS_KEY_DURATION and is signed with current FILE_SECRET_KEY
+//
+//	directoryAccessKey, err := auth.GenerateDirectoryAccessKey(
+//	    directory.Id,
+//	    directory.User,
+//	    permissions,
+//	    directory.KeyGeneration,
+//	)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+func GenerateDirectoryAccessKey(
+	id, user string,
+	permissions []string,
+	generation int64,
+) (string, error) {
+	return signAccessKey(&DirectoryClaims{
+		Id:          id,
+		User:        user,
+		Permissions: permissions,
+		Generation:  generation,
+	})
+}
+
+// GenerateAccessKey generates access key for directory with all options: owner is set only if directory
+// is shared with user (permissions must be allowed by level of share), recursive key also authorizes
+// all directories inside directory with id
+func GenerateAccessKey(
+	id, user, owner string,
+	permissions []string,
+	generation int64,
+	recursive bool,
+) (string, error) {
+	return signAccessKey(&DirectoryClaims{
+		Id:          id,
+		User:        user,
+		Owner:       owner,
+		Permissions: permissions,
+		Generation:  generation,
+		Recursive:   recursive,
+	})
+}
+
+// GenerateAccessKeyLike generates access key for new directory with id
+// with the same user, owner and permissions as claims
+func GenerateAccessKeyLike(claims *DirectoryClaims, id string) (string, error) {
+	return signAccessKey(&DirectoryClaims{
+		Id:          id,
+		User:        claims.User,
+		Owner:       claims.Owner,
+		Permissions: claims.Permissions,
+	})
+}
+
+// Set issue and expiration dates of claims and sign them with current FILE_SECRET_KEY
+func signAccessKey(claims *DirectoryClaims) (string, error) {
+	now := time.Now()
+
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(AccessKeyDuration)),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	token.Header["kid"] = FileSecretKeyId
+
+	return token.SignedString([]byte(FileSecretKey))
+}
+
+// GenerateDerivedAccessKey generates access key for DerivedKey record.
+// Key doesn't expire if Expires of record is 0
+func GenerateDerivedAccessKey(key *models.DerivedKey, generation int64) (string, error) {
+	claims := &DirectoryClaims{
+		Id:          key.Directory,
+		User:        key.User,
+		Owner:       key.Owner,
+		Permissions: key.Permissions,
+		Generation:  generation,
+		Recursive:   key.Recursive,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       key.Id,
+			IssuedAt: jwt.NewNumericDate(time.UnixMilli(key.Created)),
+		},
+	}
+	if key.Expires != 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.UnixMilli(key.Expires))
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	token.Header["kid"] = FileSecretKeyId
+
+	return token.SignedString([]byte(FileSecretKey))
+}
+
+// Verify signature and expiry of access key, generation isn't checked
+func parseAccessKey(accessKey string) (*DirectoryClaims, error) {
+	token, err := jwt.ParseWithClaims(
+		accessKey,
+		&DirectoryClaims{},
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.New("unexpected signing method")
+			}
+
+			switch token.Header["kid"] {
+			case FileSecretKeyId:
+				return []byte(FileSecretKey), nil
+			case PreviousFileSecretKeyId:
+				if PreviousFileSecretKey == "" {
+					break
+				}
+				// Issue date isn't used, derived keys keep date of their record when they are signed again
+				if time.Now().After(FileSecretKeyRotatedAt.Add(FileSecretKeyGrace)) {
+					return nil, errors.New("grace period of previous key is over")
+				}
+				return []byte(PreviousFileSecretKey), nil
+			}
+
+			return nil, errors.New("unknown signing key")
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*DirectoryClaims)
+	if !ok {
+		return nil, errors.New("couldn't parse claims")
+	}
+
+	// Keys issued before expiry was introduced are never valid, only derived keys can be issued without expiry
+	if claims.ExpiresAt == nil && claims.ID == "" {
+		return nil, errors.New("access key doesn't expire")
+	}
+
+	return claims, nil
+}
+
+// DirectoryOwner returns owner of directory of key, it's different from User for directories shared with User
+func (claims *DirectoryClaims) DirectoryOwner() string {
+	if claims.Owner != "" {
+		return claims.Owner
+	}
+	return claims.User
+}
+
+// ValidateAccessKey checks signature, expiry, generation and owner of access key.
+//
+// Key is invalid after key of its directory was rotated or directory was deleted,
+// if directory doesn't belong to owner of key anymore, or isn't shared with user of key anymore.
+// In requests authenticated with Auth, key must belong to authenticated user
+func ValidateAccessKey(
+	ctx context.Context,
+	db *mongo.Database,
+	accessKey string,
+) (claims *DirectoryClaims, valid bool) {
+	claims, err := parseAccessKey(accessKey)
+	if err != nil || claims.User == "" {
+		return &DirectoryClaims{}, false
+	}
+
+	if c, ok := ctx.(*gin.Context); ok {
+		if signedClaims, exists := c.Get(claimsKey); exists && signedClaims.(*SignedClaims).Id != claims.User {
+			return &DirectoryClaims{}, false
+		}
+	}
+
+	var directory models.Directory
+
+	opts := options.FindOne().SetProjection(bson.D{
+		{Key: "user", Value: 1},
+		{Key: "key_generation", Value: 1},
+	})
+	err = db.Collection("directories").FindOne(ctx, bson.D{{Key: "_id", Value: claims.Id}}, opts).
+		Decode(&directory)
+	if err != nil || directory.KeyGeneration != claims.Generation {
+		return &DirectoryClaims{}, false
+	}
+
+	if directory.User != claims.DirectoryOwner() {
+		return &DirectoryClaims{}, false
+	}
+
+	// Share or group membership is checked for every request, so revoking it or lowering its level cuts access immediately
+	if claims.Owner != "" && claims.Owner != claims.User {
+		permissions, shared := SharedPermissions(ctx, db, claims.Id, claims.Owner, claims.User)
+		if !shared {
+			return &DirectoryClaims{}, false
+		}
+
+		for _, permission := range claims.Permissions {
+			if !helper.ArrayContains(permissions, permission) {
+				return &DirectoryClaims{}, false
+			}
+		}
+	}
+
+	// Derived key is revoked by removing its record
+	if claims.ID != "" {
+		count, err := db.Collection("derived_keys").CountDocuments(ctx, bson.D{
+			{Key: "_id", Value: claims.ID},
+			{Key: "directory", Value: claims.Id},
+		})
+		if err != nil || count == 0 {
+			return &DirectoryClaims{}, false
+		}
+	}
+
+	return claims, true
+}
+
+// SharedPermissions returns permissions of user in directory with id which belongs to owner,
+// if directory is shared with user or owner is group user is member of
+func SharedPermissions(ctx context.Context, db *mongo.Database, id, owner, user string) ([]string, bool) {
+	share, err := models.FindDirectoryShare(ctx, db, id, user)
+	if err == nil {
+		return SharePermissions[share.Level], true
+	}
+	if err != mongo.ErrNoDocuments {
+		log.Println(err)
+		return nil, false
+	}
+
+	member, err := models.FindGroupMember(ctx, db, owner, user)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println(err)
+		}
+		return nil, false
+	}
+
+	return SharePermissions[models.GroupRoleLevels[member.Role]], true
+}
+
+// KeyCoversDirectory checks if access key authorizes directory with id:
+// it's directory of key, or directory inside it for recursive keys
+func KeyCoversDirectory(ctx context.Context, db *mongo.Database, claims *DirectoryClaims, id string) bool {
+	if claims.Id == id {
+		return true
+	}
+	if !claims.Recursive || id == "" {
+		return false
+	}
+
+	inside, err := models.IsInsideDirectory(ctx, db, id, claims.Id)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return inside
+}
+
+// ForDirectory returns copy of claims with Id of directory covered by key (see KeyCoversDirectory)
+func (claims *DirectoryClaims) ForDirectory(id string) *DirectoryClaims {
+	covered := *claims
+	covered.Id = id
+	return &covered
+}
+
+func ValidateAccessKeyWithId(
+	ctx context.Context,
+	db *mongo.Database,
+	accessKey, id string,
+) bool {
+	claims, valid := ValidateAccessKey(ctx, db, accessKey)
+	if !valid {
+		return false
+	}
+
+	return KeyCoversDirectory(ctx, db, claims, id)
+}
+
+// ValidatePermissions MUST only be used after ValidateAccessKey function
+func ValidatePermissions(accessKey, permission string) bool {
+	claims, err := parseAccessKey(accessKey)
+	if err != nil {
+		return false
+	}
+
+	return helper.ArrayContains(claims.Permissions, permission)
+}
+
+// AccessKeyOwner returns owner of directory of access key, MUST only be used after ValidateAccessKey function
+func AccessKeyOwner(accessKey string) string {
+	claims, err := parseAccessKey(accessKey)
+	if err != nil {
+		return ""
+	}
+
+	return claims.DirectoryOwner()
+}
+
+func ValidatePermissionsFromClaims(claims *DirectoryClaims, permission string) bool {
+	return helper.ArrayContains(claims.Permissions, permission)
+}
+
+// BatchAccessKey returns accessKey of item from request body, or key from DirectoryAccessKey header if it's empty,
+// so all items of batch request can be authorized with one recursive key
+func BatchAccessKey(c *gin.Context, accessKey string) string {
+	if accessKey == "" {
+		return c.GetHeader("DirectoryAccessKey")
+	}
+	return accessKey
+}
+
+// ValidateAccessKeyPermission validates access key from request body,
+// checks that it is for directory with id and has permission.
+// In requests with personal access token restricted to directory, directory must be inside its tree (see DirectoryAllowed)
+func ValidateAccessKeyPermission(
+	ctx context.Context,
+	db *mongo.Database,
+	accessKey, id, permission string,
+) bool {
+	if c, ok := ctx.(*gin.Context); ok && !DirectoryAllowed(c, id) {
+		return false
+	}
+
+	claims, valid := ValidateAccessKey(ctx, db, accessKey)
+	if !valid {
+		return false
+	}
+
+	return ValidatePermissionsFromClaims(claims, permission) && KeyCoversDirectory(ctx, db, claims, id)
+}
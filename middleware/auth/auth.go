@@ -1,8 +1,11 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -10,89 +13,76 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"ncloud-api/models"
 	"ncloud-api/utils/helper"
 )
 
-var (
-	SecretKey     = helper.GetEnv("SECRET_KEY", "secret")
-	FileSecretKey = helper.GetEnv("FILE_SECRET_KEY", "file_secret")
-)
+var SecretKey = helper.GetEnv("SECRET_KEY", "secret")
 
 type SignedClaims struct {
-	Id    string `json:"user_id"`
-	Token string `json:"token,omitempty"`
-	jwt.RegisteredClaims
-}
+	Id      string `json:"user_id"`
+	Session string `json:"session,omitempty"`
+	Token   string `json:"token,omitempty"`
+
+	// Only set for personal access tokens (they are not JWT)
+	PersonalAccessToken string `json:"-"`
+	Scope               string `json:"-"`
+	Directory           string `json:"-"`
+
+	// Loaded from database in Auth
+	Roles []string `json:"-"`
 
-type DirectoryClaims struct {
-	Id          string   `json:"id"`
-	Permissions []string `json:"permissions"`
 	jwt.RegisteredClaims
 }
 
-func GenerateTokens(userId string) (accessToken, refreshToken string, err error) {
-	newToken, err := generateAccessToken(userId)
+// RefreshTokenDuration is time after which unused session expires
+const RefreshTokenDuration = time.Hour * 168
+
+// GenerateTokens
+// generates access token for user and session, and new opaque refresh token.
+//
+// Refresh token isn't JWT, it's random string that must be stored (hashed with HashToken) in session record
+func GenerateTokens(userId, sessionId string) (accessToken, refreshToken string, err error) {
+	newToken, err := generateAccessToken(userId, sessionId)
 	if err != nil {
-		log.Panic(err)
 		return "", "", err
 	}
 
-	// Refresh token for 7 days
-	refreshClaims := &SignedClaims{
-		Id:    userId,
-		Token: "refresh",
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(time.Hour * time.Duration(168))),
-		},
-	}
-
-	newRefreshToken, err := jwt.NewWithClaims(jwt.SigningMethodHS512, refreshClaims).
-		SignedString([]byte(SecretKey))
+	newRefreshToken, err := GenerateRandomToken()
 	if err != nil {
-		log.Panic(err)
 		return "", "", err
 	}
 
 	return newToken, newRefreshToken, nil
 }
 
-func GenerateAccessTokenFromRefreshToken(refreshToken string) (accessToken string, err error) {
-	token, err := jwt.ParseWithClaims(
-		refreshToken,
-		&SignedClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(SecretKey), nil
-		})
-	if err != nil {
-		fmt.Println(err)
-		err = errors.New("invalid refresh token")
-		return
-	}
-
-	claims, ok := token.Claims.(*SignedClaims)
-
-	if !ok {
-		return
-	}
-
-	if claims.ExpiresAt.Unix() < time.Now().Local().Unix() {
-		return "", errors.New("refresh token expired")
+// GenerateRandomToken returns 256-bit random string encoded with base64url
+func GenerateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
 
-	if claims.Token != "refresh" {
-		return "", errors.New("provided token is not refresh token")
-	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
-	newAccessToken, _ := generateAccessToken(claims.Id)
+// HashToken returns SHA-256 hash of random token.
+// Random tokens have enough entropy, so they don't need slow password hash
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
 
-	return newAccessToken, nil
+	return hex.EncodeToString(hash[:])
 }
 
-func generateAccessToken(userId string) (accessToken string, err error) {
+func generateAccessToken(userId, sessionId string) (accessToken string, err error) {
 	// Access token for 20 minutes
 	claims := &SignedClaims{
-		Id: userId,
+		Id:      userId,
+		Session: sessionId,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(time.Minute * time.Duration(20))),
 		},
@@ -107,80 +97,35 @@ func generateAccessToken(userId string) (accessToken string, err error) {
 	return newToken, nil
 }
 
-// GenerateDirectoryAccessKey
-// generates access key for file or directory with parameters:
-//
-//	id, permissions, parentDirectory (optional)
-//
-// parentDirectory should only be used for files and doesn't need to be verified before
-//
-// although parentDirectory is optional as function argument, it is MANDATORY to use parentDirectory for files
-//
-//	directoryAccessKey, err := auth.GenerateDirectoryAccessKey(fileId, permissions, directory)
-//	if err != nil {
-//	    log.Fatal(err)
-//	}
-//	fmt.Println(directoryAccessKey.id)
-//	fmt.Println(directoryAccessKey.permissions)
-func GenerateDirectoryAccessKey(id string, permissions []string) (string, error) {
-	claims := &DirectoryClaims{
-		Id:          id,
-		Permissions: permissions,
-	}
+// MfaTokenDuration is time user has to provide second factor after password was verified
+const MfaTokenDuration = time.Minute * 5
 
-	newToken, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).
-		SignedString([]byte(FileSecretKey))
-	if err != nil {
-		return "", err
+// GenerateMfaToken generates short-lived challenge token for user who passed password check,
+// but still needs to provide second factor. It can only be exchanged for real tokens
+func GenerateMfaToken(userId string) (string, error) {
+	claims := &SignedClaims{
+		Id:    userId,
+		Token: "mfa",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(MfaTokenDuration)),
+		},
 	}
 
-	return newToken, nil
+	return jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte(SecretKey))
 }
 
-func ValidateAccessKey(accessKey string) (claims *DirectoryClaims, valid bool) {
-	token, err := jwt.ParseWithClaims(
-		accessKey,
-		&DirectoryClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(FileSecretKey), nil
-		})
+// ValidateMfaToken returns claims of valid challenge token generated with GenerateMfaToken
+func ValidateMfaToken(mfaToken string) (*SignedClaims, error) {
+	claims, err := ValidateToken(mfaToken)
 	if err != nil {
-		return &DirectoryClaims{}, false
-	}
-
-	claims, ok := token.Claims.(*DirectoryClaims)
-
-	if !ok {
-		return &DirectoryClaims{}, false
+		return nil, err
 	}
 
-	return claims, true
-}
-
-func ValidateAccessKeyWithId(accessKey, id string) bool {
-	claims, valid := ValidateAccessKey(accessKey)
-	if !valid {
-		return false
+	if claims.Token != "mfa" {
+		return nil, errors.New("provided token is not mfa token")
 	}
 
-	return claims.Id == id
-}
-
-// ValidatePermissions MUST only be used after ValidateAccessKey function
-func ValidatePermissions(accessKey, permission string) bool {
-	token, _ := jwt.ParseWithClaims(
-		accessKey,
-		&DirectoryClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(FileSecretKey), nil
-		})
-
-	claims, _ := token.Claims.(*DirectoryClaims)
-	return helper.ArrayContains(claims.Permissions, permission)
-}
-
-func ValidatePermissionsFromClaims(claims *DirectoryClaims, permission string) bool {
-	return helper.ArrayContains(claims.Permissions, permission)
+	return claims, nil
 }
 
 func ValidateToken(signedToken string) (claims *SignedClaims, err error) {
@@ -245,16 +190,29 @@ func ExtractClaims(signedToken string) *SignedClaims {
 //
 // # Return JWT claims from gin.Context as SignedClaims
 //
+// Claims saved by Auth middleware are returned if present (also for personal access tokens).
 // This function does not contain any checks for validity
 // It should only be used after successfully passing ValidateToken method
 func ExtractClaimsFromContext(c *gin.Context) *SignedClaims {
+	if claims, exists := c.Get(claimsKey); exists {
+		return claims.(*SignedClaims)
+	}
+
 	token := c.GetHeader("Authorization")
 	token = token[len("Bearer "):]
 
 	return ExtractClaims(token)
 }
 
-func Auth() gin.HandlerFunc {
+// UserIdFromContext returns id of user authenticated by Auth middleware, or empty string on public routes
+func UserIdFromContext(c *gin.Context) string {
+	if claims, exists := c.Get(claimsKey); exists {
+		return claims.(*SignedClaims).Id
+	}
+	return ""
+}
+
+func Auth(db *mongo.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
 
@@ -269,9 +227,13 @@ func Auth() gin.HandlerFunc {
 
 		token = token[len("Bearer "):]
 
+		if strings.HasPrefix(token, PersonalAccessTokenPrefix) {
+			authPersonalAccessToken(c, db, token)
+			return
+		}
+
 		claims, err := ValidateToken(token)
 		if err != nil {
-			fmt.Print("XD")
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "invalid access token",
 			})
@@ -280,11 +242,150 @@ func Auth() gin.HandlerFunc {
 			return
 		}
 
-		if claims.Token == "refresh" {
+		if claims.Token != "" {
 			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "provided token is refresh token (should be access token)",
+				"error": "provided token is " + claims.Token + " token (should be access token)",
+			})
+			c.Header("WWW-Authenticate", "provided token is "+claims.Token+" token (should be access token)")
+			c.Abort()
+			return
+		}
+
+		if !loadUser(c, db, claims) {
+			return
+		}
+
+		c.Set(claimsKey, claims)
+
+		c.Next()
+	}
+}
+
+// OptionalAuth authenticates requests with Authorization header with Auth, so personal access tokens keep their
+// scope and directory restriction. Requests without it are authorized only by access keys
+func OptionalAuth(db *mongo.Database) gin.HandlerFunc {
+	authHeader := Auth(db)
+
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+
+		authHeader(c)
+	}
+}
+
+// BasicAuth authenticates clients which only support basic authentication (WebDAV).
+// Password is personal access token (app password) of user with username
+func BasicAuth(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			basicAuthFailed(c, "no credentials")
+			return
+		}
+
+		claims, err := validatePersonalAccessToken(c, db, password)
+		if err != nil {
+			basicAuthFailed(c, err.Error())
+			return
+		}
+
+		count, err := db.Collection("user").CountDocuments(c, bson.D{
+			{Key: "_id", Value: claims.Id},
+			{Key: "username", Value: username},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if count == 0 {
+			basicAuthFailed(c, "invalid username")
+			return
+		}
+
+		if !loadUser(c, db, claims) {
+			return
+		}
+
+		c.Set(claimsKey, claims)
+
+		c.Next()
+	}
+}
+
+func basicAuthFailed(c *gin.Context, reason string) {
+	c.Header("WWW-Authenticate", `Basic realm="ncloud", charset="UTF-8"`)
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error": reason,
+	})
+	c.Abort()
+}
+
+// Load roles of user and reject requests of deleted and suspended users and of revoked sessions.
+// Request is aborted if false is returned
+func loadUser(c *gin.Context, db *mongo.Database, claims *SignedClaims) bool {
+	if status, reason := checkUser(c, db, claims); status != 0 {
+		c.JSON(status, gin.H{
+			"error": reason,
+		})
+		c.Abort()
+		return false
+	}
+
+	return true
+}
+
+// Load roles of user, status and reason are returned if user can't make requests
+func checkUser(c *gin.Context, db *mongo.Database, claims *SignedClaims) (status int, reason string) {
+	var user models.User
+
+	opts := options.FindOne().SetProjection(bson.D{
+		{Key: "roles", Value: 1},
+		{Key: "suspended", Value: 1},
+	})
+
+	err := db.Collection("user").FindOne(c, bson.D{{Key: "_id", Value: claims.Id}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return http.StatusUnauthorized, "user doesn't exist"
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if user.Suspended {
+		return http.StatusForbidden, "account is suspended"
+	}
+
+	// Access tokens of revoked sessions (logout, password change) can't be used until they expire
+	if claims.Session != "" {
+		count, err := db.Collection("sessions").CountDocuments(c, bson.D{
+			{Key: "_id", Value: claims.Session},
+			{Key: "user", Value: claims.Id},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if count == 0 {
+			return http.StatusUnauthorized, "session was revoked"
+		}
+	}
+
+	claims.Roles = user.Roles
+
+	return 0, ""
+}
+
+// RequireRole allows only users with role, must be used after Auth.
+// Personal access tokens are rejected, roles can only be used with token from login
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := ExtractClaimsFromContext(c)
+
+		if claims.PersonalAccessToken != "" || !helper.ArrayContains(claims.Roles, role) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "insufficient permissions",
 			})
-			c.Header("WWW-Authenticate", "provided token is refresh token (should be access token)")
 			c.Abort()
 			return
 		}
@@ -292,3 +393,39 @@ func Auth() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func authPersonalAccessToken(c *gin.Context, db *mongo.Database, token string) {
+	claims, err := validatePersonalAccessToken(c, db, token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+		})
+		c.Header("WWW-Authenticate", err.Error())
+		c.Abort()
+		return
+	}
+
+	if !IsScopeAllowed(claims, c.Request.Method, c.FullPath()) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "personal access token scope doesn't allow this operation",
+		})
+		c.Abort()
+		return
+	}
+
+	if !loadUser(c, db, claims) {
+		return
+	}
+
+	if claims.Directory != "" {
+		allowedDirectories, err := models.FindDirectoryTree(db, claims.Id, claims.Directory)
+		if err != nil {
+			log.Panic(err)
+		}
+		c.Set(allowedDirectoriesKey, allowedDirectories)
+	}
+
+	c.Set(claimsKey, claims)
+
+	c.Next()
+}
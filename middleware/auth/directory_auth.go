@@ -2,23 +2,26 @@ package auth
 
 import (
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
 	"net/http"
 )
 
-func DirectoryAuth() gin.HandlerFunc {
+func DirectoryAuth(db *mongo.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		directoryAccessKey := c.GetHeader("DirectoryAccessKey")
 		directory := c.Param("id")
 
 		// Verify access key
-		claims, isValidAccessKey := ValidateAccessKey(directoryAccessKey)
-		if !isValidAccessKey || directoryAccessKey == "" || claims.Id != directory {
+		claims, isValidAccessKey := ValidateAccessKey(c, db, directoryAccessKey)
+		if !isValidAccessKey || directoryAccessKey == "" || !KeyCoversDirectory(c, db, claims, directory) ||
+			!DirectoryAllowed(c, directory) {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": "invalid access key",
 			})
 			c.Abort()
 			return
 		}
+		c.Set(directoryClaimsKey, claims.ForDirectory(directory))
 		c.Next()
 	}
 }
\ No newline at end of file
@@ -4,6 +4,11 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/models"
 )
 
 type AccessKey struct {
@@ -11,16 +16,37 @@ type AccessKey struct {
 	Permissions []string
 }
 
-func FileAuth() gin.HandlerFunc {
+// FileAuth verifies access key of parent directory and checks that requested file is inside this directory
+// (or inside its subdirectory for recursive keys)
+func FileAuth(db *mongo.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		parentDirectoryAccessKey := c.GetHeader("DirectoryAccessKey")
-		_, isValidAccessKey := ValidateAccessKey(parentDirectoryAccessKey)
+		claims, isValidAccessKey := ValidateAccessKey(c, db, parentDirectoryAccessKey)
 		if !isValidAccessKey {
 			c.Status(http.StatusForbidden)
 			c.Abort()
 			return
 		}
 
+		var file models.File
+
+		opts := options.FindOne().SetProjection(bson.D{{Key: "parent_directory", Value: 1}})
+		err := db.Collection("files").FindOne(c, bson.D{{Key: "_id", Value: c.Param("id")}}, opts).Decode(&file)
+		if err != nil || !KeyCoversDirectory(c, db, claims, file.ParentDirectory) {
+			c.Status(http.StatusNotFound)
+			c.Abort()
+			return
+		}
+
+		if !DirectoryAllowed(c, file.ParentDirectory) {
+			c.Status(http.StatusForbidden)
+			c.Abort()
+			return
+		}
+
+		// Handlers use Id of claims as directory of file
+		c.Set(directoryClaimsKey, claims.ForDirectory(file.ParentDirectory))
+
 		c.Next()
 	}
 }
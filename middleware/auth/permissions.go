@@ -1,5 +1,13 @@
 package auth
 
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/models"
+)
+
 const (
 	PermissionRead   = "read"
 	PermissionModify = "modify"
@@ -14,3 +22,39 @@ var AllDirectoryPermissions = []string{
 	PermissionDelete,
 	PermissionUpload,
 }
+
+// Permissions of access keys for directories shared with other users, by level of share
+var SharePermissions = map[string][]string{
+	models.ShareLevelRead:   {PermissionRead},
+	models.ShareLevelUpload: {PermissionRead, PermissionUpload},
+	models.ShareLevelEdit:   AllDirectoryPermissions,
+}
+
+// Set by DirectoryAuth and FileAuth
+const directoryClaimsKey = "directory_claims"
+
+// DirectoryClaimsFromContext returns claims of access key from DirectoryAccessKey header,
+// verified by DirectoryAuth or FileAuth
+func DirectoryClaimsFromContext(c *gin.Context) *DirectoryClaims {
+	if claims, exists := c.Get(directoryClaimsKey); exists {
+		return claims.(*DirectoryClaims)
+	}
+	return &DirectoryClaims{}
+}
+
+// RequirePermission allows request only if access key from DirectoryAccessKey header has permission.
+// Must be used after DirectoryAuth or FileAuth, access keys from request body are checked in handlers
+// with ValidateAccessKeyPermission
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ValidatePermissionsFromClaims(DirectoryClaimsFromContext(c), permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "no " + permission + " permission",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/models"
+)
+
+// S3Error is error response of S3-compatible API
+type S3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestId string   `xml:"RequestId"`
+}
+
+// AbortWithS3Error responds with S3 error and aborts request
+func AbortWithS3Error(c *gin.Context, status int, code, message string) {
+	c.XML(status, S3Error{
+		Code:     code,
+		Message:  message,
+		Resource: c.Request.URL.Path,
+	})
+	c.Abort()
+}
+
+// S3Auth authenticates requests of S3-compatible API signed with AWS Signature Version 4,
+// in Authorization header or query of presigned URL. Access key pair is S3 credential of user
+func S3Auth(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" && c.Query("X-Amz-Algorithm") == "" {
+			AbortWithS3Error(c, http.StatusForbidden, "AccessDenied", "anonymous access isn't allowed")
+			return
+		}
+
+		request, err := parseSigV4Request(c.Request)
+		if err != nil {
+			AbortWithS3Error(c, http.StatusBadRequest, "AuthorizationHeaderMalformed", err.Error())
+			return
+		}
+
+		expired, skewed := request.checkTime(time.Now())
+		if expired {
+			AbortWithS3Error(c, http.StatusForbidden, "AccessDenied", "request has expired")
+			return
+		}
+		if skewed {
+			AbortWithS3Error(c, http.StatusForbidden, "RequestTimeTooSkewed",
+				"difference between request time and server time is too large")
+			return
+		}
+
+		var credential models.S3Credential
+
+		collection := db.Collection("s3_credentials")
+
+		err = collection.FindOne(c, bson.D{{Key: "_id", Value: request.accessKeyId}}).Decode(&credential)
+		if err == mongo.ErrNoDocuments {
+			AbortWithS3Error(c, http.StatusForbidden, "InvalidAccessKeyId", "access key id doesn't exist")
+			return
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+
+		key := request.signingKey(credential.Secret)
+		if !hmacEqual(request.sign(c.Request, key), request.signature) {
+			AbortWithS3Error(c, http.StatusForbidden, "SignatureDoesNotMatch",
+				"signature of request doesn't match signature computed with secret access key")
+			return
+		}
+
+		if err := request.verifyBody(c.Request, key); err != nil {
+			AbortWithS3Error(c, http.StatusBadRequest, "InvalidRequest", err.Error())
+			return
+		}
+
+		claims := &SignedClaims{Id: credential.User, Scope: credential.Scope}
+		if status, reason := checkUser(c, db, claims); status != 0 {
+			AbortWithS3Error(c, http.StatusForbidden, "AccessDenied", reason)
+			return
+		}
+
+		// Save last usage at most once per minute
+		now := time.Now().UnixMilli()
+		if now-credential.LastUsed > time.Minute.Milliseconds() {
+			if _, err := collection.UpdateOne(c,
+				bson.D{{Key: "_id", Value: credential.Id}},
+				bson.D{{Key: "$set", Value: bson.M{"last_used": now}}},
+			); err != nil {
+				log.Println(err)
+			}
+		}
+
+		c.Set(claimsKey, claims)
+
+		c.Next()
+	}
+}
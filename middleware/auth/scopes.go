@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+// Scopes of personal access tokens and S3 credentials
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeFull   = "full"
+)
+
+// PersonalAccessTokenPrefix is used to distinguish personal access tokens from JWT
+const PersonalAccessTokenPrefix = "ncp_"
+
+// Routes available for personal access tokens with limited scope or directory restriction.
+// Every other route requires full scope without directory restriction
+var scopeRoutes = map[string][]string{
+	"GET /api/directories":        {ScopeRead},
+	"GET /api/directories/:id":    {ScopeRead},
+	"GET /api/directories/search": {ScopeRead},
+	"GET /files/:id":              {ScopeRead},
+	"POST /api/files/download":    {ScopeRead},
+	"POST /api/upload/:id":        {ScopeUpload},
+	"POST /api/directories/:id":   {ScopeUpload},
+	"PATCH /api/directories/:id":  {},
+	"PATCH /api/files/:id":        {},
+}
+
+// Directory permissions allowed by scope, used where personal access tokens and S3 credentials authorize
+// directories without access keys (WebDAV and S3-compatible API)
+var ScopePermissions = map[string][]string{
+	ScopeRead:   {PermissionRead},
+	ScopeUpload: {PermissionRead, PermissionUpload},
+	ScopeFull:   AllDirectoryPermissions,
+}
+
+// Context keys set by Auth
+const (
+	claimsKey             = "claims"
+	allowedDirectoriesKey = "allowed_directories"
+)
+
+// GeneratePersonalAccessToken returns new random personal access token with prefix
+func GeneratePersonalAccessToken() (string, error) {
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	return PersonalAccessTokenPrefix + token, nil
+}
+
+// IsScopeAllowed checks if personal access token claims can be used for route
+func IsScopeAllowed(claims *SignedClaims, method, route string) bool {
+	if claims.PersonalAccessToken == "" {
+		return true
+	}
+
+	if claims.Scope == ScopeFull && claims.Directory == "" {
+		return true
+	}
+
+	scopes, ok := scopeRoutes[method+" "+route]
+	if !ok {
+		return false
+	}
+
+	return claims.Scope == ScopeFull || helper.ArrayContains(scopes, claims.Scope)
+}
+
+// AllowedDirectories returns directory tree available for token used in request.
+// Tree exists only for personal access tokens restricted to directory
+func AllowedDirectories(c *gin.Context) (directories []string, restricted bool) {
+	allowed, exists := c.Get(allowedDirectoriesKey)
+	if !exists {
+		return nil, false
+	}
+
+	return allowed.([]string), true
+}
+
+// DirectoryAllowed checks if directory can be accessed with token used in request.
+// It's false only for personal access tokens restricted to directory tree without this directory
+func DirectoryAllowed(c *gin.Context, directoryId string) bool {
+	allowed, restricted := AllowedDirectories(c)
+	if !restricted {
+		return true
+	}
+
+	return helper.ArrayContains(allowed, directoryId)
+}
+
+// validatePersonalAccessToken finds token by its hash and returns claims based on it
+func validatePersonalAccessToken(
+	ctx context.Context,
+	db *mongo.Database,
+	token string,
+) (*SignedClaims, error) {
+	if !strings.HasPrefix(token, PersonalAccessTokenPrefix) {
+		return nil, errors.New("invalid personal access token")
+	}
+
+	var accessToken models.PersonalAccessToken
+
+	now := time.Now().UnixMilli()
+	collection := db.Collection("access_tokens")
+
+	err := collection.FindOne(ctx, bson.D{{Key: "token_hash", Value: HashToken(token)}}).
+		Decode(&accessToken)
+	if err != nil {
+		return nil, errors.New("invalid personal access token")
+	}
+
+	if accessToken.Expires != 0 && accessToken.Expires < now {
+		return nil, errors.New("personal access token expired")
+	}
+
+	// Save last usage at most once per minute
+	if _, err := collection.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: accessToken.Id},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "last_used", Value: bson.D{{Key: "$exists", Value: false}}}},
+				bson.D{{Key: "last_used", Value: bson.D{{Key: "$lt", Value: now - time.Minute.Milliseconds()}}}},
+			}},
+		},
+		bson.D{{Key: "$set", Value: bson.M{"last_used": now}}},
+	); err != nil {
+		log.Println(err)
+	}
+
+	return &SignedClaims{
+		Id:                  accessToken.User,
+		PersonalAccessToken: accessToken.Id,
+		Scope:               accessToken.Scope,
+		Directory:           accessToken.Directory,
+	}, nil
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/crypto"
+	"ncloud-api/utils/helper"
+)
+
+// Set by ShareAuth
+const shareLinkKey = "share_link"
+
+// Share session is issued after password of link was verified, so password isn't checked with every request
+var ShareSessionDuration = helper.GetEnvDuration("SHARE_SESSION_DURATION", time.Hour)
+
+// PasswordLockout locks share link after repeated password failures, implemented by ratelimit.Lockout
+type PasswordLockout interface {
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+	RegisterFailure(ctx context.Context, key string) error
+	Reset(ctx context.Context, key string) error
+}
+
+type shareSessionClaims struct {
+	// Always "share", so session can't be used as access token
+	Token string `json:"token"`
+	Link  string `json:"link"`
+	// Hash of password hash, session ends when password of link is changed
+	Password string `json:"pwd"`
+	jwt.RegisteredClaims
+}
+
+func generateShareSession(link *models.ShareLink) (string, error) {
+	claims := &shareSessionClaims{
+		Token:    "share",
+		Link:     link.Id,
+		Password: HashToken(link.Password),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ShareSessionDuration)),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte(SecretKey))
+}
+
+func validateShareSession(session string, link *models.ShareLink) error {
+	claims := &shareSessionClaims{}
+
+	_, err := jwt.ParseWithClaims(session, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(SecretKey), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if claims.Token != "share" || claims.Link != link.Id ||
+		subtle.ConstantTimeCompare([]byte(claims.Password), []byte(HashToken(link.Password))) != 1 {
+		return errors.New("invalid share session")
+	}
+
+	return nil
+}
+
+// Verify session from ShareSession header, or password from SharePassword header.
+// New session is returned in ShareSession header after password is verified
+func authorizeSharePassword(c *gin.Context, lockout PasswordLockout, link *models.ShareLink) bool {
+	if session := c.GetHeader("ShareSession"); session != "" && validateShareSession(session, link) == nil {
+		return true
+	}
+
+	password := c.GetHeader("SharePassword")
+	if password == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid password",
+		})
+		return false
+	}
+
+	key := "share:" + link.Id
+
+	lockedFor, err := lockout.LockedFor(c, key)
+	if err != nil {
+		log.Println(err)
+	}
+	if lockedFor > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "share link temporarily locked",
+		})
+		return false
+	}
+
+	if !crypto.ComparePasswordAndHash(password, link.Password) {
+		if err := lockout.RegisterFailure(c, key); err != nil {
+			log.Println(err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid password",
+		})
+		return false
+	}
+
+	if err := lockout.Reset(c, key); err != nil {
+		log.Println(err)
+	}
+
+	session, err := generateShareSession(link)
+	if err != nil {
+		log.Panic(err)
+	}
+	c.Header("ShareSession", session)
+
+	return true
+}
+
+// ShareLinkFromContext returns share link verified by ShareAuth
+func ShareLinkFromContext(c *gin.Context) *models.ShareLink {
+	if link, exists := c.Get(shareLinkKey); exists {
+		return link.(*models.ShareLink)
+	}
+	return &models.ShareLink{}
+}
+
+// ShareAuth verifies share link from token parameter: its expiry and password from SharePassword header
+// (or share session issued after password was verified). Link is locked after repeated password failures.
+//
+// Claims of shared directory are set like in DirectoryAuth, so file handlers can be reused.
+// Directory shares are recursive, file requests only have upload permission for shared directory itself.
+// File shares don't have any permissions for directory of file,
+// the file itself is authorized with ShareFileAuth
+func ShareAuth(db *mongo.Database, lockout PasswordLockout) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var link models.ShareLink
+
+		err := db.Collection("share_links").FindOne(c, bson.D{{Key: "token_hash", Value: HashToken(c.Param("token"))}}).
+			Decode(&link)
+		if err != nil || (link.Expires != 0 && link.Expires < time.Now().UnixMilli()) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "share link doesn't exist",
+			})
+			c.Abort()
+			return
+		}
+
+		if link.Password != "" && !authorizeSharePassword(c, lockout, &link) {
+			c.Abort()
+			return
+		}
+
+		claims := &DirectoryClaims{Id: link.Directory, User: link.User, Permissions: []string{}}
+
+		if link.File != "" {
+			var file models.File
+
+			opts := options.FindOne().SetProjection(bson.D{{Key: "parent_directory", Value: 1}})
+			err := db.Collection("files").FindOne(c, bson.D{
+				{Key: "_id", Value: link.File},
+				{Key: "user", Value: link.User},
+			}, opts).Decode(&file)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				c.Abort()
+				return
+			}
+
+			claims.Id = file.ParentDirectory
+		} else {
+			count, err := db.Collection("directories").CountDocuments(c, bson.D{
+				{Key: "_id", Value: link.Directory},
+				{Key: "user", Value: link.User},
+			})
+			if err != nil || count == 0 {
+				c.Status(http.StatusNotFound)
+				c.Abort()
+				return
+			}
+
+			// File requests allow only uploads to shared directory itself
+			if link.Mode == models.ShareModeRequest {
+				claims.Permissions = []string{PermissionUpload}
+			} else {
+				claims.Recursive = true
+				claims.Permissions = []string{PermissionRead}
+				if link.Mode == models.ShareModeUpload {
+					claims.Permissions = append(claims.Permissions, PermissionUpload)
+				}
+			}
+		}
+
+		link.HasPassword = link.Password != ""
+
+		c.Set(shareLinkKey, &link)
+		c.Set(directoryClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// ShareFileAuth checks that file from id parameter is shared file, or is inside shared directory.
+// Must be used after ShareAuth
+func ShareFileAuth(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link := ShareLinkFromContext(c)
+		claims := DirectoryClaimsFromContext(c)
+		fileId := c.Param("id")
+
+		if link.File != "" {
+			if fileId != link.File {
+				c.Status(http.StatusNotFound)
+				c.Abort()
+				return
+			}
+
+			shared := claims.ForDirectory(claims.Id)
+			shared.Permissions = []string{PermissionRead}
+			c.Set(directoryClaimsKey, shared)
+			c.Next()
+			return
+		}
+
+		var file models.File
+
+		opts := options.FindOne().SetProjection(bson.D{{Key: "parent_directory", Value: 1}})
+		err := db.Collection("files").FindOne(c, bson.D{{Key: "_id", Value: fileId}}, opts).Decode(&file)
+		if err != nil || !KeyCoversDirectory(c, db, claims, file.ParentDirectory) {
+			c.Status(http.StatusNotFound)
+			c.Abort()
+			return
+		}
+
+		c.Set(directoryClaimsKey, claims.ForDirectory(file.ParentDirectory))
+		c.Next()
+	}
+}
+
+// CountShareDownload records download of share link, request is rejected if link reached its download limit.
+// Download is reserved before handler, so concurrent downloads can't exceed limit, and released if it fails.
+// Must be used after ShareAuth
+func CountShareDownload(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link := ShareLinkFromContext(c)
+
+		filter := bson.D{{Key: "_id", Value: link.Id}}
+		if link.MaxDownloads > 0 {
+			filter = append(filter, bson.E{Key: "downloads", Value: bson.D{{Key: "$lt", Value: link.MaxDownloads}}})
+		}
+
+		res, err := db.Collection("share_links").UpdateOne(c, filter, bson.D{
+			{Key: "$inc", Value: bson.M{"downloads": 1}},
+			{Key: "$set", Value: bson.M{"last_accessed": time.Now().UnixMilli()}},
+		})
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			c.Abort()
+			return
+		}
+
+		if res.MatchedCount == 0 {
+			c.JSON(http.StatusGone, gin.H{
+				"error": "download limit reached",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+
+		if status := c.Writer.Status(); status < 200 || status >= 300 {
+			if _, err := db.Collection("share_links").UpdateByID(context.TODO(), link.Id, bson.D{
+				{Key: "$inc", Value: bson.M{"downloads": -1}},
+			}); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
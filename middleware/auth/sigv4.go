@@ -0,0 +1,537 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ncloud-api/utils/helper"
+)
+
+// AWS Signature Version 4 of S3-compatible API
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4DateFormat  = "20060102"
+	sigV4Service     = "s3"
+	sigV4Termination = "aws4_request"
+
+	// Values of X-Amz-Content-Sha256 which aren't hash of payload
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// Allowed difference between time of request and server
+	sigV4MaxSkew = 15 * time.Minute
+	// Longest validity of presigned URL
+	sigV4MaxExpires = 7 * 24 * time.Hour
+)
+
+// Errors of reading body of S3 request, returned when body doesn't match its signature or hash
+var (
+	ErrContentSHA256Mismatch = errors.New("SHA-256 of body doesn't match x-amz-content-sha256")
+	ErrChunkSignatureInvalid = errors.New("signature of body chunk doesn't match")
+	ErrIncompleteBody        = errors.New("body is shorter than its declared length")
+)
+
+// GenerateS3Credentials returns new random access key id and secret access key
+func GenerateS3Credentials() (accessKeyId, secret string, err error) {
+	id := make([]byte, 10)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+
+	key := make([]byte, 30)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+
+	return "NC" + base32.StdEncoding.EncodeToString(id), base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Parsed signature of request, from Authorization header or query of presigned URL
+type sigV4Request struct {
+	accessKeyId   string
+	date          string
+	region        string
+	timestamp     time.Time
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	// Presigned URL is valid until timestamp + expires
+	presigned bool
+	expires   time.Duration
+}
+
+func (s *sigV4Request) scope() string {
+	return s.date + "/" + s.region + "/" + sigV4Service + "/" + sigV4Termination
+}
+
+// Parse signature of request, returned errors are messages of S3 error
+func parseSigV4Request(r *http.Request) (*sigV4Request, error) {
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return parseSigV4Query(r.URL.Query())
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, sigV4Algorithm+" ") {
+		return nil, errors.New("unsupported authorization type")
+	}
+
+	s := &sigV4Request{payloadHash: r.Header.Get("X-Amz-Content-Sha256")}
+
+	for _, field := range strings.Split(header[len(sigV4Algorithm)+1:], ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			if err := s.parseCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			s.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			s.signature = value
+		}
+	}
+
+	if s.accessKeyId == "" || len(s.signedHeaders) == 0 || s.signature == "" {
+		return nil, errors.New("authorization header is malformed")
+	}
+	if !helper.ArrayContains(s.signedHeaders, "host") {
+		return nil, errors.New("host header must be signed")
+	}
+	if s.payloadHash == "" {
+		return nil, errors.New("missing x-amz-content-sha256 header")
+	}
+
+	timestamp := r.Header.Get("X-Amz-Date")
+	if timestamp == "" {
+		return nil, errors.New("missing x-amz-date header")
+	}
+	if err := s.parseTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func parseSigV4Query(query url.Values) (*sigV4Request, error) {
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errors.New("unsupported signing algorithm")
+	}
+
+	s := &sigV4Request{
+		presigned:     true,
+		signedHeaders: strings.Split(query.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     query.Get("X-Amz-Signature"),
+		payloadHash:   query.Get("X-Amz-Content-Sha256"),
+	}
+	if s.payloadHash == "" {
+		s.payloadHash = unsignedPayload
+	}
+
+	if err := s.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if err := s.parseTimestamp(query.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires <= 0 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+		return nil, errors.New("X-Amz-Expires must be between 1 and 604800 seconds")
+	}
+	s.expires = time.Duration(expires) * time.Second
+
+	if s.signature == "" || s.signedHeaders[0] == "" {
+		return nil, errors.New("query parameters of presigned URL are malformed")
+	}
+	if !helper.ArrayContains(s.signedHeaders, "host") {
+		return nil, errors.New("host header must be signed")
+	}
+
+	return s, nil
+}
+
+// Credential is access key id and scope: AKID/20230101/us-east-1/s3/aws4_request
+func (s *sigV4Request) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] == "" || parts[3] != sigV4Service || parts[4] != sigV4Termination {
+		return errors.New("credential is malformed")
+	}
+
+	s.accessKeyId, s.date, s.region = parts[0], parts[1], parts[2]
+
+	return nil
+}
+
+func (s *sigV4Request) parseTimestamp(timestamp string) error {
+	t, err := time.Parse(sigV4TimeFormat, timestamp)
+	if err != nil {
+		return errors.New("x-amz-date is malformed")
+	}
+	if t.Format(sigV4DateFormat) != s.date {
+		return errors.New("date of credential doesn't match x-amz-date")
+	}
+
+	s.timestamp = t
+
+	return nil
+}
+
+// Check if request was signed recently, or if presigned URL is still valid
+func (s *sigV4Request) checkTime(now time.Time) (expired, skewed bool) {
+	if s.presigned {
+		return now.After(s.timestamp.Add(s.expires)), s.timestamp.After(now.Add(sigV4MaxSkew))
+	}
+
+	return false, s.timestamp.Before(now.Add(-sigV4MaxSkew)) || s.timestamp.After(now.Add(sigV4MaxSkew))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *sigV4Request) signingKey(secret string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), s.date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, sigV4Service)
+
+	return hmacSHA256(key, sigV4Termination)
+}
+
+// Signature of request computed with secret of credential
+func (s *sigV4Request) sign(r *http.Request, key []byte) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		s.timestamp.Format(sigV4TimeFormat),
+		s.scope(),
+		sha256Hex([]byte(s.canonicalRequest(r))),
+	}, "\n")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func (s *sigV4Request) canonicalRequest(r *http.Request) string {
+	var headers strings.Builder
+	for _, name := range s.signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if value == "" {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			values := make([]string, 0, 1)
+			for _, v := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		sigV4Escape(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(s.signedHeaders, ";"),
+		s.payloadHash,
+	}, "\n")
+}
+
+// Query sorted by names and values, without signature of presigned URL
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, sigV4Escape(name, true)+"="+sigV4Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// URI encoding of AWS, only unreserved characters (and slashes of path) aren't encoded
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' && !encodeSlash {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+
+	return b.String()
+}
+
+// Replace body of request with reader which verifies it against signature of request.
+// Verification errors are returned from Read
+func (s *sigV4Request) verifyBody(r *http.Request, key []byte) error {
+	switch s.payloadHash {
+	case unsignedPayload:
+		return nil
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return errors.New("missing x-amz-decoded-content-length header")
+		}
+
+		reader := &chunkedReader{
+			body:      r.Body,
+			r:         bufio.NewReader(r.Body),
+			remaining: decoded,
+			trailer:   s.payloadHash != streamingPayload,
+		}
+		if s.payloadHash != streamingUnsignedTrailer {
+			reader.signer = &chunkSigner{request: s, key: key, previous: s.signature}
+		}
+
+		r.Body = reader
+		r.ContentLength = decoded
+		return nil
+	}
+
+	expected, err := hex.DecodeString(s.payloadHash)
+	if err != nil || len(expected) != sha256.Size {
+		return errors.New("x-amz-content-sha256 is malformed")
+	}
+
+	r.Body = &hashedReader{ReadCloser: r.Body, hash: sha256.New(), expected: expected}
+	return nil
+}
+
+// hashedReader returns ErrContentSHA256Mismatch at the end of body if its hash is different
+type hashedReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func (h *hashedReader) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.hash.Write(p[:n])
+
+	if errors.Is(err, io.EOF) && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, ErrContentSHA256Mismatch
+	}
+
+	return n, err
+}
+
+// chunkSigner verifies signatures of chunks, each is signed with signature of previous one
+type chunkSigner struct {
+	request  *sigV4Request
+	key      []byte
+	previous string
+}
+
+func (s *chunkSigner) verify(kind, hash, signature string) bool {
+	parts := []string{
+		sigV4Algorithm + "-" + kind,
+		s.request.timestamp.Format(sigV4TimeFormat),
+		s.request.scope(),
+		s.previous,
+	}
+	if kind == "PAYLOAD" {
+		parts = append(parts, sha256Hex(nil))
+	}
+	parts = append(parts, hash)
+
+	expected := hex.EncodeToString(hmacSHA256(s.key, strings.Join(parts, "\n")))
+	s.previous = signature
+
+	return hmacEqual(expected, signature)
+}
+
+// chunkedReader decodes aws-chunked body: "size[;chunk-signature=signature]\r\ndata\r\n",
+// ended by chunk of size 0 and optional trailing headers
+type chunkedReader struct {
+	body   io.Closer
+	r      *bufio.Reader
+	signer *chunkSigner
+	// Body ends with trailing headers (checksums)
+	trailer bool
+
+	// Decoded bytes which weren't read yet
+	remaining int64
+	// Unread bytes of current chunk
+	chunk     int64
+	inChunk   bool
+	hash      hash.Hash
+	signature string
+	err       error
+}
+
+func (cr *chunkedReader) Close() error {
+	return cr.body.Close()
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	if cr.chunk == 0 {
+		if err := cr.next(); err != nil {
+			cr.err = err
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > cr.chunk {
+		p = p[:cr.chunk]
+	}
+
+	n, err := cr.r.Read(p)
+	cr.hash.Write(p[:n])
+	cr.chunk -= int64(n)
+	cr.remaining -= int64(n)
+
+	if errors.Is(err, io.EOF) {
+		err = ErrIncompleteBody
+	}
+	if err != nil {
+		cr.err = err
+	}
+
+	return n, err
+}
+
+// Finish current chunk and start next one, io.EOF is returned after last chunk
+func (cr *chunkedReader) next() error {
+	if cr.inChunk {
+		if line, err := cr.readLine(); err != nil || line != "" {
+			return ErrIncompleteBody
+		}
+		if err := cr.verifyChunk(); err != nil {
+			return err
+		}
+		cr.inChunk = false
+	}
+
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeHex, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > cr.remaining {
+		return ErrIncompleteBody
+	}
+
+	cr.hash = sha256.New()
+	cr.signature = strings.TrimPrefix(extension, "chunk-signature=")
+
+	if size > 0 {
+		cr.chunk = size
+		cr.inChunk = true
+		return nil
+	}
+
+	if cr.remaining != 0 {
+		return ErrIncompleteBody
+	}
+	if err := cr.verifyChunk(); err != nil {
+		return err
+	}
+	if err := cr.readTrailer(); err != nil {
+		return err
+	}
+
+	return io.EOF
+}
+
+func (cr *chunkedReader) verifyChunk() error {
+	if cr.signer == nil {
+		return nil
+	}
+
+	if !cr.signer.verify("PAYLOAD", hex.EncodeToString(cr.hash.Sum(nil)), cr.signature) {
+		return ErrChunkSignatureInvalid
+	}
+
+	return nil
+}
+
+// Trailing headers end with empty line, their signature is the last header
+func (cr *chunkedReader) readTrailer() error {
+	var headers strings.Builder
+	signature := ""
+
+	for {
+		line, err := cr.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		if !cr.trailer {
+			return ErrIncompleteBody
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		if strings.ToLower(name) == "x-amz-trailer-signature" {
+			signature = strings.TrimSpace(value)
+			continue
+		}
+		headers.WriteString(strings.ToLower(name) + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	if cr.signer != nil && cr.trailer &&
+		!cr.signer.verify("TRAILER", sha256Hex([]byte(headers.String())), signature) {
+		return ErrChunkSignatureInvalid
+	}
+
+	return nil
+}
+
+func (cr *chunkedReader) readLine() (string, error) {
+	line, err := cr.r.ReadSlice('\n')
+	if err != nil {
+		return "", ErrIncompleteBody
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func hmacEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/models"
+)
+
+// StreamTicketDuration is time client has to open event stream after ticket was issued
+const StreamTicketDuration = time.Second * 30
+
+// Set by StreamAuth
+const streamTicketKey = "stream_ticket"
+
+// GenerateStreamTicket stores single-use ticket for user and session of claims with access keys
+// (they must be already validated), ticket itself is returned
+func GenerateStreamTicket(
+	ctx context.Context,
+	db *mongo.Database,
+	claims *SignedClaims,
+	accessKeys []string,
+) (string, error) {
+	ticket, err := GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := db.Collection("stream_tickets").InsertOne(ctx, models.StreamTicket{
+		TicketHash: HashToken(ticket),
+		User:       claims.Id,
+		Session:    claims.Session,
+		AccessKeys: accessKeys,
+		Expires:    time.Now().Add(StreamTicketDuration),
+	}); err != nil {
+		return "", err
+	}
+
+	return ticket, nil
+}
+
+// StreamTicketFromContext returns ticket verified by StreamAuth, it's empty if request was authorized with header
+func StreamTicketFromContext(c *gin.Context) *models.StreamTicket {
+	if ticket, exists := c.Get(streamTicketKey); exists {
+		return ticket.(*models.StreamTicket)
+	}
+	return &models.StreamTicket{}
+}
+
+// StreamAuth authorizes event stream with ticket from ticket query parameter, because browsers
+// can't set headers of EventSource and WebSocket requests. Ticket is removed, so it can't be used again.
+// Requests without ticket are authorized with Auth
+func StreamAuth(db *mongo.Database) gin.HandlerFunc {
+	authHeader := Auth(db)
+
+	return func(c *gin.Context) {
+		token := c.Query("ticket")
+		if token == "" {
+			authHeader(c)
+			return
+		}
+
+		var ticket models.StreamTicket
+
+		err := db.Collection("stream_tickets").FindOneAndDelete(c, bson.D{
+			{Key: "_id", Value: HashToken(token)},
+			{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+		}).Decode(&ticket)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid or expired ticket",
+			})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+
+		claims := &SignedClaims{Id: ticket.User, Session: ticket.Session}
+		if !loadUser(c, db, claims) {
+			return
+		}
+
+		c.Set(claimsKey, claims)
+		c.Set(streamTicketKey, &ticket)
+
+		c.Next()
+	}
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/models"
+)
+
+// MongoMonitor returns command monitor recording latency and errors of every MongoDB command
+//
+//	options.Client().SetMonitor(metrics.MongoMonitor())
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			DatabaseDuration.WithLabelValues(DatabaseMongo, e.CommandName).
+				Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			DatabaseDuration.WithLabelValues(DatabaseMongo, e.CommandName).
+				Observe(time.Duration(e.DurationNanos).Seconds())
+			DatabaseErrors.WithLabelValues(DatabaseMongo, e.CommandName).Inc()
+		},
+	}
+}
+
+// StorageCollector exposes total stored bytes and number of users
+//
+// Values are read from database on every scrape
+type StorageCollector struct {
+	db          *mongo.Database
+	storedBytes *prometheus.Desc
+	users       *prometheus.Desc
+}
+
+func NewStorageCollector(db *mongo.Database) *StorageCollector {
+	return &StorageCollector{
+		db: db,
+		storedBytes: prometheus.NewDesc(
+			"ncloud_stored_bytes",
+			"Total size of all stored files.",
+			nil, nil,
+		),
+		users: prometheus.NewDesc(
+			"ncloud_users",
+			"Number of registered users.",
+			nil, nil,
+		),
+	}
+}
+
+func (s *StorageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.storedBytes
+	ch <- s.users
+}
+
+func (s *StorageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	users, err := s.db.Collection("user").EstimatedDocumentCount(ctx)
+	if err != nil {
+		log.Println(err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(s.users, prometheus.GaugeValue, float64(users))
+	}
+
+	cursor, err := s.db.Collection("files").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "size", Value: bson.D{{Key: "$sum", Value: "$size"}}},
+		}}},
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var results []struct {
+		Size int64 `bson:"size"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		log.Println(err)
+		return
+	}
+
+	var storedBytes int64
+	if len(results) > 0 {
+		storedBytes = results[0].Size
+	}
+
+	ch <- prometheus.MustNewConstMetric(s.storedBytes, prometheus.GaugeValue, float64(storedBytes))
+}
+
+// QueueCollector exposes number of items waiting in background queues:
+// pending webhook deliveries and multipart uploads which weren't completed or aborted
+//
+// Values are read from database on every scrape
+type QueueCollector struct {
+	db         *mongo.Database
+	queueDepth *prometheus.Desc
+}
+
+// Queues and filters of their waiting items
+var queues = []struct {
+	name       string
+	collection string
+	filter     bson.D
+}{
+	{"webhook_deliveries", "webhook_deliveries", bson.D{{Key: "status", Value: models.DeliveryStatusPending}}},
+	{"multipart_uploads", "multipart_uploads", bson.D{}},
+}
+
+func NewQueueCollector(db *mongo.Database) *QueueCollector {
+	return &QueueCollector{
+		db: db,
+		queueDepth: prometheus.NewDesc(
+			"ncloud_queue_depth",
+			"Number of items waiting in background queues.",
+			[]string{"queue"}, nil,
+		),
+	}
+}
+
+func (q *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.queueDepth
+}
+
+func (q *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, queue := range queues {
+		count, err := q.db.Collection(queue.collection).CountDocuments(ctx, queue.filter)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(q.queueDepth, prometheus.GaugeValue, float64(count), queue.name)
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"ncloud-api/utils/helper"
+)
+
+var (
+	// Token is required as Bearer token when /metrics is served on the main router
+	Token = helper.GetEnv("METRICS_TOKEN", "")
+	// Address is used to serve /metrics on separate listener (e.g. 127.0.0.1:9100)
+	Address = helper.GetEnv("METRICS_ADDRESS", "")
+)
+
+var (
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ncloud",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by gin route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	BytesUploaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ncloud",
+		Name:      "uploaded_bytes_total",
+		Help:      "Total number of bytes uploaded.",
+	})
+
+	BytesDownloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ncloud",
+		Name:      "downloaded_bytes_total",
+		Help:      "Total number of bytes downloaded.",
+	})
+
+	Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ncloud",
+		Name:      "operations_total",
+		Help:      "Number of items affected by file and directory operations.",
+	}, []string{"operation", "kind"})
+
+	DatabaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ncloud",
+		Name:      "database_call_duration_seconds",
+		Help:      "Duration of MongoDB and Meilisearch calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"database", "operation"})
+
+	DatabaseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ncloud",
+		Name:      "database_call_errors_total",
+		Help:      "Number of failed MongoDB and Meilisearch calls.",
+	}, []string{"database", "operation"})
+)
+
+const (
+	OperationMove    = "move"
+	OperationCopy    = "copy"
+	OperationDelete  = "delete"
+	OperationRestore = "restore"
+
+	KindFile      = "file"
+	KindDirectory = "directory"
+
+	DatabaseMongo       = "mongodb"
+	DatabaseMeilisearch = "meilisearch"
+)
+
+func init() {
+	prometheus.MustRegister(
+		RequestDuration,
+		BytesUploaded,
+		BytesDownloaded,
+		Operations,
+		DatabaseDuration,
+		DatabaseErrors,
+	)
+}
+
+// Middleware records duration of every request with route template as label,
+// so /api/directories/:id is reported once instead of once per directory
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		RequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveOperation adds count of items affected by operation
+func ObserveOperation(operation, kind string, count int64) {
+	Operations.WithLabelValues(operation, kind).Add(float64(count))
+}
+
+// ObserveDatabaseCall records latency of database call and counts it as failed if err is not nil
+func ObserveDatabaseCall(database, operation string, start time.Time, err error) {
+	DatabaseDuration.WithLabelValues(database, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		DatabaseErrors.WithLabelValues(database, operation).Inc()
+	}
+}
+
+// Handler serves metrics in prometheus format
+//
+// If Token is set, request must contain header:
+//
+//	Authorization: Bearer <METRICS_TOKEN>
+func Handler() gin.HandlerFunc {
+	h := promhttp.Handler()
+
+	return func(c *gin.Context) {
+		if Token != "" {
+			token := c.GetHeader("Authorization")
+			if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+Token)) != 1 {
+				c.Status(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
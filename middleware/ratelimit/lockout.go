@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/utils/helper"
+)
+
+var (
+	// Number of failed logins after which account is locked
+	LockoutThreshold = int64(helper.GetEnvInt("LOCKOUT_THRESHOLD", 5))
+	// Lock duration after reaching threshold, doubled with every next failure
+	LockoutDuration    = helper.GetEnvDuration("LOCKOUT_DURATION", time.Minute)
+	LockoutMaxDuration = helper.GetEnvDuration("LOCKOUT_MAX_DURATION", time.Hour)
+	// Failures older than this are forgotten
+	LockoutFailureWindow = helper.GetEnvDuration("LOCKOUT_FAILURE_WINDOW", 24*time.Hour)
+	// Number of codes which can be tried with one MFA challenge token
+	LockoutMfaAttempts = int64(helper.GetEnvInt("LOCKOUT_MFA_ATTEMPTS", 3))
+)
+
+// Lockout implements progressive account lockout after repeated login failures
+type Lockout struct {
+	Store Store
+}
+
+// LockedFor returns how long username stays locked (0 if it isn't locked)
+func (l *Lockout) LockedFor(ctx context.Context, username string) (time.Duration, error) {
+	count, expires, err := l.Store.Get(ctx, "locked:"+username)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	return time.Until(expires), nil
+}
+
+// RegisterFailure counts failed login and locks username if threshold is reached
+func (l *Lockout) RegisterFailure(ctx context.Context, username string) error {
+	failures, _, err := l.Store.Increment(ctx, "failures:"+username, LockoutFailureWindow)
+	if err != nil {
+		return err
+	}
+
+	if failures < LockoutThreshold {
+		return nil
+	}
+
+	// Replace previous lock, so its duration is extended
+	if err := l.Store.Delete(ctx, "locked:"+username); err != nil {
+		return err
+	}
+
+	_, _, err = l.Store.Increment(ctx, "locked:"+username, lockDuration(failures))
+
+	return err
+}
+
+// Reset removes failures after successful login
+func (l *Lockout) Reset(ctx context.Context, username string) error {
+	return l.Store.Delete(ctx, "failures:"+username)
+}
+
+// RegisterMfaAttempt counts attempt to verify code with MFA challenge token,
+// false is returned if token has no attempts left
+func (l *Lockout) RegisterMfaAttempt(ctx context.Context, mfaToken string) (bool, error) {
+	attempts, _, err := l.Store.Increment(ctx, "mfa:"+auth.HashToken(mfaToken), auth.MfaTokenDuration)
+	if err != nil {
+		return false, err
+	}
+
+	return attempts <= LockoutMfaAttempts, nil
+}
+
+func lockDuration(failures int64) time.Duration {
+	duration := LockoutDuration
+	for i := LockoutThreshold; i < failures && duration < LockoutMaxDuration; i++ {
+		duration *= 2
+	}
+
+	if duration > LockoutMaxDuration {
+		return LockoutMaxDuration
+	}
+
+	return duration
+}
@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/utils/helper"
+)
+
+// Rules are configured in format "<requests>/<window>", e.g. RATE_LIMIT_LOGIN_IP=20/1m
+var (
+	LoginIpRule   = ParseRule(helper.GetEnv("RATE_LIMIT_LOGIN_IP", "20/1m"))
+	LoginUserRule = ParseRule(helper.GetEnv("RATE_LIMIT_LOGIN_USER", "10/1m"))
+	RegisterRule  = ParseRule(helper.GetEnv("RATE_LIMIT_REGISTER_IP", "5/1h"))
+	ApiUserRule   = ParseRule(helper.GetEnv("RATE_LIMIT_API_USER", "600/1m"))
+	ShareIpRule   = ParseRule(helper.GetEnv("RATE_LIMIT_SHARE_IP", "60/1m"))
+
+	// StoreType is "memory" (single instance) or "mongo" (shared between instances)
+	StoreType = helper.GetEnv("RATE_LIMIT_STORE", "memory")
+)
+
+type Rule struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// ParseRule parses rule in format "<requests>/<window>"
+//
+// Window uses time.ParseDuration format. Invalid rule is logged and disables limit
+func ParseRule(rule string) Rule {
+	limit, window, found := strings.Cut(rule, "/")
+	if !found {
+		log.Println("invalid rate limit rule: " + rule)
+		return Rule{}
+	}
+
+	parsedLimit, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil {
+		log.Println("invalid rate limit rule: " + rule)
+		return Rule{}
+	}
+
+	parsedWindow, err := time.ParseDuration(window)
+	if err != nil {
+		log.Println("invalid rate limit rule: " + rule)
+		return Rule{}
+	}
+
+	return Rule{Limit: parsedLimit, Window: parsedWindow}
+}
+
+func (r Rule) Disabled() bool {
+	return r.Limit <= 0 || r.Window <= 0
+}
+
+// NewStore returns store based on RATE_LIMIT_STORE
+func NewStore(db *mongo.Database) Store {
+	if StoreType == "mongo" {
+		return NewMongoStore(db)
+	}
+
+	return NewMemoryStore()
+}
+
+type Limiter struct {
+	Store Store
+}
+
+// ByIp limits requests from single IP address to route
+func (l *Limiter) ByIp(rule Rule) gin.HandlerFunc {
+	return l.limit(rule, func(c *gin.Context) string {
+		return "ip:" + c.FullPath() + ":" + c.ClientIP()
+	})
+}
+
+// ByUsername limits requests to route for username from JSON request body
+//
+// Request body is restored after reading, so handler can bind it again
+func (l *Limiter) ByUsername(rule Rule) gin.HandlerFunc {
+	return l.limit(rule, func(c *gin.Context) string {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return ""
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var data struct {
+			Username string `json:"username"`
+		}
+		if err := json.Unmarshal(body, &data); err != nil || data.Username == "" {
+			return ""
+		}
+
+		return "username:" + c.FullPath() + ":" + data.Username
+	})
+}
+
+// ByUser limits requests of authenticated user, it MUST be used after auth.Auth
+func (l *Limiter) ByUser(rule Rule) gin.HandlerFunc {
+	return l.limit(rule, func(c *gin.Context) string {
+		return "user:" + auth.ExtractClaimsFromContext(c).Id
+	})
+}
+
+// Returned middleware skips limit if key is empty
+func (l *Limiter) limit(rule Rule, key func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rule.Disabled() {
+			c.Next()
+			return
+		}
+
+		k := key(c)
+		if k == "" {
+			c.Next()
+			return
+		}
+
+		count, expires, err := l.Store.Increment(c, k, rule.Window)
+		if err != nil {
+			// Don't block users when store is unavailable
+			log.Println(err)
+			c.Next()
+			return
+		}
+
+		remaining := rule.Limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		reset := secondsUntil(expires)
+
+		c.Header("RateLimit-Limit", strconv.FormatInt(rule.Limit, 10))
+		c.Header("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		c.Header("RateLimit-Reset", strconv.FormatInt(reset, 10))
+
+		if count > rule.Limit {
+			c.Header("Retry-After", strconv.FormatInt(reset, 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "too many requests",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func secondsUntil(t time.Time) int64 {
+	return int64(math.Ceil(time.Until(t).Seconds()))
+}
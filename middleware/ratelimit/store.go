@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store keeps counters for fixed time windows
+type Store interface {
+	// Increment increases counter for key and returns its new value.
+	// If counter doesn't exist or is expired, it is created with value 1 and expires after window
+	Increment(ctx context.Context, key string, window time.Duration) (count int64, expires time.Time, err error)
+
+	// Get returns counter value without modifying it (0 if counter doesn't exist or is expired)
+	Get(ctx context.Context, key string) (count int64, expires time.Time, err error)
+
+	Delete(ctx context.Context, key string) error
+}
+
+type counter struct {
+	count   int64
+	expires time.Time
+}
+
+// MemoryStore keeps counters in process memory, it should only be used with single API instance
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{counters: make(map[string]*counter)}
+
+	go s.cleanup(time.Minute)
+
+	return s
+}
+
+func (s *MemoryStore) Increment(
+	_ context.Context,
+	key string,
+	window time.Duration,
+) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	c, ok := s.counters[key]
+	if !ok || !c.expires.After(now) {
+		c = &counter{expires: now.Add(window)}
+		s.counters[key] = c
+	}
+	c.count++
+
+	return c.count, c.expires, nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, key string) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok || !c.expires.After(time.Now()) {
+		return 0, time.Time{}, nil
+	}
+
+	return c.count, c.expires, nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.counters, key)
+
+	return nil
+}
+
+// Remove expired counters so memory doesn't grow with every new IP address
+func (s *MemoryStore) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+
+		s.mu.Lock()
+		for key, c := range s.counters {
+			if !c.expires.After(now) {
+				delete(s.counters, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// MongoStore keeps counters in "rate_limits" collection, so limits are shared between API instances
+type MongoStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	collection := db.Collection("rate_limits")
+
+	// Expired counters are removed by MongoDB
+	_, _ = collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+
+	return &MongoStore{collection: collection}
+}
+
+func (s *MongoStore) Increment(
+	ctx context.Context,
+	key string,
+	window time.Duration,
+) (int64, time.Time, error) {
+	now := time.Now()
+	isActive := bson.D{{Key: "$gt", Value: bson.A{"$expires", now}}}
+
+	// Single pipeline update, so counter is reset atomically when window has passed
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "count", Value: bson.D{{Key: "$cond", Value: bson.A{
+				isActive,
+				bson.D{{Key: "$add", Value: bson.A{"$count", 1}}},
+				1,
+			}}}},
+			{Key: "expires", Value: bson.D{{Key: "$cond", Value: bson.A{
+				isActive,
+				"$expires",
+				now.Add(window),
+			}}}},
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var result struct {
+		Count   int64     `bson:"count"`
+		Expires time.Time `bson:"expires"`
+	}
+
+	err := s.collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: key}}, update, opts).
+		Decode(&result)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return result.Count, result.Expires, nil
+}
+
+func (s *MongoStore) Get(ctx context.Context, key string) (int64, time.Time, error) {
+	var result struct {
+		Count   int64     `bson:"count"`
+		Expires time.Time `bson:"expires"`
+	}
+
+	filter := bson.D{
+		{Key: "_id", Value: key},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+
+	err := s.collection.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return result.Count, result.Expires, nil
+}
+
+func (s *MongoStore) Delete(ctx context.Context, key string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: key}})
+
+	return err
+}
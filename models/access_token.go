@@ -0,0 +1,57 @@
+package models
+
+import (
+	"context"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+// PersonalAccessToken is long-lived token for scripts and integrations
+//
+// Only hash of token is stored, token itself is returned once after creation
+type PersonalAccessToken struct {
+	Id        string `json:"id"                  bson:"_id"`
+	User      string `json:"user"                bson:"user"`
+	Name      string `json:"name"                bson:"name"      validate:"min=1,max=100"`
+	TokenHash string `json:"-"                   bson:"token_hash"`
+	Scope     string `json:"scope"               bson:"scope"     validate:"oneof=read upload full"`
+	Directory string `json:"directory,omitempty" bson:"directory,omitempty"`
+	Created   int64  `json:"created"             bson:"created"`
+	Expires   int64  `json:"expires,omitempty"   bson:"expires,omitempty"`
+	LastUsed  int64  `json:"last_used,omitempty" bson:"last_used,omitempty"`
+}
+
+func (t *PersonalAccessToken) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(t); err != nil {
+		return err
+	}
+	return nil
+}
+
+func CreateAccessTokenIndexes(db *mongo.Database) error {
+	_, err := db.Collection("access_tokens").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindAccessTokensByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]PersonalAccessToken, error) {
+	cursor, err := db.Collection("access_tokens").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[PersonalAccessToken](cursor)
+}
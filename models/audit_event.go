@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+
+	AuditKindFile      = "file"
+	AuditKindDirectory = "directory"
+)
+
+// AuditEvent is record of operation in append-only audit_events collection, events are never modified
+type AuditEvent struct {
+	Id     string `json:"id"     bson:"_id"`
+	Time   int64  `json:"time"   bson:"time"`
+	Action string `json:"action" bson:"action"`
+	// User who performed operation, empty for anonymous requests (e.g. share links, failed logins)
+	Actor string `json:"actor,omitempty" bson:"actor,omitempty"`
+	// Owner of affected items if it differs from Actor (shared directories, groups and share links)
+	Owner     string `json:"owner,omitempty"      bson:"owner,omitempty"`
+	Ip        string `json:"ip"                   bson:"ip"`
+	UserAgent string `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	// Kind of targets of file and directory operations (file or directory)
+	Kind string `json:"kind,omitempty" bson:"kind,omitempty"`
+	// Ids of affected files, directories, shares or keys
+	Targets []string `json:"targets,omitempty" bson:"targets,omitempty"`
+	// Parent directory of targets before and after operation (e.g. move or copy)
+	ParentBefore string `json:"parent_before,omitempty" bson:"parent_before,omitempty"`
+	ParentAfter  string `json:"parent_after,omitempty"  bson:"parent_after,omitempty"`
+	Result       string `json:"result"                  bson:"result"`
+	// Additional information, e.g. username of failed login or reason of failure
+	Details string `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+func CreateAuditEventIndexes(db *mongo.Database) error {
+	_, err := db.Collection("audit_events").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "targets", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "parent_before", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "parent_after", Value: 1}, {Key: "time", Value: -1}}},
+	})
+
+	return err
+}
+
+func FindAuditEventsByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]AuditEvent, error) {
+	cursor, err := db.Collection("audit_events").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[AuditEvent](cursor)
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+// ChangeEvent is change of files or directories delivered to subscribed clients.
+//
+// Ids are increasing sequence numbers shared by all API instances, so clients can resume from last received event
+type ChangeEvent struct {
+	Id           int64    `json:"id"                      bson:"_id"`
+	Time         int64    `json:"time"                    bson:"time"`
+	Action       string   `json:"action"                  bson:"action"`
+	Kind         string   `json:"kind"                    bson:"kind"`
+	Actor        string   `json:"actor,omitempty"         bson:"actor,omitempty"`
+	Targets      []string `json:"targets"                 bson:"targets"`
+	ParentBefore string   `json:"parent_before,omitempty" bson:"parent_before,omitempty"`
+	ParentAfter  string   `json:"parent_after,omitempty"  bson:"parent_after,omitempty"`
+
+	// Directories affected by event and directories they are inside of, used to match subscriptions
+	Directories []string `json:"-" bson:"directories"`
+	Ancestors   []string `json:"-" bson:"ancestors"`
+	// Events are removed by MongoDB after retention period
+	Expires time.Time `json:"-" bson:"expires"`
+}
+
+func CreateChangeEventIndexes(db *mongo.Database) error {
+	_, err := db.Collection("change_events").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	return err
+}
+
+func FindChangeEventsByFilter(
+	ctx context.Context,
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]ChangeEvent, error) {
+	cursor, err := db.Collection("change_events").Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[ChangeEvent](cursor)
+}
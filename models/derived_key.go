@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+// DerivedKey is record of access key minted from another access key with reduced permissions
+//
+// Key is valid only while its record exists, so owner of directory can revoke it
+type DerivedKey struct {
+	Id        string `json:"id"                bson:"_id"`
+	Directory string `json:"directory"         bson:"directory"`
+	User      string `json:"user"              bson:"user"`
+	// Owner of directory if it's shared with User
+	Owner       string   `json:"owner,omitempty"   bson:"owner,omitempty"`
+	Name        string   `json:"name"              bson:"name"        validate:"max=100"`
+	Permissions []string `json:"permissions"       bson:"permissions" validate:"min=1,dive,oneof=read modify delete upload"`
+	Recursive   bool     `json:"recursive"         bson:"recursive"`
+	// Ids of keys this key was derived from, revoking any of them revokes this key
+	Ancestors []string `json:"-"                 bson:"ancestors"`
+	Created   int64    `json:"created"           bson:"created"`
+	Expires   int64    `json:"expires,omitempty" bson:"expires,omitempty"`
+}
+
+func (k *DerivedKey) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(k); err != nil {
+		return err
+	}
+	return nil
+}
+
+func CreateDerivedKeyIndexes(db *mongo.Database) error {
+	_, err := db.Collection("derived_keys").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "directory", Value: 1}}},
+		{Keys: bson.D{{Key: "ancestors", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindDerivedKeysByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]DerivedKey, error) {
+	cursor, err := db.Collection("derived_keys").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[DerivedKey](cursor)
+}
@@ -17,9 +17,12 @@ type Directory struct {
 	ParentDirectory         string `json:"parent_directory"                    bson:"parent_directory"`
 	PreviousParentDirectory string `json:"previous_parent_directory,omitempty"`
 	User                    string `json:"user"`
-	AccessKey               string `json:"access_key"`
+	AccessKey               string `json:"access_key"                          bson:"-"`
 	Created                 int64  `json:"created"`
 	Modified                int64  `json:"modified"`
+
+	// Incremented when access key of directory is rotated, invalidating previous keys
+	KeyGeneration int64 `json:"-" bson:"key_generation,omitempty"`
 }
 
 func (d *Directory) ToBSON() bson.D {
@@ -51,9 +54,6 @@ func (d *Directory) ToBsonNotEmpty() bson.D {
 	if d.User != "" {
 		data = append(data, bson.E{Key: "user", Value: d.User})
 	}
-	if d.AccessKey != "" {
-		data = append(data, bson.E{Key: "access_key", Value: d.AccessKey})
-	}
 	if d.Created != 0 {
 		data = append(data, bson.E{Key: "created", Value: d.Created})
 	}
@@ -95,6 +95,35 @@ func FindDirectoriesByFilter[T interface{}](
 	return helper.MapCursorToObject[T](cursor)
 }
 
+// FindDirectoryTree returns id of root directory and ids of all directories inside it (recursively)
+func FindDirectoryTree(db *mongo.Database, user string, root string) ([]string, error) {
+	filter := bson.D{
+		{Key: "user", Value: user},
+		{Key: "parent_directory", Value: bson.D{{Key: "$exists", Value: true}}},
+	}
+	opts := options.Find().SetProjection(bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "parent_directory", Value: 1},
+	})
+
+	directories, err := FindDirectoriesByFilter[Directory](db, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string][]string, len(directories))
+	for _, directory := range directories {
+		children[directory.ParentDirectory] = append(children[directory.ParentDirectory], directory.Id)
+	}
+
+	tree := []string{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+
+	return tree, nil
+}
+
 func DirectoriesToBsonNotEmpty(directories []Directory) []interface{} {
 	result := make([]interface{}, 0, len(directories))
 	for _, directory := range directories {
@@ -112,3 +141,76 @@ func DirectoryPointersToBsonNotEmpty(directories []*Directory) []interface{} {
 
 	return result
 }
+
+// ContainsRootDirectory checks if any of directories is root directory (Main or Trash), which can't be
+// modified, moved or deleted
+func ContainsRootDirectory(ctx context.Context, db *mongo.Database, idList []string) (bool, error) {
+	count, err := db.Collection("directories").CountDocuments(ctx, bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: idList}}},
+		{Key: "parent_directory", Value: nil},
+	})
+
+	return count > 0, err
+}
+
+// IsInsideDirectory checks if directory with id is ancestor directory or is inside it (recursively)
+func IsInsideDirectory(ctx context.Context, db *mongo.Database, id, ancestor string) (bool, error) {
+	if id == ancestor {
+		return true, nil
+	}
+
+	cursor, err := db.Collection("directories").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: id}}}},
+		{{Key: "$graphLookup", Value: bson.D{
+			{Key: "from", Value: "directories"},
+			{Key: "startWith", Value: "$parent_directory"},
+			{Key: "connectFromField", Value: "parent_directory"},
+			{Key: "connectToField", Value: "_id"},
+			{Key: "as", Value: "ancestors"},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "ancestors._id", Value: ancestor}}}},
+		{{Key: "$count", Value: "count"}},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close(ctx)
+
+	return cursor.Next(ctx), cursor.Err()
+}
+
+// FindAncestors returns ids of all directories which directory with id is inside of
+func FindAncestors(ctx context.Context, db *mongo.Database, id string) ([]string, error) {
+	cursor, err := db.Collection("directories").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: id}}}},
+		{{Key: "$graphLookup", Value: bson.D{
+			{Key: "from", Value: "directories"},
+			{Key: "startWith", Value: "$parent_directory"},
+			{Key: "connectFromField", Value: "parent_directory"},
+			{Key: "connectToField", Value: "_id"},
+			{Key: "as", Value: "ancestors"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "ancestors._id", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		Ancestors []struct {
+			Id string `bson:"_id"`
+		} `bson:"ancestors"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	ancestors := make([]string, 0)
+	for _, result := range results {
+		for _, ancestor := range result.Ancestors {
+			ancestors = append(ancestors, ancestor.Id)
+		}
+	}
+
+	return ancestors, nil
+}
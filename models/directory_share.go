@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+const (
+	ShareLevelRead   = "read"
+	ShareLevelUpload = "upload"
+	ShareLevelEdit   = "edit"
+)
+
+// DirectoryShare gives another user access to directory and everything inside it
+type DirectoryShare struct {
+	Id        string `json:"id"        bson:"_id"`
+	Directory string `json:"directory" bson:"directory"`
+	Owner     string `json:"owner"     bson:"owner"`
+	User      string `json:"user"      bson:"user"`
+	Level     string `json:"level"     bson:"level"     validate:"oneof=read upload edit"`
+	Created   int64  `json:"created"   bson:"created"`
+
+	// Set in responses
+	Username string `json:"username,omitempty" bson:"-"`
+}
+
+func (s *DirectoryShare) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(s); err != nil {
+		return err
+	}
+	return nil
+}
+
+func CreateDirectoryShareIndexes(db *mongo.Database) error {
+	_, err := db.Collection("directory_shares").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "directory", Value: 1}, {Key: "user", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindDirectorySharesByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]DirectoryShare, error) {
+	cursor, err := db.Collection("directory_shares").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[DirectoryShare](cursor)
+}
+
+// Higher level has all permissions of lower levels
+var shareLevelRanks = map[string]int{
+	ShareLevelRead:   1,
+	ShareLevelUpload: 2,
+	ShareLevelEdit:   3,
+}
+
+// FindDirectoryShare returns share of directory with id, or of directory it's inside of, with user.
+// If directory and its ancestors are shared with user at different levels, share with the highest level is returned.
+// mongo.ErrNoDocuments is returned if directory isn't shared with user
+func FindDirectoryShare(ctx context.Context, db *mongo.Database, id, user string) (*DirectoryShare, error) {
+	ancestors, err := FindAncestors(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := db.Collection("directory_shares").Find(ctx, bson.D{
+		{Key: "directory", Value: bson.D{{Key: "$in", Value: append(ancestors, id)}}},
+		{Key: "user", Value: user},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := helper.MapCursorToObject[DirectoryShare](cursor)
+	if err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	share := &shares[0]
+	for idx := range shares {
+		if shareLevelRanks[shares[idx].Level] > shareLevelRanks[share.Level] {
+			share = &shares[idx]
+		}
+	}
+
+	return share, nil
+}
@@ -21,6 +21,8 @@ type File struct {
 	Size                    int64  `json:"size"`
 	Created                 int64  `json:"created"`
 	Modified                int64  `json:"modified"`
+	// Hex encoded SHA-256 of content, empty for files uploaded before hashes were stored
+	Hash string `json:"hash,omitempty" bson:"hash,omitempty"`
 }
 
 func (f *File) ToBSON() bson.D {
@@ -69,6 +71,9 @@ func (f *File) ToBSONnotEmpty() bson.D {
 	if f.Modified != 0 {
 		data = append(data, bson.E{Key: "modified", Value: f.Modified})
 	}
+	if f.Hash != "" {
+		data = append(data, bson.E{Key: "hash", Value: f.Hash})
+	}
 
 	return data
 }
@@ -128,3 +133,65 @@ func FilesToMap(files []File) []map[string]interface{} {
 	return result
 
 }
+
+// StorageUsage is total size and count of files stored by user (including trash)
+type StorageUsage struct {
+	User  string `json:"-"     bson:"_id"`
+	Size  int64  `json:"size"  bson:"size"`
+	Files int64  `json:"files" bson:"files"`
+}
+
+// FindStorageUsage returns storage usage of users by their id, users without files are not included
+func FindStorageUsage(ctx context.Context, db *mongo.Database, users []string) (map[string]StorageUsage, error) {
+	cursor, err := db.Collection("files").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "user", Value: bson.D{{Key: "$in", Value: users}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$user"},
+			{Key: "size", Value: bson.D{{Key: "$sum", Value: "$size"}}},
+			{Key: "files", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := helper.MapCursorToObject[StorageUsage](cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]StorageUsage, len(results))
+	for _, result := range results {
+		usage[result.User] = result
+	}
+
+	return usage, nil
+}
+
+// QuotaExceeded checks if user (or group, its id is used as user of its files) has quota
+// and storing additional bytes would exceed it
+func QuotaExceeded(ctx context.Context, db *mongo.Database, userId string, additional int64) (bool, error) {
+	var user User
+
+	opts := options.FindOne().SetProjection(bson.D{{Key: "quota", Value: 1}})
+	err := db.Collection("user").FindOne(ctx, bson.D{{Key: "_id", Value: userId}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		var group Group
+		err = db.Collection("groups").FindOne(ctx, bson.D{{Key: "_id", Value: userId}}, opts).Decode(&group)
+		user.Quota = group.Quota
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if user.Quota == 0 {
+		return false, nil
+	}
+
+	usage, err := FindStorageUsage(ctx, db, []string{userId})
+	if err != nil {
+		return false, err
+	}
+
+	return usage[userId].Size+additional > user.Quota, nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+const (
+	GroupRoleOwner       = "owner" // manages group and its members
+	GroupRoleEditor      = "editor"
+	GroupRoleContributor = "contributor"
+	GroupRoleViewer      = "viewer"
+)
+
+// Members have the same access to directories of group as users directory is shared with at these levels
+var GroupRoleLevels = map[string]string{
+	GroupRoleOwner:       ShareLevelEdit,
+	GroupRoleEditor:      ShareLevelEdit,
+	GroupRoleContributor: ShareLevelUpload,
+	GroupRoleViewer:      ShareLevelRead,
+}
+
+// Group owns its root directory and everything inside it, so its data stays when members leave.
+// Id of group is used as user of its directories and files
+type Group struct {
+	Id        string        `json:"id"              bson:"_id"`
+	Name      string        `json:"name"            bson:"name"            validate:"min=1,max=100"`
+	Directory string        `json:"directory"       bson:"directory"`
+	Members   []GroupMember `json:"members"         bson:"members"`
+	Quota     int64         `json:"quota,omitempty" bson:"quota,omitempty"`
+	Created   int64         `json:"created"         bson:"created"`
+}
+
+type GroupMember struct {
+	User string `json:"user" bson:"user"`
+	Role string `json:"role" bson:"role" validate:"oneof=owner editor contributor viewer"`
+
+	// Set in responses
+	Username string `json:"username,omitempty" bson:"-"`
+}
+
+func (g *Group) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(g); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *GroupMember) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(m); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Member returns member of group with user id, or nil if user isn't member
+func (g *Group) Member(user string) *GroupMember {
+	for idx := range g.Members {
+		if g.Members[idx].User == user {
+			return &g.Members[idx]
+		}
+	}
+	return nil
+}
+
+func CreateGroupIndexes(db *mongo.Database) error {
+	_, err := db.Collection("groups").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "members.user", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindGroupsByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]Group, error) {
+	cursor, err := db.Collection("groups").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[Group](cursor)
+}
+
+// FindGroupMember returns member of group with user id.
+// mongo.ErrNoDocuments is returned if group doesn't exist or user isn't its member
+func FindGroupMember(ctx context.Context, db *mongo.Database, groupId, user string) (*GroupMember, error) {
+	var group Group
+
+	err := db.Collection("groups").FindOne(ctx, bson.D{
+		{Key: "_id", Value: groupId},
+		{Key: "members.user", Value: user},
+	}).Decode(&group)
+	if err != nil {
+		return nil, err
+	}
+
+	member := group.Member(user)
+	if member == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return member, nil
+}
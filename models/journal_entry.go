@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+// Operations of journal entries
+const (
+	JournalOpCreate = "create"
+	JournalOpUpdate = "update"
+	JournalOpMove   = "move"
+	JournalOpDelete = "delete"
+)
+
+// JournalEntry is change of one file or directory in change journal of its owner (user or group).
+//
+// Entries of owner have increasing sequence numbers, used as cursors by sync clients
+type JournalEntry struct {
+	Id    string `json:"-"    bson:"_id"`
+	Owner string `json:"-"    bson:"owner"`
+	Seq   int64  `json:"seq"  bson:"seq"`
+	Time  int64  `json:"time" bson:"time"`
+	Op    string `json:"op"   bson:"op"`
+	Kind  string `json:"kind" bson:"kind"`
+	Item  string `json:"id"   bson:"item"`
+	// Parent directory after change, or before it for deletions
+	Parent string `json:"parent,omitempty" bson:"parent,omitempty"`
+	// Entries are removed by MongoDB after retention period
+	Expires time.Time `json:"-" bson:"expires"`
+}
+
+func CreateJournalEntryIndexes(db *mongo.Database) error {
+	_, err := db.Collection("journal").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	return err
+}
+
+func FindJournalEntriesByFilter(
+	ctx context.Context,
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]JournalEntry, error) {
+	cursor, err := db.Collection("journal").Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[JournalEntry](cursor)
+}
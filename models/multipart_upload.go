@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MultipartUpload is S3 multipart upload in progress, parts are stored on disk until upload is completed
+type MultipartUpload struct {
+	Id     string `bson:"_id"`
+	User   string `bson:"user"`
+	Bucket string `bson:"bucket"`
+	Key    string `bson:"key"`
+	// Type of file, from Content-Type of request which created upload
+	ContentType string          `bson:"content_type,omitempty"`
+	Parts       []MultipartPart `bson:"parts"`
+	Created     int64           `bson:"created"`
+	// Upload and its parts are removed after this time
+	Expires time.Time `bson:"expires"`
+}
+
+type MultipartPart struct {
+	Number int   `bson:"number"`
+	Size   int64 `bson:"size"`
+	// MD5 of part, quoted like in ETag header
+	ETag string `bson:"etag"`
+}
+
+// PendingMultipartSize returns size of parts stored by unexpired multipart uploads of user, except upload with given id
+func PendingMultipartSize(ctx context.Context, db *mongo.Database, userId string, except string) (int64, error) {
+	cursor, err := db.Collection("multipart_uploads").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "user", Value: userId},
+			{Key: "_id", Value: bson.D{{Key: "$ne", Value: except}}},
+			{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+		}}},
+		{{Key: "$unwind", Value: "$parts"}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "size", Value: bson.D{{Key: "$sum", Value: "$parts.size"}}},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var results []struct {
+		Size int64 `bson:"size"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return 0, err
+	}
+	if len(results) == 0 {
+		return 0, nil
+	}
+
+	return results[0].Size, nil
+}
+
+func CreateMultipartUploadIndexes(db *mongo.Database) error {
+	_, err := db.Collection("multipart_uploads").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "bucket", Value: 1}}},
+		{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	return err
+}
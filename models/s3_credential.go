@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+// S3Credential is access key pair of S3-compatible API
+//
+// Secret is needed to verify signatures (AWS Signature Version 4), so it's stored like webhook secrets
+// and returned only once after creation
+type S3Credential struct {
+	// Access key id
+	Id       string `json:"id"                  bson:"_id"`
+	User     string `json:"user"                bson:"user"`
+	Name     string `json:"name"                bson:"name"   validate:"min=1,max=100"`
+	Secret   string `json:"-"                   bson:"secret"`
+	Scope    string `json:"scope"               bson:"scope"  validate:"oneof=read upload full"`
+	Created  int64  `json:"created"             bson:"created"`
+	LastUsed int64  `json:"last_used,omitempty" bson:"last_used,omitempty"`
+}
+
+func (c *S3Credential) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(c); err != nil {
+		return err
+	}
+	return nil
+}
+
+func CreateS3CredentialIndexes(db *mongo.Database) error {
+	_, err := db.Collection("s3_credentials").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindS3CredentialsByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]S3Credential, error) {
+	cursor, err := db.Collection("s3_credentials").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[S3Credential](cursor)
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+// Session is created on login and represents chain (family) of rotated refresh tokens
+//
+// Only hashes of refresh tokens are stored. PreviousTokenHashes contains last rotated tokens,
+// so their reuse can be detected
+type Session struct {
+	Id                  string   `json:"id"                 bson:"_id"`
+	User                string   `json:"user"               bson:"user"`
+	TokenHash           string   `json:"-"                  bson:"token_hash"`
+	PreviousTokenHashes []string `json:"-"                  bson:"previous_token_hashes"`
+	Device              string   `json:"device,omitempty"   bson:"device,omitempty"`
+	Ip                  string   `json:"ip"                 bson:"ip"`
+	UserAgent           string   `json:"user_agent"         bson:"user_agent"`
+	Created             int64    `json:"created"            bson:"created"`
+	LastUsed            int64    `json:"last_used"          bson:"last_used"`
+	Expires             int64    `json:"expires"            bson:"expires"`
+	Current             bool     `json:"current,omitempty"  bson:"-"`
+}
+
+func CreateSessionIndexes(db *mongo.Database) error {
+	_, err := db.Collection("sessions").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "previous_token_hashes", Value: 1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindSessionsByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]Session, error) {
+	cursor, err := db.Collection("sessions").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[Session](cursor)
+}
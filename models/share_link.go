@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+const (
+	ShareModeRead   = "read"
+	ShareModeUpload = "upload" // only for directories
+	// File request, only for directories. Allows only uploads, content of directory isn't listed
+	ShareModeRequest = "request"
+)
+
+// ShareLink gives anyone with its token access to file or directory, without account
+//
+// Only hash of token is stored, token itself is returned once after creation
+type ShareLink struct {
+	Id        string `json:"id"                  bson:"_id"`
+	User      string `json:"user"                bson:"user"`
+	TokenHash string `json:"-"                   bson:"token_hash"`
+	// Either File or Directory is set
+	File      string `json:"file,omitempty"      bson:"file,omitempty"`
+	Directory string `json:"directory,omitempty" bson:"directory,omitempty"`
+	// Argon2 hash of optional password
+	Password     string `json:"-"                       bson:"password,omitempty"`
+	HasPassword  bool   `json:"has_password"            bson:"-"`
+	Mode         string `json:"mode"                    bson:"mode"                    validate:"oneof=read upload request"`
+	MaxDownloads int64  `json:"max_downloads,omitempty" bson:"max_downloads,omitempty" validate:"min=0"`
+	Downloads    int64  `json:"downloads"               bson:"downloads"`
+	Views        int64  `json:"views"                   bson:"views"`
+	LastAccessed int64  `json:"last_accessed,omitempty" bson:"last_accessed,omitempty"`
+	Created      int64  `json:"created"                 bson:"created"`
+	Expires      int64  `json:"expires,omitempty"       bson:"expires,omitempty"`
+	// Limits of uploads, in bytes for single file and in number of files for whole link
+	MaxFileSize int64 `json:"max_file_size,omitempty" bson:"max_file_size,omitempty" validate:"min=0"`
+	MaxUploads  int64 `json:"max_uploads,omitempty"   bson:"max_uploads,omitempty"   validate:"min=0"`
+	Uploads     int64 `json:"uploads"                 bson:"uploads"`
+	// Uploader must provide name, which is prefixed to names of uploaded files
+	UploaderName bool `json:"uploader_name,omitempty" bson:"uploader_name,omitempty"`
+	// Owner is notified by email when files are uploaded
+	Notify bool `json:"notify,omitempty" bson:"notify,omitempty"`
+}
+
+// AllowsUpload returns true if files can be uploaded through link
+func (l *ShareLink) AllowsUpload() bool {
+	return l.Mode == ShareModeUpload || l.Mode == ShareModeRequest
+}
+
+func (l *ShareLink) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(l); err != nil {
+		return err
+	}
+	return nil
+}
+
+func CreateShareLinkIndexes(db *mongo.Database) error {
+	_, err := db.Collection("share_links").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+	})
+
+	return err
+}
+
+func FindShareLinksByFilter(
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]ShareLink, error) {
+	cursor, err := db.Collection("share_links").Find(context.TODO(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := helper.MapCursorToObject[ShareLink](cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range links {
+		links[idx].HasPassword = links[idx].Password != ""
+	}
+
+	return links, nil
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StreamTicket authorizes one request of change event stream, so access token and access keys
+// aren't sent in URL. Only hash of ticket is stored, it's removed when it's used
+type StreamTicket struct {
+	TicketHash string    `bson:"_id"`
+	User       string    `bson:"user"`
+	Session    string    `bson:"session,omitempty"`
+	AccessKeys []string  `bson:"access_keys"`
+	Expires    time.Time `bson:"expires"`
+}
+
+func CreateStreamTicketIndexes(db *mongo.Database) error {
+	_, err := db.Collection("stream_tickets").Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+
+	return err
+}
@@ -1,21 +1,105 @@
 package models
 
 import (
+	"context"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// RoleAdmin allows access to administration API
+const RoleAdmin = "admin"
+
 type User struct {
 	Id             string `json:"id"                         bson:"_id"`
 	Username       string `json:"username"                              validate:"min=1"`
 	Password       string `json:"password,omitempty"                    validate:"min=5"`
-	TrashAccessKey string `json:"trash_access_key,omitempty"`
+	TrashAccessKey string `json:"trash_access_key,omitempty" bson:"-"`
+	Email          string `json:"email,omitempty"            bson:"email,omitempty"`
+	EmailVerified  bool   `json:"email_verified,omitempty"   bson:"email_verified,omitempty"`
+
+	Roles     []string `json:"roles,omitempty"     bson:"roles,omitempty"`
+	Suspended bool     `json:"suspended,omitempty" bson:"suspended,omitempty"`
+	// Maximum size of stored files in bytes, 0 means no limit
+	Quota int64 `json:"quota,omitempty" bson:"quota,omitempty"`
+
+	// Set for users authenticated by external identity provider
+	Provider   string `json:"provider,omitempty" bson:"provider,omitempty"`
+	ExternalId string `json:"-"                  bson:"external_id,omitempty"`
+	// Roles granted by LDAP_GROUP_ROLES, only these are removed when user leaves mapped group
+	LdapRoles []string `json:"-" bson:"ldap_roles,omitempty"`
+
+	// Two-factor authentication, never returned in responses
+	TotpEnabled       bool     `json:"-" bson:"totp_enabled,omitempty"`
+	TotpSecret        string   `json:"-" bson:"totp_secret,omitempty"`
+	TotpPendingSecret string   `json:"-" bson:"totp_pending_secret,omitempty"`
+	TotpLastStep      int64    `json:"-" bson:"totp_last_step,omitempty"`
+	RecoveryCodes     []string `json:"-" bson:"recovery_codes,omitempty"`
 }
 
 func (u *User) ToBSON() bson.D {
-	return bson.D{
+	data := bson.D{
 		{Key: "username", Value: u.Username},
 		{Key: "password", Value: u.Password},
-		{Key: "trash_access_key", Value: u.TrashAccessKey},
 		{Key: "_id", Value: u.Id},
 	}
+
+	if u.Email != "" {
+		data = append(data, bson.E{Key: "email", Value: u.Email})
+	}
+
+	if u.Provider != "" {
+		data = append(data,
+			bson.E{Key: "provider", Value: u.Provider},
+			bson.E{Key: "external_id", Value: u.ExternalId},
+		)
+	}
+
+	return data
+}
+
+// CreateUserIndexes creates indexes used to find users by email and users from external identity providers
+func CreateUserIndexes(db *mongo.Database) error {
+	_, err := db.Collection("user").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "provider", Value: 1}, {Key: "external_id", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "provider", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+		{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "email", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Single-use tokens are removed by MongoDB after they expire
+	_, err = db.Collection("user_tokens").Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+
+	return err
+}
+
+// Types of UserToken
+const (
+	UserTokenPasswordReset     = "password_reset"
+	UserTokenEmailVerification = "email_verification"
+)
+
+// UserToken is single-use token sent to user by email, only its hash is stored
+type UserToken struct {
+	TokenHash string    `bson:"_id"`
+	User      string    `bson:"user"`
+	Type      string    `bson:"type"`
+	Email     string    `bson:"email,omitempty"`
+	Expires   time.Time `bson:"expires"`
 }
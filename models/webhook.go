@@ -0,0 +1,144 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/utils/helper"
+)
+
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSuccess = "success"
+	DeliveryStatusFailure = "failure"
+)
+
+// Webhook sends change events of directory (and directories inside it if it's recursive) to URL of user
+type Webhook struct {
+	Id        string `json:"id"        bson:"_id"`
+	User      string `json:"user"      bson:"user"`
+	Directory string `json:"directory" bson:"directory"`
+	// Owner of directory if it's shared with User
+	Owner     string `json:"owner,omitempty" bson:"owner,omitempty"`
+	Url       string `json:"url"             bson:"url"       validate:"url,max=2048"`
+	Recursive bool   `json:"recursive"       bson:"recursive"`
+	// Actions of events sent to webhook, all change actions if empty
+	Events []string `json:"events" bson:"events" validate:"dive,oneof=upload create_directory rename move copy delete restore"`
+	// Key of HMAC signatures, returned only after creation
+	Secret string `json:"-"      bson:"secret"`
+	Active bool   `json:"active" bson:"active"`
+	// Failed delivery attempts in row, webhook is disabled after too many
+	Failures int64 `json:"failures"           bson:"failures"`
+	Disabled int64 `json:"disabled,omitempty" bson:"disabled,omitempty"`
+	Created  int64 `json:"created"            bson:"created"`
+}
+
+func (w *Webhook) Validate() error {
+	validate := validator.New()
+	if err := validate.Struct(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WebhookDelivery is change event sent to webhook, with log of attempts
+type WebhookDelivery struct {
+	Id      string `json:"id"      bson:"_id"`
+	Webhook string `json:"webhook" bson:"webhook"`
+	// Change event id
+	Event  int64  `json:"event"  bson:"event"`
+	Action string `json:"action" bson:"action"`
+	// Signed JSON body
+	Payload string `json:"payload" bson:"payload"`
+	Status  string `json:"status"  bson:"status"`
+	// Time of next attempt of pending delivery, also used as lease of delivery being sent
+	NextAttempt int64            `json:"next_attempt,omitempty" bson:"next_attempt,omitempty"`
+	Attempts    []WebhookAttempt `json:"attempts"               bson:"attempts"`
+	// Id of delivery this is manual redelivery of
+	Redelivery string    `json:"redelivery,omitempty" bson:"redelivery,omitempty"`
+	Created    int64     `json:"created"              bson:"created"`
+	Expires    time.Time `json:"-"                    bson:"expires"`
+}
+
+type WebhookAttempt struct {
+	Time int64 `json:"time" bson:"time"`
+	// HTTP status of response, 0 if request failed
+	ResponseCode int    `json:"response_code"      bson:"response_code"`
+	Response     string `json:"response,omitempty" bson:"response,omitempty"`
+	Error        string `json:"error,omitempty"    bson:"error,omitempty"`
+	// Milliseconds
+	Duration int64 `json:"duration" bson:"duration"`
+}
+
+func CreateWebhookIndexes(db *mongo.Database) error {
+	_, err := db.Collection("webhooks").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "directory", Value: 1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("webhook_deliveries").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook", Value: 1}, {Key: "created", Value: -1}}},
+		{Keys: bson.D{{Key: "expires", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	return err
+}
+
+func FindWebhooksByFilter(
+	ctx context.Context,
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]Webhook, error) {
+	cursor, err := db.Collection("webhooks").Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[Webhook](cursor)
+}
+
+func FindWebhookDeliveriesByFilter(
+	ctx context.Context,
+	db *mongo.Database,
+	filter interface{},
+	opts ...*options.FindOptions,
+) ([]WebhookDelivery, error) {
+	cursor, err := db.Collection("webhook_deliveries").Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.MapCursorToObject[WebhookDelivery](cursor)
+}
+
+// DeleteWebhooks deletes webhooks matching filter with their deliveries
+func DeleteWebhooks(ctx context.Context, db *mongo.Database, filter interface{}) error {
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}})
+	webhooks, err := FindWebhooksByFilter(ctx, db, filter, opts)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	ids := make([]string, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		ids = append(ids, webhook.Id)
+	}
+
+	if _, err := db.Collection("webhooks").DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}); err != nil {
+		return err
+	}
+
+	_, err = db.Collection("webhook_deliveries").DeleteMany(ctx, bson.D{{Key: "webhook", Value: bson.D{{Key: "$in", Value: ids}}}})
+	return err
+}
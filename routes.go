@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ncloud-api/handlers/directories"
+	"ncloud-api/handlers/files"
+	"ncloud-api/handlers/shares"
+	"ncloud-api/middleware/auth"
+)
+
+// permissionRoute is route authorized by access key or share link, which requires permission of key
+type permissionRoute struct {
+	method     string
+	path       string
+	permission string
+	// Run after permission is verified
+	handlers []gin.HandlerFunc
+}
+
+func registerPermissionRoutes(group *gin.RouterGroup, routes []permissionRoute) {
+	for _, route := range routes {
+		handlers := append([]gin.HandlerFunc{auth.RequirePermission(route.permission)}, route.handlers...)
+		group.Handle(route.method, route.path, handlers...)
+	}
+}
+
+// Routes of directory from id parameter, must be used after DirectoryAuth
+func directoryRoutes(directoryHandler *directories.Handler, fileHandler *files.Handler) []permissionRoute {
+	return []permissionRoute{
+		{
+			method:     http.MethodPost,
+			path:       "directories/:id",
+			permission: auth.PermissionUpload,
+			handlers:   []gin.HandlerFunc{directoryHandler.CreateDirectory},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "upload/:id",
+			permission: auth.PermissionUpload,
+			handlers:   []gin.HandlerFunc{fileHandler.Upload},
+		},
+		{
+			method:     http.MethodPatch,
+			path:       "directories/:id",
+			permission: auth.PermissionModify,
+			handlers:   []gin.HandlerFunc{directoryHandler.ModifyDirectory},
+		},
+	}
+}
+
+// Routes of file from id parameter, must be used after FileAuth
+func fileRoutes(fileHandler *files.Handler) []permissionRoute {
+	return []permissionRoute{
+		{
+			method:     http.MethodGet,
+			path:       "/files/:id",
+			permission: auth.PermissionRead,
+			handlers:   []gin.HandlerFunc{fileHandler.GetFile},
+		},
+		{
+			method:     http.MethodPatch,
+			path:       "/api/files/:id",
+			permission: auth.PermissionModify,
+			handlers:   []gin.HandlerFunc{fileHandler.UpdateFile},
+		},
+	}
+}
+
+// Routes of share link, must be used after ShareAuth
+func shareRoutes(db *mongo.Database, shareHandler *shares.Handler, fileHandler *files.Handler) []permissionRoute {
+	return []permissionRoute{
+		{
+			method:     http.MethodPost,
+			path:       "/download",
+			permission: auth.PermissionRead,
+			handlers:   []gin.HandlerFunc{auth.CountShareDownload(db), fileHandler.GetFiles},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/upload",
+			permission: auth.PermissionUpload,
+			handlers:   []gin.HandlerFunc{shareHandler.LimitShareUpload, fileHandler.Upload},
+		},
+	}
+}
+
+// Routes of shared file from id parameter, must be used after ShareAuth and ShareFileAuth
+func shareFileRoutes(db *mongo.Database, fileHandler *files.Handler) []permissionRoute {
+	return []permissionRoute{
+		{
+			method:     http.MethodGet,
+			path:       "/:id",
+			permission: auth.PermissionRead,
+			handlers:   []gin.HandlerFunc{auth.CountShareDownload(db), fileHandler.GetFile},
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238), they are compatible with most authenticator apps
+const (
+	TotpDigits = 6
+	TotpPeriod = 30
+	// Number of periods before and after current one that are accepted to allow clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTotpSecret returns random 160-bit secret encoded with base32
+func GenerateTotpSecret() (string, error) {
+	secret, err := generateRandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TotpProvisioningUri returns otpauth:// URI that can be encoded as QR code for authenticator apps
+func TotpProvisioningUri(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TotpDigits))
+	params.Set("period", fmt.Sprint(TotpPeriod))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// ValidateTotp checks code against secret at time t
+//
+// Returns time step that matched, it should be stored and codes with step lower or equal
+// should be rejected, so the same code can't be used twice
+func ValidateTotp(secret, code string, t time.Time) (step int64, valid bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TotpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / TotpPeriod
+
+	for i := -totpSkew; i <= totpSkew; i++ {
+		candidate := current + int64(i)
+		expected := generateTotpCode(key, candidate)
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+
+	return 0, false
+}
+
+// HOTP (RFC 4226) for counter
+func generateTotpCode(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TotpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TotpDigits, value%mod)
+}
+
+// GenerateRecoveryCodes returns n random codes in format xxxxx-xxxxx
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		b, err := generateRandomBytes(7)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	return codes, nil
+}
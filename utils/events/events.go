@@ -0,0 +1,200 @@
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+var (
+	// How often each API instance reads new events from database
+	PollInterval = helper.GetEnvDuration("EVENTS_POLL_INTERVAL", time.Second)
+	// How long events are kept for clients resuming with last event id
+	Retention = helper.GetEnvDuration("EVENTS_RETENTION", 24*time.Hour)
+)
+
+const (
+	// Sequence number can be allocated before event with lower number is inserted by another instance,
+	// missing events are waited for this long (e.g. failed insert) before they are skipped
+	gapTimeout = 10 * time.Second
+	// Events delivered in one poll or replay
+	batchSize = 1000
+	// Subscriber which doesn't read this many events is disconnected, it can resume with last event id
+	subscriberBuffer = 256
+)
+
+// Publish stores event in change_events collection with next sequence number,
+// directories affected by event and their ancestors are resolved for matching subscriptions.
+//
+// Time and directories are set on event before it's stored, so they are set even if error is returned
+// (id is 0 if sequence number couldn't be assigned)
+func Publish(ctx context.Context, db *mongo.Database, event *models.ChangeEvent) error {
+	parents := make([]string, 0, 2)
+	for _, directory := range []string{event.ParentBefore, event.ParentAfter} {
+		if directory != "" && !helper.ArrayContains(parents, directory) {
+			parents = append(parents, directory)
+		}
+	}
+
+	directories := append(make([]string, 0, len(parents)+len(event.Targets)), parents...)
+	if event.Kind == models.AuditKindDirectory {
+		directories = append(directories, event.Targets...)
+	}
+
+	now := time.Now()
+
+	event.Time = now.UnixMilli()
+	event.Directories = directories
+	event.Ancestors = make([]string, 0)
+	event.Expires = now.Add(Retention)
+
+	for _, directory := range parents {
+		found, err := models.FindAncestors(ctx, db, directory)
+		if err != nil {
+			return err
+		}
+		event.Ancestors = append(event.Ancestors, found...)
+	}
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := db.Collection("counters").FindOneAndUpdate(
+		ctx,
+		bson.D{{Key: "_id", Value: "change_events"}},
+		bson.D{{Key: "$inc", Value: bson.M{"seq": int64(1)}}},
+		opts,
+	).Decode(&counter)
+	if err != nil {
+		return err
+	}
+
+	event.Id = counter.Seq
+
+	_, err = db.Collection("change_events").InsertOne(ctx, event)
+	return err
+}
+
+// Bus delivers events published by all API instances to subscribers of this instance.
+// New events are read from database every PollInterval
+type Bus struct {
+	db          *mongo.Database
+	mu          sync.Mutex
+	subscribers map[chan models.ChangeEvent]struct{}
+	// Id of last delivered event
+	last int64
+}
+
+func NewBus(db *mongo.Database) *Bus {
+	return &Bus{db: db, subscribers: make(map[chan models.ChangeEvent]struct{})}
+}
+
+// Run delivers new events to subscribers until context is cancelled, events published before it are skipped
+func (b *Bus) Run(ctx context.Context) {
+	var latest models.ChangeEvent
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.D{{Key: "_id", Value: 1}})
+	err := b.db.Collection("change_events").FindOne(ctx, bson.D{}, opts).Decode(&latest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println(err)
+	}
+
+	b.mu.Lock()
+	b.last = latest.Id
+	b.mu.Unlock()
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.poll(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (b *Bus) poll(ctx context.Context) error {
+	b.mu.Lock()
+	last := b.last
+	b.mu.Unlock()
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(batchSize)
+	events, err := models.FindChangeEventsByFilter(ctx, b.db, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: last}}}}, opts)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, event := range events {
+		// Event with lower id can still be inserted
+		if event.Id != b.last+1 && time.Since(time.UnixMilli(event.Time)) < gapTimeout {
+			break
+		}
+
+		b.last = event.Id
+
+		for subscriber := range b.subscribers {
+			select {
+			case subscriber <- event:
+			default:
+				delete(b.subscribers, subscriber)
+				close(subscriber)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Subscribe returns channel receiving all events with id greater than returned last id.
+// Channel is closed if subscriber doesn't keep up with events, or after Unsubscribe
+func (b *Bus) Subscribe() (events <-chan models.ChangeEvent, last int64) {
+	subscriber := make(chan models.ChangeEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers[subscriber] = struct{}{}
+
+	return subscriber, b.last
+}
+
+func (b *Bus) Unsubscribe(events <-chan models.ChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for subscriber := range b.subscribers {
+		if subscriber == events {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+// Replay returns stored events with ids greater than after and not greater than until, at most batchSize events
+func Replay(ctx context.Context, db *mongo.Database, after, until int64) ([]models.ChangeEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(batchSize)
+
+	return models.FindChangeEventsByFilter(ctx, db, bson.D{{Key: "_id", Value: bson.D{
+		{Key: "$gt", Value: after},
+		{Key: "$lte", Value: until},
+	}}}, opts)
+}
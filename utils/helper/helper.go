@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -26,6 +27,24 @@ func GetEnv(name, fallback string) string {
 	return fallback
 }
 
+// GetEnvDuration returns duration in time.ParseDuration format, program exits if it's invalid
+func GetEnvDuration(name string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(GetEnv(name, fallback.String()))
+	if err != nil {
+		log.Fatal("invalid " + name + ": " + err.Error())
+	}
+	return duration
+}
+
+// GetEnvInt returns integer, program exits if it's invalid
+func GetEnvInt(name string, fallback int) int {
+	value, err := strconv.Atoi(GetEnv(name, strconv.Itoa(fallback)))
+	if err != nil {
+		log.Fatal("invalid " + name + ": " + err.Error())
+	}
+	return value
+}
+
 func ArrayContains[T comparable](arr []T, element T) bool {
 	for _, v := range arr {
 		if v == element {
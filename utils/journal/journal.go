@@ -0,0 +1,209 @@
+package journal
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+// How long entries are kept, older cursors require full resync
+var Retention = helper.GetEnvDuration("JOURNAL_RETENTION", 30*24*time.Hour)
+
+// Sequence numbers can be allocated before entries with lower numbers are inserted by another request,
+// entries after missing ones are returned after this long (e.g. failed insert)
+const GapTimeout = 10 * time.Second
+
+// Operations of change actions of audit events, restored items are moved back from trash
+var actionOps = map[string]string{
+	"upload":           models.JournalOpCreate,
+	"create_directory": models.JournalOpCreate,
+	"copy":             models.JournalOpCreate,
+	"rename":           models.JournalOpUpdate,
+	"move":             models.JournalOpMove,
+	"restore":          models.JournalOpMove,
+	"delete":           models.JournalOpDelete,
+}
+
+// Append adds entries of change to journal of owner of changed items.
+//
+// Copies have both source and copied items in targets, copied directories are added with
+// all directories and files inside them. Deleted directories aren't expanded, their content is deleted with them
+func Append(ctx context.Context, db *mongo.Database, owner string, change *models.ChangeEvent) error {
+	op, exists := actionOps[change.Action]
+	if !exists || owner == "" {
+		return nil
+	}
+
+	parent := change.ParentAfter
+	if parent == "" {
+		parent = change.ParentBefore
+	}
+
+	targets := change.Targets
+	if change.Action == "copy" {
+		copies := make([]string, 0, len(targets)/2)
+		for i := 1; i < len(targets); i += 2 {
+			copies = append(copies, targets[i])
+		}
+		targets = copies
+	}
+
+	entries := make([]models.JournalEntry, 0, len(targets))
+	for _, target := range targets {
+		entries = append(entries, models.JournalEntry{Op: op, Kind: change.Kind, Item: target, Parent: parent})
+	}
+
+	if change.Action == "copy" && change.Kind == models.AuditKindDirectory {
+		content, err := findContent(ctx, db, owner, targets)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, content...)
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Allocate sequence numbers for all entries at once
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := db.Collection("counters").FindOneAndUpdate(
+		ctx,
+		bson.D{{Key: "_id", Value: "journal:" + owner}},
+		bson.D{{Key: "$inc", Value: bson.M{"seq": int64(len(entries))}}},
+		opts,
+	).Decode(&counter)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	first := counter.Seq - int64(len(entries)) + 1
+
+	documents := make([]interface{}, 0, len(entries))
+	for idx, entry := range entries {
+		entry.Id = uuid.New().String()
+		entry.Owner = owner
+		entry.Seq = first + int64(idx)
+		entry.Time = now.UnixMilli()
+		entry.Expires = now.Add(Retention)
+		documents = append(documents, entry)
+	}
+
+	_, err = db.Collection("journal").InsertMany(ctx, documents)
+	return err
+}
+
+// Entries creating directories and files inside copied directories, parents before their content
+func findContent(ctx context.Context, db *mongo.Database, owner string, directories []string) ([]models.JournalEntry, error) {
+	entries := make([]models.JournalEntry, 0)
+	tree := make([]string, 0, len(directories))
+
+	for _, directory := range directories {
+		found, err := models.FindDirectoryTree(db, owner, directory)
+		if err != nil {
+			return nil, err
+		}
+		tree = append(tree, found...)
+	}
+
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "parent_directory", Value: 1}})
+	found, err := models.FindDirectoriesById[models.Directory](db, tree, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string]string, len(found))
+	for _, directory := range found {
+		parents[directory.Id] = directory.ParentDirectory
+	}
+
+	for _, directory := range tree {
+		// Copied directories already have entries
+		if helper.ArrayContains(directories, directory) {
+			continue
+		}
+		entries = append(entries, models.JournalEntry{
+			Op:     models.JournalOpCreate,
+			Kind:   models.AuditKindDirectory,
+			Item:   directory,
+			Parent: parents[directory],
+		})
+	}
+
+	files, err := models.FindFilesByFilter[models.File](
+		db,
+		bson.D{{Key: "parent_directory", Value: bson.D{{Key: "$in", Value: tree}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "parent_directory", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		entries = append(entries, models.JournalEntry{
+			Op:     models.JournalOpCreate,
+			Kind:   models.AuditKindFile,
+			Item:   file.Id,
+			Parent: file.ParentDirectory,
+		})
+	}
+
+	return entries, nil
+}
+
+// Latest returns sequence number of the latest entry of owner, 0 if owner has no entries
+func Latest(ctx context.Context, db *mongo.Database, owner string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+
+	err := db.Collection("counters").FindOne(ctx, bson.D{{Key: "_id", Value: "journal:" + owner}}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+
+	return counter.Seq, err
+}
+
+// Since returns at most limit entries of owner after sequence number after, in order.
+//
+// Entries after missing sequence number are returned only after GapTimeout, because missing entries
+// can still be inserted. more reports if next page is available now
+func Since(ctx context.Context, db *mongo.Database, owner string, after int64, limit int64) (entries []models.JournalEntry, more bool, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(limit + 1)
+	found, err := models.FindJournalEntriesByFilter(ctx, db, bson.D{
+		{Key: "owner", Value: owner},
+		{Key: "seq", Value: bson.D{{Key: "$gt", Value: after}}},
+	}, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries = make([]models.JournalEntry, 0, len(found))
+	expected := after + 1
+	for _, entry := range found {
+		if entry.Seq != expected && time.Since(time.UnixMilli(entry.Time)) < GapTimeout {
+			return entries, false, nil
+		}
+		if int64(len(entries)) == limit {
+			return entries, true, nil
+		}
+
+		entries = append(entries, entry)
+		expected = entry.Seq + 1
+	}
+
+	return entries, false, nil
+}
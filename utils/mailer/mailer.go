@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/utils/helper"
+)
+
+var (
+	SmtpHost     = helper.GetEnv("SMTP_HOST", "")
+	SmtpPort     = helper.GetEnv("SMTP_PORT", "587")
+	SmtpUsername = helper.GetEnv("SMTP_USERNAME", "")
+	SmtpPassword = helper.GetEnv("SMTP_PASSWORD", "")
+	SmtpFrom     = helper.GetEnv("SMTP_FROM", "ncloud <no-reply@ncloudapp.com>")
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// New returns SMTP mailer. If SMTP_HOST isn't set, mailer which only logs messages is returned in debug mode,
+// in other modes it's error, messages contain password reset and verification tokens
+func New() (Mailer, error) {
+	if SmtpHost == "" {
+		if gin.Mode() != gin.DebugMode {
+			return nil, errors.New("SMTP_HOST must be set outside of debug mode")
+		}
+		return &LogMailer{}, nil
+	}
+
+	return &SmtpMailer{
+		Address:  net.JoinHostPort(SmtpHost, SmtpPort),
+		Username: SmtpUsername,
+		Password: SmtpPassword,
+		From:     SmtpFrom,
+	}, nil
+}
+
+// SmtpMailer sends plain text messages, STARTTLS is used if server supports it
+type SmtpMailer struct {
+	Address  string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SmtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Address)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	from := m.From
+	if start, end := strings.Index(from, "<"), strings.Index(from, ">"); start != -1 && end > start {
+		from = from[start+1 : end]
+	}
+
+	return smtp.SendMail(m.Address, auth, from, []string{to}, buildMessage(m.From, to, subject, body))
+}
+
+// LogMailer is used in debug mode, when SMTP server isn't configured
+type LogMailer struct{}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	// Header values can't contain new lines
+	clean := strings.NewReplacer("\r", "", "\n", "")
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(&message, "To: %s\r\n", clean.Replace(to))
+	fmt.Fprintf(&message, "Subject: %s\r\n", clean.Replace(subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return []byte(message.String())
+}
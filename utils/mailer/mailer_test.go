@@ -0,0 +1,78 @@
+package mailer_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"ncloud-api/utils/mailer"
+	"ncloud-api/utils/mailer/mailertest"
+)
+
+func TestSmtpMailerSend(t *testing.T) {
+	sink, err := mailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	m := &mailer.SmtpMailer{Address: sink.Addr(), From: "ncloud <no-reply@ncloud.test>"}
+
+	body := "First line\n.line starting with dot\n\nLast line"
+	if err := m.Send("user@ncloud.test", "Subject\r\nBcc: attacker@ncloud.test", body); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("received %d messages, want 1", len(messages))
+	}
+
+	message := messages[0]
+	if message.From != "no-reply@ncloud.test" || len(message.To) != 1 || message.To[0] != "user@ncloud.test" {
+		t.Fatalf("envelope from %q to %v", message.From, message.To)
+	}
+
+	parsed, received, err := message.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject := parsed.Header.Get("Subject"); subject != "SubjectBcc: attacker@ncloud.test" {
+		t.Fatalf("subject = %q, new lines must be removed from headers", subject)
+	}
+	if parsed.Header.Get("Bcc") != "" {
+		t.Fatal("header was injected through subject")
+	}
+	// Line ending is added before end of data
+	if strings.TrimSuffix(received, "\n") != body {
+		t.Fatalf("body = %q, want %q", received, body)
+	}
+}
+
+func TestNewWithoutSmtpHost(t *testing.T) {
+	host, mode := mailer.SmtpHost, gin.Mode()
+	defer func() {
+		mailer.SmtpHost = host
+		gin.SetMode(mode)
+	}()
+	mailer.SmtpHost = ""
+
+	gin.SetMode(gin.DebugMode)
+	m, err := mailer.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*mailer.LogMailer); !ok {
+		t.Fatalf("mailer is %T in debug mode, want *mailer.LogMailer", m)
+	}
+
+	// Messages with tokens can't be logged in production
+	for _, mode := range []string{gin.ReleaseMode, gin.TestMode} {
+		gin.SetMode(mode)
+		if _, err := mailer.New(); err == nil {
+			t.Fatalf("mailer was created without SMTP_HOST in %s mode", mode)
+		}
+	}
+}
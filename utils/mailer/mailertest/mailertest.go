@@ -0,0 +1,156 @@
+// Package mailertest provides SMTP sink for tests, it accepts all messages and keeps them in memory
+package mailertest
+
+import (
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Message received by sink
+type Message struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Parse returns headers and body of message
+func (m *Message) Parse() (*mail.Message, string, error) {
+	message, err := mail.ReadMessage(strings.NewReader(m.Data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, err := io.ReadAll(message.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return message, strings.ReplaceAll(string(body), "\r\n", "\n"), nil
+}
+
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewServer starts SMTP sink on random local port
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s, nil
+}
+
+// Addr is address for mailer.SmtpMailer
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Messages returns received messages in order
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message{}, s.messages...)
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	reply := func(line string) bool {
+		return text.PrintfLine("%s", line) == nil
+	}
+
+	if !reply("220 mailertest ESMTP") {
+		return
+	}
+
+	var message Message
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		command, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			if !reply("250 mailertest") {
+				return
+			}
+		case "MAIL":
+			message = Message{From: address(argument)}
+			if !reply("250 OK") {
+				return
+			}
+		case "RCPT":
+			message.To = append(message.To, address(argument))
+			if !reply("250 OK") {
+				return
+			}
+		case "DATA":
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			message.Data = string(data)
+
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+
+			if !reply("250 OK") {
+				return
+			}
+		case "RSET", "NOOP":
+			if !reply("250 OK") {
+				return
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			if !reply("502 command not implemented") {
+				return
+			}
+		}
+	}
+}
+
+// Address from argument of MAIL and RCPT commands, e.g. "FROM:<user@example.com> BODY=8BITMIME"
+func address(argument string) string {
+	start, end := strings.Index(argument, "<"), strings.Index(argument, ">")
+	if start == -1 || end < start {
+		return ""
+	}
+	return argument[start+1 : end]
+}
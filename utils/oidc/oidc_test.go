@@ -0,0 +1,88 @@
+package oidc_test
+
+import (
+	"context"
+	"testing"
+
+	"ncloud-api/utils/oidc"
+	"ncloud-api/utils/oidc/oidctest"
+)
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name string
+		// Nonce and verifier used for exchange instead of ones from authorization request
+		nonce    string
+		verifier string
+		// Nonce of ID token issued by provider
+		providerNonce string
+		valid         bool
+	}{
+		{name: "valid", valid: true},
+		{name: "nonce mismatch", nonce: "other nonce"},
+		{name: "nonce of provider mismatch", providerNonce: "other nonce"},
+		{name: "PKCE verifier mismatch", verifier: "other verifier"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := oidctest.NewServer()
+			defer server.Close()
+			server.Nonce = test.providerNonce
+
+			provider := server.Provider()
+			ctx := context.Background()
+
+			state, nonce, verifier := random(t), random(t), random(t)
+
+			authorizationUrl, err := provider.AuthCodeUrl(ctx, state, nonce, verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code, returnedState, err := server.Authorize(authorizationUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if returnedState != state {
+				t.Fatalf("state = %q, want %q", returnedState, state)
+			}
+
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+			if test.verifier != "" {
+				verifier = test.verifier
+			}
+
+			claims, err := provider.Exchange(ctx, code, verifier, nonce)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("exchange succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != server.Subject || claims.Username() != server.Username {
+				t.Fatalf("claims = %+v", claims)
+			}
+
+			// Code can be exchanged only once
+			if _, err := provider.Exchange(ctx, code, verifier, nonce); err == nil {
+				t.Fatal("code was exchanged twice")
+			}
+		})
+	}
+}
+
+func random(t *testing.T) string {
+	t.Helper()
+
+	value, err := oidc.GenerateRandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
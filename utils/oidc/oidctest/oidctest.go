@@ -0,0 +1,181 @@
+// Package oidctest provides mock OpenID Connect provider for tests
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"ncloud-api/utils/oidc"
+)
+
+const (
+	ClientId    = "ncloud-test"
+	RedirectUrl = "https://ncloud.test/oidc/callback"
+	keyId       = "test-key"
+)
+
+// Server is identity provider with discovery document, JWKS and token endpoint.
+// User is logged in by Authorize instead of login page
+type Server struct {
+	*httptest.Server
+
+	// Subject and preferred username of ID tokens
+	Subject  string
+	Username string
+	// Nonce of ID tokens issued for next authorizations if it's set, instead of nonce from authorization request
+	Nonce string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+// Authorization request of code, code can be exchanged only once
+type authorization struct {
+	challenge string
+	nonce     string
+}
+
+func NewServer() *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &Server{
+		Subject:  "subject",
+		Username: "oidc-user",
+		key:      key,
+		codes:    map[string]authorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/jwks", s.jwks)
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Provider returns client of server
+func (s *Server) Provider() *oidc.Provider {
+	return &oidc.Provider{
+		Issuer:      s.URL,
+		ClientId:    ClientId,
+		RedirectUrl: RedirectUrl,
+		Scopes:      []string{"openid"},
+		HttpClient:  s.Client(),
+	}
+}
+
+// Authorize logs user in at authorization URL and returns code and state of redirect to client
+func (s *Server) Authorize(authorizationUrl string) (code, state string, err error) {
+	parsed, err := url.Parse(authorizationUrl)
+	if err != nil {
+		return "", "", err
+	}
+	query := parsed.Query()
+
+	if query.Get("client_id") != ClientId || query.Get("code_challenge_method") != "S256" {
+		return "", "", errors.New("invalid authorization request")
+	}
+
+	code, err = oidc.GenerateRandomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := query.Get("nonce")
+	if s.Nonce != "" {
+		nonce = s.Nonce
+	}
+
+	s.mu.Lock()
+	s.codes[code] = authorization{challenge: query.Get("code_challenge"), nonce: nonce}
+	s.mu.Unlock()
+
+	return code, query.Get("state"), nil
+}
+
+func (s *Server) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": keyId,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+// Exchange code for ID token, code verifier must match challenge of authorization request (PKCE)
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	code := r.PostFormValue("code")
+
+	s.mu.Lock()
+	authorization, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("client_id") != ClientId {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if oidc.CodeChallenge(r.PostFormValue("code_verifier")) != authorization.challenge {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, oidc.IdTokenClaims{
+		Nonce:             authorization.nonce,
+		PreferredUsername: s.Username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.URL,
+			Subject:   s.Subject,
+			Audience:  jwt.ClaimStrings{ClientId},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	})
+	token.Header["kid"] = keyId
+
+	idToken, err := token.SignedString(s.key)
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]string{
+		"token_type": "Bearer",
+		"id_token":   idToken,
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
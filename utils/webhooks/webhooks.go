@@ -0,0 +1,394 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ncloud-api/middleware/auth"
+	"ncloud-api/models"
+	"ncloud-api/utils/helper"
+)
+
+var (
+	// Timeout of one delivery attempt
+	Timeout = helper.GetEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	// Attempts of each delivery, delay before retry is doubled after every failed attempt
+	MaxAttempts = helper.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 6)
+	RetryDelay  = helper.GetEnvDuration("WEBHOOK_RETRY_DELAY", 30*time.Second)
+	// Webhook is disabled after this many failed attempts in row
+	DisableAfter = helper.GetEnvInt("WEBHOOK_DISABLE_AFTER", 20)
+	// Deliveries sent concurrently by each API instance
+	Workers = helper.GetEnvInt("WEBHOOK_WORKERS", 4)
+	// How often each API instance looks for pending deliveries
+	PollInterval = helper.GetEnvDuration("WEBHOOK_POLL_INTERVAL", 2*time.Second)
+	// How long delivery log is kept
+	Retention = helper.GetEnvDuration("WEBHOOK_DELIVERY_RETENTION", 30*24*time.Hour)
+	// Webhooks can't send requests to loopback, private and link-local addresses unless it's allowed
+	AllowPrivate = helper.GetEnv("WEBHOOK_ALLOW_PRIVATE", "false") == "true"
+)
+
+const (
+	SignatureHeader = "X-Ncloud-Signature"
+	TimestampHeader = "X-Ncloud-Timestamp"
+	EventHeader     = "X-Ncloud-Event"
+	DeliveryHeader  = "X-Ncloud-Delivery"
+
+	// Stored part of response body
+	maxResponseSize = 1024
+)
+
+var errPrivateAddress = errors.New("address isn't public")
+
+func init() {
+	for key, value := range map[string]int{
+		"WEBHOOK_MAX_ATTEMPTS":  MaxAttempts,
+		"WEBHOOK_DISABLE_AFTER": DisableAfter,
+		"WEBHOOK_WORKERS":       Workers,
+	} {
+		if value < 1 {
+			log.Fatal("invalid " + key + ": must be at least 1")
+		}
+	}
+}
+
+// Payload is JSON body of delivery
+type Payload struct {
+	Webhook   string              `json:"webhook"`
+	Directory string              `json:"directory"`
+	Event     *models.ChangeEvent `json:"event"`
+}
+
+// Sign returns signature of payload sent at timestamp (unix seconds):
+// hex encoded HMAC-SHA256 of "timestamp.payload" with secret of webhook
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDelivery(webhook string, event int64, action string, payload string) models.WebhookDelivery {
+	now := time.Now()
+
+	return models.WebhookDelivery{
+		Id:          uuid.New().String(),
+		Webhook:     webhook,
+		Event:       event,
+		Action:      action,
+		Payload:     payload,
+		Status:      models.DeliveryStatusPending,
+		NextAttempt: now.UnixMilli(),
+		Attempts:    []models.WebhookAttempt{},
+		Created:     now.UnixMilli(),
+		Expires:     now.Add(Retention),
+	}
+}
+
+// Enqueue creates pending deliveries of published event (see events.Publish) for active webhooks
+// of its directories, webhooks of shared directories are skipped if directory is no longer shared with user
+func Enqueue(ctx context.Context, db *mongo.Database, event *models.ChangeEvent) error {
+	webhooks, err := models.FindWebhooksByFilter(ctx, db, bson.D{
+		{Key: "active", Value: true},
+		{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "directory", Value: bson.D{{Key: "$in", Value: event.Directories}}}},
+				bson.D{
+					{Key: "recursive", Value: true},
+					{Key: "directory", Value: bson.D{{Key: "$in", Value: event.Ancestors}}},
+				},
+			}}},
+			bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "events", Value: bson.D{{Key: "$size", Value: 0}}}},
+				bson.D{{Key: "events", Value: event.Action}},
+			}}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	deliveries := make([]interface{}, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		if webhook.Owner != "" {
+			if _, shared := auth.SharedPermissions(ctx, db, webhook.Directory, webhook.Owner, webhook.User); !shared {
+				continue
+			}
+		}
+
+		payload, err := json.Marshal(Payload{Webhook: webhook.Id, Directory: webhook.Directory, Event: event})
+		if err != nil {
+			return err
+		}
+
+		deliveries = append(deliveries, newDelivery(webhook.Id, event.Id, event.Action, string(payload)))
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	_, err = db.Collection("webhook_deliveries").InsertMany(ctx, deliveries)
+	return err
+}
+
+// Redeliver creates new pending delivery with the same payload as delivery
+func Redeliver(ctx context.Context, db *mongo.Database, delivery *models.WebhookDelivery) (*models.WebhookDelivery, error) {
+	redelivery := newDelivery(delivery.Webhook, delivery.Event, delivery.Action, delivery.Payload)
+	redelivery.Redelivery = delivery.Id
+
+	if _, err := db.Collection("webhook_deliveries").InsertOne(ctx, redelivery); err != nil {
+		return nil, err
+	}
+
+	return &redelivery, nil
+}
+
+// Dispatcher sends pending deliveries, deliveries are claimed in database,
+// so each is sent by one API instance
+type Dispatcher struct {
+	db      *mongo.Database
+	client  *http.Client
+	workers chan struct{}
+}
+
+func NewDispatcher(db *mongo.Database) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return errPrivateAddress
+			}
+			if !AllowPrivate && (ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast()) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	return &Dispatcher{
+		db: db,
+		client: &http.Client{
+			Timeout:   Timeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			// Redirects aren't followed, they are failed attempts
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		workers: make(chan struct{}, Workers),
+	}
+}
+
+// Run sends pending deliveries until context is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.dispatch(ctx)
+		}
+	}
+}
+
+// Claim pending deliveries while there are free workers
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	for {
+		select {
+		case d.workers <- struct{}{}:
+		default:
+			return
+		}
+
+		delivery, err := d.claim(ctx)
+		if err != nil {
+			<-d.workers
+			if err != mongo.ErrNoDocuments {
+				log.Println(err)
+			}
+			return
+		}
+
+		go func() {
+			defer func() { <-d.workers }()
+			d.deliver(ctx, delivery)
+		}()
+	}
+}
+
+// Claimed delivery isn't claimed again until attempt is finished, or lease expires if instance stops
+func (d *Dispatcher) claim(ctx context.Context) (*models.WebhookDelivery, error) {
+	now := time.Now()
+
+	var delivery models.WebhookDelivery
+
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt", Value: 1}})
+	err := d.db.Collection("webhook_deliveries").FindOneAndUpdate(
+		ctx,
+		bson.D{
+			{Key: "status", Value: models.DeliveryStatusPending},
+			{Key: "next_attempt", Value: bson.D{{Key: "$lte", Value: now.UnixMilli()}}},
+		},
+		bson.D{{Key: "$set", Value: bson.M{"next_attempt": now.Add(Timeout + time.Minute).UnixMilli()}}},
+		opts,
+	).Decode(&delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *models.WebhookDelivery) {
+	var webhook models.Webhook
+	err := d.db.Collection("webhooks").FindOne(ctx, bson.D{{Key: "_id", Value: delivery.Webhook}}).Decode(&webhook)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println(err)
+		return
+	}
+
+	// Deliveries of deleted and disabled webhooks fail without attempt, they can be redelivered after webhook is enabled
+	disabled := err == mongo.ErrNoDocuments || !webhook.Active
+
+	var attempt models.WebhookAttempt
+	if disabled {
+		attempt = models.WebhookAttempt{Time: time.Now().UnixMilli(), Error: "webhook is disabled"}
+	} else {
+		attempt = d.send(ctx, &webhook, delivery)
+	}
+
+	succeeded := attempt.ResponseCode >= 200 && attempt.ResponseCode < 300
+
+	update := bson.D{{Key: "$push", Value: bson.M{"attempts": attempt}}}
+	switch {
+	case succeeded:
+		update = append(update,
+			bson.E{Key: "$set", Value: bson.M{"status": models.DeliveryStatusSuccess}},
+			bson.E{Key: "$unset", Value: bson.M{"next_attempt": ""}},
+		)
+	case disabled || len(delivery.Attempts)+1 >= MaxAttempts:
+		update = append(update,
+			bson.E{Key: "$set", Value: bson.M{"status": models.DeliveryStatusFailure}},
+			bson.E{Key: "$unset", Value: bson.M{"next_attempt": ""}},
+		)
+	default:
+		delay := RetryDelay << len(delivery.Attempts)
+		update = append(update, bson.E{Key: "$set", Value: bson.M{"next_attempt": time.Now().Add(delay).UnixMilli()}})
+	}
+
+	if _, err := d.db.Collection("webhook_deliveries").UpdateByID(ctx, delivery.Id, update); err != nil {
+		log.Println(err)
+	}
+
+	if disabled {
+		return
+	}
+
+	if succeeded {
+		if webhook.Failures > 0 {
+			if _, err := d.db.Collection("webhooks").UpdateByID(ctx, webhook.Id, bson.D{
+				{Key: "$set", Value: bson.M{"failures": 0}},
+			}); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+
+	d.registerFailure(ctx, webhook.Id)
+}
+
+// Count failed attempt of webhook and disable it after DisableAfter failures in row
+func (d *Dispatcher) registerFailure(ctx context.Context, webhookId string) {
+	var webhook models.Webhook
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := d.db.Collection("webhooks").FindOneAndUpdate(
+		ctx,
+		bson.D{{Key: "_id", Value: webhookId}},
+		bson.D{{Key: "$inc", Value: bson.M{"failures": int64(1)}}},
+		opts,
+	).Decode(&webhook)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println(err)
+		}
+		return
+	}
+
+	if webhook.Failures < int64(DisableAfter) {
+		return
+	}
+
+	if _, err := d.db.Collection("webhooks").UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: webhookId},
+		{Key: "active", Value: true},
+	}, bson.D{{Key: "$set", Value: bson.M{"active": false, "disabled": time.Now().UnixMilli()}}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// Send signed payload of delivery to URL of webhook
+func (d *Dispatcher) send(ctx context.Context, webhook *models.Webhook, delivery *models.WebhookDelivery) models.WebhookAttempt {
+	start := time.Now()
+	attempt := models.WebhookAttempt{Time: start.UnixMilli()}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, strings.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := start.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "ncloud-webhook")
+	request.Header.Set(EventHeader, delivery.Action)
+	request.Header.Set(DeliveryHeader, delivery.Id)
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	response, err := d.client.Do(request)
+	attempt.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer response.Body.Close()
+
+	attempt.ResponseCode = response.StatusCode
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	attempt.Response = string(body)
+
+	return attempt
+}